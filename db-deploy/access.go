@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// workloadResources are the apps/v1 resources the tool needs to list.
+var workloadResources = []string{"deployments", "statefulsets", "daemonsets"}
+
+// accessibleNamespaces returns the namespaces in which the caller may list
+// every workload resource. Candidates are the given namespaces or, if none
+// are given, all namespaces in the cluster; each one is checked with a
+// SelfSubjectRulesReview.
+func accessibleNamespaces(ctx context.Context, clientset *kubernetes.Clientset, candidates []string) ([]string, error) {
+	if len(candidates) == 0 {
+		namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list namespaces, use --fallback-namespaces to name them: %w", err)
+		}
+		for _, ns := range namespaces.Items {
+			candidates = append(candidates, ns.Name)
+		}
+	}
+
+	var accessible []string
+	for _, namespace := range candidates {
+		review, err := clientset.AuthorizationV1().SelfSubjectRulesReviews().Create(ctx, &authorizationv1.SelfSubjectRulesReview{
+			Spec: authorizationv1.SelfSubjectRulesReviewSpec{Namespace: namespace},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to review permissions in namespace %s: %w", namespace, err)
+		}
+
+		// An incomplete review may omit rules granted by other authorizers,
+		// so the namespace is kept and listing is left to decide
+		if review.Status.Incomplete || canListWorkloads(review.Status.ResourceRules) {
+			accessible = append(accessible, namespace)
+		}
+	}
+	return accessible, nil
+}
+
+// canListWorkloads reports whether the rules allow listing every workload
+// resource.
+func canListWorkloads(rules []authorizationv1.ResourceRule) bool {
+	for _, resource := range workloadResources {
+		allowed := false
+		for _, rule := range rules {
+			if contains(rule.Verbs, "list") && contains(rule.APIGroups, "apps") && contains(rule.Resources, resource) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// contains reports whether values holds value or the "*" wildcard.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value || v == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotations the tool maintains on the workloads it restarts.
+const (
+	// restartInProgressAnnotation holds the ID of the run that is currently
+	// restarting the workload. It is removed once the run is done with it.
+	restartInProgressAnnotation = "db-deploy/restart-in-progress"
+
+	// runIDAnnotation holds the ID of the last run that restarted the
+	// workload.
+	runIDAnnotation = "db-deploy/run-id"
+
+	// planFingerprintAnnotation holds the fingerprint of the plan file
+	// whose run last restarted the workload, so that re-running the same
+	// plan skips it.
+	planFingerprintAnnotation = "db-deploy/plan-fingerprint"
+)
+
+// runIDTimeFormat is the timestamp prefix of every run ID, which lets the age
+// of a run be recovered from its ID alone.
+const runIDTimeFormat = "20060102T150405Z"
+
+// newRunID returns a unique, time-ordered identifier for a run.
+func newRunID() string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return time.Now().UTC().Format(runIDTimeFormat) + "-" + hex.EncodeToString(suffix)
+}
+
+// runIDTime returns the time a run was started, as encoded in its ID.
+func runIDTime(id string) (time.Time, error) {
+	if len(id) < len(runIDTimeFormat) {
+		return time.Time{}, fmt.Errorf("malformed run ID %q", id)
+	}
+	return time.Parse(runIDTimeFormat, id[:len(runIDTimeFormat)])
+}
+
+// patchAnnotations merges the given annotations into the workload's metadata.
+// A nil value removes the annotation. Only the workload's own metadata is
+// changed, so the patch never triggers a rollout.
+func patchAnnotations(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, t target, annotations map[string]interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var patch func(ctx context.Context) error
+	switch t.Kind {
+	case "deployment":
+		patch = func(ctx context.Context) error {
+			_, err := clientset.AppsV1().Deployments(t.Namespace).Patch(ctx, t.Name, types.MergePatchType, data, metav1.PatchOptions{})
+			return err
+		}
+	case "statefulset":
+		patch = func(ctx context.Context) error {
+			_, err := clientset.AppsV1().StatefulSets(t.Namespace).Patch(ctx, t.Name, types.MergePatchType, data, metav1.PatchOptions{})
+			return err
+		}
+	case "daemonset":
+		patch = func(ctx context.Context) error {
+			_, err := clientset.AppsV1().DaemonSets(t.Namespace).Patch(ctx, t.Name, types.MergePatchType, data, metav1.PatchOptions{})
+			return err
+		}
+	case "rollout":
+		patch = func(ctx context.Context) error {
+			_, err := dynamicClient.Resource(rolloutResource).Namespace(t.Namespace).Patch(ctx, t.Name, types.MergePatchType, data, metav1.PatchOptions{})
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported workload kind %q", t.Kind)
+	}
+	if err := retryAPI(ctx, "annotate "+t.String(), patch); err != nil {
+		return fmt.Errorf("failed to patch %s: %w", t.Kind, err)
+	}
+	return nil
+}
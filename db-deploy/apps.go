@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const (
+	// partOfLabel names the application a workload belongs to.
+	partOfLabel = "app.kubernetes.io/part-of"
+
+	// restartOrderAnnotation orders the workloads of an application. Lower
+	// values restart first and workloads with equal values restart together;
+	// workloads without it count as 0.
+	restartOrderAnnotation = "db-deploy/restart-order"
+)
+
+// application is a set of targets that is restarted as one unit, in steps.
+type application struct {
+	name  string // namespace/part-of, or empty for a standalone workload
+	steps [][]target
+}
+
+// groupByApplication groups targets by namespace and part-of label, keeping
+// the order in which each application first appears. Targets without the
+// label form an application of their own.
+func groupByApplication(targets []target) []application {
+	var apps []application
+	members := make(map[string][]target)
+	for _, t := range targets {
+		partOf := t.Labels[partOfLabel]
+		if partOf == "" {
+			apps = append(apps, application{steps: [][]target{{t}}})
+			continue
+		}
+		name := t.Namespace + "/" + partOf
+		if _, ok := members[name]; !ok {
+			apps = append(apps, application{name: name})
+		}
+		members[name] = append(members[name], t)
+	}
+
+	for i := range apps {
+		if apps[i].name != "" {
+			apps[i].steps = restartSteps(members[apps[i].name])
+		}
+	}
+	return apps
+}
+
+// restartSteps splits the targets of an application into steps according to
+// their restart order.
+func restartSteps(targets []target) [][]target {
+	sort.SliceStable(targets, func(i, j int) bool {
+		return restartOrder(targets[i]) < restartOrder(targets[j])
+	})
+
+	var steps [][]target
+	for i, t := range targets {
+		if i == 0 || restartOrder(t) != restartOrder(targets[i-1]) {
+			steps = append(steps, nil)
+		}
+		steps[len(steps)-1] = append(steps[len(steps)-1], t)
+	}
+	return steps
+}
+
+// restartOrder returns the position of the target within its application.
+func restartOrder(t target) int {
+	value, ok := t.Annotations[restartOrderAnnotation]
+	if !ok {
+		return 0
+	}
+	order, err := strconv.Atoi(value)
+	if err != nil {
+		workloadLogger(t).Warn("Ignoring invalid annotation", "annotation", restartOrderAnnotation, "value", value)
+		return 0
+	}
+	return order
+}
+
+// runApplication restarts an application step by step, restarting the
+// targets of each step together. Once a step fails, the remaining steps are
+// skipped so that, for example, a connection pooler is not bounced while its
+// database is broken.
+func (r *runner) runApplication(ctx context.Context, app application) []result {
+	var results []result
+	failed := false
+	for _, step := range app.steps {
+		if failed {
+			for _, t := range step {
+				res := result{Target: t, Skipped: fmt.Sprintf("an earlier step of application %s failed", app.name)}
+				progressSkip(t, res.Skipped)
+				if r.progress != nil {
+					r.progress.finish(ctx, t)
+				}
+				results = append(results, res)
+			}
+			continue
+		}
+
+		for _, res := range r.runTogether(ctx, step) {
+			if status := res.status(); status == statusFailed || status == statusRolloutFailed {
+				failed = true
+			}
+			results = append(results, res)
+		}
+	}
+
+	for i := range results {
+		results[i].Application = app.name
+	}
+	return results
+}
+
+// applicationStatus summarises the results of an application's targets: it
+// failed if any target failed, was skipped if every target was skipped and
+// was restarted otherwise.
+func applicationStatus(results []result) string {
+	status := statusSkipped
+	for _, res := range results {
+		switch res.status() {
+		case statusFailed, statusRolloutFailed:
+			return statusFailed
+		case statusRestarted:
+			status = statusRestarted
+		}
+	}
+	return status
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// auditTarget records the security findings of the target's pod template.
+func auditTarget(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, t *target) error {
+	spec, err := workloadPodSpec(ctx, clientset, dynamicClient, *t)
+	if err != nil {
+		return err
+	}
+	t.SecurityFindings = auditPodSpec(spec)
+	return nil
+}
+
+// workloadPodSpec returns the pod template spec of a workload.
+func workloadPodSpec(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, t target) (*corev1.PodSpec, error) {
+	switch t.Kind {
+	case "deployment":
+		w, err := clientset.AppsV1().Deployments(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get deployment: %w", err)
+		}
+		return &w.Spec.Template.Spec, nil
+	case "statefulset":
+		w, err := clientset.AppsV1().StatefulSets(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get statefulset: %w", err)
+		}
+		return &w.Spec.Template.Spec, nil
+	case "daemonset":
+		w, err := clientset.AppsV1().DaemonSets(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get daemonset: %w", err)
+		}
+		return &w.Spec.Template.Spec, nil
+	case "rollout":
+		w, err := dynamicClient.Resource(rolloutResource).Namespace(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get rollout: %w", err)
+		}
+		// Rollouts referencing a Deployment through workloadRef have no
+		// template of their own
+		template, found, _ := unstructured.NestedMap(w.Object, "spec", "template", "spec")
+		if !found {
+			return nil, fmt.Errorf("rollout has no pod template")
+		}
+		spec := &corev1.PodSpec{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(template, spec); err != nil {
+			return nil, fmt.Errorf("invalid pod template: %w", err)
+		}
+		return spec, nil
+	}
+	return nil, fmt.Errorf("unsupported workload kind %q", t.Kind)
+}
+
+// auditPodSpec returns the security findings of a pod spec: host namespaces,
+// privileged containers or containers that may run as root, and application
+// containers without probes or resource limits.
+func auditPodSpec(spec *corev1.PodSpec) []string {
+	var findings []string
+	if spec.HostNetwork {
+		findings = append(findings, "uses the host network")
+	}
+	if spec.HostPID {
+		findings = append(findings, "uses the host PID namespace")
+	}
+	if spec.HostIPC {
+		findings = append(findings, "uses the host IPC namespace")
+	}
+
+	audit := func(c corev1.Container, init bool) {
+		if sc := c.SecurityContext; sc != nil && sc.Privileged != nil && *sc.Privileged {
+			findings = append(findings, fmt.Sprintf("container %s is privileged", c.Name))
+		}
+		if mayRunAsRoot(spec.SecurityContext, c.SecurityContext) {
+			findings = append(findings, fmt.Sprintf("container %s may run as root", c.Name))
+		}
+		if _, ok := c.Resources.Limits[corev1.ResourceMemory]; !ok {
+			findings = append(findings, fmt.Sprintf("container %s has no memory limit", c.Name))
+		}
+		if _, ok := c.Resources.Limits[corev1.ResourceCPU]; !ok {
+			findings = append(findings, fmt.Sprintf("container %s has no CPU limit", c.Name))
+		}
+		if init {
+			return
+		}
+		if c.ReadinessProbe == nil {
+			findings = append(findings, fmt.Sprintf("container %s has no readiness probe", c.Name))
+		}
+		if c.LivenessProbe == nil {
+			findings = append(findings, fmt.Sprintf("container %s has no liveness probe", c.Name))
+		}
+	}
+	for _, c := range spec.InitContainers {
+		audit(c, true)
+	}
+	for _, c := range spec.Containers {
+		audit(c, false)
+	}
+	return findings
+}
+
+// mayRunAsRoot reports whether a container may run as root: neither it nor
+// its pod requires a non-root user, and the user it runs as is root or left to
+// the image. Container settings take precedence over those of the pod.
+func mayRunAsRoot(pod *corev1.PodSecurityContext, container *corev1.SecurityContext) bool {
+	var nonRoot *bool
+	var user *int64
+	if pod != nil {
+		nonRoot, user = pod.RunAsNonRoot, pod.RunAsUser
+	}
+	if container != nil {
+		if container.RunAsNonRoot != nil {
+			nonRoot = container.RunAsNonRoot
+		}
+		if container.RunAsUser != nil {
+			user = container.RunAsUser
+		}
+	}
+	if user != nil {
+		return *user == 0
+	}
+	return nonRoot == nil || !*nonRoot
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotations telling the backup freshness gate where a workload's backups
+// are found.
+const (
+	// backupSourceAnnotation is one of:
+	//   volumesnapshot                     newest ready VolumeSnapshot of the pods' claims (the default)
+	//   url:URL                            Last-Modified of an object, e.g. a presigned S3 URL
+	//   resource:GROUP/VERSION/RESOURCE:SELECTOR
+	//                                      newest matching backup resource in the namespace
+	backupSourceAnnotation = "db-deploy/backup-source"
+
+	// backupTimeFieldAnnotation is the dotted path of the completion time in
+	// backup resources, status.completionTimestamp by default.
+	backupTimeFieldAnnotation = "db-deploy/backup-time-field"
+)
+
+var volumeSnapshotResource = schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshots"}
+
+// lastBackup returns the time of the most recent backup of a target, from the
+// source its annotations declare. A zero time means no backup was found.
+func lastBackup(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, t target) (time.Time, error) {
+	source := t.Annotations[backupSourceAnnotation]
+	switch {
+	case source == "" || source == "volumesnapshot":
+		return lastVolumeSnapshot(ctx, clientset, dynamicClient, t)
+	case strings.HasPrefix(source, "url:"):
+		return lastModified(ctx, strings.TrimPrefix(source, "url:"))
+	case strings.HasPrefix(source, "resource:"):
+		field := t.Annotations[backupTimeFieldAnnotation]
+		if field == "" {
+			field = "status.completionTimestamp"
+		}
+		return lastBackupResource(ctx, dynamicClient, t.Namespace, strings.TrimPrefix(source, "resource:"), field)
+	}
+	return time.Time{}, fmt.Errorf("invalid %s=%q", backupSourceAnnotation, source)
+}
+
+// lastVolumeSnapshot returns the creation time of the newest ready
+// VolumeSnapshot taken of a claim mounted by the target's pods.
+func lastVolumeSnapshot(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, t target) (time.Time, error) {
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid selector: %w", err)
+	}
+	pods, err := clientset.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to list pods: %w", err)
+	}
+	claims := make(map[string]bool)
+	for _, pod := range pods.Items {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil {
+				claims[volume.PersistentVolumeClaim.ClaimName] = true
+			}
+		}
+	}
+
+	snapshots, err := dynamicClient.Resource(volumeSnapshotResource).Namespace(t.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to list volume snapshots: %w", err)
+	}
+	var newest time.Time
+	for _, snapshot := range snapshots.Items {
+		claim, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "persistentVolumeClaimName")
+		ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse")
+		if !claims[claim] || !ready {
+			continue
+		}
+		created := snapshot.GetCreationTimestamp().Time
+		if value, found, _ := unstructured.NestedString(snapshot.Object, "status", "creationTime"); found {
+			if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+				created = parsed
+			}
+		}
+		if created.After(newest) {
+			newest = created
+		}
+	}
+	return newest, nil
+}
+
+// lastModified returns the Last-Modified time of an object served over HTTP,
+// such as a presigned URL of the latest backup in S3.
+func lastModified(ctx context.Context, url string) (time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return time.Time{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("backup object returned %s", resp.Status)
+	}
+	return http.ParseTime(resp.Header.Get("Last-Modified"))
+}
+
+// lastBackupResource returns the newest completion time among the backup
+// resources, given as GROUP/VERSION/RESOURCE:SELECTOR, in a namespace.
+func lastBackupResource(ctx context.Context, dynamicClient dynamic.Interface, namespace, spec, field string) (time.Time, error) {
+	ref, selector, _ := strings.Cut(spec, ":")
+	parts := strings.Split(ref, "/")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("invalid backup resource %q, expected GROUP/VERSION/RESOURCE:SELECTOR", spec)
+	}
+	gvr := schema.GroupVersionResource{Group: parts[0], Version: parts[1], Resource: parts[2]}
+
+	list, err := dynamicClient.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to list %s: %w", gvr.Resource, err)
+	}
+	var newest time.Time
+	for _, item := range list.Items {
+		value, found, _ := unstructured.NestedString(item.Object, strings.Split(field, ".")...)
+		if !found {
+			continue
+		}
+		completed, err := time.Parse(time.RFC3339, value)
+		if err == nil && completed.After(newest) {
+			newest = completed
+		}
+	}
+	return newest, nil
+}
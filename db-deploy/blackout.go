@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Annotations with which application teams declare their own blackout
+// periods on a workload.
+const (
+	// noRestartBeforeAnnotation holds a date (2025-01-15) or RFC 3339 time
+	// before which the workload must not be restarted.
+	noRestartBeforeAnnotation = "db-deploy/no-restart-before"
+
+	// noRestartCronAnnotation holds a five-field cron expression, evaluated
+	// in UTC unless prefixed with TZ=ZONE, during whose matching minutes the
+	// workload must not be restarted, e.g. "* 9-17 * * 1-5" for office
+	// hours.
+	noRestartCronAnnotation = "db-deploy/no-restart-cron"
+)
+
+// blackout returns why the target is inside a blackout period it declared,
+// or "" if it may be restarted now. Like a freeze, a malformed annotation
+// counts as a blackout, since whoever set it meant to protect the workload.
+func blackout(t target, now time.Time) string {
+	if value, ok := t.Annotations[noRestartBeforeAnnotation]; ok {
+		before, err := parseNoRestartBefore(value)
+		if err != nil {
+			return fmt.Sprintf("malformed %s annotation %q", noRestartBeforeAnnotation, value)
+		}
+		if now.Before(before) {
+			return fmt.Sprintf("no restarts before %s (%s)", value, noRestartBeforeAnnotation)
+		}
+	}
+	if value, ok := t.Annotations[noRestartCronAnnotation]; ok {
+		schedule, err := parseCron(value)
+		if err != nil {
+			return fmt.Sprintf("malformed %s annotation %q: %v", noRestartCronAnnotation, value, err)
+		}
+		if schedule.matches(now) {
+			return fmt.Sprintf("inside blackout window %q (%s)", value, noRestartCronAnnotation)
+		}
+	}
+	return ""
+}
+
+// parseNoRestartBefore parses a date, taken as midnight UTC, or an RFC 3339
+// time.
+func parseNoRestartBefore(value string) (time.Time, error) {
+	if before, err := time.Parse("2006-01-02", value); err == nil {
+		return before, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// cronSchedule is a parsed five-field cron expression. Each field is the set
+// of values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+
+	// domRestricted and dowRestricted record whether the day fields were
+	// anything but "*": as in cron, a day matches if either restricted
+	// field does.
+	domRestricted, dowRestricted bool
+
+	location *time.Location
+}
+
+// parseCron parses a standard five-field cron expression, optionally
+// prefixed with TZ=ZONE. Fields accept *, numbers, ranges, lists and steps.
+// Day of week 7 is Sunday, like 0.
+func parseCron(expr string) (cronSchedule, error) {
+	s := cronSchedule{location: time.UTC}
+	expr = strings.TrimSpace(expr)
+	if rest, ok := strings.CutPrefix(expr, "TZ="); ok {
+		zone, fields, _ := strings.Cut(rest, " ")
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return s, err
+		}
+		s.location, expr = loc, fields
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return s, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return s, fmt.Errorf("minute: %w", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return s, fmt.Errorf("hour: %w", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return s, fmt.Errorf("day of month: %w", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return s, fmt.Errorf("month: %w", err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return s, fmt.Errorf("day of week: %w", err)
+	}
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+	s.domRestricted = fields[2] != "*"
+	s.dowRestricted = fields[4] != "*"
+	return s, nil
+}
+
+// parseCronField parses one field of a cron expression into the set of
+// values between min and max it matches.
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		spec, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+
+		low, high := min, max
+		if spec != "*" {
+			lowText, highText, isRange := strings.Cut(spec, "-")
+			var err error
+			if low, err = strconv.Atoi(lowText); err != nil {
+				return nil, fmt.Errorf("invalid value %q", lowText)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(highText); err != nil {
+					return nil, fmt.Errorf("invalid value %q", highText)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := low; v <= high; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// matches reports whether the minute containing t matches the schedule.
+func (s cronSchedule) matches(t time.Time) bool {
+	t = t.In(s.location)
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := s.dom[t.Day()], s.dow[int(t.Weekday())]
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// cronSearchLimit bounds the search for the next matching minute of a
+// schedule. Four years cover every valid date, February 29 included.
+const cronSearchLimit = 4 * 366 * 24 * time.Hour
+
+// next returns the first minute after t that matches the schedule, and false
+// if none does within cronSearchLimit, as for February 30.
+func (s cronSchedule) next(t time.Time) (time.Time, bool) {
+	limit := t.Add(cronSearchLimit)
+	for t = t.Truncate(time.Minute).Add(time.Minute); t.Before(limit); t = t.Add(time.Minute) {
+		if s.matches(t) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotations maintained on the progress ConfigMap, so dashboards can show
+// how far a run is without integrating with the tool.
+const (
+	// progressAnnotation holds DONE/TOTAL, e.g. "17/42".
+	progressAnnotation = "db-deploy/progress"
+
+	// progressStateAnnotation is "running" or "finished".
+	progressStateAnnotation = "db-deploy/progress-state"
+
+	// progressUpdatedAnnotation holds the time of the last update.
+	progressUpdatedAnnotation = "db-deploy/progress-updated"
+)
+
+// progressConfigMapName is the well-known ConfigMap carrying the progress of
+// the current run.
+const progressConfigMapName = "db-pods-progress"
+
+// campaignProgress publishes the progress of a run on a ConfigMap. Updates
+// are best effort: failing to publish progress never fails the run.
+type campaignProgress struct {
+	clientset *kubernetes.Clientset
+	namespace string
+	name      string
+	runID     string
+	total     int
+
+	mu       sync.Mutex
+	finished map[string]bool
+	disabled bool
+}
+
+// startProgress creates or takes over the progress ConfigMap for a run of
+// total targets.
+func startProgress(ctx context.Context, clientset *kubernetes.Clientset, namespace, name, runID string, total int) *campaignProgress {
+	p := &campaignProgress{clientset: clientset, namespace: namespace, name: name, runID: runID, total: total, finished: make(map[string]bool)}
+
+	_, err := clientset.CoreV1().ConfigMaps(namespace).Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+	}, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		slog.Warn("Cannot publish progress on configmap", "namespace", namespace, "configmap", name, "error", err)
+		p.disabled = true
+		return p
+	}
+	p.publish(ctx, "running")
+	return p
+}
+
+// finish records that a target is done, however it ended. A target that is
+// retried is only counted once.
+func (p *campaignProgress) finish(ctx context.Context, t target) {
+	p.mu.Lock()
+	p.finished[t.String()] = true
+	p.mu.Unlock()
+	p.publish(ctx, "running")
+}
+
+// complete marks the run as finished.
+func (p *campaignProgress) complete(ctx context.Context) {
+	p.publish(ctx, "finished")
+}
+
+func (p *campaignProgress) publish(ctx context.Context, state string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.disabled {
+		return
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				progressAnnotation:        fmt.Sprintf("%d/%d", len(p.finished), p.total),
+				progressStateAnnotation:   state,
+				progressUpdatedAnnotation: time.Now().UTC().Format(time.RFC3339),
+				runIDAnnotation:           p.runID,
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	if _, err := p.clientset.CoreV1().ConfigMaps(p.namespace).Patch(ctx, p.name, types.MergePatchType, data, metav1.PatchOptions{}); err != nil {
+		slog.Error("Error publishing progress on configmap", "namespace", p.namespace, "configmap", p.name, "error", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// chaosAnnotation tags workloads restarted by a game-day run with the run ID,
+// so their restarts can be told apart from routine maintenance.
+const chaosAnnotation = "db-deploy/chaos-run"
+
+// chaosConfirmation is the word an operator has to type to start a game day.
+const chaosConfirmation = "chaos"
+
+// chaosOptions selects a random subset of the matched databases for resilience
+// game days.
+type chaosOptions struct {
+	percent   int
+	namespace bool
+}
+
+func (c chaosOptions) enabled() bool {
+	return c.percent > 0 || c.namespace
+}
+
+// selectChaosTargets narrows targets down to one random namespace and/or a
+// random percentage of them.
+func selectChaosTargets(targets []target, c chaosOptions, rng *rand.Rand) []target {
+	selected := append([]target(nil), targets...)
+
+	if c.namespace && len(selected) > 0 {
+		seen := make(map[string]bool)
+		var namespaces []string
+		for _, t := range selected {
+			if !seen[t.Namespace] {
+				seen[t.Namespace] = true
+				namespaces = append(namespaces, t.Namespace)
+			}
+		}
+		sort.Strings(namespaces)
+		namespace := namespaces[rng.Intn(len(namespaces))]
+
+		var inNamespace []target
+		for _, t := range selected {
+			if t.Namespace == namespace {
+				inNamespace = append(inNamespace, t)
+			}
+		}
+		selected = inNamespace
+	}
+
+	if c.percent > 0 && c.percent < 100 {
+		n := (len(selected)*c.percent + 99) / 100
+		rng.Shuffle(len(selected), func(i, j int) { selected[i], selected[j] = selected[j], selected[i] })
+		selected = selected[:n]
+	}
+	return selected
+}
+
+// confirmChaos asks the operator to confirm a game-day run by typing the
+// confirmation word.
+func confirmChaos(in io.Reader, out io.Writer, targets []target) bool {
+	fmt.Fprintf(out, "Chaos mode will restart %d randomly selected workloads. Type %q to continue: ", len(targets), chaosConfirmation)
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return false
+	}
+	return strings.TrimSpace(line) == chaosConfirmation
+}
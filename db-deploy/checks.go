@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The checks a verification pipeline is made of.
+const (
+	// checkRollout waits for the rollout to complete. It always comes
+	// first, since the other checks look at the new pods.
+	checkRollout = "rollout"
+
+	// checkSidecars waits for the mesh sidecars of meshed workloads.
+	checkSidecars = "sidecars"
+
+	// checkWarmup probes the --warmup-url of workloads that have one.
+	checkWarmup = "warmup"
+
+	// checkEndpoints waits for every pod to be a ready endpoint of each
+	// Service selecting it.
+	checkEndpoints = "endpoints"
+
+	// checkConnectivity opens a TCP connection to every pod.
+	checkConnectivity = "connectivity"
+
+	// checkExec runs a command against every pod in an ephemeral container
+	// and expects it to exit with 0.
+	checkExec = "exec"
+
+	// checkMetrics waits for a Prometheus query to fall within bounds.
+	checkMetrics = "metrics"
+)
+
+// Outcomes of a check.
+const (
+	checkPassed  = "passed"
+	checkFailed  = "failed"
+	checkSkipped = "skipped"
+	checkNotRun  = "not_run"
+)
+
+// configVerificationKey is the key of the --config file holding the
+// verification pipelines.
+const configVerificationKey = "verification"
+
+// defaultCheckTimeout bounds the checks that have no timeout of their own.
+const defaultCheckTimeout = 2 * time.Minute
+
+// errCheckSkipped is returned by checks that do not apply to a target, such
+// as the sidecar check of a workload outside the mesh.
+var errCheckSkipped = errors.New("not applicable")
+
+// defaultChecks is the pipeline of targets that match no verification class.
+var defaultChecks = []checkSpec{{Check: checkRollout}, {Check: checkSidecars}, {Check: checkWarmup}}
+
+// verificationConfig is the verification section of a --config file:
+//
+//	verification:
+//	  classes:
+//	  - name: postgres
+//	    kinds: [statefulset]
+//	    selector: app.kubernetes.io/name=postgresql
+//	    checks:
+//	    - check: rollout
+//	      delay: 2m
+//	    - check: endpoints
+//	    - check: exec
+//	      command: pg_isready -h 127.0.0.1
+//	      image: postgres:16
+//	    - check: metrics
+//	      query: pg_up{namespace="{namespace}"}
+//	      min: 1
+//
+// A target is verified with the checks of the first class it matches, or
+// with the default rollout, sidecars and warm-up checks if it matches none.
+type verificationConfig struct {
+	Classes []verificationClass `json:"classes"`
+}
+
+// verificationClass selects targets by kind, namespace glob patterns and a
+// label selector on the workload. A class without any of them matches every
+// target.
+type verificationClass struct {
+	Name       string      `json:"name"`
+	Kinds      []string    `json:"kinds"`
+	Namespaces []string    `json:"namespaces"`
+	Selector   string      `json:"selector"`
+	Checks     []checkSpec `json:"checks"`
+
+	selector labels.Selector
+}
+
+// checkSpec configures one check of a pipeline. Fields a check does not use
+// are ignored.
+type checkSpec struct {
+	Check string `json:"check"`
+
+	// Name labels the check in the report, for pipelines running a check
+	// more than once. It defaults to the check.
+	Name string `json:"name"`
+
+	// Timeout bounds the check, as a duration such as 5m. The rollout
+	// check uses it instead of --rollout-timeout.
+	Timeout string `json:"timeout"`
+
+	// Delay holds the rollout check back after the restart, as a duration
+	// such as 2m, for databases that take a while to even begin
+	// terminating, such as after a long checkpoint. The timeout only starts
+	// once it has passed, so a slow start is not mistaken for a stalled
+	// rollout.
+	Delay string `json:"delay"`
+
+	// Port is the port connectivity connects to, by default the first
+	// declared TCP port of the pod.
+	Port int `json:"port"`
+
+	// Command, Image and Container configure exec. The command runs with
+	// sh -c in Image, by default the --debug-image, targeting Container, by
+	// default the first container of the pod.
+	Command   string `json:"command"`
+	Image     string `json:"image"`
+	Container string `json:"container"`
+
+	// Query, Min and Max configure metrics: every series the query returns
+	// must lie within the bounds. The query may contain {namespace} and
+	// {name}.
+	Query string   `json:"query"`
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+
+	timeout time.Duration
+	delay   time.Duration
+}
+
+// label returns the name the check is reported under.
+func (s checkSpec) label() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Check
+}
+
+// checkResult is the outcome of one check of a pipeline.
+type checkResult struct {
+	Name     string
+	Status   string
+	Duration time.Duration
+	Err      error
+}
+
+// loadVerificationConfig reads the verification section of a --config file.
+// It returns nil if the file has none.
+func loadVerificationConfig(file string) (*verificationConfig, error) {
+	raw, err := readConfigSection(file, configVerificationKey)
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	var vc verificationConfig
+	if err := json.Unmarshal(raw, &vc); err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", file, configVerificationKey, err)
+	}
+	for i := range vc.Classes {
+		class := &vc.Classes[i]
+		if class.Name == "" {
+			class.Name = fmt.Sprintf("class %d", i+1)
+		}
+		if err := class.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s: %s: %w", file, configVerificationKey, class.Name, err)
+		}
+	}
+	return &vc, nil
+}
+
+// validate checks a class and parses its selector and timeouts.
+func (c *verificationClass) validate() error {
+	for _, kind := range c.Kinds {
+		if !containsString(workloadKinds, kind) {
+			return fmt.Errorf("unknown kind %q, expected one of %s", kind, strings.Join(workloadKinds, ", "))
+		}
+	}
+	for _, pattern := range c.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid namespace pattern %q: %w", pattern, err)
+		}
+	}
+	var err error
+	if c.selector, err = labels.Parse(c.Selector); err != nil {
+		return fmt.Errorf("invalid selector: %w", err)
+	}
+
+	if len(c.Checks) == 0 || c.Checks[0].Check != checkRollout {
+		return fmt.Errorf("checks must start with %s", checkRollout)
+	}
+	for i := range c.Checks {
+		spec := &c.Checks[i]
+		switch spec.Check {
+		case checkRollout, checkSidecars, checkWarmup, checkEndpoints, checkConnectivity:
+		case checkExec:
+			if spec.Command == "" {
+				return fmt.Errorf("%s: command is required", spec.label())
+			}
+		case checkMetrics:
+			if spec.Query == "" || (spec.Min == nil && spec.Max == nil) {
+				return fmt.Errorf("%s: query and min or max are required", spec.label())
+			}
+		default:
+			return fmt.Errorf("unknown check %q, expected %s, %s, %s, %s, %s, %s or %s", spec.Check,
+				checkRollout, checkSidecars, checkWarmup, checkEndpoints, checkConnectivity, checkExec, checkMetrics)
+		}
+		if spec.Timeout != "" {
+			if spec.timeout, err = time.ParseDuration(spec.Timeout); err != nil || spec.timeout <= 0 {
+				return fmt.Errorf("%s: invalid timeout %q", spec.label(), spec.Timeout)
+			}
+		}
+		if spec.Delay != "" {
+			if spec.Check != checkRollout {
+				return fmt.Errorf("%s: delay only applies to the %s check", spec.label(), checkRollout)
+			}
+			if spec.delay, err = time.ParseDuration(spec.Delay); err != nil || spec.delay < 0 {
+				return fmt.Errorf("%s: invalid delay %q", spec.label(), spec.Delay)
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports whether the class covers the target.
+func (c verificationClass) matches(t target) bool {
+	if len(c.Kinds) > 0 && !containsString(c.Kinds, t.Kind) {
+		return false
+	}
+	if len(c.Namespaces) > 0 && !excludedNamespace(t.Namespace, c.Namespaces) {
+		return false
+	}
+	return c.selector == nil || c.selector.Matches(labels.Set(t.Labels))
+}
+
+// checksFor returns the class of a target, or "" for the default pipeline,
+// and the checks to verify it with.
+func (vc *verificationConfig) checksFor(t target) (string, []checkSpec) {
+	if vc != nil {
+		for _, class := range vc.Classes {
+			if class.matches(t) {
+				return class.Name, class.Checks
+			}
+		}
+	}
+	return "", defaultChecks
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// runningPods returns the pods of a target that are running and not being
+// deleted.
+func runningPods(ctx context.Context, clientset *kubernetes.Clientset, t target) ([]corev1.Pod, error) {
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %w", err)
+	}
+	pods, err := clientset.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+	var running []corev1.Pod
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
+			running = append(running, pod)
+		}
+	}
+	return running, nil
+}
+
+// pollCheck polls cond every interval until it holds or timeout expires.
+// cond describes what it is waiting for, which explains a timeout.
+func pollCheck(ctx context.Context, interval, timeout time.Duration, cond func(ctx context.Context) (bool, string, error)) error {
+	var state string
+	err := wait.PollUntilContextTimeout(ctx, interval, timeout, true, func(ctx context.Context) (bool, error) {
+		ok, s, err := cond(ctx)
+		state = s
+		return ok, err
+	})
+	if wait.Interrupted(err) && ctx.Err() == nil {
+		return fmt.Errorf("timed out after %s: %s", timeout, state)
+	}
+	return err
+}
+
+// waitForEndpoints waits until every running pod of a target is a ready
+// endpoint of each Service selecting it, as listed by its EndpointSlices or,
+// on clusters without them, its Endpoints. Targets that no Service selects
+// are skipped.
+func waitForEndpoints(ctx context.Context, clientset *kubernetes.Clientset, t target, useSlices bool, timeout time.Duration) error {
+	services, err := clientset.CoreV1().Services(t.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+
+	selected := false
+	err = pollCheck(ctx, 2*time.Second, timeout, func(ctx context.Context) (bool, string, error) {
+		pods, err := runningPods(ctx, clientset, t)
+		if err != nil {
+			return false, "", err
+		}
+		if len(pods) == 0 {
+			return false, "no running pods", nil
+		}
+		for _, svc := range services.Items {
+			if len(svc.Spec.Selector) == 0 {
+				continue
+			}
+			svcSelector := labels.SelectorFromSet(svc.Spec.Selector)
+			var backing []string
+			for _, pod := range pods {
+				if svcSelector.Matches(labels.Set(pod.Labels)) {
+					backing = append(backing, pod.Name)
+				}
+			}
+			if len(backing) == 0 {
+				continue
+			}
+			selected = true
+
+			ready, err := readyEndpoints(ctx, clientset, t.Namespace, svc.Name, useSlices)
+			if err != nil {
+				return false, "", err
+			}
+			for _, pod := range backing {
+				if !ready[pod] {
+					return false, fmt.Sprintf("pod %s is not a ready endpoint of service %s", pod, svc.Name), nil
+				}
+			}
+		}
+		return true, "", nil
+	})
+	if err == nil && !selected {
+		return errCheckSkipped
+	}
+	return err
+}
+
+// readyEndpoints returns the names of the pods that are ready endpoints of a
+// Service, from its EndpointSlices or else from its Endpoints.
+func readyEndpoints(ctx context.Context, clientset *kubernetes.Clientset, namespace, service string, useSlices bool) (map[string]bool, error) {
+	if !useSlices {
+		return readyLegacyEndpoints(ctx, clientset, namespace, service)
+	}
+	slices, err := clientset.DiscoveryV1().EndpointSlices(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + service,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list endpoint slices of service %s: %w", service, err)
+	}
+	ready := make(map[string]bool)
+	for _, slice := range slices.Items {
+		for _, endpoint := range slice.Endpoints {
+			// A missing condition means ready, as for the endpoints controller
+			if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" && (endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready) {
+				ready[endpoint.TargetRef.Name] = true
+			}
+		}
+	}
+	return ready, nil
+}
+
+// readyLegacyEndpoints returns the names of the pods that are ready
+// endpoints of a Service from its Endpoints object.
+func readyLegacyEndpoints(ctx context.Context, clientset *kubernetes.Clientset, namespace, service string) (map[string]bool, error) {
+	endpoints, err := clientset.CoreV1().Endpoints(namespace).Get(ctx, service, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get endpoints of service %s: %w", service, err)
+	}
+	ready := make(map[string]bool)
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			if address.TargetRef != nil && address.TargetRef.Kind == "Pod" {
+				ready[address.TargetRef.Name] = true
+			}
+		}
+	}
+	return ready, nil
+}
+
+// waitForConnectivity waits until a TCP connection can be opened to every
+// running pod of a target, on the given port or else the first TCP port the
+// pod declares. Pods are dialled on their IP, so this check needs db-pods to
+// run inside the cluster network. Targets whose pods declare no port are
+// skipped.
+func waitForConnectivity(ctx context.Context, clientset *kubernetes.Clientset, t target, port int, timeout time.Duration) error {
+	return pollCheck(ctx, 2*time.Second, timeout, func(ctx context.Context) (bool, string, error) {
+		pods, err := runningPods(ctx, clientset, t)
+		if err != nil {
+			return false, "", err
+		}
+		if len(pods) == 0 {
+			return false, "no running pods", nil
+		}
+		for _, pod := range pods {
+			p := port
+			if p == 0 {
+				p = firstTCPPort(pod)
+			}
+			if p == 0 {
+				return false, "", errCheckSkipped
+			}
+			if pod.Status.PodIP == "" {
+				return false, fmt.Sprintf("pod %s has no IP", pod.Name), nil
+			}
+			var dialer net.Dialer
+			dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			conn, err := dialer.DialContext(dialCtx, "tcp", net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(p)))
+			cancel()
+			if err != nil {
+				return false, fmt.Sprintf("cannot connect to pod %s on port %d: %v", pod.Name, p, err), nil
+			}
+			conn.Close()
+		}
+		return true, "", nil
+	})
+}
+
+// firstTCPPort returns the first TCP port declared by the containers of a
+// pod, or 0 if there is none.
+func firstTCPPort(pod corev1.Pod) int {
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Protocol == "" || port.Protocol == corev1.ProtocolTCP {
+				return int(port.ContainerPort)
+			}
+		}
+	}
+	return 0
+}
+
+// runExecCheck runs the check's command against every running pod of a
+// target in an ephemeral container, as --debug-before-restart does, and
+// fails on the first pod where it exits with anything but 0. Ephemeral
+// containers cannot be removed, so they stay in the pod until it is next
+// replaced.
+func runExecCheck(ctx context.Context, clientset *kubernetes.Clientset, t target, spec checkSpec, debug debugConfig, timeout time.Duration) error {
+	pods, err := runningPods(ctx, clientset, t)
+	if err != nil {
+		return err
+	}
+	if len(pods) == 0 {
+		return fmt.Errorf("no running pods")
+	}
+	cfg := debugConfig{image: debug.image, command: spec.Command, timeout: timeout}
+	if spec.Image != "" {
+		cfg.image = spec.Image
+	}
+	for i := range pods {
+		pod := &pods[i]
+		container := spec.Container
+		if container == "" {
+			container = pod.Spec.Containers[0].Name
+		}
+		output, exitCode, err := runDebugContainer(ctx, clientset, pod, container, cfg)
+		if err != nil {
+			return fmt.Errorf("pod %s: %w", pod.Name, err)
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("%q exited with %d in pod %s: %s", spec.Command, exitCode, pod.Name, lastLine(output))
+		}
+	}
+	return nil
+}
+
+// lastLine returns the last non-empty line of a command's output.
+func lastLine(output []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// waitForMetrics waits until every series returned by the check's query lies
+// within its bounds.
+func waitForMetrics(ctx context.Context, prometheusURL string, t target, spec checkSpec, timeout time.Duration) error {
+	if prometheusURL == "" {
+		return fmt.Errorf("the %s check requires --prometheus-url", checkMetrics)
+	}
+	query := strings.NewReplacer("{namespace}", t.Namespace, "{name}", t.Name).Replace(spec.Query)
+	client := &http.Client{Timeout: 30 * time.Second}
+	return pollCheck(ctx, 10*time.Second, timeout, func(ctx context.Context) (bool, string, error) {
+		values, err := queryPrometheus(ctx, client, prometheusURL, query)
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		if len(values) == 0 {
+			return false, "query returned no series", nil
+		}
+		for _, v := range values {
+			if (spec.Min != nil && v < *spec.Min) || (spec.Max != nil && v > *spec.Max) {
+				return false, fmt.Sprintf("query returned %g, outside %s", v, formatBounds(spec.Min, spec.Max)), nil
+			}
+		}
+		return true, "", nil
+	})
+}
+
+// formatBounds describes the bounds of a metrics check.
+func formatBounds(min, max *float64) string {
+	switch {
+	case min != nil && max != nil:
+		return fmt.Sprintf("[%g, %g]", *min, *max)
+	case min != nil:
+		return fmt.Sprintf("[%g, +Inf)", *min)
+	}
+	return fmt.Sprintf("(-Inf, %g]", *max)
+}
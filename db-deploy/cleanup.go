@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// cleanupCommand removes tool-managed annotations that no longer serve a
+// purpose: restart-in-progress markers orphaned by runs that crashed or were
+// interrupted, and optionally the run IDs of old runs.
+func cleanupCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	olderThan := fs.Duration("older-than", time.Hour, "remove restart-in-progress markers left by runs started longer ago than this")
+	runIDsOlderThan := fs.Duration("run-ids-older-than", 0, "also remove run ID annotations of runs started longer ago than this (0 keeps them)")
+	dryRun := fs.Bool("dry-run", false, "only print the annotations that would be removed")
+	fallbackNamespaces := fs.String("fallback-namespaces", "", "comma-separated namespaces to search when workloads cannot be listed cluster-wide (default: every namespace the caller can list workloads in)")
+	includeRollouts := fs.Bool("include-rollouts", false, "also clean up Argo Rollouts")
+	return func(args []string) {
+		setupLogging()
+
+		clientset, dynamicClient := newClients()
+
+		ctx := context.Background()
+
+		workloads, err := listWorkloads(ctx, clientset, dynamicClient, discoveryOptions{
+			fallbackNamespaces: splitList(*fallbackNamespaces),
+			includeRollouts:    *includeRollouts,
+		})
+		if err != nil {
+			log.Fatalf("Error discovering workloads: %v", err)
+		}
+
+		now := time.Now()
+		cleaned := 0
+		for _, w := range workloads {
+			stale := map[string]interface{}{}
+			if id, ok := w.Annotations[restartInProgressAnnotation]; ok && staleRun(id, now, *olderThan) {
+				stale[restartInProgressAnnotation] = nil
+			}
+			if id, ok := w.Annotations[runIDAnnotation]; ok && *runIDsOlderThan > 0 && staleRun(id, now, *runIDsOlderThan) {
+				stale[runIDAnnotation] = nil
+			}
+			if len(stale) == 0 {
+				continue
+			}
+
+			keys := make([]string, 0, len(stale))
+			for key := range stale {
+				keys = append(keys, fmt.Sprintf("%s=%s", key, w.Annotations[key]))
+			}
+			sort.Strings(keys)
+
+			if *dryRun {
+				fmt.Printf("Would remove from %s: %s\n", w, strings.Join(keys, ", "))
+				cleaned++
+				continue
+			}
+			if err := patchAnnotations(ctx, clientset, dynamicClient, w, stale); err != nil {
+				slog.Error("Error cleaning up workload", "workload", w, "error", err)
+				continue
+			}
+			fmt.Printf("Removed from %s: %s\n", w, strings.Join(keys, ", "))
+			cleaned++
+		}
+
+		fmt.Printf("\nTotal workloads cleaned up: %d\n", cleaned)
+	}
+}
+
+// staleRun reports whether the run with the given ID started more than maxAge
+// ago. IDs that cannot be parsed never belonged to a live run and are always
+// considered stale.
+func staleRun(id string, now time.Time, maxAge time.Duration) bool {
+	started, err := runIDTime(id)
+	if err != nil {
+		return true
+	}
+	return now.Sub(started) > maxAge
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// cli is the command tree of db-pods. It is built by main and used to render
+// the help of each command.
+var cli *cobra.Command
+
+func main() {
+	kubectlPlugin = isKubectlPlugin(os.Args[0])
+	cli = newRootCommand()
+	args := os.Args[1:]
+	if legacyRestart(args) {
+		args = append([]string{"restart"}, args...)
+	}
+	if cmd, _, err := cli.Find(args); err == nil {
+		args = legacyFlags(cmd, args)
+	}
+	cli.SetArgs(args)
+	if err := cli.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// newRootCommand returns the db-pods command and its subcommands.
+func newRootCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:   "db-pods",
+		Short: "Gracefully restart database workloads on Kubernetes",
+		Long: `db-pods restarts database Deployments, StatefulSets, DaemonSets and Argo
+Rollouts the way "kubectl rollout restart" does, one workload at a time and
+with the checks a database deserves: freezes, backups, migrations, error
+budgets and verification of every rollout.
+
+Run "db-pods list" to see which workloads a selection matches, and
+"db-pods restart" to restart them.
+
+Every flag can also be set with an environment variable named after it,
+such as DB_DEPLOY_ROLLOUT_TIMEOUT=5m for --rollout-timeout, one value per
+line for repeatable flags. Flags on the command line take precedence over
+the environment, which takes precedence over the --config file.
+
+Run "db-pods completion bash|zsh|fish --help" to set up shell completion,
+which also completes namespaces and contexts from the cluster.`,
+		SilenceUsage: true,
+	}
+	if kubectlPlugin {
+		// Help then shows the command lines as they are typed,
+		// "kubectl db-restart restart" for instance
+		root.Use = "db-restart"
+		root.Annotations = map[string]string{cobra.CommandDisplayNameAnnotation: "kubectl db-restart"}
+	}
+	root.AddGroup(
+		&cobra.Group{ID: "restart", Title: "Restarting workloads:"},
+		&cobra.Group{ID: "manage", Title: "Managing workloads and runs:"},
+		&cobra.Group{ID: "setup", Title: "Setting up:"},
+	)
+	root.SetCompletionCommandGroupID("setup")
+
+	root.AddCommand(
+		flagSetCommand("restart", "restart [flags]", "Restart the matching database workloads", `Restart every database workload matching the selection flags, waiting for
+each rollout and verifying it before moving on. Runs without a --namespace,
+--selector, name or --plan scope are refused unless --all is given.`, restartCommand),
+		flagSetCommand("restart", "plan [flags]", "Print the restart plan or emit a Job that runs it", `Print the workloads a restart would touch without changing anything, write
+them to a plan file for approval, or emit a Job that executes the plan from
+inside the cluster.`, planCommand),
+		flagSetCommand("restart", "list [flags]", "List the matching database workloads", `List the database workloads matching the selection flags, with why they
+matched and when they were last restarted. Nothing is changed.`, listCommand),
+		flagSetCommand("restart", "status [flags]", "Show the rollout status of the matching workloads", `Show whether each matching database workload has finished rolling out, how
+many of its replicas are ready and when it was last restarted.`, statusCommand),
+		flagSetCommand("restart", "daemon [flags]", "Watch restart freshness and serve metrics", `Periodically check that every database workload has been restarted recently
+and expose the result as Prometheus metrics and a read-only dashboard;
+with --retry-deferred, also retry the restarts that runs deferred.`, daemonCommand),
+		flagSetCommand("restart", "operator [flags]", "Run the restarts declared by DatabaseRestartPolicies", `Reconcile DatabaseRestartPolicy resources, which declare the database
+workloads of their namespace to restart, on which schedule and within which
+safety constraints, so that restarts are managed in Git instead of run by
+hand. Each run takes the same lease and makes the same checks as "db-pods
+restart", and its outcome is reported in the status and events of the
+policy. Install the resource definition with "db-pods operator --print-crd".`, operatorCommand),
+		flagSetCommand("restart", "scheduled [flags] -- [restart flags]", "Restart the matching workloads only inside maintenance windows", `Stay up and run "db-pods restart" with the flags after "--" each time a
+maintenance window opens, sleeping in between. Restarts that have not
+started when the window closes are deferred to the next window. For
+example, to restart the databases of payments at 2am on Sundays:
+
+  db-pods scheduled --window "0 2 * * 0" --timezone Europe/Berlin -- --namespace payments`, scheduledCommand),
+		flagSetCommand("restart", "vclusters [flags] [--restart -- [restart flags]]", "List vclusters and restart the databases inside them", `List the vclusters hosted in the cluster, found by their control plane in
+the namespaces matching --namespace-selector, with the kubeconfig each
+exports to its vc-NAME Secret. With --restart, run "db-pods restart" with
+the flags after "--" inside each of them in turn, for example:
+
+  db-pods vclusters --namespace-selector vcluster=true --restart -- --all
+
+Kubeconfigs exported for localhost are pointed at the Service of the
+vcluster instead, which only resolves when running inside the host cluster.`, vclustersCommand),
+
+		flagSetCommand("manage", "freeze [flags] KIND/NAMESPACE/NAME...", "Freeze workloads against restarts", `Stamp workloads with a freeze expiry; runs skip frozen workloads until then.`, freezeCommand),
+		flagSetCommand("manage", "unfreeze [flags] KIND/NAMESPACE/NAME...", "Lift the freeze of workloads", `Remove the freeze from workloads.`, unfreezeCommand),
+		flagSetCommand("manage", "undo --last [flags]", "Roll back the workloads of the last run", `Roll the workloads restarted by the most recent run, or by --run, back to
+their revision from before it through their rollout history. Only the
+workloads in scope are rolled back, so part of a run can be reverted during
+an incident; workloads whose pod template changed since are left alone.`, undoCommand),
+		flagSetCommand("manage", "handoff-status [flags]", "Show whether handed-off restarts were done", `List the workloads whose restart was handed off with "db-pods restart
+--handoff" and whether their owners have restarted them since.`, handoffStatusCommand),
+		flagSetCommand("manage", "deferred list [flags]", "List the deferred restarts", `Print the queue of workloads whose restart was deferred for reasons expected
+to clear up, such as freezes, pending migrations or storage operations.`, deferredCommand),
+		flagSetCommand("manage", "report --by-workload [flags]", "Report how often each workload is restarted and why", `Aggregate the restart history recorded on the matching workloads to show how
+often each was restarted and for which reasons, surfacing the chronic
+offenders that need a real fix rather than another restart.`, reportCommand),
+		flagSetCommand("manage", "cleanup [flags]", "Remove stale annotations left by runs", `Remove restart-in-progress markers orphaned by runs that crashed or were
+interrupted, and optionally the run IDs of old runs.`, cleanupCommand),
+
+		flagSetCommand("setup", "rbac [flags]", "Print the RBAC the selected features need", `Print the ClusterRole, and optionally its binding, that grants exactly the
+permissions of the selected features.
+
+`+rbacFeatureList(), rbacCommand),
+		flagSetCommand("setup", "contexts check [flags] [CONTEXT...]", "Check access to kubeconfig contexts", `Check that each kubeconfig context is reachable and grants the permissions
+of a restart.`, contextsCommand),
+		flagSetCommand("setup", "compatibility [flags]", "Check which features the cluster supports", `Print the Kubernetes version of the cluster and which of the optional APIs
+db-pods uses it serves, with what db-pods does without them. Exits with
+status 1 on releases older than the oldest supported one.`, compatibilityCommand),
+		flagSetCommand("setup", "dashboards [flags]", "Write a Grafana dashboard for the metrics", `Write a Grafana dashboard for the Prometheus metrics of runs and the daemon.`, dashboardsCommand),
+		&cobra.Command{
+			GroupID: "setup",
+			Use:     "schema",
+			Short:   "Print the JSON schema of the report",
+			Long:    `Print the JSON schema of the report written by "db-pods restart --output json".`,
+			Args:    cobra.NoArgs,
+			Run: func(cmd *cobra.Command, args []string) {
+				schemaCommand(args)
+			},
+		},
+		flagSetCommand("setup", "verify-binary [flags]", "Verify the signature of this binary", `Check that the running executable is a signed release artifact: its digest
+must be listed in the release checksums, and the checksums themselves must
+carry a valid cosign signature.`, verifyBinaryCommand),
+	)
+	// Added now rather than when executing, so that --help lists it
+	root.InitDefaultCompletionCmd()
+	for _, cmd := range root.Commands() {
+		cmd.Example = commandExamples[cmd.Name()]
+	}
+	return root
+}
+
+// flagSetCommand returns a subcommand whose flags are defined by define on
+// its pflag set, and which runs the function define returns with its
+// positional arguments. Flags not given on the command line are first filled
+// in from their DB_DEPLOY_ environment variables, then from the --config file
+// of the commands that accept one.
+func flagSetCommand(group, use, short, long string, define func(fs *pflag.FlagSet) func(args []string)) *cobra.Command {
+	cmd := &cobra.Command{
+		GroupID: group,
+		Use:     use,
+		Short:   short,
+		Long:    long,
+	}
+	run := define(cmd.Flags())
+	cmd.Run = func(cmd *cobra.Command, args []string) {
+		fs := cmd.Flags()
+		if err := applyEnvironment(fs); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if config := fs.Lookup("config"); config != nil && config.Value.String() != "" {
+			if err := applyConfigFile(fs, cmd.Name(), config.Value.String()); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+		run(args)
+	}
+	completeFlagValues(cmd)
+	cmd.ValidArgsFunction = completeArgs(use)
+	return cmd
+}
+
+// legacyRestart reports whether the arguments are those of a restart from
+// before the subcommands, which started with its flags, so that existing
+// CronJobs keep working.
+func legacyRestart(args []string) bool {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "-") {
+		return false
+	}
+	switch args[0] {
+	case "-h", "-help", "--help":
+		return false
+	}
+	return true
+}
+
+// legacyFlags rewrites the flags of a command line written for the flag
+// package, which CronJobs from before the subcommands pass with a single dash
+// as in -namespace=payments, to the double dash pflag expects. Only the
+// names of flags of cmd are rewritten, which leaves shorthands such as -n
+// alone, and so are the arguments after "--", which scheduled and vclusters
+// pass on to restart.
+func legacyFlags(cmd *cobra.Command, args []string) []string {
+	cmd.InitDefaultHelpFlag()
+	rewritten := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(rewritten, args[i:]...)
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(arg, "-"), "=")
+		if strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && len(name) > 1 && cmd.Flags().Lookup(name) != nil {
+			arg = "-" + arg
+		}
+		rewritten = append(rewritten, arg)
+	}
+	return rewritten
+}
+
+// commandExamples are the examples shown in the help of each command, by
+// name.
+var commandExamples = map[string]string{
+	"restart": `  # Preview, then restart the databases of one namespace
+  db-pods restart --namespace payments --dry-run
+  db-pods restart --namespace payments --wait
+
+  # Restart a canary first, then the rest five at a time
+  db-pods restart --all --selector app.kubernetes.io/component=database --wait --canary workload --batch-size 5
+
+  # Restart exactly the workloads of an approved plan
+  db-pods restart --plan plan.yaml --reason "memory leak, INC-1234"`,
+	"plan": `  # Write the plan of a restart for approval
+  db-pods plan --namespace payments --write-plan plan.yaml
+
+  # Emit a Job that runs the plan from inside the cluster
+  db-pods plan --plan plan.yaml --emit-job | kubectl apply -f -`,
+	"list": `  db-pods list --namespace payments
+  db-pods list --selector app.kubernetes.io/component=database --kinds statefulset --output json`,
+	"status": `  db-pods status --namespace payments`,
+	"daemon": `  # Flag workloads not restarted in two weeks, and retry deferred restarts
+  db-pods daemon --max-uptime 336h --listen :9090 --retry-deferred`,
+	"operator": `  db-pods operator --print-crd | kubectl apply -f -
+  db-pods operator`,
+	"scheduled": `  db-pods scheduled --window "0 2 * * 0" --timezone Europe/Berlin -- --namespace payments --wait`,
+	"vclusters": `  db-pods vclusters --namespace-selector vcluster=true
+  db-pods vclusters --namespace-selector vcluster=true --restart -- --all --wait`,
+	"freeze":   `  db-pods freeze statefulset/payments/postgres --for 24h --reason "month-end close"`,
+	"unfreeze": `  db-pods unfreeze statefulset/payments/postgres`,
+	"undo": `  # Roll back the last run in one namespace only
+  db-pods undo --last --namespace payments --dry-run
+  db-pods undo --last --namespace payments --wait`,
+	"handoff-status": `  # Exit with status 1 while handed-off restarts are still pending
+  db-pods handoff-status --fail-pending`,
+	"deferred": `  db-pods deferred list --lock-namespace db-ops`,
+	"report": `  db-pods report --by-workload --since 720h
+  db-pods report --by-workload --namespace payments --output json`,
+	"cleanup": `  db-pods cleanup --older-than 2h --dry-run`,
+	"rbac":    `  db-pods rbac --features all --service-account db-ops/db-pods | kubectl apply -f -`,
+	"contexts": `  db-pods contexts check
+  db-pods contexts check prod-eu prod-us --timeout 5s`,
+	"compatibility": `  db-pods compatibility --context prod-eu`,
+	"dashboards":    `  db-pods dashboards --output db-pods-dashboard.json`,
+	"verify-binary": `  db-pods verify-binary --checksums checksums.txt --require-fips`,
+}
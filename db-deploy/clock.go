@@ -0,0 +1,19 @@
+package main
+
+import "time"
+
+// planTime is the frozen timestamp set with --plan-time. Plans attached to
+// change tickets are generated ahead of time; freezing the clock makes the
+// annotation values and window decisions of the later run match the approved
+// plan exactly.
+var planTime time.Time
+
+// planNow returns the time used for values written to workloads and for
+// window calculations: the frozen plan time if one is set, otherwise the
+// current time. Durations and timeouts always use the real clock.
+func planNow() time.Time {
+	if !planTime.IsZero() {
+		return planTime
+	}
+	return time.Now()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Attributes of the CloudEvents posted with an http:// or https://
+// --events-broker.
+const (
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsSource      = "db-deploy/db-pods"
+
+	// cloudEventsTypePrefix is prepended to the event types, giving for
+	// instance db-deploy.workload.finished.
+	cloudEventsTypePrefix = "db-deploy."
+)
+
+// cloudEventsPublisher posts events to an HTTP sink as CloudEvents in binary
+// content mode: the attributes travel as ce- headers and the body is the
+// same JSON as on the other brokers, so Knative triggers and Argo Events
+// sensors can filter on the type and subject without parsing it.
+type cloudEventsPublisher struct {
+	url    string
+	runID  string
+	client *http.Client
+
+	// sequence numbers the events of the run, making their IDs unique.
+	sequence int
+}
+
+func newCloudEventsPublisher(url, runID string) *cloudEventsPublisher {
+	return &cloudEventsPublisher{url: url, runID: runID, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *cloudEventsPublisher) publish(ctx context.Context, event runEvent, data []byte) error {
+	p.sequence++
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("ce-specversion", cloudEventsSpecVersion)
+	req.Header.Set("ce-id", fmt.Sprintf("%s-%d", p.runID, p.sequence))
+	req.Header.Set("ce-source", cloudEventsSource)
+	req.Header.Set("ce-type", cloudEventsTypePrefix+event.Type)
+	req.Header.Set("ce-time", event.Time.Format(time.RFC3339Nano))
+	if event.Name != "" {
+		req.Header.Set("ce-subject", event.Kind+"/"+event.Namespace+"/"+event.Name)
+	}
+	// Extension attributes, for filtering by run and outcome
+	req.Header.Set("ce-runid", p.runID)
+	if event.Status != "" {
+		req.Header.Set("ce-status", event.Status)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("events sink returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *cloudEventsPublisher) close() error {
+	return nil
+}
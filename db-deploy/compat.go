@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// minSupportedMinor is the oldest Kubernetes 1.x release db-pods supports.
+const minSupportedMinor = 23
+
+// Optional cluster features the tool adapts to.
+const (
+	featureEphemeralContainers  = "ephemeral containers"
+	featureEndpointSlices       = "EndpointSlices"
+	featureDisruptionConditions = "pod disruption conditions"
+	featurePodOS                = "pod OS field"
+)
+
+// clusterFeature is an API or behaviour that some releases of Kubernetes in
+// the supported range lack.
+type clusterFeature struct {
+	name string
+
+	// since is the minor release that enables the feature by default.
+	since int
+
+	// resource is the API resource, as GROUP/VERSION RESOURCE, whose
+	// presence in discovery tells whether the feature is served, for
+	// features that clusters may turn off. Others are judged by version.
+	resource string
+
+	usedBy   string
+	fallback string
+}
+
+// clusterFeatures lists the optional features, in the order of the
+// compatibility report.
+var clusterFeatures = []clusterFeature{
+	{
+		name:     featureEphemeralContainers,
+		since:    23,
+		resource: "v1 pods/ephemeralcontainers",
+		usedBy:   "--debug-before-restart and exec checks",
+		fallback: "debug commands are not run and exec checks are skipped",
+	},
+	{
+		name:     featureEndpointSlices,
+		since:    21,
+		resource: "discovery.k8s.io/v1 endpointslices",
+		usedBy:   "endpoints checks",
+		fallback: "endpoints checks read the Endpoints of Services instead",
+	},
+	{
+		name:     featureDisruptionConditions,
+		since:    26,
+		usedBy:   "recognising pods evicted by the cluster autoscaler during rollouts",
+		fallback: "evicted pods are only recognised once they are deleted",
+	},
+	{
+		name:     featurePodOS,
+		since:    24,
+		usedBy:   "longer rollout timeouts for Windows workloads",
+		fallback: "only the " + osLabel + " node selector marks Windows workloads",
+	},
+}
+
+// clusterCapabilities records the server version of a cluster and which of
+// the optional features it has. A nil *clusterCapabilities has every
+// feature, for clusters whose version could not be detected.
+type clusterCapabilities struct {
+	version  string
+	minor    int
+	features map[string]bool
+}
+
+// has reports whether the cluster has a feature.
+func (c *clusterCapabilities) has(feature string) bool {
+	return c == nil || c.features[feature]
+}
+
+// supported reports whether the cluster runs a release db-pods supports.
+func (c *clusterCapabilities) supported() bool {
+	return c == nil || c.minor >= minSupportedMinor
+}
+
+// detectCapabilities asks the API server for its version and the optional
+// resources it serves.
+func detectCapabilities(clientset kubernetes.Interface) (*clusterCapabilities, error) {
+	info, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the server version: %w", err)
+	}
+	// Managed distributions report minors such as "27+"
+	minor, err := strconv.Atoi(strings.TrimRight(info.Minor, "+"))
+	if err != nil || info.Major != "1" {
+		return nil, fmt.Errorf("unrecognised server version %s", info.GitVersion)
+	}
+
+	caps := &clusterCapabilities{version: info.GitVersion, minor: minor, features: make(map[string]bool)}
+	served := make(map[string]map[string]bool)
+	for _, feature := range clusterFeatures {
+		if feature.resource == "" {
+			caps.features[feature.name] = minor >= feature.since
+			continue
+		}
+		groupVersion, resource, _ := strings.Cut(feature.resource, " ")
+		if served[groupVersion] == nil {
+			served[groupVersion] = make(map[string]bool)
+			resources, err := clientset.Discovery().ServerResourcesForGroupVersion(groupVersion)
+			if err != nil && !apierrors.IsNotFound(err) {
+				return nil, fmt.Errorf("failed to discover the resources of %s: %w", groupVersion, err)
+			}
+			if resources != nil {
+				for _, r := range resources.APIResources {
+					served[groupVersion][r.Name] = true
+				}
+			}
+		}
+		caps.features[feature.name] = served[groupVersion][resource]
+	}
+	return caps, nil
+}
+
+// detectCapabilitiesOrWarn detects the capabilities of the cluster at the
+// start of a command and warns about what the run will do without the
+// missing features. If detection fails, every feature is assumed.
+func detectCapabilitiesOrWarn(clientset kubernetes.Interface) *clusterCapabilities {
+	caps, err := detectCapabilities(clientset)
+	if err != nil {
+		slog.Warn("Could not detect the cluster version, assuming every feature is available", "error", err)
+		return nil
+	}
+	slog.Debug("Detected the cluster version", "version", caps.version)
+	if !caps.supported() {
+		slog.Warn("The cluster runs an unsupported release of Kubernetes", "version", caps.version, "minimum", fmt.Sprintf("v1.%d", minSupportedMinor))
+	}
+	for _, feature := range clusterFeatures {
+		if !caps.has(feature.name) {
+			slog.Info("Cluster lacks an optional feature", "feature", feature.name, "version", caps.version, "fallback", feature.fallback)
+		}
+	}
+	return caps
+}
+
+// compatibilityCommand runs "db-pods compatibility", which prints the server
+// version of the cluster and which of the optional features db-pods uses it
+// has.
+func compatibilityCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	return func(args []string) {
+		setupLogging()
+
+		clientset, _ := newClients()
+		caps, err := detectCapabilities(clientset)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		printCompatibility(os.Stdout, caps)
+		if !caps.supported() {
+			os.Exit(1)
+		}
+	}
+}
+
+// printCompatibility prints the compatibility report of a cluster.
+func printCompatibility(w io.Writer, caps *clusterCapabilities) {
+	support := "supported"
+	if !caps.supported() {
+		support = fmt.Sprintf("not supported, db-pods needs v1.%d or later", minSupportedMinor)
+	}
+	fmt.Fprintf(w, "Kubernetes %s: %s\n\n", caps.version, support)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FEATURE\tSINCE\tSTATUS\tUSED FOR")
+	for _, feature := range clusterFeatures {
+		status := "available"
+		if !caps.has(feature.name) {
+			status = "unavailable: " + feature.fallback
+		}
+		fmt.Fprintf(tw, "%s\tv1.%d\t%s\t%s\n", feature.name, feature.since, status, feature.usedBy)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// completionTimeout bounds the cluster queries of a completion, so that an
+// unreachable cluster does not hang the shell.
+const completionTimeout = 5 * time.Second
+
+// flagValues are the values of the flags that take one of a fixed set.
+var flagValues = map[string][]string{
+	"log-format":         {logFormatText, logFormatJSON},
+	"log-level":          {"debug", "info", "warn", "error"},
+	"order":              {orderAge, orderMemory, orderDiscovery},
+	"canary":             {canaryWorkload, canaryNamespace},
+	"suspended-cronjobs": {suspendedCronJobsSkip, suspendedCronJobsTrigger},
+	"on-conflict":        {onConflictExit, onConflictQueue, onConflictObserve},
+	"profile":            {profileDev},
+}
+
+// completeFlagValues registers the completion of the values of the flags of
+// a command made by flagSetCommand.
+func completeFlagValues(cmd *cobra.Command) {
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		cmd.RegisterFlagCompletionFunc(f.Name, func(cmd *cobra.Command, _ []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			clusterFlagsFromEnv(cmd.Flags())
+			return completeFlagValue(f, "", toComplete)
+		})
+	})
+}
+
+// completeArgs returns the completion of the arguments of a command made by
+// flagSetCommand: the literal words of its use line, the kubeconfig contexts
+// contexts check takes, the workloads freeze and unfreeze take, and the
+// restart flags after the "--" of scheduled and vclusters.
+func completeArgs(use string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	var words []string
+	for _, word := range strings.Fields(use)[1:] {
+		if word != strings.ToLower(word) || strings.HasPrefix(word, "[") || strings.HasPrefix(word, "-") {
+			break
+		}
+		words = append(words, word)
+	}
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if dash := cmd.ArgsLenAtDash(); dash >= 0 && strings.Contains(use, "[restart flags]") {
+			return completeRestartFlags(args[dash:], toComplete)
+		}
+		if len(args) < len(words) {
+			return matching(words[len(args):len(args)+1], toComplete), cobra.ShellCompDirectiveNoFileComp
+		}
+		clusterFlagsFromEnv(cmd.Flags())
+		switch cmd.Name() {
+		case "contexts":
+			return matching(kubeconfigContexts(), toComplete), cobra.ShellCompDirectiveNoFileComp
+		case "freeze", "unfreeze":
+			return completeWorkloadRef(toComplete)
+		}
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// completeRestartFlags completes the flags of restart, and their values,
+// which scheduled and vclusters pass on after "--" and cobra leaves to them.
+func completeRestartFlags(args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	restart, _, err := cli.Find([]string{"restart"})
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	fs := restart.Flags()
+	// The cluster queried is the one the restarts will run against
+	_ = fs.Parse(args)
+	clusterFlagsFromEnv(fs)
+
+	if n := len(args); n > 0 && !strings.HasPrefix(toComplete, "-") && !strings.Contains(args[n-1], "=") {
+		if f := lookupFlag(fs, args[n-1]); f != nil && !isBoolFlag(f) {
+			return completeFlagValue(f, "", toComplete)
+		}
+	}
+	if name, value, ok := strings.Cut(toComplete, "="); ok && strings.HasPrefix(name, "-") {
+		if f := lookupFlag(fs, name); f != nil {
+			return completeFlagValue(f, name+"=", value)
+		}
+	}
+	if strings.HasPrefix(toComplete, "-") {
+		var names []string
+		fs.VisitAll(func(f *pflag.Flag) {
+			names = append(names, "--"+f.Name+"\t"+f.Usage)
+			if f.Shorthand != "" {
+				names = append(names, "-"+f.Shorthand+"\t"+f.Usage)
+			}
+		})
+		return matching(names, toComplete), cobra.ShellCompDirectiveNoFileComp
+	}
+	return nil, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeFlagValue completes the value of a flag, typed after prefix.
+// Values that are none of the known ones are file names.
+func completeFlagValue(f *pflag.Flag, prefix, toComplete string) ([]string, cobra.ShellCompDirective) {
+	var values []string
+	list := false
+	switch {
+	case f.Name == "context":
+		values = kubeconfigContexts()
+	case f.Name == "namespace" || strings.HasSuffix(f.Name, "-namespace") || f.Name == "fallback-namespaces":
+		values = clusterNamespaces()
+		list = f.Name == "fallback-namespaces"
+	case f.Name == "kinds":
+		values, list = workloadKinds, true
+	case f.Name == "features":
+		for name := range rbacFeatures {
+			values = append(values, name)
+		}
+		sort.Strings(values)
+		values, list = append(values, "all"), true
+	case f.Name == "output" && f.DefValue == "text":
+		values = []string{"text", "json"}
+	case flagValues[f.Name] != nil:
+		values = flagValues[f.Name]
+	default:
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+
+	// Comma-separated lists complete their last item
+	if list {
+		if i := strings.LastIndex(toComplete, ","); i >= 0 {
+			prefix += toComplete[:i+1]
+			toComplete = toComplete[i+1:]
+		}
+	}
+	var completions []string
+	for _, value := range matching(values, toComplete) {
+		completions = append(completions, prefix+value)
+	}
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeWorkloadRef completes a KIND/NAMESPACE/NAME reference one segment
+// at a time.
+func completeWorkloadRef(toComplete string) ([]string, cobra.ShellCompDirective) {
+	segments := strings.Split(toComplete, "/")
+	var values []string
+	switch len(segments) {
+	case 1:
+		for _, kind := range workloadKinds {
+			values = append(values, kind+"/")
+		}
+		return matching(values, toComplete), cobra.ShellCompDirectiveNoSpace | cobra.ShellCompDirectiveNoFileComp
+	case 2:
+		for _, namespace := range clusterNamespaces() {
+			values = append(values, segments[0]+"/"+namespace+"/")
+		}
+		return matching(values, toComplete), cobra.ShellCompDirectiveNoSpace | cobra.ShellCompDirectiveNoFileComp
+	case 3:
+		for _, name := range clusterWorkloads(segments[0], segments[1]) {
+			values = append(values, segments[0]+"/"+segments[1]+"/"+name)
+		}
+	}
+	return matching(values, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// clusterFlagsFromEnv sets --kubeconfig and --context from their DB_DEPLOY_
+// variables unless they were given, as running the command would, so that
+// the cluster queried is the one the command will run against.
+func clusterFlagsFromEnv(fs *pflag.FlagSet) {
+	for _, name := range []string{"kubeconfig", "context"} {
+		if f := fs.Lookup(name); f != nil && !f.Changed {
+			if value, ok := os.LookupEnv(flagEnvName(name)); ok {
+				f.Value.Set(value)
+			}
+		}
+	}
+}
+
+// kubeconfigContexts returns the names of the contexts of the kubeconfig.
+func kubeconfigContexts() []string {
+	config, err := kubeconfigLoader().RawConfig()
+	if err != nil {
+		cobra.CompErrorln(err.Error())
+		return nil
+	}
+	var names []string
+	for name := range config.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// completionClient returns a client of the configured cluster for
+// completion, or nil if there is none.
+func completionClient() kubernetes.Interface {
+	config, err := loadConfig()
+	if err != nil {
+		cobra.CompErrorln(err.Error())
+		return nil
+	}
+	config.Timeout = completionTimeout
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		cobra.CompErrorln(err.Error())
+		return nil
+	}
+	return clientset
+}
+
+// clusterNamespaces returns the names of the namespaces of the cluster.
+func clusterNamespaces() []string {
+	clientset := completionClient()
+	if clientset == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+	list, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		cobra.CompErrorln(err.Error())
+		return nil
+	}
+	var names []string
+	for _, ns := range list.Items {
+		names = append(names, ns.Name)
+	}
+	return names
+}
+
+// clusterWorkloads returns the names of the workloads of a kind in a
+// namespace. Argo Rollouts are not listed.
+func clusterWorkloads(kind, namespace string) []string {
+	clientset := completionClient()
+	if clientset == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+	apps := clientset.AppsV1()
+	var names []string
+	var err error
+	switch kind {
+	case "deployment":
+		var list *appsv1.DeploymentList
+		if list, err = apps.Deployments(namespace).List(ctx, metav1.ListOptions{}); err == nil {
+			for _, w := range list.Items {
+				names = append(names, w.Name)
+			}
+		}
+	case "statefulset":
+		var list *appsv1.StatefulSetList
+		if list, err = apps.StatefulSets(namespace).List(ctx, metav1.ListOptions{}); err == nil {
+			for _, w := range list.Items {
+				names = append(names, w.Name)
+			}
+		}
+	case "daemonset":
+		var list *appsv1.DaemonSetList
+		if list, err = apps.DaemonSets(namespace).List(ctx, metav1.ListOptions{}); err == nil {
+			for _, w := range list.Items {
+				names = append(names, w.Name)
+			}
+		}
+	}
+	if err != nil {
+		cobra.CompErrorln(err.Error())
+	}
+	return names
+}
+
+// lookupFlag returns the flag an argument such as --output, --output=json or
+// -n names, or nil.
+func lookupFlag(fs *pflag.FlagSet, arg string) *pflag.Flag {
+	if !strings.HasPrefix(arg, "-") || arg == "--" {
+		return nil
+	}
+	name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+	if !strings.HasPrefix(arg, "--") && len(name) == 1 {
+		return fs.ShorthandLookup(name)
+	}
+	return fs.Lookup(name)
+}
+
+// isBoolFlag reports whether a flag takes no value, like pflag decides it.
+func isBoolFlag(f *pflag.Flag) bool {
+	return f.NoOptDefVal != ""
+}
+
+// matching returns the completions starting with toComplete.
+func matching(completions []string, toComplete string) []string {
+	var matches []string
+	for _, c := range completions {
+		if strings.HasPrefix(c, toComplete) {
+			matches = append(matches, c)
+		}
+	}
+	return matches
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// maxConcurrentAnnotation lets a namespace declare how many of its workloads
+// may be rolling out at the same time. It takes precedence over
+// --max-concurrent-restarts.
+const maxConcurrentAnnotation = "db-deploy/max-concurrent-restarts"
+
+// namespaceConcurrency reads the concurrency limit declared by each namespace
+// that has targets. Namespaces without a valid declaration are left out.
+func namespaceConcurrency(ctx context.Context, clientset *kubernetes.Clientset, targets []target) map[string]int {
+	limits := make(map[string]int)
+	for _, namespace := range targetNamespaces(targets) {
+		ns, err := clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+		if apierrors.IsForbidden(err) {
+			slog.Warn("Cannot read namespace, using the global concurrency limit", "namespace", namespace, "error", err)
+			continue
+		}
+		if err != nil {
+			slog.Error("Error reading namespace", "namespace", namespace, "error", err)
+			continue
+		}
+
+		value, ok := ns.Annotations[maxConcurrentAnnotation]
+		if !ok {
+			continue
+		}
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			slog.Warn("Ignoring invalid annotation", "annotation", maxConcurrentAnnotation, "value", value, "namespace", namespace)
+			continue
+		}
+		limits[namespace] = limit
+	}
+	return limits
+}
+
+// concurrencyLimit returns how many targets of the namespace may roll out at
+// once, or 0 if there is no limit.
+func (r *runner) concurrencyLimit(namespace string) int {
+	if limit, ok := r.namespaceLimits[namespace]; ok {
+		return limit
+	}
+	return r.opts.maxConcurrent
+}
+
+// runConcurrently runs units of work on up to n workers and returns their
+// results in the order of the units, however they finish.
+func runConcurrently(units []func() []result, n int) []result {
+	out := make([][]result, len(units))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < n && w < len(units); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				out[i] = units[i]()
+			}
+		}()
+	}
+	for i := range units {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var results []result
+	for _, rs := range out {
+		results = append(results, rs...)
+	}
+	return results
+}
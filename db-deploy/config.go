@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+// configSections are the top-level keys of a configuration file that hold
+// the settings of a single command, named after it, so that one file can
+// serve all of them.
+var configSections = map[string]bool{
+	"restart":   true,
+	"daemon":    true,
+	"plan":      true,
+	"scheduled": true,
+}
+
+// configStructuredKeys are the keys of a configuration file holding
+// structured settings rather than flag values, which applyConfigFile leaves
+// to their own loaders.
+var configStructuredKeys = map[string]bool{
+	configNotificationsKey: true,
+	configVerificationKey:  true,
+}
+
+// addConfigFlag defines --config on fs. Settings from the configuration file
+// fill in the flags that were given neither on the command line nor in
+// DB_DEPLOY_ environment variables, once flagSetCommand has parsed them.
+func addConfigFlag(fs *pflag.FlagSet) *string {
+	return fs.String("config", "", "YAML file of flag values, such as \"name-pattern: ^pg-\" or \"kinds: [statefulset]\", optionally grouped under restart:, daemon:, plan: or scheduled:, of the notification routes under "+configNotificationsKey+": and of the verification pipelines under "+configVerificationKey+":; flags given on the command line or in DB_DEPLOY_ variables take precedence")
+}
+
+// applyConfigFile sets the flags of fs, those of command, that were not given
+// on the command line or in the environment from a YAML file. Top-level keys
+// are flag names, or the name of a command whose flags are nested under it;
+// sections of other commands and the structured settings are ignored. As one
+// file serves every command, top-level keys that are not flags of command are
+// skipped, while those of its own section must be. Lists set repeatable flags
+// once per item and are joined with commas for the others.
+func applyConfigFile(fs *pflag.FlagSet, command, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	settings := make(map[string]interface{})
+	for key, value := range config {
+		if !configSections[key] && !configStructuredKeys[key] {
+			settings[key] = value
+		}
+	}
+	inSection := make(map[string]bool)
+	if section, ok := config[command].(map[string]interface{}); ok {
+		for key, value := range section {
+			settings[key] = value
+			inSection[key] = true
+		}
+	}
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		f := fs.Lookup(key)
+		if f == nil || key == "config" {
+			if !inSection[key] {
+				continue
+			}
+			return fmt.Errorf("%s: unknown setting %q for db-pods %s", path, key, command)
+		}
+		if f.Changed || settings[key] == nil {
+			continue
+		}
+		if err := setFlag(fs, f, settings[key]); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+	}
+	return nil
+}
+
+// readConfigSection returns the raw value of a top-level key of a
+// configuration file, or nil if the file has none.
+func readConfigSection(path, key string) (json.RawMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]json.RawMessage
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config[key], nil
+}
+
+// setFlag sets a flag from a decoded YAML value. Flags set this way count as
+// given, so that profile defaults do not override them.
+func setFlag(fs *pflag.FlagSet, f *pflag.Flag, value interface{}) error {
+	items, isList := value.([]interface{})
+	if !isList {
+		s, err := configString(value)
+		if err != nil {
+			return err
+		}
+		return fs.Set(f.Name, s)
+	}
+
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		s, err := configString(item)
+		if err != nil {
+			return err
+		}
+		values = append(values, s)
+	}
+	if _, repeatable := f.Value.(*stringList); repeatable {
+		for _, s := range values {
+			if err := fs.Set(f.Name, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fs.Set(f.Name, strings.Join(values, ","))
+}
+
+// configString formats a scalar YAML value as it would be written on the
+// command line.
+func configString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("expected a string, number, boolean or list, got %T", value)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// requiredPermission is an RBAC permission a run needs cluster-wide.
+type requiredPermission struct {
+	label    string
+	verb     string
+	group    string
+	resource string
+}
+
+// requiredPermissions are checked by "db-pods contexts check".
+var requiredPermissions = []requiredPermission{
+	{"list workloads", "list", "apps", "deployments"},
+	{"restart workloads", "update", "apps", "deployments"},
+	{"list pods", "list", "", "pods"},
+	{"leases", "update", "coordination.k8s.io", "leases"},
+}
+
+// contextCheck is the health of one kubeconfig context.
+type contextCheck struct {
+	name        string
+	reachable   error
+	permissions []bool
+	rbacErr     error
+}
+
+// contextsCommand dispatches the contexts subcommands.
+func contextsCommand(fs *pflag.FlagSet) func(args []string) {
+	timeout := fs.Duration("timeout", 10*time.Second, "maximum time to spend checking a single context")
+	fs.StringVar(&clusterFlags.kubeconfig, "kubeconfig", "", "path of the kubeconfig whose contexts are checked (default: the files listed in $KUBECONFIG, or ~/.kube/config)")
+	return func(args []string) {
+		if len(args) == 0 || args[0] != "check" {
+			log.Fatalf("Usage: db-pods contexts check [--timeout DURATION] [--kubeconfig PATH] [CONTEXT...]")
+		}
+		names := args[1:]
+
+		config, err := kubeconfigLoadingRules().Load()
+		if err != nil {
+			log.Fatalf("Error loading kubeconfig: %v", err)
+		}
+		if len(names) == 0 {
+			for name := range config.Contexts {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+
+		// Every context is checked at once, so one unreachable cluster does not
+		// hold up the others
+		checks := make([]contextCheck, len(names))
+		var wg sync.WaitGroup
+		for i, name := range names {
+			wg.Add(1)
+			go func(i int, name string) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+				defer cancel()
+				checks[i] = checkContext(ctx, name)
+			}(i, name)
+		}
+		wg.Wait()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		header := []string{"CONTEXT", "REACHABLE"}
+		for _, p := range requiredPermissions {
+			header = append(header, strings.ToUpper(p.label))
+		}
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+
+		healthy := true
+		var problems []string
+		for _, c := range checks {
+			row := []string{c.name, "yes"}
+			if c.reachable != nil {
+				row[1] = "no"
+				healthy = false
+				problems = append(problems, fmt.Sprintf("%s: %v", c.name, c.reachable))
+			} else if c.rbacErr != nil {
+				healthy = false
+				problems = append(problems, fmt.Sprintf("%s: %v", c.name, c.rbacErr))
+			}
+			for i := range requiredPermissions {
+				switch {
+				case c.reachable != nil || c.rbacErr != nil:
+					row = append(row, "?")
+				case c.permissions[i]:
+					row = append(row, "yes")
+				default:
+					row = append(row, "no")
+					healthy = false
+				}
+			}
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		w.Flush()
+
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stdout, "\n%s", problem)
+		}
+		if len(problems) > 0 {
+			fmt.Fprintln(os.Stdout)
+		}
+		if !healthy {
+			os.Exit(1)
+		}
+	}
+}
+
+// checkContext verifies that a context's cluster is reachable with its
+// credentials and that they carry the permissions a run needs.
+func checkContext(ctx context.Context, name string) contextCheck {
+	c := contextCheck{name: name}
+
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		kubeconfigLoadingRules(),
+		&clientcmd.ConfigOverrides{CurrentContext: name},
+	).ClientConfig()
+	if err != nil {
+		c.reachable = err
+		return c
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		c.reachable = err
+		return c
+	}
+
+	// The reviews double as the connectivity and authentication check: unlike
+	// the version endpoint, they always require valid credentials
+	for _, p := range requiredPermissions {
+		review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{Verb: p.verb, Group: p.group, Resource: p.resource},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			if ctx.Err() != nil || len(c.permissions) == 0 {
+				c.reachable = err
+			} else {
+				c.rbacErr = err
+			}
+			return c
+		}
+		c.permissions = append(c.permissions, review.Status.Allowed)
+	}
+	return c
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Ways of handling suspended database CronJobs, selected with
+// --suspended-cronjobs.
+const (
+	// suspendedCronJobsSkip leaves suspended CronJobs alone.
+	suspendedCronJobsSkip = "skip"
+
+	// suspendedCronJobsTrigger runs a suspended CronJob once after the
+	// restarts, without lifting its suspension.
+	suspendedCronJobsTrigger = "trigger"
+)
+
+// Actions taken on a CronJob, as reported in cronJob.Action.
+const (
+	cronJobScheduled = "scheduled" // not suspended, runs on its own schedule
+	cronJobSkipped   = "skipped"
+	cronJobTriggered = "triggered"
+	cronJobFailed    = "failed"
+)
+
+// cronJob is a database-related CronJob in scope of a run. Backup and
+// maintenance jobs must be coordinated with restarts, so they are listed in
+// the plan and report even though they are not restarted themselves.
+type cronJob struct {
+	Namespace    string
+	Name         string
+	Schedule     string
+	Suspended    bool
+	Active       int
+	LastSchedule time.Time
+
+	// Action is what the run did with the CronJob, Job the name of the Job
+	// it triggered and Err why triggering it failed.
+	Action string
+	Job    string
+	Err    error
+}
+
+func (c cronJob) String() string {
+	return fmt.Sprintf("cronjob %s/%s", c.Namespace, c.Name)
+}
+
+// findCronJobs returns the CronJobs whose name marks them as databases, or
+// that match the label selector of the discovery options if one is set. It
+// searches the namespaces given with --namespace, or else the whole cluster,
+// or only the given namespaces if CronJobs cannot be listed cluster-wide.
+func findCronJobs(ctx context.Context, clientset *kubernetes.Clientset, opts discoveryOptions, fallbackNamespaces []string) ([]cronJob, error) {
+	var items []batchv1.CronJob
+	var err error
+	if len(opts.namespaces) == 0 {
+		items, err = listCronJobs(ctx, clientset, metav1.NamespaceAll, opts.selector)
+	} else {
+		fallbackNamespaces = opts.namespaces
+	}
+	if len(opts.namespaces) > 0 || apierrors.IsForbidden(err) {
+		items = nil
+		for _, namespace := range fallbackNamespaces {
+			found, err := listCronJobs(ctx, clientset, namespace, opts.selector)
+			if apierrors.IsForbidden(err) {
+				slog.Warn("Skipping CronJobs in namespace", "namespace", namespace, "error", err)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, found...)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var cronJobs []cronJob
+	for _, item := range items {
+		if opts.selector == "" && !opts.names.matches(item.Name) || !opts.inScope(item.Namespace) {
+			continue
+		}
+		c := cronJob{
+			Namespace: item.Namespace,
+			Name:      item.Name,
+			Schedule:  item.Spec.Schedule,
+			Suspended: item.Spec.Suspend != nil && *item.Spec.Suspend,
+			Active:    len(item.Status.Active),
+		}
+		if item.Status.LastScheduleTime != nil {
+			c.LastSchedule = item.Status.LastScheduleTime.Time
+		}
+		cronJobs = append(cronJobs, c)
+	}
+	return cronJobs, nil
+}
+
+func listCronJobs(ctx context.Context, clientset *kubernetes.Clientset, namespace, selector string) ([]batchv1.CronJob, error) {
+	list, err := clientset.BatchV1().CronJobs(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cronjobs: %w", err)
+	}
+	return list.Items, nil
+}
+
+// handleCronJobs applies the chosen handling to suspended CronJobs once the
+// restarts are done and records the action taken on each CronJob.
+func handleCronJobs(ctx context.Context, clientset *kubernetes.Clientset, cronJobs []cronJob, mode, runID string) {
+	for i := range cronJobs {
+		c := &cronJobs[i]
+		switch {
+		case !c.Suspended:
+			c.Action = cronJobScheduled
+		case mode != suspendedCronJobsTrigger:
+			c.Action = cronJobSkipped
+		default:
+			job, err := triggerCronJob(ctx, clientset, c.Namespace, c.Name, runID)
+			if err != nil {
+				slog.Error("Error triggering CronJob", "cronjob", c, "error", err)
+				c.Action, c.Err = cronJobFailed, err
+				continue
+			}
+			fmt.Fprintf(progress, "Triggered suspended %s as job %s\n", c, job)
+			c.Action, c.Job = cronJobTriggered, job
+		}
+	}
+}
+
+// triggerCronJob runs a CronJob once by creating a Job from its template, the
+// way "kubectl create job --from=cronjob/NAME" does. The CronJob itself stays
+// suspended, so its schedule cannot fire while it is briefly active.
+func triggerCronJob(ctx context.Context, clientset *kubernetes.Clientset, namespace, name, runID string) (string, error) {
+	cj, err := clientset.BatchV1().CronJobs(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get cronjob: %w", err)
+	}
+
+	annotations := map[string]string{
+		"cronjob.kubernetes.io/instantiate": "manual",
+		runIDAnnotation:                     runID,
+	}
+	for k, v := range cj.Spec.JobTemplate.Annotations {
+		annotations[k] = v
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: truncateName(cj.Name, 52) + "-",
+			Namespace:    namespace,
+			Labels:       cj.Spec.JobTemplate.Labels,
+			Annotations:  annotations,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(cj, batchv1.SchemeGroupVersion.WithKind("CronJob")),
+			},
+		},
+		Spec: cj.Spec.JobTemplate.Spec,
+	}
+	created, err := clientset.BatchV1().Jobs(namespace).Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create job: %w", err)
+	}
+	return created.Name, nil
+}
+
+// truncateName shortens a name so that generated suffixes keep it within the
+// limits of the API server.
+func truncateName(name string, max int) string {
+	if len(name) > max {
+		return name[:max]
+	}
+	return name
+}
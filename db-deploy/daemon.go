@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// hygieneStatus is the restart hygiene of one database workload.
+type hygieneStatus struct {
+	Target         target        `json:"-"`
+	Workload       string        `json:"workload"`
+	OldestPodAge   time.Duration `json:"-"`
+	NeverRestarted bool          `json:"neverRestarted"`
+	Overdue        bool          `json:"overdue"`
+	Restarts       restartStats  `json:"-"`
+}
+
+// violation reports whether the workload needs attention.
+func (s hygieneStatus) violation() bool {
+	return s.NeverRestarted || s.Overdue
+}
+
+// hygieneSnapshot is the outcome of one hygiene check.
+type hygieneSnapshot struct {
+	checkedAt time.Time
+	statuses  []hygieneStatus
+}
+
+// snapshotStore holds the latest hygiene snapshot for the HTTP handlers.
+type snapshotStore struct {
+	mu       sync.Mutex
+	snapshot *hygieneSnapshot
+}
+
+func (s *snapshotStore) get() *hygieneSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot
+}
+
+func (s *snapshotStore) set(snapshot *hygieneSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshot = snapshot
+}
+
+// runMetricsStore accumulates the metrics of the deferred restarts retried
+// by the daemon.
+type runMetricsStore struct {
+	mu         sync.Mutex
+	samples    map[string]float64
+	finishedAt time.Time
+	workloads  map[string]int
+}
+
+// observe adds the results of a retry.
+func (s *runMetricsStore) observe(results []result, finishedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workloads = observeRestarts(s.samples, results, true)
+	s.finishedAt = finishedAt
+}
+
+// format renders the metrics, or "" before the first retry.
+func (s *runMetricsStore) format() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finishedAt.IsZero() {
+		return ""
+	}
+	return formatRunMetrics(s.samples, s.finishedAt, s.workloads)
+}
+
+// daemonCommand runs "db-pods daemon", which periodically checks that every
+// database workload has been restarted recently and exposes the result as
+// Prometheus metrics and a read-only web dashboard. It only restarts
+// workloads with --retry-deferred, and then only those that runs deferred;
+// the restart metrics of those retries are served alongside.
+func daemonCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	interval := fs.Duration("interval", 5*time.Minute, "time between hygiene checks")
+	maxUptime := fs.Duration("max-uptime", 30*24*time.Hour, "flag workloads whose oldest pod is older than this")
+	restartsWindow := fs.Duration("restarts-window", 90*24*time.Hour, "window of the restart counts by reason exported as "+metricWorkloadRestarts)
+	listen := fs.String("listen", ":9090", "address to serve /metrics and the dashboard on")
+	lockNamespace := fs.String("lock-namespace", "default", "namespace of the "+runLeaseName+" Lease and the progress ConfigMap of runs shown on the dashboard")
+	progressConfigMap := fs.String("progress-configmap", progressConfigMapName, "ConfigMap in --lock-namespace carrying the progress of the active run")
+	webhookURL := fs.String("webhook-url", "", "URL to POST a JSON notification to when workloads start violating the hygiene check")
+	retry := fs.Bool("retry-deferred", false, "after each check, retry the restarts queued in --deferred-configmap, waiting for their rollouts; runs holding the lease take precedence")
+	leaderElect := fs.Bool("leader-elect", false, "with --retry-deferred, elect a leader through the "+daemonLeaderLease+" Lease in --lock-namespace, so that only one of several replicas retries restarts; all of them check and serve metrics")
+	deferredConfigMap := fs.String("deferred-configmap", deferredConfigMapName, "ConfigMap in --lock-namespace holding the deferred queue")
+	retryOpts := options{wait: true, windowsTimeoutFactor: 3, volumeOpTimeout: time.Minute, debug: debugConfig{image: defaultDebugImage}}
+	fs.DurationVar(&retryOpts.rolloutTimeout, "rollout-timeout", 10*time.Minute, "maximum time to wait for the rollout of a retried workload")
+	fs.DurationVar(&retryOpts.maxBackupAge, "max-backup-age", 0, "refuse to retry databases whose last backup is older than this, as in a normal run (0 disables the check)")
+	fs.StringVar(&retryOpts.slo.prometheusURL, "prometheus-url", "", "Prometheus server queried by --slo-budget-query")
+	fs.StringVar(&retryOpts.slo.query, "slo-budget-query", "", "PromQL query for the remaining error budget ratio of the services consuming each database, as in a normal run")
+	fs.Float64Var(&retryOpts.slo.minBudget, "slo-min-budget", 0.1, "remaining error budget ratio below which retried workloads are deferred again")
+	addRetentionFlags(fs, &retryOpts.retention)
+	discovery := addDiscoveryFlags(fs)
+	configFile := addConfigFlag(fs)
+	return func(args []string) {
+		setupLogging()
+
+		if *interval <= 0 {
+			log.Fatalf("--interval must be positive")
+		}
+		if retryOpts.slo.query != "" && retryOpts.slo.prometheusURL == "" {
+			log.Fatalf("--slo-budget-query requires --prometheus-url")
+		}
+		if err := retryOpts.retention.validate(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		retryOpts.slo.action = sloBudgetBlock
+		discoveryOpts, err := discovery.options()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if *configFile != "" {
+			if retryOpts.verification, err = loadVerificationConfig(*configFile); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+
+		clientset, dynamicClient := newClients()
+		if *retry {
+			retryOpts.cluster = detectCapabilitiesOrWarn(clientset)
+		}
+
+		store := &snapshotStore{}
+		runs := &runMetricsStore{samples: make(map[string]float64)}
+		http.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+			snapshot := store.get()
+			if snapshot == nil {
+				http.Error(w, "no hygiene check has completed yet", http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			fmt.Fprint(w, formatHygieneMetrics(snapshot))
+			fmt.Fprint(w, runs.format())
+		})
+		serveDashboard(http.DefaultServeMux, store, clientset, *lockNamespace, *progressConfigMap)
+		go func() {
+			log.Fatal(http.ListenAndServe(*listen, nil))
+		}()
+		slog.Info("Serving hygiene metrics on /metrics and the dashboard on /", "listen", *listen)
+
+		ctx := context.Background()
+		var leading <-chan struct{}
+		if *retry && *leaderElect {
+			leading = electLeader(ctx, clientset, *lockNamespace, daemonLeaderLease)
+		}
+		flagged := make(map[string]bool)
+		for {
+			snapshot, err := checkHygiene(ctx, clientset, dynamicClient, discoveryOpts, *maxUptime, *restartsWindow)
+			if err != nil {
+				slog.Error("Hygiene check failed", "error", err)
+			} else {
+				store.set(snapshot)
+
+				var newlyFlagged []hygieneStatus
+				current := make(map[string]bool)
+				for _, s := range snapshot.statuses {
+					if !s.violation() {
+						continue
+					}
+					current[s.Workload] = true
+					if !flagged[s.Workload] {
+						newlyFlagged = append(newlyFlagged, s)
+					}
+					switch {
+					case s.NeverRestarted && s.Overdue:
+						workloadLogger(s.Target).Warn("Workload was never restarted and its oldest pod is overdue", "oldestPodAge", s.OldestPodAge.Round(time.Minute).String())
+					case s.NeverRestarted:
+						workloadLogger(s.Target).Warn("Workload was never restarted")
+					default:
+						workloadLogger(s.Target).Warn("Workload has a pod older than --max-uptime", "oldestPodAge", s.OldestPodAge.Round(time.Minute).String(), "maxUptime", maxUptime.String())
+					}
+				}
+				flagged = current
+
+				if *webhookURL != "" && len(newlyFlagged) > 0 {
+					if err := notifyHygiene(ctx, *webhookURL, newlyFlagged); err != nil {
+						slog.Error("Hygiene notification failed", "error", err)
+					}
+				}
+			}
+			if *retry && *deferredConfigMap != "" && isLeader(leading) {
+				results, err := retryDeferred(ctx, clientset, dynamicClient, retryOpts, *lockNamespace, *deferredConfigMap)
+				if err != nil {
+					slog.Error("Retrying deferred workloads failed", "error", err)
+				}
+				if len(results) > 0 {
+					runs.observe(results, time.Now())
+				}
+			}
+			time.Sleep(*interval)
+		}
+	}
+}
+
+// checkHygiene discovers the database workloads, measures how long their
+// oldest pod has been running and counts their restarts within the window.
+func checkHygiene(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, opts discoveryOptions, maxUptime, restartsWindow time.Duration) (*hygieneSnapshot, error) {
+	targets, err := discoverTargets(ctx, clientset, dynamicClient, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	snapshot := &hygieneSnapshot{checkedAt: now}
+	for _, t := range targets {
+		age, err := oldestPodAge(ctx, clientset, t, now)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t, err)
+		}
+		snapshot.statuses = append(snapshot.statuses, hygieneStatus{
+			Target:         t,
+			Workload:       t.String(),
+			OldestPodAge:   age,
+			NeverRestarted: t.LastRestart.IsZero(),
+			Overdue:        maxUptime > 0 && age > maxUptime,
+			Restarts:       countRestarts(t, now.Add(-restartsWindow), 0),
+		})
+	}
+	return snapshot, nil
+}
+
+// oldestPodAge returns the age of the longest running pod of a workload, or
+// zero if it has none.
+func oldestPodAge(ctx context.Context, clientset *kubernetes.Clientset, t target, now time.Time) (time.Duration, error) {
+	if t.Selector == nil {
+		return 0, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return 0, fmt.Errorf("invalid selector: %w", err)
+	}
+	pods, err := clientset.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	var oldest time.Duration
+	for _, pod := range pods.Items {
+		if pod.Status.StartTime == nil || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if age := now.Sub(pod.Status.StartTime.Time); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest, nil
+}
+
+// formatHygieneMetrics renders a snapshot in the Prometheus text format.
+func formatHygieneMetrics(snapshot *hygieneSnapshot) string {
+	statuses := append([]hygieneStatus(nil), snapshot.statuses...)
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Workload < statuses[j].Workload })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s Age of the oldest pod of each database workload.\n", metricPodUptime)
+	fmt.Fprintf(&b, "# TYPE %s gauge\n", metricPodUptime)
+	for _, s := range statuses {
+		fmt.Fprintf(&b, "%s{namespace=%q,kind=%q,name=%q} %s\n", metricPodUptime, s.Target.Namespace, s.Target.Kind, s.Target.Name, strconv.FormatFloat(s.OldestPodAge.Seconds(), 'f', 0, 64))
+	}
+
+	fmt.Fprintf(&b, "# HELP %s Whether a database workload has no restartedAt annotation.\n", metricNeverRestarted)
+	fmt.Fprintf(&b, "# TYPE %s gauge\n", metricNeverRestarted)
+	violations := 0
+	for _, s := range statuses {
+		never := 0
+		if s.NeverRestarted {
+			never = 1
+		}
+		if s.violation() {
+			violations++
+		}
+		fmt.Fprintf(&b, "%s{namespace=%q,kind=%q,name=%q} %d\n", metricNeverRestarted, s.Target.Namespace, s.Target.Kind, s.Target.Name, never)
+	}
+
+	fmt.Fprintf(&b, "# HELP %s Restarts of a database workload within the window, by reason.\n", metricWorkloadRestarts)
+	fmt.Fprintf(&b, "# TYPE %s gauge\n", metricWorkloadRestarts)
+	for _, s := range statuses {
+		reasons := make([]string, 0, len(s.Restarts.Reasons))
+		for reason := range s.Restarts.Reasons {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(&b, "%s{namespace=%q,kind=%q,name=%q,reason=%q} %d\n", metricWorkloadRestarts, s.Target.Namespace, s.Target.Kind, s.Target.Name, reason, s.Restarts.Reasons[reason])
+		}
+	}
+
+	fmt.Fprintf(&b, "# HELP %s Number of database workloads overdue for a restart or never restarted.\n", metricHygieneViolations)
+	fmt.Fprintf(&b, "# TYPE %s gauge\n", metricHygieneViolations)
+	fmt.Fprintf(&b, "%s %d\n", metricHygieneViolations, violations)
+	return b.String()
+}
+
+// notifyHygiene posts the workloads that started violating the hygiene check
+// to a webhook as JSON.
+func notifyHygiene(ctx context.Context, url string, statuses []hygieneStatus) error {
+	type entry struct {
+		hygieneStatus
+		OldestPodAgeSeconds int64 `json:"oldestPodAgeSeconds"`
+	}
+	payload := struct {
+		Text      string  `json:"text"`
+		Workloads []entry `json:"workloads"`
+	}{Text: fmt.Sprintf("%d database workload(s) are overdue for a restart", len(statuses))}
+	for _, s := range statuses {
+		payload.Workloads = append(payload.Workloads, entry{s, int64(s.OldestPodAge.Seconds())})
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+//go:embed dashboard
+var dashboardAssets embed.FS
+
+// dashboardWorkload is a database workload as shown on the dashboard.
+type dashboardWorkload struct {
+	Kind                    string     `json:"kind"`
+	Namespace               string     `json:"namespace"`
+	Name                    string     `json:"name"`
+	OS                      string     `json:"os,omitempty"`
+	LastRestart             *time.Time `json:"lastRestart,omitempty"`
+	LastRunID               string     `json:"lastRunId,omitempty"`
+	OldestPodAgeSeconds     int64      `json:"oldestPodAgeSeconds"`
+	NeverRestarted          bool       `json:"neverRestarted"`
+	Overdue                 bool       `json:"overdue"`
+	RolloutDurationsSeconds []int64    `json:"rolloutDurationsSeconds,omitempty"`
+}
+
+// dashboardRun is a run as shown on the dashboard.
+type dashboardRun struct {
+	RunID     string `json:"runId"`
+	Workloads int    `json:"workloads"`
+}
+
+// dashboardFleet is served on /api/fleet.
+type dashboardFleet struct {
+	CheckedAt time.Time           `json:"checkedAt"`
+	Workloads []dashboardWorkload `json:"workloads"`
+
+	// Runs are the runs that last restarted at least one of the workloads,
+	// newest first.
+	Runs []dashboardRun `json:"runs"`
+}
+
+// dashboardActiveRun is served on /api/run.
+type dashboardActiveRun struct {
+	Active   bool   `json:"active"`
+	RunID    string `json:"runId,omitempty"`
+	Progress string `json:"progress,omitempty"`
+	State    string `json:"state,omitempty"`
+	Updated  string `json:"updated,omitempty"`
+}
+
+// serveDashboard registers the read-only dashboard and its JSON API on mux.
+// The fleet comes from the latest hygiene snapshot; the active run is read
+// from the run lease and the progress ConfigMap on every request.
+func serveDashboard(mux *http.ServeMux, store *snapshotStore, clientset *kubernetes.Clientset, namespace, progressConfigMap string) {
+	assets, err := fs.Sub(dashboardAssets, "dashboard")
+	if err != nil {
+		log.Fatalf("Error loading dashboard assets: %v", err)
+	}
+	mux.Handle("/", http.FileServer(http.FS(assets)))
+
+	mux.HandleFunc("/api/fleet", func(w http.ResponseWriter, _ *http.Request) {
+		snapshot := store.get()
+		if snapshot == nil {
+			http.Error(w, "no hygiene check has completed yet", http.StatusServiceUnavailable)
+			return
+		}
+		writeDashboardJSON(w, fleetView(snapshot))
+	})
+
+	mux.HandleFunc("/api/run", func(w http.ResponseWriter, r *http.Request) {
+		run, err := activeRun(r.Context(), clientset, namespace, progressConfigMap)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeDashboardJSON(w, run)
+	})
+}
+
+// fleetView converts a hygiene snapshot for the dashboard.
+func fleetView(snapshot *hygieneSnapshot) dashboardFleet {
+	fleet := dashboardFleet{CheckedAt: snapshot.checkedAt.UTC(), Workloads: []dashboardWorkload{}, Runs: []dashboardRun{}}
+	runs := make(map[string]int)
+	for _, s := range snapshot.statuses {
+		t := s.Target
+		w := dashboardWorkload{
+			Kind:                t.Kind,
+			Namespace:           t.Namespace,
+			Name:                t.Name,
+			OS:                  t.OS,
+			LastRunID:           t.Annotations[runIDAnnotation],
+			OldestPodAgeSeconds: int64(s.OldestPodAge.Seconds()),
+			NeverRestarted:      s.NeverRestarted,
+			Overdue:             s.Overdue,
+		}
+		if !t.LastRestart.IsZero() {
+			restarted := t.LastRestart.UTC()
+			w.LastRestart = &restarted
+		}
+		for _, d := range rolloutHistory(t) {
+			w.RolloutDurationsSeconds = append(w.RolloutDurationsSeconds, int64(d.Seconds()))
+		}
+		if w.LastRunID != "" {
+			runs[w.LastRunID]++
+		}
+		fleet.Workloads = append(fleet.Workloads, w)
+	}
+	sort.Slice(fleet.Workloads, func(i, j int) bool {
+		a, b := fleet.Workloads[i], fleet.Workloads[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Kind+"/"+a.Name < b.Kind+"/"+b.Name
+	})
+
+	for id, n := range runs {
+		fleet.Runs = append(fleet.Runs, dashboardRun{RunID: id, Workloads: n})
+	}
+	// Run IDs start with their start time, so they sort chronologically
+	sort.Slice(fleet.Runs, func(i, j int) bool { return fleet.Runs[i].RunID > fleet.Runs[j].RunID })
+	return fleet
+}
+
+// activeRun returns the run holding the run lease and its progress.
+func activeRun(ctx context.Context, clientset *kubernetes.Clientset, namespace, progressConfigMap string) (dashboardActiveRun, error) {
+	holder, err := currentLeaseHolder(ctx, clientset, namespace)
+	if err != nil || holder == "" {
+		return dashboardActiveRun{}, err
+	}
+	run := dashboardActiveRun{Active: true, RunID: holder}
+	if progressConfigMap == "" {
+		return run, nil
+	}
+
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, progressConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return run, nil
+	}
+	if err != nil {
+		return dashboardActiveRun{}, err
+	}
+	// The ConfigMap may still describe a previous run
+	if cm.Annotations[runIDAnnotation] == holder {
+		run.Progress = cm.Annotations[progressAnnotation]
+		run.State = cm.Annotations[progressStateAnnotation]
+		run.Updated = cm.Annotations[progressUpdatedAnnotation]
+	}
+	return run, nil
+}
+
+func writeDashboardJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing dashboard response", "error", err)
+	}
+}
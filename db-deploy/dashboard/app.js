@@ -0,0 +1,108 @@
+// Read-only dashboard of "db-pods daemon". Everything is fetched from the
+// JSON API served next to it and refreshed periodically.
+
+const refreshInterval = 15000;
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+}
+
+function duration(seconds) {
+  if (seconds <= 0) {
+    return "-";
+  }
+  const days = Math.floor(seconds / 86400);
+  const hours = Math.floor((seconds % 86400) / 3600);
+  const minutes = Math.floor((seconds % 3600) / 60);
+  if (days > 0) {
+    return `${days}d ${hours}h`;
+  }
+  if (hours > 0) {
+    return `${hours}h ${minutes}m`;
+  }
+  return `${minutes}m`;
+}
+
+function status(w) {
+  if (w.neverRestarted && w.overdue) {
+    return ["never restarted, overdue", "violation"];
+  }
+  if (w.neverRestarted) {
+    return ["never restarted", "violation"];
+  }
+  if (w.overdue) {
+    return ["overdue", "violation"];
+  }
+  return ["ok", "ok"];
+}
+
+async function refreshFleet() {
+  const response = await fetch("api/fleet");
+  if (!response.ok) {
+    document.getElementById("checked").textContent = await response.text();
+    return;
+  }
+  const fleet = await response.json();
+  document.getElementById("checked").textContent = `checked ${new Date(fleet.checkedAt).toLocaleString()}`;
+
+  const body = document.getElementById("fleet");
+  body.replaceChildren();
+  for (const w of fleet.workloads) {
+    const row = body.insertRow();
+    cell(row, `${w.kind}/${w.namespace}/${w.name}`);
+    cell(row, w.os || "-");
+    cell(row, w.lastRestart ? new Date(w.lastRestart).toLocaleString() : "never");
+    cell(row, w.lastRunId || "-");
+    cell(row, duration(w.oldestPodAgeSeconds));
+    cell(row, (w.rolloutDurationsSeconds || []).slice(-5).join(", ") || "-");
+    const [text, className] = status(w);
+    cell(row, text, className);
+  }
+
+  const runs = document.getElementById("runs");
+  runs.replaceChildren();
+  for (const run of fleet.runs) {
+    const row = runs.insertRow();
+    cell(row, run.runId);
+    cell(row, String(run.workloads));
+  }
+}
+
+async function refreshRun() {
+  const target = document.getElementById("run");
+  const response = await fetch("api/run");
+  if (!response.ok) {
+    target.textContent = await response.text();
+    return;
+  }
+  const run = await response.json();
+  if (!run.active) {
+    target.textContent = "No run in progress.";
+    return;
+  }
+
+  target.replaceChildren();
+  const label = document.createElement("div");
+  label.textContent = `Run ${run.runId}` + (run.updated ? `, updated ${new Date(run.updated).toLocaleString()}` : "");
+  target.appendChild(label);
+  if (run.progress) {
+    const [done, total] = run.progress.split("/").map(Number);
+    const bar = document.createElement("progress");
+    bar.max = total;
+    bar.value = done;
+    target.appendChild(bar);
+    target.appendChild(document.createTextNode(` ${run.progress} workloads`));
+  }
+}
+
+function refresh() {
+  refreshFleet().catch((err) => console.error(err));
+  refreshRun().catch((err) => console.error(err));
+}
+
+refresh();
+setInterval(refresh, refreshInterval);
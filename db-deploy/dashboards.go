@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/pflag"
+)
+
+// dashboardsCommand writes a Grafana dashboard for the tool's Prometheus
+// metrics.
+func dashboardsCommand(fs *pflag.FlagSet) func(args []string) {
+	output := fs.String("output", "-", "file to write the dashboard JSON to, or - for stdout")
+	datasource := fs.String("datasource", "Prometheus", "name of the Grafana Prometheus datasource the panels query")
+	return func(args []string) {
+		data, err := json.MarshalIndent(grafanaDashboard(*datasource), "", "  ")
+		if err != nil {
+			log.Fatalf("Error encoding dashboard: %v", err)
+		}
+		data = append(data, '\n')
+
+		if *output == "-" {
+			os.Stdout.Write(data)
+			return
+		}
+		if err := os.WriteFile(*output, data, 0o644); err != nil {
+			log.Fatalf("Error writing dashboard: %v", err)
+		}
+		fmt.Printf("Wrote Grafana dashboard to %s\n", *output)
+	}
+}
+
+// grafanaPanel describes a single dashboard panel and the PromQL queries it
+// plots.
+type grafanaPanel struct {
+	title   string
+	kind    string
+	unit    string
+	queries []grafanaQuery
+}
+
+// grafanaQuery is a PromQL expression and the legend of the series it
+// returns.
+type grafanaQuery struct {
+	legend string
+	expr   string
+}
+
+// grafanaDashboard builds the dashboard model in Grafana's JSON format.
+func grafanaDashboard(datasource string) map[string]interface{} {
+	panels := []grafanaPanel{
+		{
+			title: "Restart rate by result",
+			kind:  "timeseries",
+			unit:  "ops",
+			queries: []grafanaQuery{
+				{"{{result}}", fmt.Sprintf(`sum by (result) (rate(%s[$__rate_interval]))`, metricRestartsTotal)},
+			},
+		},
+		{
+			title: "Failed restarts by namespace",
+			kind:  "timeseries",
+			unit:  "short",
+			queries: []grafanaQuery{
+				{"{{namespace}}", fmt.Sprintf(`sum by (namespace) (increase(%s{result="failed"}[$__range]))`, metricRestartsTotal)},
+			},
+		},
+		{
+			title: "Rollout duration",
+			kind:  "timeseries",
+			unit:  "s",
+			queries: []grafanaQuery{
+				{"p50", fmt.Sprintf(`histogram_quantile(0.5, sum by (le) (rate(%s_bucket[$__rate_interval])))`, metricRolloutDuration)},
+				{"p95", fmt.Sprintf(`histogram_quantile(0.95, sum by (le) (rate(%s_bucket[$__rate_interval])))`, metricRolloutDuration)},
+			},
+		},
+		{
+			title: "Rollout duration by namespace (p95)",
+			kind:  "timeseries",
+			unit:  "s",
+			queries: []grafanaQuery{
+				{"{{namespace}}", fmt.Sprintf(`histogram_quantile(0.95, sum by (namespace, le) (rate(%s_bucket[$__rate_interval])))`, metricRolloutDuration)},
+			},
+		},
+		{
+			title: "Time since last run",
+			kind:  "stat",
+			unit:  "s",
+			queries: []grafanaQuery{
+				{"last run", fmt.Sprintf(`time() - max(%s)`, metricLastRunTimestamp)},
+			},
+		},
+		{
+			title: "Most restarted workloads",
+			kind:  "timeseries",
+			unit:  "short",
+			queries: []grafanaQuery{
+				{"{{namespace}}/{{name}}", fmt.Sprintf(`topk(10, sum by (namespace, name) (%s))`, metricWorkloadRestarts)},
+			},
+		},
+		{
+			title: "Restarts by reason",
+			kind:  "timeseries",
+			unit:  "short",
+			queries: []grafanaQuery{
+				{"{{reason}}", fmt.Sprintf(`sum by (reason) (%s)`, metricWorkloadRestarts)},
+			},
+		},
+	}
+
+	ds := map[string]interface{}{"type": "prometheus", "uid": datasource}
+	var model []map[string]interface{}
+	for i, p := range panels {
+		var targets []map[string]interface{}
+		for j, q := range p.queries {
+			targets = append(targets, map[string]interface{}{
+				"datasource":   ds,
+				"expr":         q.expr,
+				"legendFormat": q.legend,
+				"refId":        string(rune('A' + j)),
+			})
+		}
+		model = append(model, map[string]interface{}{
+			"id":         i + 1,
+			"title":      p.title,
+			"type":       p.kind,
+			"datasource": ds,
+			"gridPos":    map[string]int{"h": 8, "w": 12, "x": (i % 2) * 12, "y": (i / 2) * 8},
+			"fieldConfig": map[string]interface{}{
+				"defaults":  map[string]interface{}{"unit": p.unit},
+				"overrides": []interface{}{},
+			},
+			"targets": targets,
+		})
+	}
+
+	return map[string]interface{}{
+		"title":         "Database pod restarts",
+		"uid":           "db-pods",
+		"tags":          []string{"db-pods", "databases"},
+		"timezone":      "browser",
+		"schemaVersion": 39,
+		"time":          map[string]string{"from": "now-7d", "to": "now"},
+		"refresh":       "1m",
+		"panels":        model,
+	}
+}
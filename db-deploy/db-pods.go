@@ -1,158 +1,476 @@
-.package main
+package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"path/filepath"
-	"strings"
+	"log/slog"
+	"math/rand"
+	"os"
 	"time"
 
-	appsv1 "k8s.io/api/apps/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/homedir"
-)
 
-func main() {
-	// Build kubeconfig path
-	var kubeconfig string
-	if home := homedir.HomeDir(); home != "" {
-		kubeconfig = filepath.Join(home, ".kube", "config")
-	}
+	"redeploy-database-pods/pkg/restart"
+)
 
-	// Create the clientset
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
-	if err != nil {
-		log.Fatalf("Error building kubeconfig: %v", err)
-	}
+// unscopedGuidance is printed when a run that would change the cluster has no
+// explicit scope.
+const unscopedGuidance = `Refusing to restart database workloads across the whole cluster without an explicit scope.
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		log.Fatalf("Error creating kubernetes client: %v", err)
-	}
+Narrow the run down with one or more of:
+  --namespace NAMESPACE        only workloads in this namespace
+  --selector LABELS            only workloads matching this label selector
+  --name-pattern REGEXP        only workloads whose name matches
+  --name-contains TEXT         only workloads whose name contains TEXT
+  --pv, --service, --plan      only the workloads behind volumes, services or a plan
 
-	ctx := context.Background()
+Preview what would be restarted with --dry-run, or pass --all to restart
+every matching workload in the cluster.
+`
 
-	// Get all deployments across all namespaces
-	deployments, err := clientset.AppsV1().Deployments("").List(ctx, metav1.ListOptions{})
-	if err != nil {
-		log.Fatalf("Error listing deployments: %v", err)
-	}
+// restartCommand runs "db-pods restart", which restarts every matching
+// workload. Command lines starting with a flag run it too.
+func restartCommand(fs *pflag.FlagSet) func(args []string) {
+	var opts options
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	fs.BoolVar(&opts.wait, "wait", true, "wait for each restarted workload to finish rolling out, up to --rollout-timeout, and report the rollouts that did not complete as failed; --wait=false only checks that the restart was accepted")
+	fs.DurationVar(&opts.rolloutTimeout, "rollout-timeout", 10*time.Minute, "maximum time to wait for a single rollout to complete")
+	fs.BoolVar(&opts.adaptiveTimeout.enabled, "adaptive-timeout", false, "wait for each rollout for the 95th percentile of the workload's past rollouts, recorded in the "+rolloutHistoryAnnotation+" annotation, plus --adaptive-timeout-margin instead of --rollout-timeout, once it has completed at least 3")
+	fs.Float64Var(&opts.adaptiveTimeout.margin, "adaptive-timeout-margin", 0.5, "fraction of the 95th percentile added to adaptive timeouts")
+	fs.DurationVar(&opts.adaptiveTimeout.min, "adaptive-timeout-min", time.Minute, "shortest adaptive timeout")
+	fs.Float64Var(&opts.windowsTimeoutFactor, "windows-timeout-factor", 3, "multiply the rollout timeouts of workloads scheduled to Windows nodes, through spec.os or the "+osLabel+" node selector, by this factor")
+	fs.BoolVar(&opts.meshOutlierHold, "mesh-outlier-hold", false, "suspend Istio outlier detection on the DestinationRule named by the "+meshDestinationRuleAnnotation+" annotation while a workload restarts")
+	fs.StringVar(&opts.warmup.url, "warmup-url", "", "endpoint probed after a rollout until its latency drops below --warmup-threshold; may contain {namespace}, {name}, {pod} and {pod_ip} and is overridden by the "+warmupURLAnnotation+" annotation")
+	fs.DurationVar(&opts.warmup.threshold, "warmup-threshold", 100*time.Millisecond, "latency below which a warm-up probe counts as warm")
+	fs.IntVar(&opts.warmup.samples, "warmup-samples", 3, "number of consecutive warm probes required")
+	fs.DurationVar(&opts.warmup.interval, "warmup-interval", 2*time.Second, "delay between warm-up probes")
+	fs.DurationVar(&opts.warmup.timeout, "warmup-timeout", 5*time.Minute, "maximum time to spend warming up a single workload")
+	fs.IntVar(&opts.maxFleetUnavailable, "max-fleet-unavailable", 0, "pause before each restart while more than this many replicas across all matched workloads are unavailable (0 disables the check)")
+	fs.IntVar(&opts.maxConcurrent, "max-concurrent-restarts", 0, "maximum number of workloads per namespace rolling out at once (0 means no limit); namespaces can override it with the "+maxConcurrentAnnotation+" annotation")
+	discovery := addDiscoveryFlags(fs)
+	fs.IntVar(&opts.chaos.percent, "chaos-percent", 0, "game days: restart only this random percentage of the matched workloads")
+	fs.BoolVar(&opts.chaos.namespace, "chaos-namespace", false, "game days: restart only the matched workloads of one random namespace")
+	handoff := fs.Bool("handoff", false, "only stamp the "+restartRequestedAnnotation+" annotation on matched workloads and exit, leaving the restart to their owners; follow up with \"db-pods handoff-status\"")
+	order := fs.String("order", orderAge, "order of the restarts: \""+orderAge+"\" restarts workloads with the longest running pods first, \""+orderMemory+"\" those whose pods use the largest share of their memory limit, \""+orderDiscovery+"\" keeps the discovery order; plans always run in their own order")
+	fs.Float64Var(&opts.minMemoryUsage, "min-memory-usage", 0, "skip workloads whose pods all use less than this share of their memory limit, or of their request without a limit, such as 0.8, as reported by metrics-server; workloads without metrics are restarted (0 disables the check)")
+	concurrency := fs.Int("concurrency", 1, "number of workloads, or applications with --group-by-app, restarted in parallel; --max-concurrent-restarts still caps each namespace, while --max-fleet-unavailable is checked by each worker before its restart and may be overshot by up to this many restarts")
+	strict := fs.Bool("strict", false, "watch the selected workloads during the run and, if anyone else changes them, abort the run and exit with status 1 after printing how they differ from their state before the run, so that the cluster ends up exactly as the plan intended")
+	canary := fs.String("canary", "", "restart a canary first and only go on with the rest once it rolled out, aborting the run if it fails: "+canaryWorkload+" restarts the first workload, or application with --group-by-app, and "+canaryNamespace+" every workload of its namespace")
+	batchSize := fs.Int("batch-size", 0, "restart the workloads, or applications with --group-by-app, in batches of this many, each started once the previous one is done, aborting the run if one fails; 0 restarts them in a single batch")
+	groupByApp := fs.Bool("group-by-app", false, "restart workloads sharing the "+partOfLabel+" label together, ordered by the "+restartOrderAnnotation+" annotation, and report per application")
+	fs.IntVar(&opts.retries, "retries", 0, "requeue failed workloads at the end of the run up to this many times")
+	fs.DurationVar(&opts.retryDelay, "retry-delay", time.Minute, "pause before each pass over the requeued workloads")
+	fs.DurationVar(&opts.volumeOpTimeout, "volume-op-timeout", 30*time.Minute, "maximum time to defer a restart while its volumes are being resized, attached or detached; the workload is skipped afterwards")
+	fs.StringVar(&opts.pacing.prometheusURL, "prometheus-url", "", "Prometheus server queried by --pacing-query and --slo-budget-query")
+	fs.StringVar(&opts.pacing.query, "pacing-query", "", "PromQL query for the error rate of services consuming the databases; restarts slow down or pause while it rises above its value at the start of the run")
+	fs.Float64Var(&opts.pacing.maxIncrease, "pacing-max-increase", 0.01, "rise of the pacing query above its baseline at which the run pauses; above half of it restarts slow down")
+	fs.DurationVar(&opts.pacing.interval, "pacing-interval", 30*time.Second, "delay added before a restart while slowed down, and between checks while paused")
+	fs.DurationVar(&opts.pacing.maxPause, "pacing-max-pause", 30*time.Minute, "maximum time to pause for the error rate to recover before giving up on a workload")
+	fs.StringVar(&opts.slo.query, "slo-budget-query", "", "PromQL query for the remaining error budget ratio (0 to 1) of the services consuming each database, such as Sloth's slo:period_error_budget_remaining:ratio; may contain {namespace} and {name} and is overridden by the "+sloBudgetQueryAnnotation+" annotation")
+	fs.Float64Var(&opts.slo.minBudget, "slo-min-budget", 0.1, "remaining error budget ratio below which --slo-budget-action applies")
+	fs.StringVar(&opts.slo.action, "slo-budget-action", sloBudgetBlock, "what to do when the error budget is below --slo-min-budget: block skips the workload, warn restarts it and reports a warning")
+	all := fs.Bool("all", false, "allow restarting every matching workload across the cluster without a --namespace, --selector, --name-pattern, --name-contains, --naming-convention, --pv, --service or --plan scope")
+	dryRun := fs.Bool("dry-run", false, "only list the workloads that would be restarted and why they matched, without changing anything")
+	fs.BoolVar(&opts.migration.run, "run-migrations", false, "trigger the migration CronJob linked by the "+migrationAnnotation+" annotation before restarting a workload and wait for it, instead of only checking its latest run")
+	fs.DurationVar(&opts.migration.timeout, "migration-timeout", 15*time.Minute, "maximum time to wait for a triggered migration")
+	fs.BoolVar(&opts.serverDryRun, "server-dry-run", false, "send each restart through admission with a server side dry run and report which webhooks and policies would deny, warn about or change it, without restarting anything")
+	fs.DurationVar(&opts.maxBackupAge, "max-backup-age", 0, "refuse to restart databases whose last backup, found as declared by the "+backupSourceAnnotation+" annotation, is older than this (0 disables the check)")
+	fs.DurationVar(&opts.replicationTimeout, "replication-timeout", 15*time.Minute, "before restarting a member of a cluster managed by the Zalando postgres-operator, the MongoDB Community operator or the Percona Operator for MongoDB, wait this long for the cluster to report healthy replication; the workload is deferred if it is still degraded")
+	fs.DurationVar(&opts.pdbTimeout, "pdb-timeout", 5*time.Minute, "before restarting a workload whose pods are covered by PodDisruptionBudgets, wait this long for them to allow as many disruptions as its rollout causes; the workload is deferred if pods they count as unhealthy keep them short, and skipped if they allow too few even with every pod healthy")
+	fs.StringVar(&opts.debug.command, "debug-before-restart", "", "shell command run in an ephemeral debug container attached to each crashlooping container before its workload is restarted; output goes to --diagnostics-dir if set")
+	fs.StringVar(&opts.debug.image, "debug-image", defaultDebugImage, "image of the debug container, and of the exec checks of verification classes")
+	fs.DurationVar(&opts.debug.timeout, "debug-timeout", 2*time.Minute, "maximum time to wait for the debug command")
+	fs.BoolVar(&opts.rollback, "rollback-on-failure", false, "roll Deployments whose rollout does not complete within --rollout-timeout back to their previous revision; they are still reported as failed")
+	fs.BoolVar(&opts.pauseOnPreemption, "pause-on-preemption", false, "once a pod of a restarted workload is preempted by a higher-priority pod during its rollout, defer the remaining workloads instead of restarting them, so the run does not keep draining capacity")
+	fs.BoolVar(&opts.onlyUnhealthy, "only-unhealthy", false, "instead of rolling each workload, delete only its pods that have been unready for "+unreadyGrace.String()+", are crashlooping or are stuck terminating; workloads without such pods are skipped")
+	fs.BoolVar(&opts.scaleIdle, "scale-idle", false, "restart workloads scaled to zero by scaling them up to one replica, waiting for the rollout and scaling them back down, instead of skipping them")
+	fs.StringVar(&opts.reason, "reason", "", "why the workloads are restarted, such as \"memory leak\" or a ticket, recorded in their "+restartHistoryAnnotation+" annotation for \"db-pods report --by-workload\"; defaults to "+reasonCrashLooping+" for crashlooping workloads and to "+reasonRoutine+" otherwise")
+	addRetentionFlags(fs, &opts.retention)
+	fs.StringVar(&opts.diagnosticsDir, "diagnostics-dir", "", "collect a diagnostic bundle (pod state, events, logs, node conditions) for every failed workload under this directory")
+	suspendedCronJobs := fs.String("suspended-cronjobs", suspendedCronJobsSkip, "how to handle suspended database CronJobs once the restarts are done: skip, or trigger to run them once without lifting the suspension")
+	metricsTextfile := fs.String("metrics-textfile", "", "write run metrics to this file for node-exporter's textfile collector")
+	slackWebhook := fs.String("slack-webhook-url", os.Getenv("SLACK_WEBHOOK_URL"), "Slack incoming webhook posted a summary of the run, with every failure and its error, once it finishes; defaults to the SLACK_WEBHOOK_URL variable, which keeps the secret URL off the command line")
+	pushgateway := fs.String("pushgateway-url", "", "push run metrics to this Prometheus Pushgateway, under job \""+pushgatewayJob+"\", once the run is done")
+	planTimeFlag := fs.String("plan-time", "", "frozen RFC 3339 timestamp used instead of the current time in restart annotations and freeze window checks, so a run matches its approved plan")
+	rerunPlan := fs.Bool("rerun-plan", false, "restart the workloads of the --plan even if an earlier run of the same plan file restarted them, as recorded in their "+planFingerprintAnnotation+" annotation")
+	notAfter := fs.String("not-after", "", "RFC 3339 time after which no further restart is started and the remaining workloads are deferred, such as the end of a maintenance window; \"db-pods scheduled\" sets it")
+	forceDuringUpgrade := fs.Bool("force-during-upgrade", false, "restart even while a cluster upgrade or a rolling node reboot appears to be underway, as shown by a held kured lock, cordoned control plane nodes, kubelets of different versions or nodes marked for replacement")
+	lockNamespace := fs.String("lock-namespace", "default", "namespace of the "+runLeaseName+" Lease that keeps concurrent runs apart")
+	onConflict := fs.String("on-conflict", onConflictExit, "what to do when another run holds the lease: exit, queue behind it, or observe it until it finishes")
+	progressConfigMap := fs.String("progress-configmap", progressConfigMapName, "ConfigMap in --lock-namespace whose "+progressAnnotation+" annotation tracks the run's progress (empty disables it)")
+	deferredConfigMap := fs.String("deferred-configmap", deferredConfigMapName, "ConfigMap in --lock-namespace queueing workloads skipped for reasons expected to clear up, such as freezes, pending migrations or storage operations, for \"db-pods daemon --retry-deferred\" (empty disables)")
+	securityAudit := fs.Bool("security-audit", false, "audit the pod templates of the matched workloads for host namespaces, privileged or root containers, missing probes and missing resource limits, and include the findings in the report")
+	eventsBroker := fs.String("events-broker", os.Getenv("K_SINK"), "publish run and workload events as JSON to kafka://HOST:PORT[,HOST:PORT]/TOPIC or nats://HOST:PORT/SUBJECT, or as CloudEvents over HTTP to an http:// or https:// sink such as a Knative broker or an Argo Events webhook; defaults to the K_SINK variable set by a Knative SinkBinding")
+	profile := fs.String("profile", "", "\""+profileDev+"\" relaxes the defaults on a single-node kind, minikube or k3s cluster: shorter timeouts and delays, no backup age check and no confirmation prompts; refused on any other cluster")
+	output := fs.String("output", "text", "report format: text or json (see \"db-pods schema\")")
+	configFile := addConfigFlag(fs)
+	return func(args []string) {
+		setupLogging()
 
-	// Get all statefulsets across all namespaces
-	statefulsets, err := clientset.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
-	if err != nil {
-		log.Fatalf("Error listing statefulsets: %v", err)
-	}
+		switch *output {
+		case "text":
+		case "json":
+			// Keep progress out of the report, unless it is logged already.
+			if !logsProgress() {
+				progress = os.Stderr
+			}
+		default:
+			log.Fatalf("Unknown --output %q, expected text or json", *output)
+		}
 
-	// Get all daemonsets across all namespaces
-	daemonsets, err := clientset.AppsV1().DaemonSets("").List(ctx, metav1.ListOptions{})
-	if err != nil {
-		log.Fatalf("Error listing daemonsets: %v", err)
-	}
+		if *suspendedCronJobs != suspendedCronJobsSkip && *suspendedCronJobs != suspendedCronJobsTrigger {
+			log.Fatalf("Unknown --suspended-cronjobs %q, expected %s or %s", *suspendedCronJobs, suspendedCronJobsSkip, suspendedCronJobsTrigger)
+		}
 
-	restarted := 0
+		switch *onConflict {
+		case onConflictExit, onConflictQueue, onConflictObserve:
+		default:
+			log.Fatalf("Unknown --on-conflict %q, expected %s, %s or %s", *onConflict, onConflictExit, onConflictQueue, onConflictObserve)
+		}
 
-	// Process deployments
-	for _, deployment := range deployments.Items {
-		if strings.Contains(strings.ToLower(deployment.Name), "database") {
-			err := restartDeployment(ctx, clientset, deployment.Namespace, deployment.Name)
+		if *planTimeFlag != "" {
+			t, err := time.Parse(time.RFC3339, *planTimeFlag)
 			if err != nil {
-				log.Printf("Error restarting deployment %s/%s: %v", deployment.Namespace, deployment.Name, err)
-			} else {
-				fmt.Printf("Successfully restarted deployment: %s/%s\n", deployment.Namespace, deployment.Name)
-				restarted++
+				log.Fatalf("Invalid --plan-time: %v", err)
 			}
+			planTime = t
 		}
-	}
 
-	// Process statefulsets
-	for _, statefulset := range statefulsets.Items {
-		if strings.Contains(strings.ToLower(statefulset.Name), "database") {
-			err := restartStatefulSet(ctx, clientset, statefulset.Namespace, statefulset.Name)
+		if *notAfter != "" {
+			t, err := time.Parse(time.RFC3339, *notAfter)
 			if err != nil {
-				log.Printf("Error restarting statefulset %s/%s: %v", statefulset.Namespace, statefulset.Name, err)
-			} else {
-				fmt.Printf("Successfully restarted statefulset: %s/%s\n", statefulset.Namespace, statefulset.Name)
-				restarted++
+				log.Fatalf("Invalid --not-after: %v", err)
 			}
+			opts.notAfter = t
+		}
+
+		if opts.pacing.query != "" && opts.pacing.prometheusURL == "" {
+			log.Fatalf("--pacing-query requires --prometheus-url")
+		}
+		if opts.slo.action != sloBudgetBlock && opts.slo.action != sloBudgetWarn {
+			log.Fatalf("--slo-budget-action must be %q or %q", sloBudgetBlock, sloBudgetWarn)
+		}
+		opts.slo.prometheusURL = opts.pacing.prometheusURL
+		if opts.slo.query != "" && opts.slo.prometheusURL == "" {
+			log.Fatalf("--slo-budget-query requires --prometheus-url")
 		}
-	}
 
-	// Process daemonsets
-	for _, daemonset := range daemonsets.Items {
-		if strings.Contains(strings.ToLower(daemonset.Name), "database") {
-			err := restartDaemonSet(ctx, clientset, daemonset.Namespace, daemonset.Name)
+		if opts.chaos.percent < 0 || opts.chaos.percent > 100 {
+			log.Fatalf("--chaos-percent must be between 0 and 100")
+		}
+		if *order != orderAge && *order != orderMemory && *order != orderDiscovery {
+			log.Fatalf("--order must be %q, %q or %q", orderAge, orderMemory, orderDiscovery)
+		}
+		if *concurrency < 1 {
+			log.Fatalf("--concurrency must be at least 1")
+		}
+		if err := opts.retention.validate(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if *canary != "" && *canary != canaryWorkload && *canary != canaryNamespace {
+			log.Fatalf("--canary must be %s or %s", canaryWorkload, canaryNamespace)
+		}
+		if (*canary != "" || *batchSize > 0) && !opts.wait {
+			log.Fatalf("--canary and --batch-size need --wait to tell whether a stage succeeded")
+		}
+		if *strict && opts.rollback {
+			log.Fatalf("--strict cannot be combined with --rollback-on-failure, whose rollbacks change the workloads beyond the plan")
+		}
+		if *batchSize < 0 {
+			log.Fatalf("--batch-size must not be negative")
+		}
+		if *concurrency > 1 && opts.serverDryRun {
+			log.Fatalf("--server-dry-run attributes API warnings to each workload and cannot be combined with --concurrency")
+		}
+		if opts.rollback && !opts.wait {
+			log.Fatalf("--rollback-on-failure requires --wait")
+		}
+		if opts.pauseOnPreemption && !opts.wait {
+			log.Fatalf("--pause-on-preemption requires --wait")
+		}
+		if opts.onlyUnhealthy && (opts.scaleIdle || opts.serverDryRun) {
+			log.Fatalf("--only-unhealthy cannot be combined with --scale-idle or --server-dry-run")
+		}
+		if *profile != "" && *profile != profileDev {
+			log.Fatalf("Unknown --profile %q, expected %s", *profile, profileDev)
+		}
+
+		discoveryOpts, err := discovery.options()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if !*all && !discovery.scoped() && !*dryRun && !opts.serverDryRun {
+			fmt.Fprint(os.Stderr, unscopedGuidance)
+			os.Exit(2)
+		}
+		if discoveryOpts.planFile != "" && !*rerunPlan {
+			if opts.planFingerprint, err = planFingerprint(discoveryOpts.planFile); err != nil {
+				log.Fatalf("Error reading plan: %v", err)
+			}
+		}
+
+		var notifications *notificationConfig
+		if *configFile != "" {
+			if notifications, err = loadNotificationConfig(*configFile); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			if opts.verification, err = loadVerificationConfig(*configFile); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+
+		clientset, dynamicClient := newClients()
+		opts.cluster = detectCapabilitiesOrWarn(clientset)
+		if opts.debug.enabled() && !opts.cluster.has(featureEphemeralContainers) {
+			slog.Warn("Ignoring --debug-before-restart, the cluster does not serve ephemeral containers", "version", opts.cluster.version)
+			opts.debug.command = ""
+		}
+
+		ctx := context.Background()
+
+		if *profile == profileDev {
+			distribution, err := detectDevCluster(ctx, clientset)
 			if err != nil {
-				log.Printf("Error restarting daemonset %s/%s: %v", daemonset.Namespace, daemonset.Name, err)
-			} else {
-				fmt.Printf("Successfully restarted daemonset: %s/%s\n", daemonset.Namespace, daemonset.Name)
-				restarted++
+				log.Fatalf("Error detecting the cluster for --profile %s: %v", profileDev, err)
+			}
+			if distribution == "" {
+				log.Fatalf("--profile %s only applies to single-node kind, minikube and k3s clusters", profileDev)
 			}
+			if err := applyDevProfile(fs); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			opts.devProfile = true
+			fmt.Fprintf(progress, "Using the %s profile on a single-node %s cluster\n", profileDev, distribution)
 		}
-	}
 
-	fmt.Printf("\nTotal resources restarted: %d\n", restarted)
-}
+		matched, err := discoverTargets(ctx, clientset, dynamicClient, discoveryOpts)
+		if err != nil {
+			log.Fatalf("Error discovering workloads: %v", err)
+		}
 
-func restartDeployment(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string) error {
-	deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to get deployment: %w", err)
-	}
+		cronJobs, err := findCronJobs(ctx, clientset, discoveryOpts, targetNamespaces(matched))
+		if err != nil {
+			slog.Error("Error discovering CronJobs", "error", err)
+		}
 
-	// Add restart annotation to trigger rollout
-	if deployment.Spec.Template.Annotations == nil {
-		deployment.Spec.Template.Annotations = make(map[string]string)
-	}
-	deployment.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = time.Now().Format(time.RFC3339)
+		targets := matched
+		if opts.chaos.enabled() {
+			targets = selectChaosTargets(matched, opts.chaos, rand.New(rand.NewSource(time.Now().UnixNano())))
+		}
 
-	_, err = clientset.AppsV1().Deployments(namespace).Update(ctx, deployment, metav1.UpdateOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to update deployment: %w", err)
-	}
+		// Record pods that were already Pending so that later failures are not
+		// blamed on the restart itself, and note which targets run in a mesh
+		for i := range targets {
+			if err := inspectPods(ctx, clientset, &targets[i]); err != nil {
+				workloadLogger(targets[i]).Error("Error inspecting pods", "error", err)
+			}
+			if err := inspectMemory(ctx, clientset, dynamicClient, &targets[i]); err != nil {
+				workloadLogger(targets[i]).Error("Error inspecting memory usage", "error", err)
+			}
+			if *securityAudit {
+				if err := auditTarget(ctx, clientset, dynamicClient, &targets[i]); err != nil {
+					workloadLogger(targets[i]).Error("Error auditing workload", "error", err)
+				}
+			}
+		}
 
-	return nil
-}
+		if discoveryOpts.planFile == "" {
+			switch *order {
+			case orderAge:
+				sortByPodAge(targets)
+			case orderMemory:
+				sortByMemory(targets)
+			}
+		}
 
-func restartStatefulSet(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string) error {
-	statefulset, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to get statefulset: %w", err)
-	}
+		runID := newRunID()
+		startedAt := time.Now()
+		fmt.Fprintf(progress, "Run ID: %s\n", runID)
+		if opts.planFingerprint != "" {
+			fmt.Fprintf(progress, "Plan fingerprint: %s\n", opts.planFingerprint)
+		}
+		printPlan(targets)
+		printCronJobPlan(cronJobs, *suspendedCronJobs)
 
-	// Add restart annotation to trigger rollout
-	if statefulset.Spec.Template.Annotations == nil {
-		statefulset.Spec.Template.Annotations = make(map[string]string)
-	}
-	statefulset.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = time.Now().Format(time.RFC3339)
+		if *dryRun {
+			printDryRun(os.Stdout, targets)
+			if err := checkUpgrade(ctx, clientset, *forceDuringUpgrade); err != nil {
+				slog.Warn("A real run would not start", "error", err)
+			}
+			return
+		}
 
-	_, err = clientset.AppsV1().StatefulSets(namespace).Update(ctx, statefulset, metav1.UpdateOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to update statefulset: %w", err)
-	}
+		if opts.chaos.enabled() && !opts.devProfile && !confirmChaos(os.Stdin, progress, targets) {
+			log.Fatalf("Chaos run not confirmed, nothing was restarted")
+		}
 
-	return nil
-}
+		if *handoff {
+			requestRestarts(ctx, clientset, dynamicClient, targets)
+			return
+		}
 
-func restartDaemonSet(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string) error {
-	daemonset, err := clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to get daemonset: %w", err)
-	}
+		if err := checkUpgrade(ctx, clientset, *forceDuringUpgrade); err != nil {
+			log.Fatalf("Error: %v; pass --force-during-upgrade to restart anyway", err)
+		}
 
-	// Add restart annotation to trigger rollout
-	if daemonset.Spec.Template.Annotations == nil {
-		daemonset.Spec.Template.Annotations = make(map[string]string)
-	}
-	daemonset.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] = time.Now().Format(time.RFC3339)
+		// Deferred before the lock, so that it is released before exiting
+		var externalChanges map[string][]string
+		defer func() {
+			if len(externalChanges) > 0 {
+				printExternalChanges(progress, externalChanges)
+				os.Exit(1)
+			}
+		}()
+
+		lock, err := acquireRunLock(ctx, clientset, *lockNamespace, runID, *onConflict)
+		if errors.Is(err, errRunObserved) {
+			fmt.Fprintln(progress, "Active run finished, nothing was restarted")
+			return
+		}
+		if err != nil {
+			log.Fatalf("Error acquiring run lock: %v", err)
+		}
+		if lock != nil {
+			defer lock.release()
+		}
+
+		r := &runner{clientset: clientset, dynamic: dynamicClient, opts: opts, runID: runID}
+		r.namespaceLimits = namespaceConcurrency(ctx, clientset, targets)
+		if opts.maxFleetUnavailable > 0 || opts.maxConcurrent > 0 || len(r.namespaceLimits) > 0 {
+			fleet, err := newFleetMonitor(ctx, clientset, dynamicClient, matched)
+			if err != nil {
+				log.Fatalf("Error watching workloads: %v", err)
+			}
+			defer fleet.stop()
+			r.fleet = fleet
+		}
+		if opts.pacing.query != "" {
+			r.pacer, err = newPacer(ctx, opts.pacing)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+		if *eventsBroker != "" {
+			r.events, err = newEventBus(*eventsBroker, runID)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			defer r.events.close()
+		}
+		r.events.runStarted(ctx, len(targets))
+		if *progressConfigMap != "" {
+			r.progress = startProgress(ctx, clientset, *lockNamespace, *progressConfigMap, runID, len(targets))
+		}
+		var units []runUnit
+		if *groupByApp {
+			for _, app := range groupByApplication(targets) {
+				app := app
+				first := app.steps[0][0]
+				name := app.name
+				if name == "" {
+					name = first.String()
+				}
+				units = append(units, runUnit{name: name, namespace: first.Namespace, run: func() []result { return r.runApplication(ctx, app) }})
+			}
+		} else {
+			for _, t := range targets {
+				t := t
+				units = append(units, runUnit{name: t.String(), namespace: t.Namespace, run: func() []result { return []result{r.run(ctx, t)} }})
+			}
+		}
+		var guard *mutationGuard
+		guardCtx, stopGuard := context.WithCancel(ctx)
+		defer stopGuard()
+		if *strict {
+			guard, err = guardTargets(guardCtx, clientset, dynamicClient, targets, opts.scaleIdle, func(t target) {
+				r.abort("an external change to " + t.String())
+			})
+			if err != nil {
+				log.Fatalf("Error watching workloads for --strict: %v", err)
+			}
+		}
+		results := r.runStaged(units, *canary, *batchSize, *concurrency)
 
-	_, err = clientset.AppsV1().DaemonSets(namespace).Update(ctx, daemonset, metav1.UpdateOptions{})
-	if err != nil {
-		return fmt.Errorf("failed to update daemonset: %w", err)
+		cronJobMode := *suspendedCronJobs
+		if opts.serverDryRun {
+			// Nothing was restarted, so nothing is retried or triggered
+			cronJobMode = suspendedCronJobsSkip
+		} else {
+			r.retryFailed(ctx, results)
+			if *deferredConfigMap != "" {
+				if err := updateDeferred(ctx, clientset, *lockNamespace, *deferredConfigMap, runID, results, opts.retention); err != nil {
+					slog.Error("Error updating the deferred queue", "error", err)
+				}
+			}
+		}
+		if guard != nil {
+			stopGuard()
+			externalChanges = guard.stop()
+		}
+		handleCronJobs(ctx, clientset, cronJobs, cronJobMode, runID)
+		if opts.diagnosticsDir != "" {
+			pruneDiagnostics(opts.diagnosticsDir, opts.retention)
+		}
+		if r.progress != nil {
+			r.progress.complete(ctx)
+		}
+		r.events.runFinished(ctx, results)
+		finishedAt := time.Now()
+
+		if notifications != nil {
+			if err := notifications.notify(ctx, runID, results); err != nil {
+				slog.Error("Notifications failed", "error", err)
+			}
+		}
+		if *slackWebhook != "" {
+			if err := postSlackSummary(ctx, *slackWebhook, runID, results); err != nil {
+				slog.Error("Slack notification failed", "error", err)
+			}
+		}
+
+		if *metricsTextfile != "" {
+			if err := writeMetricsTextfile(*metricsTextfile, finishedAt, results, opts.wait); err != nil {
+				slog.Error("Error writing metrics", "file", *metricsTextfile, "error", err)
+			}
+		}
+		if *pushgateway != "" {
+			if err := pushMetrics(ctx, *pushgateway, finishedAt, results, opts.wait); err != nil {
+				slog.Error("Error pushing metrics", "pushgateway", *pushgateway, "error", err)
+			}
+		}
+
+		if *output == "json" {
+			if err := writeJSONReport(os.Stdout, runID, startedAt, finishedAt, results, cronJobs, apiWarnings.distinct()); err != nil {
+				log.Fatalf("Error writing report: %v", err)
+			}
+			return
+		}
+		printReport(os.Stdout, results, cronJobs, apiWarnings.distinct())
 	}
+}
 
-	return nil
-}
\ No newline at end of file
+// restartTarget triggers a graceful rollout of the given target. It returns
+// the pod template fields that admission webhooks changed on the way. With
+// dryRun, the change only passes through admission on the server and is not
+// persisted.
+func restartTarget(ctx context.Context, clientset kubernetes.Interface, dynamicClient dynamic.Interface, t target, dryRun bool) ([]string, error) {
+	restarter := restart.New(clientset, dynamicClient)
+	restarter.Now = planNow
+	var mutations []string
+	err := retryAPI(ctx, "restart "+t.String(), func(ctx context.Context) error {
+		var err error
+		mutations, err = restarter.Restart(ctx, t.ref(), dryRun)
+		return err
+	})
+	return mutations, err
+}
+
+// dryRunOption returns the DryRun field of create, update and patch options.
+func dryRunOption(dryRun bool) []string {
+	return restart.DryRunOption(dryRun)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// defaultDebugImage is the image of debug containers and exec checks.
+const defaultDebugImage = "busybox:1.36"
+
+// debugConfig describes the ephemeral debug container attached to
+// crashlooping pods before they are restarted.
+type debugConfig struct {
+	image   string
+	command string
+	timeout time.Duration
+}
+
+// enabled reports whether pods are debugged before restarting.
+func (c debugConfig) enabled() bool {
+	return c.command != ""
+}
+
+// crashLoopingContainers returns the containers of a pod that are in
+// CrashLoopBackOff.
+func crashLoopingContainers(pod *corev1.Pod) []string {
+	var containers []string
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting != nil && status.State.Waiting.Reason == "CrashLoopBackOff" {
+			containers = append(containers, status.Name)
+		}
+	}
+	return containers
+}
+
+// debugCrashLoopingPods attaches an ephemeral debug container to every
+// crashlooping container of the target and captures the output of the
+// configured command, since the restart is about to replace the pods and with
+// them the evidence. Output is written to files in dir, or to the progress
+// output if dir is empty. It returns the files written.
+func debugCrashLoopingPods(ctx context.Context, clientset *kubernetes.Clientset, t target, cfg debugConfig, dir string) ([]string, error) {
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %w", err)
+	}
+	pods, err := clientset.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	var files []string
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		for _, container := range crashLoopingContainers(pod) {
+			output, _, err := runDebugContainer(ctx, clientset, pod, container, cfg)
+			if err != nil {
+				return files, fmt.Errorf("debugging %s/%s: %w", pod.Name, container, err)
+			}
+
+			if dir == "" {
+				fmt.Fprintf(progress, "Debug output of %s/%s:\n%s\n", pod.Name, container, output)
+				continue
+			}
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return files, fmt.Errorf("failed to create diagnostics directory: %w", err)
+			}
+			path := filepath.Join(dir, fmt.Sprintf("debug_%s_%s_%s.txt", pod.Namespace, pod.Name, container))
+			if err := os.WriteFile(path, output, 0o644); err != nil {
+				return files, fmt.Errorf("failed to write debug output: %w", err)
+			}
+			fmt.Fprintf(progress, "Captured debug output of %s/%s to %s\n", pod.Name, container, path)
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// runDebugContainer adds an ephemeral container targeting the given container
+// of a pod, waits for the debug command to finish and returns its logs and
+// exit code.
+func runDebugContainer(ctx context.Context, clientset *kubernetes.Clientset, pod *corev1.Pod, container string, cfg debugConfig) ([]byte, int32, error) {
+	name := "db-pods-debug-" + rand.String(5)
+	pod = pod.DeepCopy()
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:                     name,
+			Image:                    cfg.image,
+			Command:                  []string{"sh", "-c", cfg.command},
+			ImagePullPolicy:          corev1.PullIfNotPresent,
+			TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+		},
+		TargetContainerName: container,
+	})
+	if _, err := clientset.CoreV1().Pods(pod.Namespace).UpdateEphemeralContainers(ctx, pod.Name, pod, metav1.UpdateOptions{}); err != nil {
+		return nil, 0, fmt.Errorf("failed to add ephemeral container: %w", err)
+	}
+
+	var exitCode int32
+	err := wait.PollUntilContextTimeout(ctx, 2*time.Second, cfg.timeout, true, func(ctx context.Context) (bool, error) {
+		current, err := clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, status := range current.Status.EphemeralContainerStatuses {
+			if status.Name == name && status.State.Terminated != nil {
+				exitCode = status.State.Terminated.ExitCode
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("debug container did not finish: %w", err)
+	}
+
+	output, err := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Container: name}).Do(ctx).Raw()
+	return output, exitCode, err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"redeploy-database-pods/pkg/restart"
+)
+
+// deferredConfigMapName is the well-known ConfigMap holding the queue of
+// deferred targets.
+const deferredConfigMapName = "db-pods-deferred"
+
+// deferredEntry is a target whose restart was held back for a reason that is
+// expected to clear up, such as a freeze window, a pending migration or
+// storage operations in progress. It is kept in the data of the deferred
+// ConfigMap until a run restarts it.
+type deferredEntry struct {
+	Kind       string    `json:"kind"`
+	Namespace  string    `json:"namespace"`
+	Name       string    `json:"name"`
+	Reason     string    `json:"reason"`
+	RunID      string    `json:"runId"`
+	DeferredAt time.Time `json:"deferredAt"`
+	Attempts   int       `json:"attempts"`
+}
+
+func (e deferredEntry) ref() restart.TargetRef {
+	return restart.TargetRef{Kind: e.Kind, Namespace: e.Namespace, Name: e.Name}
+}
+
+// deferredKey returns the ConfigMap data key of a target. Kinds and
+// namespaces contain no dots, so the key stays unambiguous.
+func deferredKey(ref restart.TargetRef) string {
+	return ref.Kind + "." + ref.Namespace + "." + ref.Name
+}
+
+// loadDeferred returns the deferred targets, oldest first. A missing
+// ConfigMap is an empty queue.
+func loadDeferred(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string) ([]deferredEntry, error) {
+	cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get configmap %s/%s: %w", namespace, name, err)
+	}
+
+	var entries []deferredEntry
+	for key, value := range cm.Data {
+		var e deferredEntry
+		if err := json.Unmarshal([]byte(value), &e); err != nil {
+			slog.Warn("Ignoring malformed deferred entry", "key", key, "namespace", namespace, "configmap", name, "error", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeferredAt.Before(entries[j].DeferredAt) })
+	return entries, nil
+}
+
+// updateDeferred queues the results that were deferred and removes the
+// targets that have now been restarted. Targets already queued keep the time
+// they were first deferred. Entries first deferred longer ago than the TTL of
+// the retention are pruned, whether deferred again or not: the next run that
+// defers their target queues it afresh.
+func updateDeferred(ctx context.Context, clientset *kubernetes.Clientset, namespace, name, runID string, results []result, retention historyRetention) error {
+	existing, err := loadDeferred(ctx, clientset, namespace, name)
+	if err != nil {
+		return err
+	}
+	queued := make(map[string]deferredEntry, len(existing))
+	for _, e := range existing {
+		queued[deferredKey(e.ref())] = e
+	}
+
+	changes := make(map[string]interface{})
+	for _, res := range results {
+		key := deferredKey(res.Target.ref())
+		switch {
+		case res.Deferred:
+			e := deferredEntry{
+				Kind:       res.Target.Kind,
+				Namespace:  res.Target.Namespace,
+				Name:       res.Target.Name,
+				Reason:     res.Skipped,
+				RunID:      runID,
+				DeferredAt: time.Now().UTC(),
+				Attempts:   1,
+			}
+			if prev, ok := queued[key]; ok {
+				e.DeferredAt = prev.DeferredAt
+				e.Attempts = prev.Attempts + 1
+			}
+			if retention.expired(e.DeferredAt) {
+				changes[key] = nil
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			changes[key] = string(data)
+		case res.Restarted:
+			if _, ok := queued[key]; ok {
+				changes[key] = nil
+			}
+		}
+	}
+	for key, e := range queued {
+		if _, touched := changes[key]; !touched && retention.expired(e.DeferredAt) {
+			changes[key] = nil
+		}
+	}
+	return patchDeferred(ctx, clientset, namespace, name, changes)
+}
+
+// removeDeferred drops targets from the queue.
+func removeDeferred(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string, refs []restart.TargetRef) error {
+	changes := make(map[string]interface{}, len(refs))
+	for _, ref := range refs {
+		changes[deferredKey(ref)] = nil
+	}
+	return patchDeferred(ctx, clientset, namespace, name, changes)
+}
+
+// patchDeferred applies changes to the data of the deferred ConfigMap,
+// creating it first if needed. A nil value removes the key. Keys are patched
+// individually, so runs only touch the targets they dealt with.
+func patchDeferred(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string, changes map[string]interface{}) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	_, err := clientset.CoreV1().ConfigMaps(namespace).Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+	}, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create configmap %s/%s: %w", namespace, name, err)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"data": changes})
+	if err != nil {
+		return err
+	}
+	if _, err := clientset.CoreV1().ConfigMaps(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to update configmap %s/%s: %w", namespace, name, err)
+	}
+	return nil
+}
+
+// retryDeferred restarts the queued targets with the given options, unless
+// another run holds the run lease. Each target goes through the same checks
+// as in a normal run, so it is deferred again if its reason still holds.
+// Targets that no longer exist are dropped from the queue. It returns the
+// results of the targets it tried.
+func retryDeferred(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, opts options, lockNamespace, configMap string) ([]result, error) {
+	entries, err := loadDeferred(ctx, clientset, lockNamespace, configMap)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+
+	runID := newRunID()
+	lock, err := acquireRunLock(ctx, clientset, lockNamespace, runID, onConflictExit)
+	if err != nil {
+		return nil, err
+	}
+	if lock != nil {
+		defer lock.release()
+	}
+
+	slog.Info("Retrying deferred workloads", "count", len(entries), "runId", runID)
+	r := &runner{clientset: clientset, dynamic: dynamicClient, opts: opts, runID: runID}
+	var results []result
+	var gone []restart.TargetRef
+	for _, e := range entries {
+		ref := e.ref()
+		if opts.retention.expired(e.DeferredAt) {
+			slog.Info("Dropping workload deferred for longer than --history-ttl from the deferred queue", "kind", ref.Kind, "namespace", ref.Namespace, "name", ref.Name, "deferredAt", e.DeferredAt)
+			gone = append(gone, ref)
+			continue
+		}
+		found, err := resolveTargets(ctx, clientset, dynamicClient, []target{{Kind: e.Kind, Namespace: e.Namespace, Name: e.Name}})
+		if errors.Is(err, errTargetNotFound) {
+			slog.Info("Dropping workload from the deferred queue", "kind", ref.Kind, "namespace", ref.Namespace, "name", ref.Name, "error", err)
+			gone = append(gone, ref)
+			continue
+		}
+		if err != nil {
+			slog.Error("Error looking up deferred workload", "kind", ref.Kind, "namespace", ref.Namespace, "name", ref.Name, "error", err)
+			continue
+		}
+		t := found[0]
+		t.MatchReason = "deferred: " + e.Reason
+		if err := inspectPods(ctx, clientset, &t); err != nil {
+			workloadLogger(t).Error("Error inspecting pods", "error", err)
+		}
+
+		res := r.run(ctx, t)
+		switch res.status() {
+		case statusRestarted:
+			workloadLogger(t).Info("Restarted deferred workload")
+		case statusSkipped:
+			workloadLogger(t).Info("Deferred workload again", "reason", res.Skipped)
+		default:
+			workloadLogger(t).Warn("Retry of deferred workload did not restart it", "status", res.status(), "error", res.Err)
+		}
+		results = append(results, res)
+	}
+
+	if err := removeDeferred(ctx, clientset, lockNamespace, configMap, gone); err != nil {
+		return results, err
+	}
+	return results, updateDeferred(ctx, clientset, lockNamespace, configMap, runID, results, opts.retention)
+}
+
+// deferredCommand runs "db-pods deferred list", which prints the queue of
+// deferred targets.
+func deferredCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	namespace := fs.String("lock-namespace", "default", "namespace of the deferred queue ConfigMap")
+	configMap := fs.String("deferred-configmap", deferredConfigMapName, "ConfigMap in --lock-namespace holding the deferred queue")
+	return func(args []string) {
+		setupLogging()
+		if len(args) != 1 || args[0] != "list" {
+			log.Fatalf("Usage: db-pods deferred list [--lock-namespace NAMESPACE] [--deferred-configmap NAME]")
+		}
+
+		clientset, _ := newClients()
+		entries, err := loadDeferred(context.Background(), clientset, *namespace, *configMap)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if len(entries) == 0 {
+			fmt.Println("No deferred workloads")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "WORKLOAD\tDEFERRED\tATTEMPTS\tRUN\tREASON")
+		now := time.Now()
+		for _, e := range entries {
+			reason := strings.ReplaceAll(e.Reason, "\t", " ")
+			fmt.Fprintf(w, "%s\t%s ago\t%d\t%s\t%s\n", e.ref(), formatAge(now.Sub(e.DeferredAt)), e.Attempts, e.RunID, reason)
+		}
+		w.Flush()
+	}
+}
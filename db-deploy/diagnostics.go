@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// diagnosticEvents is the number of most recent events kept per target.
+	diagnosticEvents = 50
+
+	// diagnosticLogLines is the number of log lines kept per container.
+	diagnosticLogLines = int64(100)
+)
+
+// collectDiagnostics writes a bundle describing the current state of a target
+// to a file in dir and returns its path. The bundle holds what triage usually
+// starts with: the state and resources of every pod, recent events, the last
+// log lines of each container and the conditions of the nodes involved.
+// Sections that cannot be collected record the error instead, so a partial
+// bundle is still written.
+func collectDiagnostics(ctx context.Context, clientset *kubernetes.Clientset, t target, dir string) (string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Diagnostics for %s\nCollected at %s\n", t, time.Now().UTC().Format(time.RFC3339))
+
+	var pods []corev1.Pod
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err == nil {
+		var list *corev1.PodList
+		list, err = clientset.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if list != nil {
+			pods = list.Items
+		}
+	}
+	section(&buf, "Pods")
+	if err != nil {
+		fmt.Fprintf(&buf, "error listing pods: %v\n", err)
+	}
+	for i := range pods {
+		describePod(&buf, &pods[i])
+	}
+
+	section(&buf, "Events")
+	describeEvents(ctx, &buf, clientset, t, pods)
+
+	section(&buf, "Logs")
+	for _, pod := range pods {
+		for _, status := range pod.Status.ContainerStatuses {
+			writeLogs(ctx, &buf, clientset, pod, status.Name, false)
+			if status.RestartCount > 0 {
+				writeLogs(ctx, &buf, clientset, pod, status.Name, true)
+			}
+		}
+	}
+
+	section(&buf, "Nodes")
+	nodes := make(map[string]bool)
+	for _, pod := range pods {
+		if name := pod.Spec.NodeName; name != "" && !nodes[name] {
+			nodes[name] = true
+			describeNode(ctx, &buf, clientset, name)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create diagnostics directory: %w", err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s_%s_%s.txt", t.Kind, t.Namespace, t.Name))
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write diagnostics: %w", err)
+	}
+	return path, nil
+}
+
+func section(buf *bytes.Buffer, title string) {
+	fmt.Fprintf(buf, "\n=== %s ===\n", title)
+}
+
+// describePod writes the state of a pod and its containers in the spirit of
+// kubectl describe.
+func describePod(buf *bytes.Buffer, pod *corev1.Pod) {
+	fmt.Fprintf(buf, "\nPod %s\n  Node: %s\n  Phase: %s\n", pod.Name, pod.Spec.NodeName, pod.Status.Phase)
+	if pod.Status.Reason != "" {
+		fmt.Fprintf(buf, "  Reason: %s: %s\n", pod.Status.Reason, pod.Status.Message)
+	}
+	if pod.DeletionTimestamp != nil {
+		fmt.Fprintf(buf, "  Terminating since: %s\n", pod.DeletionTimestamp.UTC().Format(time.RFC3339))
+	}
+	for _, cond := range pod.Status.Conditions {
+		fmt.Fprintf(buf, "  Condition %s=%s %s %s\n", cond.Type, cond.Status, cond.Reason, cond.Message)
+	}
+
+	statuses := make(map[string]corev1.ContainerStatus)
+	for _, status := range pod.Status.ContainerStatuses {
+		statuses[status.Name] = status
+	}
+	for _, c := range pod.Spec.Containers {
+		fmt.Fprintf(buf, "  Container %s\n    Image: %s\n", c.Name, c.Image)
+		fmt.Fprintf(buf, "    Requests: %s\n    Limits: %s\n", resourceList(c.Resources.Requests), resourceList(c.Resources.Limits))
+		status, ok := statuses[c.Name]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(buf, "    Ready: %t, Restarts: %d\n", status.Ready, status.RestartCount)
+		fmt.Fprintf(buf, "    State: %s\n", containerState(status.State))
+		if status.LastTerminationState.Terminated != nil {
+			fmt.Fprintf(buf, "    Last State: %s\n", containerState(status.LastTerminationState))
+		}
+	}
+}
+
+func resourceList(resources corev1.ResourceList) string {
+	if len(resources) == 0 {
+		return "<none>"
+	}
+	var parts []string
+	for name, quantity := range resources {
+		parts = append(parts, fmt.Sprintf("%s=%s", name, quantity.String()))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+func containerState(state corev1.ContainerState) string {
+	switch {
+	case state.Waiting != nil:
+		return fmt.Sprintf("Waiting (%s) %s", state.Waiting.Reason, state.Waiting.Message)
+	case state.Terminated != nil:
+		return fmt.Sprintf("Terminated (%s, exit code %d) %s", state.Terminated.Reason, state.Terminated.ExitCode, state.Terminated.Message)
+	case state.Running != nil:
+		return fmt.Sprintf("Running since %s", state.Running.StartedAt.UTC().Format(time.RFC3339))
+	}
+	return "Unknown"
+}
+
+// describeEvents writes the most recent events about the target and its pods.
+func describeEvents(ctx context.Context, buf *bytes.Buffer, clientset *kubernetes.Clientset, t target, pods []corev1.Pod) {
+	events, err := clientset.CoreV1().Events(t.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		fmt.Fprintf(buf, "error listing events: %v\n", err)
+		return
+	}
+
+	involved := map[string]bool{t.Name: true}
+	for _, pod := range pods {
+		involved[pod.Name] = true
+	}
+
+	var relevant []corev1.Event
+	for _, event := range events.Items {
+		if involved[event.InvolvedObject.Name] {
+			relevant = append(relevant, event)
+		}
+	}
+	sort.Slice(relevant, func(i, j int) bool {
+		return eventTime(relevant[i]).Before(eventTime(relevant[j]))
+	})
+	if len(relevant) > diagnosticEvents {
+		relevant = relevant[len(relevant)-diagnosticEvents:]
+	}
+
+	for _, event := range relevant {
+		fmt.Fprintf(buf, "%s %s %s/%s %s: %s\n", eventTime(event).UTC().Format(time.RFC3339), event.Type, event.InvolvedObject.Kind, event.InvolvedObject.Name, event.Reason, event.Message)
+	}
+}
+
+// eventTime returns the most meaningful timestamp of an event.
+func eventTime(event corev1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
+
+// writeLogs writes the last lines logged by a container, or by its previous
+// instance.
+func writeLogs(ctx context.Context, buf *bytes.Buffer, clientset *kubernetes.Clientset, pod corev1.Pod, container string, previous bool) {
+	label := ""
+	if previous {
+		label = " (previous)"
+	}
+	fmt.Fprintf(buf, "\n--- %s/%s%s ---\n", pod.Name, container, label)
+
+	tail := diagnosticLogLines
+	data, err := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: container,
+		Previous:  previous,
+		TailLines: &tail,
+	}).Do(ctx).Raw()
+	if err != nil {
+		fmt.Fprintf(buf, "error fetching logs: %v\n", err)
+		return
+	}
+	buf.Write(data)
+}
+
+// describeNode writes the conditions of a node.
+func describeNode(ctx context.Context, buf *bytes.Buffer, clientset *kubernetes.Clientset, name string) {
+	node, err := clientset.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		fmt.Fprintf(buf, "\nNode %s: error: %v\n", name, err)
+		return
+	}
+	fmt.Fprintf(buf, "\nNode %s (unschedulable: %t)\n", name, node.Spec.Unschedulable)
+	for _, cond := range node.Status.Conditions {
+		fmt.Fprintf(buf, "  Condition %s=%s %s %s\n", cond.Type, cond.Status, cond.Reason, cond.Message)
+	}
+}
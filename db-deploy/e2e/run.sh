@@ -0,0 +1,146 @@
+#!/usr/bin/env bash
+# Black-box tests of db-pods against a throwaway kind cluster.
+#
+#   make e2e                                   latest kind node image
+#   make e2e KIND_NODE_IMAGE=kindest/node:v1.27.13
+#   E2E_KEEP=1 make e2e                        keep the cluster afterwards
+#
+# Requires kind, kubectl, jq and go on the PATH.
+set -euo pipefail
+
+cd "$(dirname "$0")/.."
+
+CLUSTER=${E2E_CLUSTER:-db-pods-e2e}
+KIND_NODE_IMAGE=${KIND_NODE_IMAGE:-}
+WORK=$(mktemp -d)
+export KUBECONFIG=$WORK/kubeconfig
+
+for tool in kind kubectl jq go; do
+	command -v "$tool" >/dev/null || { echo "e2e: $tool is required" >&2; exit 1; }
+done
+
+cleanup() {
+	if [ -z "${E2E_KEEP:-}" ]; then
+		kind delete cluster --name "$CLUSTER" >/dev/null 2>&1 || true
+	else
+		echo "Keeping cluster $CLUSTER, kubeconfig at $KUBECONFIG"
+	fi
+}
+trap cleanup EXIT
+
+failures=0
+pass() { echo "ok   $1"; }
+fail() { echo "FAIL $1" >&2; failures=$((failures + 1)); }
+
+# check NAME COMMAND... passes if the command succeeds
+check() {
+	local name=$1
+	shift
+	if "$@"; then pass "$name"; else fail "$name"; fi
+}
+
+# db_pods COMMAND [FLAGS...] runs a db-pods command against the cluster.
+db_pods() {
+	local command=$1
+	shift
+	"$WORK/db-pods" "$command" --kubeconfig "$KUBECONFIG" "$@"
+}
+
+restarted_at() {
+	kubectl -n "$1" get "$2" "$3" -o jsonpath='{.spec.template.metadata.annotations.kubectl\.kubernetes\.io/restartedAt}'
+}
+
+echo "Building db-pods"
+go build -o "$WORK/db-pods" .
+
+echo "Creating kind cluster $CLUSTER ${KIND_NODE_IMAGE:+($KIND_NODE_IMAGE)}"
+kind create cluster --name "$CLUSTER" --kubeconfig "$KUBECONFIG" --wait 2m ${KIND_NODE_IMAGE:+--image "$KIND_NODE_IMAGE"}
+
+echo "Seeding workloads"
+kubectl apply -f e2e/workloads.yaml >/dev/null
+for w in deployment/orders-database statefulset/users-database deployment/frozen-database deployment/exempt-database deployment/web; do
+	kubectl -n e2e-db rollout status "$w" --timeout 3m >/dev/null
+done
+kubectl -n database-operator-system rollout status deployment/database-operator --timeout 3m >/dev/null
+
+echo "Compatibility"
+check "kind cluster is supported" bash -c '"$@" >/dev/null' _ "$WORK/db-pods" compatibility --kubeconfig "$KUBECONFIG"
+
+echo "Dry run"
+out=$(db_pods restart --dry-run --namespace e2e-db --namespace database-operator-system)
+check "dry run lists the deployment" grep -q "orders-database" <<<"$out"
+check "dry run lists the statefulset" grep -q "users-database" <<<"$out"
+check "dry run marks the frozen workload" grep -q "frozen, would be skipped" <<<"$out"
+check "dry run leaves other workloads out" bash -c '! grep -qw web <<<"$1"' _ "$out"
+check "dry run changes nothing" test -z "$(restarted_at e2e-db deployment orders-database)"
+
+out=$(db_pods list --namespace e2e-db)
+check "list shows the matching workloads" bash -c 'grep -q orders-database <<<"$1" && grep -q users-database <<<"$1" && ! grep -qw web <<<"$1"' _ "$out"
+
+out=$(db_pods restart --dry-run --kinds statefulset)
+check "--kinds selects only statefulsets" bash -c 'grep -q users-database <<<"$1" && ! grep -q orders-database <<<"$1"' _ "$out"
+
+out=$(db_pods restart --dry-run --require-annotation)
+check "--require-annotation selects only opted-in workloads" bash -c 'grep -q users-database <<<"$1" && ! grep -q orders-database <<<"$1"' _ "$out"
+
+out=$(db_pods restart --dry-run)
+check "system namespaces are left out" bash -c '! grep -q database-operator <<<"$1"' _ "$out"
+
+echo "Restart"
+check "unscoped run is refused" bash -c '! "$@" --wait=false 2>/dev/null' _ "$WORK/db-pods" restart --kubeconfig "$KUBECONFIG"
+report=$(db_pods restart --all --wait --rollout-timeout 3m --output json)
+check "report follows the schema version" test "$(jq -r .schemaVersion <<<"$report")" = "db-pods.report/v1"
+check "two workloads restarted" test "$(jq .summary.restarted <<<"$report")" = 2
+check "frozen workload skipped" test "$(jq -r '.results[] | select(.name == "frozen-database") | .status' <<<"$report")" = skipped
+check "frozen workload deferred" test "$(jq -r '.results[] | select(.name == "frozen-database") | .deferred' <<<"$report")" = true
+check "deployment annotated" test -n "$(restarted_at e2e-db deployment orders-database)"
+check "statefulset annotated" test -n "$(restarted_at e2e-db statefulset users-database)"
+check "unrelated workload untouched" test -z "$(restarted_at e2e-db deployment web)"
+check "opted-out workload untouched" test -z "$(restarted_at e2e-db deployment exempt-database)"
+check "status shows the restarted workloads rolled out" bash -c '[ "$(grep -c "rolled out" <<<"$1")" -ge 2 ]' _ "$(db_pods status --namespace e2e-db)"
+check "operator untouched" test -z "$(restarted_at database-operator-system deployment database-operator)"
+check "deferred queue lists the frozen workload" bash -c 'db_out=$("$@"); grep -q frozen-database <<<"$db_out"' _ "$WORK/db-pods" deferred list --kubeconfig "$KUBECONFIG"
+
+echo "Plan"
+first_restart=$(restarted_at e2e-db deployment orders-database)
+db_pods plan --namespace e2e-db --write-plan "$WORK/plan.txt" >/dev/null
+check "plan file lists both databases" test "$(grep -c database "$WORK/plan.txt")" -ge 2
+report=$(db_pods restart --plan "$WORK/plan.txt" --wait --rollout-timeout 3m --output json)
+check "plan run restarts the planned workloads" test "$(jq .summary.restarted <<<"$report")" = 2
+report=$(db_pods restart --plan "$WORK/plan.txt" --wait --rollout-timeout 3m --output json)
+check "re-running the plan restarts nothing" test "$(jq .summary.restarted <<<"$report")" = 0
+
+echo "Undo"
+check "undo is refused without a scope" bash -c '! "$@" --last 2>/dev/null' _ "$WORK/db-pods" undo --kubeconfig "$KUBECONFIG"
+check "undo rolls back the last run" bash -c '"$@" >/dev/null' _ "$WORK/db-pods" undo --kubeconfig "$KUBECONFIG" --last --namespace e2e-db --rollout-timeout 3m
+check "deployment is back at its earlier restart" test "$(restarted_at e2e-db deployment orders-database)" = "$first_restart"
+check "undoing again changes nothing" bash -c '"$@" | grep -q "already undone"' _ "$WORK/db-pods" undo --kubeconfig "$KUBECONFIG" --last --namespace e2e-db
+
+echo "Operator"
+db_pods operator --print-crd | kubectl apply -f - >/dev/null
+kubectl wait --for condition=established crd/databaserestartpolicies.db-restart.io --timeout 1m >/dev/null
+kubectl -n e2e-db apply -f - >/dev/null <<'EOF'
+apiVersion: db-restart.io/v1alpha1
+kind: DatabaseRestartPolicy
+metadata:
+  name: nightly
+spec:
+  schedule: "0 3 * * *"
+  safety:
+    rolloutTimeout: 3m
+    minInterval: 20h
+EOF
+"$WORK/db-pods" operator --kubeconfig "$KUBECONFIG" --metrics-listen 0 --health-listen 0 >"$WORK/operator.log" 2>&1 &
+operator=$!
+check "policy is scheduled by the operator" kubectl -n e2e-db wait --for condition=Ready databaserestartpolicy/nightly --timeout 1m
+check "policy reports its next run" test -n "$(kubectl -n e2e-db get databaserestartpolicy nightly -o jsonpath='{.status.nextScheduleTime}')"
+kill "$operator"
+
+echo "Cleanup"
+check "no restart markers are left behind" bash -c '! "$@" --dry-run --older-than 0s | grep -q restart-in-progress' _ "$WORK/db-pods" cleanup --kubeconfig "$KUBECONFIG"
+
+if [ "$failures" -gt 0 ]; then
+	echo "$failures e2e check(s) failed" >&2
+	exit 1
+fi
+echo "All e2e checks passed"
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// envPrefix starts the names of the environment variables that set flags:
+// DB_DEPLOY_ROLLOUT_TIMEOUT sets --rollout-timeout, for instance.
+const envPrefix = "DB_DEPLOY_"
+
+// flagEnvName returns the environment variable that sets a flag.
+func flagEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvironment sets the flags of fs that were not given on the command
+// line from their DB_DEPLOY_ environment variable, so that Jobs can be
+// configured through env instead of templated arguments. Repeatable flags
+// take one value per line. Flags set this way count as given, so that they
+// take precedence over the configuration file.
+func applyEnvironment(fs *pflag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed {
+			return
+		}
+		name := flagEnvName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		values := []string{value}
+		if _, repeatable := f.Value.(*stringList); repeatable {
+			values = strings.FieldsFunc(value, func(r rune) bool { return r == '\n' })
+		}
+		for _, v := range values {
+			if setErr := fs.Set(f.Name, strings.TrimSpace(v)); setErr != nil {
+				err = fmt.Errorf("invalid %s: %w", name, setErr)
+				return
+			}
+		}
+	})
+	return err
+}
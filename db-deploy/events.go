@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Types of the events published with --events-broker.
+const (
+	eventRunStarted       = "run.started"
+	eventWorkloadFinished = "workload.finished"
+	eventRunFinished      = "run.finished"
+)
+
+// runEvent is published to the event bus. Its fields are part of the
+// contract with downstream consumers and must not change meaning.
+type runEvent struct {
+	Type  string    `json:"type"`
+	RunID string    `json:"runId"`
+	Time  time.Time `json:"time"`
+
+	// Set on workload.finished
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Attempts  int    `json:"attempts,omitempty"`
+
+	// Set on workload.finished and run.finished
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+
+	// Set on run.started and run.finished
+	Workloads int            `json:"workloads,omitempty"`
+	Summary   map[string]int `json:"summary,omitempty"`
+}
+
+// eventPublisher sends events to a message broker. The event is passed
+// alongside its encoding for publishers that carry metadata outside of it.
+type eventPublisher interface {
+	publish(ctx context.Context, event runEvent, data []byte) error
+	close() error
+}
+
+// eventBus publishes the events of a run. Failing to publish never fails the
+// run; the error is logged instead.
+type eventBus struct {
+	publisher eventPublisher
+	runID     string
+
+	// started is when the run.started event was published.
+	started time.Time
+
+	// mu serializes publishing, since workers restarting targets
+	// concurrently share the bus.
+	mu sync.Mutex
+}
+
+// newEventBus connects to the broker named by a kafka://HOST:PORT[,HOST:PORT]/TOPIC
+// or nats://HOST:PORT/SUBJECT URL, or prepares to post CloudEvents to an
+// http:// or https:// sink.
+func newEventBus(broker, runID string) (*eventBus, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid events broker %q: %w", broker, err)
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid events sink %q, expected a URL with a host", broker)
+		}
+		return &eventBus{publisher: newCloudEventsPublisher(broker, runID), runID: runID}, nil
+	}
+	destination := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || destination == "" {
+		return nil, fmt.Errorf("invalid events broker %q, expected SCHEME://HOST:PORT/DESTINATION", broker)
+	}
+
+	var publisher eventPublisher
+	switch u.Scheme {
+	case "kafka":
+		publisher = &kafkaPublisher{writer: &kafka.Writer{
+			Addr:         kafka.TCP(strings.Split(u.Host, ",")...),
+			Topic:        destination,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 10 * time.Millisecond,
+			RequiredAcks: kafka.RequireAll,
+		}, key: []byte(runID)}
+	case "nats":
+		publisher, err = dialNATS(u.Host, destination)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported events broker scheme %q, expected kafka, nats, http or https", u.Scheme)
+	}
+	return &eventBus{publisher: publisher, runID: runID}, nil
+}
+
+// emit publishes an event, stamping it with the run ID and the current time.
+func (b *eventBus) emit(ctx context.Context, event runEvent) {
+	if b == nil {
+		return
+	}
+	event.RunID = b.runID
+	event.Time = time.Now().UTC()
+	data, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding event", "type", event.Type, "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.publisher.publish(ctx, event, data); err != nil {
+		slog.Error("Error publishing event", "type", event.Type, "error", err)
+	}
+}
+
+// workloadFinished publishes the outcome of a target.
+func (b *eventBus) workloadFinished(ctx context.Context, res result) {
+	event := runEvent{
+		Type:            eventWorkloadFinished,
+		Kind:            res.Target.Kind,
+		Namespace:       res.Target.Namespace,
+		Name:            res.Target.Name,
+		Status:          res.status(),
+		DurationSeconds: res.Duration.Seconds(),
+		Attempts:        res.attempts(),
+	}
+	switch {
+	case res.Err != nil:
+		event.Error = res.Err.Error()
+	case res.RolloutErr != nil:
+		event.Error = res.RolloutErr.Error()
+	}
+	b.emit(ctx, event)
+}
+
+// runStarted publishes the number of targets of the run.
+func (b *eventBus) runStarted(ctx context.Context, workloads int) {
+	if b == nil {
+		return
+	}
+	b.started = time.Now()
+	b.emit(ctx, runEvent{Type: eventRunStarted, Workloads: workloads})
+}
+
+// runFinished publishes the number of targets by status and how long the
+// run took.
+func (b *eventBus) runFinished(ctx context.Context, results []result) {
+	if b == nil {
+		return
+	}
+	summary := make(map[string]int)
+	for _, res := range results {
+		summary[res.status()]++
+	}
+	b.emit(ctx, runEvent{Type: eventRunFinished, Workloads: len(results), Summary: summary, DurationSeconds: time.Since(b.started).Seconds()})
+}
+
+// close flushes and closes the connection to the broker.
+func (b *eventBus) close() {
+	if b == nil {
+		return
+	}
+	if err := b.publisher.close(); err != nil {
+		slog.Error("Error closing events broker connection", "error", err)
+	}
+}
+
+// kafkaPublisher writes events to a Kafka topic. Every event of a run has the
+// run ID as key, so that they land on the same partition in order.
+type kafkaPublisher struct {
+	writer *kafka.Writer
+	key    []byte
+}
+
+func (p *kafkaPublisher) publish(ctx context.Context, _ runEvent, data []byte) error {
+	return p.writer.WriteMessages(ctx, kafka.Message{Key: p.key, Value: data})
+}
+
+func (p *kafkaPublisher) close() error {
+	return p.writer.Close()
+}
+
+// natsPublisher publishes events on a NATS subject. The NATS client protocol
+// is plain text, and publishing needs no more than CONNECT and PUB, so no
+// client library is used.
+type natsPublisher struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	subject string
+}
+
+// dialNATS connects to a NATS server and completes the handshake.
+func dialNATS(address, subject string) (*natsPublisher, error) {
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	p := &natsPublisher{conn: conn, reader: bufio.NewReader(conn), subject: subject}
+
+	// The server greets with INFO before accepting CONNECT
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if line, err := p.reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected NATS greeting %q: %v", strings.TrimSpace(line), err)
+	}
+	if _, err := fmt.Fprint(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"db-pods\"}\r\n"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	if err := p.ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// ping waits for the server to acknowledge everything sent so far, which
+// also surfaces errors such as a permission violation on the subject.
+func (p *natsPublisher) ping() error {
+	if _, err := fmt.Fprint(p.conn, "PING\r\n"); err != nil {
+		return err
+	}
+	for {
+		line, err := p.reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("NATS server did not answer: %w", err)
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// INFO updates and OK acknowledgements are not relevant here
+	}
+}
+
+func (p *natsPublisher) publish(ctx context.Context, _ runEvent, data []byte) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		p.conn.SetDeadline(deadline)
+	}
+	if _, err := fmt.Fprintf(p.conn, "PUB %s %d\r\n%s\r\n", p.subject, len(data), data); err != nil {
+		return err
+	}
+	return p.ping()
+}
+
+func (p *natsPublisher) close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+// autoscalerScaleDownTaint is the taint the cluster autoscaler puts on nodes
+// it is about to remove.
+const autoscalerScaleDownTaint = "ToBeDeletedByClusterAutoscaler"
+
+// watchAutoscalerEvictions follows the pods of a target created since the
+// given time and calls onEviction for each one that is evicted because the
+// cluster autoscaler scales its node down. Such a pod is disrupted twice, by
+// the restart and again by the autoscaler, and its replacement needs the full
+// rollout time again. It returns nil once ctx is done.
+func watchAutoscalerEvictions(ctx context.Context, clientset *kubernetes.Clientset, t target, since time.Time, onEviction func(pod, node string)) error {
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	_, err = watchtools.UntilWithSync(ctx, newPodListWatch(ctx, clientset, t.Namespace, selector), &corev1.Pod{}, nil, func(event watch.Event) (bool, error) {
+		pod, ok := event.Object.(*corev1.Pod)
+		if !ok || seen[pod.Name] || pod.Spec.NodeName == "" || pod.CreationTimestamp.Time.Before(since) {
+			return false, nil
+		}
+		if event.Type != watch.Deleted && pod.DeletionTimestamp == nil && !disruptionTarget(pod) {
+			return false, nil
+		}
+		seen[pod.Name] = true
+
+		node, err := clientset.CoreV1().Nodes().Get(ctx, pod.Spec.NodeName, metav1.GetOptions{})
+		if err != nil {
+			// The autoscaler may already have removed the node
+			return false, nil
+		}
+		for _, taint := range node.Spec.Taints {
+			if taint.Key == autoscalerScaleDownTaint {
+				onEviction(pod.Name, node.Name)
+				break
+			}
+		}
+		return false, nil
+	})
+	if wait.Interrupted(err) {
+		return nil
+	}
+	return err
+}
+
+// disruptionTarget reports whether a pod has been marked for deletion by a
+// disruption such as an eviction.
+func disruptionTarget(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.DisruptionTarget && cond.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+// maxFailureEvents caps the number of events quoted in a rollout failure.
+const maxFailureEvents = 5
+
+// explainRolloutFailure adds what the cluster knows about a failed rollout to
+// err: the workload's unhealthy status conditions and the warning events
+// recorded for it and its pods since the restart. A bare timeout says nothing
+// about why the rollout is stuck; these usually do.
+func explainRolloutFailure(ctx context.Context, clientset *kubernetes.Clientset, t target, obj runtime.Object, since time.Time, err error) error {
+	var details []string
+	if conditions := workloadConditions(obj); len(conditions) > 0 {
+		details = append(details, "conditions: "+strings.Join(conditions, "; "))
+	}
+	if events := rolloutWarnings(ctx, clientset, t, since); len(events) > 0 {
+		details = append(details, "events: "+strings.Join(events, "; "))
+	}
+	if len(details) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w (%s)", err, strings.Join(details, "; "))
+}
+
+// workloadConditions returns the status conditions of a workload that point
+// at a problem, formatted as Type=Status Reason: Message.
+func workloadConditions(obj runtime.Object) []string {
+	var conditions []string
+	add := func(kind string, status, reason, message string) {
+		c := kind + "=" + status
+		if reason != "" {
+			c += " " + reason
+		}
+		if message != "" {
+			c += ": " + message
+		}
+		conditions = append(conditions, c)
+	}
+
+	switch w := obj.(type) {
+	case *appsv1.Deployment:
+		for _, cond := range w.Status.Conditions {
+			if unhealthyCondition(string(cond.Type), string(cond.Status), cond.Reason) {
+				add(string(cond.Type), string(cond.Status), cond.Reason, cond.Message)
+			}
+		}
+	case *appsv1.StatefulSet:
+		for _, cond := range w.Status.Conditions {
+			if unhealthyCondition(string(cond.Type), string(cond.Status), cond.Reason) {
+				add(string(cond.Type), string(cond.Status), cond.Reason, cond.Message)
+			}
+		}
+	case *appsv1.DaemonSet:
+		for _, cond := range w.Status.Conditions {
+			if unhealthyCondition(string(cond.Type), string(cond.Status), cond.Reason) {
+				add(string(cond.Type), string(cond.Status), cond.Reason, cond.Message)
+			}
+		}
+	case *unstructured.Unstructured:
+		items, _, _ := unstructured.NestedSlice(w.Object, "status", "conditions")
+		for _, item := range items {
+			cond, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			kind, status := fmt.Sprint(cond["type"]), fmt.Sprint(cond["status"])
+			reason, _ := cond["reason"].(string)
+			if unhealthyCondition(kind, status, reason) {
+				message, _ := cond["message"].(string)
+				add(kind, status, reason, message)
+			}
+		}
+	}
+	return conditions
+}
+
+// unhealthyCondition reports whether a workload condition indicates a
+// problem. Available, Progressing and Healthy are healthy when true, while
+// ReplicaFailure and the like are healthy when absent or false. Running out
+// of progress deadline always counts as a problem.
+func unhealthyCondition(kind, status, reason string) bool {
+	if reason == "ProgressDeadlineExceeded" {
+		return true
+	}
+	switch kind {
+	case "Paused", "Completed":
+		return false
+	case "Available", "Progressing", "Healthy":
+		return status == string(corev1.ConditionFalse)
+	}
+	return status == string(corev1.ConditionTrue)
+}
+
+// rolloutWarnings returns the distinct warning events recorded since the
+// restart for the workload and the objects it owns. Owned ReplicaSets, pods
+// and revisions are named after the workload, which is how they are
+// recognised without following owner references.
+func rolloutWarnings(ctx context.Context, clientset *kubernetes.Clientset, t target, since time.Time) []string {
+	events, err := clientset.CoreV1().Events(t.Namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("type", corev1.EventTypeWarning).String(),
+	})
+	if err != nil {
+		return nil
+	}
+
+	var relevant []corev1.Event
+	for _, event := range events.Items {
+		name := event.InvolvedObject.Name
+		if name != t.Name && !strings.HasPrefix(name, t.Name+"-") {
+			continue
+		}
+		if eventTime(event).Before(since) {
+			continue
+		}
+		relevant = append(relevant, event)
+	}
+	sort.Slice(relevant, func(i, j int) bool {
+		return eventTime(relevant[i]).After(eventTime(relevant[j]))
+	})
+
+	var warnings []string
+	seen := make(map[string]bool)
+	for _, event := range relevant {
+		key := event.Reason + "\x00" + event.Message
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		warnings = append(warnings, fmt.Sprintf("%s %s/%s: %s", event.Reason, strings.ToLower(event.InvolvedObject.Kind), event.InvolvedObject.Name, event.Message))
+		if len(warnings) == maxFailureEvents {
+			break
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,9 @@
+//go:build !goexperiment.boringcrypto
+
+package main
+
+// fipsEnabled reports whether the binary uses a FIPS 140 validated
+// cryptographic module. Only builds made with GOEXPERIMENT=boringcrypto do.
+func fipsEnabled() bool {
+	return false
+}
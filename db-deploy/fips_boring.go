@@ -0,0 +1,17 @@
+//go:build goexperiment.boringcrypto
+
+package main
+
+import (
+	"crypto/boring"
+
+	// Restrict TLS to FIPS-approved versions, cipher suites and curves, so
+	// the FIPS build never negotiates anything else with the API server.
+	_ "crypto/tls/fipsonly"
+)
+
+// fipsEnabled reports whether the binary uses a FIPS 140 validated
+// cryptographic module.
+func fipsEnabled() bool {
+	return boring.Enabled()
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"redeploy-database-pods/pkg/restart"
+)
+
+// fleetMonitor keeps an informer-backed view of every target so the number of
+// database replicas that are currently not available can be computed at any
+// time without querying the API server.
+type fleetMonitor struct {
+	targets   []target
+	factories map[string]informers.SharedInformerFactory
+	rollouts  map[string]dynamicinformer.DynamicSharedInformerFactory
+
+	// changed is closed and replaced whenever a watched workload changes or
+	// a slot is released, which wakes every waiter at once.
+	changed   chan struct{}
+	changedMu sync.Mutex
+
+	mu        sync.Mutex
+	restarted map[string]bool
+
+	// claimed holds the targets that were granted a namespace slot but have
+	// not been restarted yet. slotMu makes checking for a free slot and
+	// claiming it atomic when targets are restarted concurrently.
+	claimed map[string]bool
+	slotMu  sync.Mutex
+}
+
+// newFleetMonitor starts informers for the namespaces and kinds of the given
+// targets and waits for their caches to fill.
+func newFleetMonitor(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, targets []target) (*fleetMonitor, error) {
+	m := &fleetMonitor{
+		targets:   targets,
+		factories: make(map[string]informers.SharedInformerFactory),
+		rollouts:  make(map[string]dynamicinformer.DynamicSharedInformerFactory),
+		changed:   make(chan struct{}),
+		restarted: make(map[string]bool),
+		claimed:   make(map[string]bool),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { m.notify() },
+		UpdateFunc: func(interface{}, interface{}) { m.notify() },
+		DeleteFunc: func(interface{}) { m.notify() },
+	}
+
+	watched := make(map[string]bool)
+	for _, t := range targets {
+		key := t.Namespace + "/" + t.Kind
+		if watched[key] {
+			continue
+		}
+		watched[key] = true
+
+		if t.Kind == "rollout" {
+			factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, 0, t.Namespace, nil)
+			m.rollouts[t.Namespace] = factory
+			if _, err := factory.ForResource(rolloutResource).Informer().AddEventHandler(handler); err != nil {
+				return nil, fmt.Errorf("failed to watch rollouts in %s: %w", t.Namespace, err)
+			}
+			continue
+		}
+
+		factory, ok := m.factories[t.Namespace]
+		if !ok {
+			factory = informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(t.Namespace))
+			m.factories[t.Namespace] = factory
+		}
+
+		var informer cache.SharedIndexInformer
+		switch t.Kind {
+		case "deployment":
+			informer = factory.Apps().V1().Deployments().Informer()
+		case "statefulset":
+			informer = factory.Apps().V1().StatefulSets().Informer()
+		case "daemonset":
+			informer = factory.Apps().V1().DaemonSets().Informer()
+		default:
+			return nil, fmt.Errorf("unsupported workload kind %q", t.Kind)
+		}
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			return nil, fmt.Errorf("failed to watch %ss in %s: %w", t.Kind, t.Namespace, err)
+		}
+	}
+
+	for namespace, factory := range m.factories {
+		factory.Start(ctx.Done())
+		for informerType, synced := range factory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				return nil, fmt.Errorf("failed to sync %v cache in namespace %s", informerType, namespace)
+			}
+		}
+	}
+	for namespace, factory := range m.rollouts {
+		factory.Start(ctx.Done())
+		for resource, synced := range factory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				return nil, fmt.Errorf("failed to sync %s cache in namespace %s", resource.Resource, namespace)
+			}
+		}
+	}
+	return m, nil
+}
+
+// notify wakes every waiter to re-evaluate its condition, without blocking
+// the informer.
+func (m *fleetMonitor) notify() {
+	m.changedMu.Lock()
+	defer m.changedMu.Unlock()
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// changes returns a channel that is closed on the next notify.
+func (m *fleetMonitor) changes() <-chan struct{} {
+	m.changedMu.Lock()
+	defer m.changedMu.Unlock()
+	return m.changed
+}
+
+// stop shuts down all informers.
+func (m *fleetMonitor) stop() {
+	for _, factory := range m.factories {
+		factory.Shutdown()
+	}
+	for _, factory := range m.rollouts {
+		factory.Shutdown()
+	}
+}
+
+// get returns the cached object of a target, or nil if it is not known.
+func (m *fleetMonitor) get(t target) runtime.Object {
+	var (
+		obj runtime.Object
+		err error
+	)
+	switch t.Kind {
+	case "deployment":
+		obj, err = m.factories[t.Namespace].Apps().V1().Deployments().Lister().Deployments(t.Namespace).Get(t.Name)
+	case "statefulset":
+		obj, err = m.factories[t.Namespace].Apps().V1().StatefulSets().Lister().StatefulSets(t.Namespace).Get(t.Name)
+	case "daemonset":
+		obj, err = m.factories[t.Namespace].Apps().V1().DaemonSets().Lister().DaemonSets(t.Namespace).Get(t.Name)
+	case "rollout":
+		obj, err = m.rollouts[t.Namespace].ForResource(rolloutResource).Lister().ByNamespace(t.Namespace).Get(t.Name)
+	}
+	if err != nil {
+		return nil
+	}
+	return obj
+}
+
+// unavailable returns the number of replicas across all targets that are
+// currently not available.
+func (m *fleetMonitor) unavailable() int {
+	total := 0
+	for _, t := range m.targets {
+		want, available := workloadAvailability(m.get(t))
+		if want > available {
+			total += int(want - available)
+		}
+	}
+	return total
+}
+
+// workloadAvailability returns the desired and available replica counts of
+// a workload, or zeros if obj is nil.
+func workloadAvailability(obj runtime.Object) (want, available int32) {
+	switch w := obj.(type) {
+	case *appsv1.Deployment:
+		want, available = 1, w.Status.AvailableReplicas
+		if w.Spec.Replicas != nil {
+			want = *w.Spec.Replicas
+		}
+	case *appsv1.StatefulSet:
+		want, available = 1, w.Status.AvailableReplicas
+		if w.Spec.Replicas != nil {
+			want = *w.Spec.Replicas
+		}
+	case *appsv1.DaemonSet:
+		want, available = w.Status.DesiredNumberScheduled, w.Status.NumberAvailable
+	case *unstructured.Unstructured:
+		want, available = rolloutAvailability(w)
+	}
+	return want, available
+}
+
+// markRestarted records that a target has been restarted by this run, so
+// that it counts as in flight until its rollout completes.
+func (m *fleetMonitor) markRestarted(t target) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.restarted[t.String()] = true
+}
+
+// inFlight returns the number of targets in the namespace that this run has
+// restarted and that are still rolling out, or that hold a slot for a restart
+// about to be made.
+func (m *fleetMonitor) inFlight(namespace string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for _, t := range m.targets {
+		if t.Namespace != namespace {
+			continue
+		}
+		if m.claimed[t.String()] && !m.restarted[t.String()] {
+			n++
+			continue
+		}
+		if !m.restarted[t.String()] {
+			continue
+		}
+		obj := m.get(t)
+		if obj == nil {
+			continue
+		}
+		if done, err := restart.RolloutComplete(obj); !done && err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// waitBelow blocks until at most limit replicas are unavailable across the
+// fleet, re-evaluating whenever one of the targets changes.
+func (m *fleetMonitor) waitBelow(ctx context.Context, limit int, timeout time.Duration) error {
+	return m.waitUntil(ctx, timeout, func() (bool, string) {
+		n := m.unavailable()
+		return n <= limit, fmt.Sprintf("%d replicas unavailable across the fleet (--max-fleet-unavailable=%d)", n, limit)
+	})
+}
+
+// waitForSlot blocks until fewer than limit targets of the target's
+// namespace are rolling out, and claims the free slot for the target. The
+// claim must be released once the target is done with.
+func (m *fleetMonitor) waitForSlot(ctx context.Context, t target, limit int, timeout time.Duration) error {
+	return m.waitUntil(ctx, timeout, func() (bool, string) {
+		m.slotMu.Lock()
+		defer m.slotMu.Unlock()
+		n := m.inFlight(t.Namespace)
+		if n < limit {
+			m.mu.Lock()
+			m.claimed[t.String()] = true
+			m.mu.Unlock()
+		}
+		return n < limit, fmt.Sprintf("%d restarts in flight in namespace %s (limit %d)", n, t.Namespace, limit)
+	})
+}
+
+// releaseSlot releases the slot claimed for a target. A restarted target
+// keeps counting as in flight until its rollout completes; one skipped
+// before its restart frees the slot at once, which no informer event would
+// report, so the waiters are woken here.
+func (m *fleetMonitor) releaseSlot(t target) {
+	m.mu.Lock()
+	delete(m.claimed, t.String())
+	m.mu.Unlock()
+	m.notify()
+}
+
+// waitUntil blocks until cond holds, re-evaluating it whenever one of the
+// targets changes. The state cond describes is logged when pausing and
+// resuming.
+func (m *fleetMonitor) waitUntil(ctx context.Context, timeout time.Duration, cond func() (bool, string)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	paused := false
+	for {
+		// Taken before evaluating cond, so that a change made meanwhile
+		// is not missed
+		changed := m.changes()
+		ok, state := cond()
+		if ok {
+			if paused {
+				slog.Info("Resuming", "fleet", state)
+			}
+			return nil
+		}
+		if !paused {
+			slog.Info("Pausing", "fleet", state)
+			paused = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up after %s: %s", timeout, state)
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Annotations that shield a workload from restarts until a point in time.
+const (
+	frozenUntilAnnotation  = "db-deploy/frozen-until"
+	frozenReasonAnnotation = "db-deploy/frozen-reason"
+)
+
+// skipAnnotation opts a workload out of automated restarts for good when set
+// to "true", so that teams can exempt a sensitive database without changing
+// the selectors of every run. Freezes are for temporary exemptions.
+const skipAnnotation = "db-deploy/skip"
+
+// optedOut reports whether the target opted out of restarts with the skip
+// annotation. Like a freeze, a value that is not a boolean counts as opting
+// out, since whoever set it meant to protect the workload.
+func optedOut(t target) bool {
+	value, ok := t.Annotations[skipAnnotation]
+	if !ok {
+		return false
+	}
+	skip, err := strconv.ParseBool(value)
+	return err != nil || skip
+}
+
+// frozenUntil returns the time until which the target is frozen, and whether
+// that time is still in the future. A malformed expiry keeps the workload
+// frozen indefinitely, since whoever set it clearly meant to protect it.
+func frozenUntil(t target, now time.Time) (time.Time, bool) {
+	value, ok := t.Annotations[frozenUntilAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	until, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, true
+	}
+	return until, now.Before(until)
+}
+
+// freezeCommand stamps workloads with a freeze expiry that sweeps honor.
+func freezeCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	duration := fs.Duration("for", 4*time.Hour, "how long the workloads stay frozen")
+	reason := fs.String("reason", "", "why the workloads are frozen, shown when a sweep skips them")
+	return func(refs []string) {
+		setupLogging()
+		if len(refs) == 0 {
+			log.Fatalf("Usage: db-pods freeze KIND/NAMESPACE/NAME... [--for DURATION] [--reason TEXT]")
+		}
+
+		until := time.Now().Add(*duration).UTC().Format(time.RFC3339)
+		annotations := map[string]interface{}{frozenUntilAnnotation: until, frozenReasonAnnotation: nil}
+		if *reason != "" {
+			annotations[frozenReasonAnnotation] = *reason
+		}
+		annotateRefs(refs, annotations, fmt.Sprintf("Froze %%s until %s\n", until))
+	}
+}
+
+// unfreezeCommand removes a freeze from workloads.
+func unfreezeCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	return func(refs []string) {
+		setupLogging()
+		if len(refs) == 0 {
+			log.Fatalf("Usage: db-pods unfreeze KIND/NAMESPACE/NAME...")
+		}
+
+		annotateRefs(refs, map[string]interface{}{frozenUntilAnnotation: nil, frozenReasonAnnotation: nil}, "Unfroze %s\n")
+	}
+}
+
+// annotateRefs applies the same annotation patch to every referenced workload
+// and prints format, with the workload as its only argument, for each success.
+func annotateRefs(refs []string, annotations map[string]interface{}, format string) {
+	var targets []target
+	for _, ref := range refs {
+		t, err := parseTargetRef(ref)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		targets = append(targets, t)
+	}
+
+	clientset, dynamicClient := newClients()
+
+	ctx := context.Background()
+
+	failed := false
+	for _, t := range targets {
+		if err := patchAnnotations(ctx, clientset, dynamicClient, t, annotations); err != nil {
+			workloadLogger(t).Error("Error annotating workload", "error", err)
+			failed = true
+			continue
+		}
+		fmt.Printf(format, t)
+	}
+	if failed {
+		log.Fatalf("Not all workloads could be annotated")
+	}
+}
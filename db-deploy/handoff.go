@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// restartRequestedAnnotation asks the team owning a workload to restart it
+// themselves. It holds the time of the request.
+const restartRequestedAnnotation = "db-deploy/restart-requested"
+
+// requestRestarts stamps the restart request annotation on the targets
+// instead of restarting them, for --handoff. Targets that opted out, frozen
+// targets and targets in a blackout period are left alone.
+func requestRestarts(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, targets []target) {
+	requested := planNow().UTC().Format(time.RFC3339)
+	stamped := 0
+	for _, t := range targets {
+		if optedOut(t) {
+			progressSkip(t, "opted out with "+skipAnnotation)
+			continue
+		}
+		if _, frozen := frozenUntil(t, planNow()); frozen {
+			progressSkip(t, "frozen")
+			continue
+		}
+		if reason := blackout(t, planNow()); reason != "" {
+			progressSkip(t, reason)
+			continue
+		}
+		if err := patchAnnotations(ctx, clientset, dynamicClient, t, map[string]interface{}{restartRequestedAnnotation: requested}); err != nil {
+			workloadLogger(t).Error("Error requesting restart", "error", err)
+			continue
+		}
+		progressf(t, "Requested restart of %s", t)
+		stamped++
+	}
+	fmt.Fprintf(progress, "\nTotal restarts requested: %d\n", stamped)
+	fmt.Fprintln(progress, `Run "db-pods handoff-status" to follow up on them.`)
+}
+
+// handoffStatusCommand runs "db-pods handoff-status", which lists the
+// workloads whose restart was handed off with --handoff and whether their
+// owners have restarted them since.
+func handoffStatusCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	fallbackNamespaces := fs.String("fallback-namespaces", "", "comma-separated namespaces to search when workloads cannot be listed cluster-wide (default: every namespace the caller can list workloads in)")
+	includeRollouts := fs.Bool("include-rollouts", false, "also report Argo Rollouts")
+	failPending := fs.Bool("fail-pending", false, "exit with status 1 if any requested restart is still pending")
+	return func(args []string) {
+		setupLogging()
+
+		clientset, dynamicClient := newClients()
+
+		ctx := context.Background()
+
+		workloads, err := listWorkloads(ctx, clientset, dynamicClient, discoveryOptions{
+			fallbackNamespaces: splitList(*fallbackNamespaces),
+			includeRollouts:    *includeRollouts,
+		})
+		if err != nil {
+			log.Fatalf("Error discovering workloads: %v", err)
+		}
+		sort.Slice(workloads, func(i, j int) bool { return workloads[i].String() < workloads[j].String() })
+
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "WORKLOAD\tREQUESTED\tSTATUS")
+		requested, pending := 0, 0
+		for _, t := range workloads {
+			value, ok := t.Annotations[restartRequestedAnnotation]
+			if !ok {
+				continue
+			}
+			requested++
+			since, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				fmt.Fprintf(w, "%s\t%s\tinvalid request time\n", t, value)
+				continue
+			}
+
+			acted, err := restartedSince(ctx, clientset, t, since, now)
+			switch {
+			case err != nil:
+				fmt.Fprintf(w, "%s\t%s\tunknown: %v\n", t, value, err)
+			case acted:
+				fmt.Fprintf(w, "%s\t%s\trestarted\n", t, value)
+			default:
+				pending++
+				fmt.Fprintf(w, "%s\t%s\tpending for %s\n", t, value, now.Sub(since).Round(time.Minute))
+			}
+		}
+		w.Flush()
+
+		fmt.Printf("\nRequested restarts: %d, pending: %d\n", requested, pending)
+		if *failPending && pending > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// restartedSince reports whether the workload was restarted after the given
+// time, either through its restartedAt annotation or because none of its
+// pods is older than that.
+func restartedSince(ctx context.Context, clientset *kubernetes.Clientset, t target, since, now time.Time) (bool, error) {
+	if !t.LastRestart.Before(since) {
+		return true, nil
+	}
+	if t.Selector == nil {
+		return false, nil
+	}
+	age, err := oldestPodAge(ctx, clientset, t, now)
+	if err != nil {
+		return false, err
+	}
+	return age > 0 && now.Add(-age).After(since), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// rolloutHistoryAnnotation holds the durations, in whole seconds, of the last
+// rollouts of a workload that completed, oldest first and comma-separated.
+const rolloutHistoryAnnotation = "db-deploy/rollout-durations"
+
+// Bounds of the rollout history kept for adaptive timeouts.
+const (
+	// rolloutHistorySize is the number of durations kept per workload.
+	rolloutHistorySize = 20
+
+	// rolloutHistoryMinimum is the number of durations needed before the
+	// timeout adapts to them.
+	rolloutHistoryMinimum = 3
+)
+
+// adaptiveTimeoutConfig derives per-target rollout timeouts from their past
+// rollout durations.
+type adaptiveTimeoutConfig struct {
+	enabled bool
+
+	// margin is added to the 95th percentile, as a fraction of it.
+	margin float64
+
+	// min is the shortest timeout ever used.
+	min time.Duration
+}
+
+// rolloutHistory parses the rollout durations recorded on a workload.
+func rolloutHistory(t target) []time.Duration {
+	var durations []time.Duration
+	for _, field := range strings.Split(t.Annotations[rolloutHistoryAnnotation], ",") {
+		seconds, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || seconds < 0 {
+			continue
+		}
+		durations = append(durations, time.Duration(seconds)*time.Second)
+	}
+	return durations
+}
+
+// rolloutTimeout returns the time to wait for the rollout of a target: the
+// 95th percentile of its past rollouts plus the margin, or fallback while too
+// few rollouts are known.
+func (c adaptiveTimeoutConfig) rolloutTimeout(t target, fallback time.Duration) time.Duration {
+	history := rolloutHistory(t)
+	if !c.enabled || len(history) < rolloutHistoryMinimum {
+		return fallback
+	}
+
+	sort.Slice(history, func(i, j int) bool { return history[i] < history[j] })
+	p95 := history[int(math.Ceil(0.95*float64(len(history))))-1]
+	timeout := p95 + time.Duration(float64(p95)*c.margin)
+	if timeout < c.min {
+		timeout = c.min
+	}
+	return timeout.Round(time.Second)
+}
+
+// recordRolloutDuration appends the duration of a completed rollout to the
+// history of the target, dropping the oldest entries beyond the history
+// size.
+func recordRolloutDuration(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, t target, d time.Duration) error {
+	var fields []string
+	for _, past := range rolloutHistory(t) {
+		fields = append(fields, strconv.Itoa(int(past.Seconds())))
+	}
+	fields = append(fields, strconv.Itoa(int(d.Round(time.Second).Seconds())))
+	if len(fields) > rolloutHistorySize {
+		fields = fields[len(fields)-rolloutHistorySize:]
+	}
+	return patchAnnotations(ctx, clientset, dynamicClient, t, map[string]interface{}{rolloutHistoryAnnotation: strings.Join(fields, ",")})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// scaledToZero reports whether the target is scaled down to no replicas, in
+// which case annotating its pod template restarts nothing.
+func scaledToZero(t target) bool {
+	return t.Replicas != nil && *t.Replicas == 0
+}
+
+// scaleWorkload sets the number of replicas of a deployment, statefulset or
+// rollout.
+func scaleWorkload(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, t target, replicas int32) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"replicas": replicas,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch t.Kind {
+	case "deployment":
+		_, err = clientset.AppsV1().Deployments(t.Namespace).Patch(ctx, t.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	case "statefulset":
+		_, err = clientset.AppsV1().StatefulSets(t.Namespace).Patch(ctx, t.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	case "rollout":
+		_, err = dynamicClient.Resource(rolloutResource).Namespace(t.Namespace).Patch(ctx, t.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	default:
+		return fmt.Errorf("cannot scale a %s", t.Kind)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to scale %s: %w", t.Kind, err)
+	}
+	return nil
+}
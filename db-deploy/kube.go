@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/homedir"
+)
+
+// clusterFlags select the cluster commands connect to. They are set by the
+// flags defined with addClusterFlags.
+var clusterFlags struct {
+	kubeconfig     string
+	context        string
+	requestTimeout string
+}
+
+// addClusterFlags defines --kubeconfig, --context and --request-timeout on
+// fs, with the meaning kubectl gives them, and --api-attempts.
+func addClusterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&clusterFlags.kubeconfig, "kubeconfig", "", "path of the kubeconfig to use (default: the files listed in $KUBECONFIG, or ~/.kube/config)")
+	fs.StringVar(&clusterFlags.context, "context", "", "kubeconfig context to use instead of the current one")
+	fs.IntVar(&apiBackoff.Steps, "api-attempts", apiBackoff.Steps, "maximum attempts of each change to a workload that fails with a conflict or a transient API error, retried with exponential backoff and jitter; 1 disables retries")
+	fs.StringVar(&clusterFlags.requestTimeout, "request-timeout", "0", "time to wait before giving up on a single API request, such as 30s or 2m, or a number of seconds; 0 never gives up. Watches are requests too and are restarted when it cuts them off")
+}
+
+// requestTimeout parses --request-timeout like kubectl, which accepts a
+// number of seconds as well as a duration.
+func requestTimeout() (time.Duration, error) {
+	value := clusterFlags.requestTimeout
+	if seconds, err := strconv.Atoi(value); err == nil {
+		value = strconv.Itoa(seconds) + "s"
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid --request-timeout %q, expected a duration such as 30s or a number of seconds", clusterFlags.requestTimeout)
+	}
+	return timeout, nil
+}
+
+// loadConfig builds a client configuration from the kubeconfig given with
+// --kubeconfig, listed in $KUBECONFIG or in the user's home directory, using
+// the context given with --context or else the current one. Without any of
+// them, such as in a Job or CronJob like the one emitted by "db-pods plan
+// --emit-job", it uses the service account of the pod it runs in instead.
+func loadConfig() (*rest.Config, error) {
+	kubeconfig := kubeconfigPath()
+	explicit := clusterFlags.kubeconfig != "" || clusterFlags.context != "" || os.Getenv(clientcmd.RecommendedConfigPathEnvVar) != ""
+	if _, err := os.Stat(kubeconfig); os.IsNotExist(err) && !explicit {
+		config, err := rest.InClusterConfig()
+		if errors.Is(err, rest.ErrNotInCluster) {
+			return nil, fmt.Errorf("no kubeconfig at %s and not running inside a cluster", kubeconfig)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("no kubeconfig at %s, and the in-cluster configuration failed: %w", kubeconfig, err)
+		}
+		slog.Info("No kubeconfig, using the in-cluster service account", "kubeconfig", kubeconfig)
+		return config, nil
+	}
+	return kubeconfigLoader().ClientConfig()
+}
+
+// kubeconfigLoadingRules returns where kubeconfigs are loaded from, as
+// kubectl does: the file given with --kubeconfig, or else the files listed in
+// $KUBECONFIG merged, or else the one in the user's home directory.
+func kubeconfigLoadingRules() *clientcmd.ClientConfigLoadingRules {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = clusterFlags.kubeconfig
+	return rules
+}
+
+// kubeconfigLoader returns the loader of the kubeconfig, using the context
+// given with --context or else the current one.
+func kubeconfigLoader() clientcmd.ClientConfig {
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		kubeconfigLoadingRules(),
+		&clientcmd.ConfigOverrides{CurrentContext: clusterFlags.context},
+	)
+}
+
+// contextNamespace returns the namespace of the kubeconfig context, as
+// kubectl uses it when no --namespace is given: the namespace set on the
+// context, that of the pod when running in a cluster, or else "default".
+func contextNamespace() (string, error) {
+	namespace, _, err := kubeconfigLoader().Namespace()
+	if err != nil {
+		return "", fmt.Errorf("failed to read the namespace of the kubeconfig context: %w", err)
+	}
+	return namespace, nil
+}
+
+// kubeconfigPath returns the path of the kubeconfig given with --kubeconfig,
+// or else the files listed in $KUBECONFIG, or else the one in the user's
+// home directory.
+func kubeconfigPath() string {
+	if clusterFlags.kubeconfig != "" {
+		return clusterFlags.kubeconfig
+	}
+	if paths := os.Getenv(clientcmd.RecommendedConfigPathEnvVar); paths != "" {
+		return paths
+	}
+	if home := homedir.HomeDir(); home != "" {
+		return filepath.Join(home, ".kube", "config")
+	}
+	return ""
+}
+
+// restConfig returns the client configuration of the configured cluster,
+// exiting if it cannot be built.
+func restConfig() *rest.Config {
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Error building kubeconfig: %v", err)
+	}
+	config.WarningHandler = apiWarnings
+	if config.Timeout, err = requestTimeout(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if apiBackoff.Steps < 1 {
+		log.Fatalf("--api-attempts must be at least 1")
+	}
+	return config
+}
+
+// newClients returns the typed and dynamic clients for the configured
+// cluster, exiting if they cannot be created.
+func newClients() (*kubernetes.Clientset, dynamic.Interface) {
+	config := restConfig()
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Error creating kubernetes client: %v", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Error creating dynamic client: %v", err)
+	}
+	return clientset, dynamicClient
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// stringList is a flag that may be repeated, collecting every value.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Type is that of pflag's StringArray, which completion offers again once
+// given.
+func (l *stringList) Type() string {
+	return "stringArray"
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Leases elected on by the replicas of the long-running modes, so that only
+// one of them restarts workloads when they run as a Deployment with several
+// replicas.
+const (
+	daemonLeaderLease   = "db-pods-daemon"
+	operatorLeaderLease = "db-pods-operator"
+)
+
+// Timings of leader election, those of controller-runtime: a crashed leader
+// is replaced after at most leaderLeaseDuration.
+const (
+	leaderLeaseDuration = 15 * time.Second
+	leaderRenewDeadline = 10 * time.Second
+	leaderRetryPeriod   = 2 * time.Second
+)
+
+// leaderIdentity identifies this replica in leader leases: the pod name,
+// which is the host name in a pod, and a suffix telling restarts apart.
+func leaderIdentity() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "db-pods"
+	}
+	return host + "_" + string(uuid.NewUUID())
+}
+
+// electLeader campaigns for the lease name in namespace in the background and
+// returns a channel closed once this replica leads. A leader that loses the
+// lease exits, as controller-runtime managers do, since another replica may
+// already be restarting workloads; its pod is then restarted and campaigns
+// again.
+func electLeader(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string) <-chan struct{} {
+	identity := leaderIdentity()
+	elected := make(chan struct{})
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Client:     clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   leaderLeaseDuration,
+		RenewDeadline:   leaderRenewDeadline,
+		RetryPeriod:     leaderRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				slog.Info("Elected leader", "namespace", namespace, "lease", name, "identity", identity)
+				close(elected)
+			},
+			OnStoppedLeading: func() {
+				if ctx.Err() == nil {
+					log.Fatalf("Lost the %s/%s leader lease", namespace, name)
+				}
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					slog.Info("Another replica leads", "namespace", namespace, "lease", name, "leader", leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		log.Fatalf("Error setting up leader election: %v", err)
+	}
+	slog.Info("Waiting to be elected leader", "namespace", namespace, "lease", name, "identity", identity)
+	go elector.Run(ctx)
+	return elected
+}
+
+// isLeader reports whether the election whose channel electLeader returned
+// was won; without an election, there is no other replica to defer to.
+func isLeader(elected <-chan struct{}) bool {
+	if elected == nil {
+		return true
+	}
+	select {
+	case <-elected:
+		return true
+	default:
+		return false
+	}
+}
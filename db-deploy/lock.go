@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// runLeaseName is the coordination Lease that records the active run.
+const runLeaseName = "db-pods-run"
+
+// What a run does when another run holds the lease, selected with
+// --on-conflict.
+const (
+	onConflictExit    = "exit"    // exit, naming the active run
+	onConflictQueue   = "queue"   // wait for the active run, then proceed
+	onConflictObserve = "observe" // follow the active run until it ends, then exit
+)
+
+const (
+	// runLeaseDuration is how long a lease stays valid without renewal, so
+	// a crashed run blocks others for no longer than this.
+	runLeaseDuration = 60 * time.Second
+
+	// runLeaseRenewal is how often the holder renews the lease.
+	runLeaseRenewal = 20 * time.Second
+
+	// runLeasePoll is how often a queued or observing run checks the lease.
+	runLeasePoll = 5 * time.Second
+)
+
+// runLock is a held run lease.
+type runLock struct {
+	clientset *kubernetes.Clientset
+	namespace string
+	runID     string
+	stopRenew context.CancelFunc
+	done      chan struct{}
+}
+
+// errRunObserved is returned by acquireRunLock when the run observed another
+// run to its end instead of taking the lease.
+var errRunObserved = errors.New("observed the active run until it finished")
+
+// acquireRunLock takes the run lease in namespace for runID, so that two
+// sweeps never interleave their patches. If another run holds the lease, it
+// exits, queues or observes according to onConflict. A nil lock with a nil
+// error means the lease could not be used, for lack of permissions, and the
+// run proceeds unguarded.
+func acquireRunLock(ctx context.Context, clientset *kubernetes.Clientset, namespace, runID, onConflict string) (*runLock, error) {
+	observing, queued := false, false
+	for {
+		var holder string
+		var err error
+		if observing {
+			holder, err = currentLeaseHolder(ctx, clientset, namespace)
+		} else {
+			holder, err = tryAcquireLease(ctx, clientset, namespace, runID)
+		}
+		if apierrors.IsForbidden(err) {
+			slog.Warn("Cannot use lease to detect concurrent runs", "namespace", namespace, "lease", runLeaseName, "error", err)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if holder == "" {
+			if observing {
+				return nil, errRunObserved
+			}
+			renewCtx, cancel := context.WithCancel(context.Background())
+			l := &runLock{clientset: clientset, namespace: namespace, runID: runID, stopRenew: cancel, done: make(chan struct{})}
+			go l.renew(renewCtx)
+			return l, nil
+		}
+
+		switch {
+		case observing:
+		case onConflict == onConflictQueue:
+			if !queued {
+				fmt.Fprintf(progress, "Run %s is active, queueing behind it\n", holder)
+				queued = true
+			}
+		case onConflict == onConflictObserve:
+			fmt.Fprintf(progress, "Run %s is active, observing it until it finishes\n", holder)
+			observing = true
+		default:
+			return nil, fmt.Errorf("run %s is active (lease %s/%s); retry once it finishes or pass --on-conflict=queue", holder, namespace, runLeaseName)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(runLeasePoll):
+		}
+	}
+}
+
+// tryAcquireLease takes the lease if it is free or expired and returns an
+// empty holder, or returns the run ID of the run holding it.
+func tryAcquireLease(ctx context.Context, clientset *kubernetes.Clientset, namespace, runID string) (string, error) {
+	leases := clientset.CoordinationV1().Leases(namespace)
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(runLeaseDuration / time.Second)
+
+	lease, err := leases.Get(ctx, runLeaseName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: runLeaseName, Namespace: namespace},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &runID,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return tryAcquireLease(ctx, clientset, namespace, runID)
+		}
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if holder := leaseHolder(lease, now.Time); holder != "" {
+		return holder, nil
+	}
+
+	lease.Spec.HolderIdentity = &runID
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		// Someone else took it first
+		return tryAcquireLease(ctx, clientset, namespace, runID)
+	}
+	return "", err
+}
+
+// currentLeaseHolder returns the run holding the lease without trying to
+// take it.
+func currentLeaseHolder(ctx context.Context, clientset *kubernetes.Clientset, namespace string) (string, error) {
+	lease, err := clientset.CoordinationV1().Leases(namespace).Get(ctx, runLeaseName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return leaseHolder(lease, time.Now()), nil
+}
+
+// leaseHolder returns the holder of a lease, or an empty string if it is
+// released or has expired.
+func leaseHolder(lease *coordinationv1.Lease, now time.Time) string {
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+		return ""
+	}
+	if lease.Spec.RenewTime != nil && lease.Spec.LeaseDurationSeconds != nil {
+		expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+		if now.After(expiry) {
+			return ""
+		}
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+// renew keeps the lease alive until the context is cancelled.
+func (l *runLock) renew(ctx context.Context) {
+	defer close(l.done)
+	ticker := time.NewTicker(runLeaseRenewal)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := l.update(ctx, func(lease *coordinationv1.Lease) {
+			now := metav1.NewMicroTime(time.Now())
+			lease.Spec.RenewTime = &now
+		}); err != nil {
+			slog.Error("Error renewing lease", "namespace", l.namespace, "lease", runLeaseName, "error", err)
+		}
+	}
+}
+
+// release stops renewing the lease and frees it for the next run.
+func (l *runLock) release() {
+	l.stopRenew()
+	<-l.done
+	if err := l.update(context.Background(), func(lease *coordinationv1.Lease) {
+		lease.Spec.HolderIdentity = nil
+		lease.Spec.RenewTime = nil
+	}); err != nil {
+		slog.Error("Error releasing lease", "namespace", l.namespace, "lease", runLeaseName, "error", err)
+	}
+}
+
+// update modifies the lease while it is still held by this run.
+func (l *runLock) update(ctx context.Context, modify func(*coordinationv1.Lease)) error {
+	leases := l.clientset.CoordinationV1().Leases(l.namespace)
+	lease, err := leases.Get(ctx, runLeaseName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.runID {
+		return fmt.Errorf("lease was taken over by another run")
+	}
+	modify(lease)
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
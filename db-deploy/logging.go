@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/spf13/pflag"
+)
+
+// Log formats accepted by --log-format.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logFlags holds the --log-format and --log-level flags shared by the
+// commands.
+var logFlags struct {
+	format string
+	level  string
+}
+
+// addLogFlags defines --log-format and --log-level on fs.
+func addLogFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&logFlags.format, "log-format", logFormatText, "format of the logs written to standard error: text, or json for log pipelines, which also logs progress as JSON records carrying the kind, namespace and name of each workload")
+	fs.StringVar(&logFlags.level, "log-level", "info", "minimum level of the logs: debug, info, warn or error")
+}
+
+// setupLogging installs the logger selected by --log-format and --log-level.
+// Whatever is still logged through the log package, fatal errors mostly, is
+// logged at the error level.
+func setupLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logFlags.level)); err != nil {
+		log.Fatalf("Unknown --log-level %q, expected debug, info, warn or error", logFlags.level)
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch logFlags.format {
+	case logFormatText:
+		handler = slog.NewTextHandler(os.Stderr, handlerOpts)
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, handlerOpts)
+		progress = progressLogger{}
+	default:
+		log.Fatalf("Unknown --log-format %q, expected %s or %s", logFlags.format, logFormatText, logFormatJSON)
+	}
+	slog.SetDefault(slog.New(handler))
+	log.SetOutput(slog.NewLogLogger(handler, slog.LevelError).Writer())
+}
+
+// workloadLogger returns a logger recording the kind, namespace and name of
+// a target with every message.
+func workloadLogger(t target) *slog.Logger {
+	return slog.With("kind", t.Kind, "namespace", t.Namespace, "name", t.Name)
+}
+
+// progressLogger is the progress writer with --log-format=json. It logs each
+// line written to it as a message.
+type progressLogger struct{}
+
+func (progressLogger) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		if line := bytes.TrimSpace(line); len(line) > 0 {
+			slog.Info(string(line))
+		}
+	}
+	return len(p), nil
+}
+
+// logsProgress reports whether progress is logged rather than printed.
+func logsProgress() bool {
+	_, ok := progress.(progressLogger)
+	return ok
+}
+
+// progressf reports progress on a target. When progress is logged, the
+// message carries the target's kind, namespace and name.
+func progressf(t target, format string, args ...interface{}) {
+	if logsProgress() {
+		workloadLogger(t).Info(fmt.Sprintf(format, args...))
+		return
+	}
+	fmt.Fprintf(progress, format+"\n", args...)
+}
+
+// progressSkip reports that a target is skipped and why.
+func progressSkip(t target, reason string) {
+	if logsProgress() {
+		workloadLogger(t).Info("Skipping workload", "reason", reason)
+		return
+	}
+	fmt.Fprintf(progress, "Skipping %s: %s\n", t, reason)
+}
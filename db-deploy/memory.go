@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// podMetricsResource is the resource metrics-server serves the current usage
+// of pods as.
+var podMetricsResource = schema.GroupVersionResource{Group: "metrics.k8s.io", Version: "v1beta1", Resource: "pods"}
+
+// orderMemory restarts the targets whose pods use the largest share of their
+// memory first, so that leaking databases are restarted before healthy ones.
+const orderMemory = "memory"
+
+// memoryUsage is the memory working set of the pod of a workload that uses
+// the largest share of its memory, against the sum of the requests and
+// limits of its containers. A zero limit means at least one container is
+// unbounded.
+type memoryUsage struct {
+	Pod        string
+	WorkingSet int64
+	Request    int64
+	Limit      int64
+}
+
+// ratio returns the working set as a share of the limit, or of the request
+// for pods without a limit, or 0 if the pod bounds neither.
+func (m memoryUsage) ratio() float64 {
+	switch {
+	case m.Limit > 0:
+		return float64(m.WorkingSet) / float64(m.Limit)
+	case m.Request > 0:
+		return float64(m.WorkingSet) / float64(m.Request)
+	}
+	return 0
+}
+
+func (m memoryUsage) String() string {
+	s := "memory " + formatBytes(m.WorkingSet)
+	switch {
+	case m.Limit > 0:
+		s += fmt.Sprintf(" of %s limit (%.0f%%)", formatBytes(m.Limit), 100*m.ratio())
+	case m.Request > 0:
+		s += fmt.Sprintf(" of %s request (%.0f%%), no limit", formatBytes(m.Request), 100*m.ratio())
+	}
+	return s
+}
+
+// formatBytes renders a byte count in the binary units of Kubernetes
+// quantities, such as 1.5Gi.
+func formatBytes(n int64) string {
+	units := []string{"Ki", "Mi", "Gi", "Ti"}
+	if n < 1024 {
+		return fmt.Sprintf("%d", n)
+	}
+	value, unit := float64(n)/1024, units[0]
+	for _, u := range units[1:] {
+		if value < 1024 {
+			break
+		}
+		value, unit = value/1024, u
+	}
+	return fmt.Sprintf("%.1f%s", value, unit)
+}
+
+// memoryMetricsUnavailable is logged once when metrics-server cannot be
+// queried, after which the memory of targets is no longer inspected.
+var memoryMetricsUnavailable sync.Once
+
+// inspectMemory records on the target the memory usage of its pod that uses
+// the largest share of its memory, as reported by metrics-server. Clusters
+// without metrics-server leave it unset.
+func inspectMemory(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, t *target) error {
+	if t.Selector == nil {
+		return nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector: %w", err)
+	}
+	metrics, err := dynamicClient.Resource(podMetricsResource).Namespace(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if apierrors.IsNotFound(err) || apierrors.IsServiceUnavailable(err) || apierrors.IsForbidden(err) {
+		memoryMetricsUnavailable.Do(func() {
+			slog.Info("Memory usage of pods is not available from metrics-server, it is left out of the plan", "error", err)
+		})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get pod metrics: %w", err)
+	}
+	pods, err := clientset.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+	specs := make(map[string]*corev1.PodSpec, len(pods.Items))
+	for i := range pods.Items {
+		specs[pods.Items[i].Name] = &pods.Items[i].Spec
+	}
+
+	var usages []memoryUsage
+	for _, m := range metrics.Items {
+		spec := specs[m.GetName()]
+		if spec == nil {
+			continue
+		}
+		usage := memoryUsage{Pod: m.GetName(), WorkingSet: podWorkingSet(m)}
+		unbounded := false
+		for _, c := range spec.Containers {
+			usage.Request += c.Resources.Requests.Memory().Value()
+			limit := c.Resources.Limits.Memory().Value()
+			unbounded = unbounded || limit == 0
+			usage.Limit += limit
+		}
+		if unbounded {
+			usage.Limit = 0
+		}
+		usages = append(usages, usage)
+	}
+	if len(usages) == 0 {
+		return nil
+	}
+	sort.SliceStable(usages, func(i, j int) bool { return usages[i].ratio() > usages[j].ratio() })
+	t.Memory = &usages[0]
+	return nil
+}
+
+// podWorkingSet sums the memory working set of the containers of a
+// PodMetrics object.
+func podWorkingSet(m unstructured.Unstructured) int64 {
+	containers, _, _ := unstructured.NestedSlice(m.Object, "containers")
+	var total int64
+	for _, c := range containers {
+		value, _, _ := unstructured.NestedString(c.(map[string]interface{}), "usage", "memory")
+		if q, err := resource.ParseQuantity(value); err == nil {
+			total += q.Value()
+		}
+	}
+	return total
+}
+
+// sortByMemory orders targets by the share of its memory their fullest pod
+// uses, highest first. Targets without memory usage come last, oldest pods
+// first.
+func sortByMemory(targets []target) {
+	sortByPodAge(targets)
+	sort.SliceStable(targets, func(i, j int) bool {
+		a, b := targets[i].Memory, targets[j].Memory
+		if a == nil || b == nil {
+			return a != nil && b == nil
+		}
+		return a.ratio() > b.ratio()
+	})
+}
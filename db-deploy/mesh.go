@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+const (
+	meshIstio   = "istio"
+	meshLinkerd = "linkerd"
+
+	// meshDestinationRuleAnnotation names the Istio DestinationRule whose
+	// outlier detection is suspended while the annotated workload restarts.
+	meshDestinationRuleAnnotation = "db-deploy/mesh-destination-rule"
+)
+
+// meshProxies maps the name of each supported mesh's proxy container to the
+// mesh it belongs to.
+var meshProxies = map[string]string{
+	"istio-proxy":   meshIstio,
+	"linkerd-proxy": meshLinkerd,
+}
+
+var destinationRuleResource = schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1beta1", Resource: "destinationrules"}
+
+// detectMesh returns the service mesh whose sidecar has been injected into
+// the pod, or an empty string if there is none.
+func detectMesh(pod *corev1.Pod) string {
+	if _, ok := pod.Annotations["sidecar.istio.io/status"]; ok {
+		return meshIstio
+	}
+	if _, ok := pod.Annotations["linkerd.io/proxy-version"]; ok {
+		return meshLinkerd
+	}
+	// Native sidecars are injected as restartable init containers
+	for _, containers := range [][]corev1.Container{pod.Spec.Containers, pod.Spec.InitContainers} {
+		for _, c := range containers {
+			if mesh, ok := meshProxies[c.Name]; ok {
+				return mesh
+			}
+		}
+	}
+	return ""
+}
+
+// proxyReady reports whether the mesh proxy of a pod is ready. Pods without a
+// proxy are considered ready.
+func proxyReady(pod *corev1.Pod) bool {
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses} {
+		for _, status := range statuses {
+			if _, ok := meshProxies[status.Name]; ok {
+				return status.Ready
+			}
+		}
+	}
+	return true
+}
+
+// waitForSidecars blocks until the mesh proxy in every running pod of the
+// target reports ready, or the timeout expires.
+func waitForSidecars(ctx context.Context, clientset *kubernetes.Clientset, t target, timeout time.Duration) error {
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector: %w", err)
+	}
+
+	lw := newPodListWatch(ctx, clientset, t.Namespace, selector)
+
+	ctx, cancel := watchtools.ContextWithOptionalTimeout(ctx, timeout)
+	defer cancel()
+
+	var pods cache.Store
+	allReady := func() bool {
+		for _, obj := range pods.List() {
+			pod := obj.(*corev1.Pod)
+			if pod.DeletionTimestamp == nil && !proxyReady(pod) {
+				return false
+			}
+		}
+		return true
+	}
+
+	_, err = watchtools.UntilWithSync(ctx, lw, &corev1.Pod{}, func(store cache.Store) (bool, error) {
+		pods = store
+		return allReady(), nil
+	}, func(watch.Event) (bool, error) {
+		return allReady(), nil
+	})
+	if wait.Interrupted(err) {
+		return fmt.Errorf("timed out after %s waiting for %s proxies", timeout, t.Mesh)
+	}
+	return err
+}
+
+// holdOutlierDetection stops Istio from ejecting the restarting replicas of a
+// target by setting maxEjectionPercent to zero on the DestinationRule named in
+// the target's annotations. It returns a function that restores the previous
+// setting, or nil if the target has no DestinationRule with outlier detection.
+func holdOutlierDetection(ctx context.Context, client dynamic.Interface, t target) (func(context.Context) error, error) {
+	name := t.Annotations[meshDestinationRuleAnnotation]
+	if name == "" {
+		return nil, nil
+	}
+
+	rules := client.Resource(destinationRuleResource).Namespace(t.Namespace)
+	rule, err := rules.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get destinationrule %s: %w", name, err)
+	}
+
+	if _, found, _ := unstructured.NestedMap(rule.Object, "spec", "trafficPolicy", "outlierDetection"); !found {
+		return nil, nil
+	}
+	previous, found, err := unstructured.NestedFieldCopy(rule.Object, "spec", "trafficPolicy", "outlierDetection", "maxEjectionPercent")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read outlier detection of destinationrule %s: %w", name, err)
+	}
+	if !found {
+		// Setting the field to null removes it again on restore
+		previous = nil
+	}
+
+	patch := func(ctx context.Context, value interface{}) error {
+		data, err := json.Marshal(map[string]interface{}{
+			"spec": map[string]interface{}{
+				"trafficPolicy": map[string]interface{}{
+					"outlierDetection": map[string]interface{}{
+						"maxEjectionPercent": value,
+					},
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = rules.Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to patch destinationrule %s: %w", name, err)
+		}
+		return nil
+	}
+
+	if err := patch(ctx, 0); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) error {
+		return patch(ctx, previous)
+	}, nil
+}
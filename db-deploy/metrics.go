@@ -0,0 +1,37 @@
+package main
+
+// Names of the Prometheus metrics describing restart runs. Dashboards and
+// alerts are built against these names, so they must not change.
+const (
+	// metricRestartsTotal counts restarts by namespace, kind and result
+	// ("succeeded" or "failed").
+	metricRestartsTotal = "db_pods_restarts_total"
+
+	// metricRolloutDuration is a histogram of the time from triggering a
+	// restart until its rollout completed, by namespace and kind.
+	metricRolloutDuration = "db_pods_rollout_duration_seconds"
+
+	// metricLastRunTimestamp is the Unix time at which the last run finished.
+	metricLastRunTimestamp = "db_pods_last_run_timestamp_seconds"
+
+	// metricLastRunWorkloads is the number of workloads of the last run by
+	// status.
+	metricLastRunWorkloads = "db_pods_last_run_workloads"
+
+	// metricPodUptime is the age of the oldest pod of each database
+	// workload, as seen by the hygiene check of "db-pods daemon".
+	metricPodUptime = "db_pods_workload_oldest_pod_age_seconds"
+
+	// metricNeverRestarted is 1 for database workloads without a
+	// restartedAt annotation, 0 otherwise.
+	metricNeverRestarted = "db_pods_workload_never_restarted"
+
+	// metricHygieneViolations is the number of database workloads that
+	// are overdue for a restart or were never restarted.
+	metricHygieneViolations = "db_pods_hygiene_violations"
+
+	// metricWorkloadRestarts is the number of restarts of each database
+	// workload by reason within the window of "db-pods daemon", from the
+	// restart history recorded on the workload.
+	metricWorkloadRestarts = "db_pods_workload_restarts"
+)
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// migrationAnnotation links a workload to the schema migration it depends
+// on, as job/NAME or cronjob/NAME in the workload's namespace. The workload
+// is only restarted once the latest run of the migration has succeeded.
+const migrationAnnotation = "db-deploy/migration"
+
+// migrationConfig describes how linked migrations are handled.
+type migrationConfig struct {
+	// run triggers linked migration CronJobs before the restart and waits
+	// for them, instead of only checking their latest run.
+	run bool
+
+	// timeout bounds the wait for a triggered migration.
+	timeout time.Duration
+}
+
+// checkMigration returns why the target must not be restarted because of its
+// linked migration, or "" if it may be. With cfg.run, a linked CronJob is
+// triggered first and awaited.
+func checkMigration(ctx context.Context, clientset *kubernetes.Clientset, t target, cfg migrationConfig, runID string) (string, error) {
+	ref := t.Annotations[migrationAnnotation]
+	kind, name, ok := strings.Cut(ref, "/")
+	if !ok || name == "" || (kind != "job" && kind != "cronjob") {
+		return "", fmt.Errorf("invalid %s=%q, expected job/NAME or cronjob/NAME", migrationAnnotation, ref)
+	}
+
+	var job *batchv1.Job
+	switch {
+	case kind == "cronjob" && cfg.run:
+		created, err := triggerCronJob(ctx, clientset, t.Namespace, name, runID)
+		if err != nil {
+			return "", fmt.Errorf("failed to trigger migration: %w", err)
+		}
+		progressf(t, "Triggered migration %s of %s as job %s", ref, t, created)
+		if job, err = waitForJob(ctx, clientset, t.Namespace, created, cfg.timeout); err != nil {
+			return "", fmt.Errorf("migration job %s: %w", created, err)
+		}
+	case kind == "cronjob":
+		var err error
+		if job, err = latestCronJobRun(ctx, clientset, t.Namespace, name); err != nil {
+			return "", err
+		}
+		if job == nil {
+			return fmt.Sprintf("migration %s has never run", ref), nil
+		}
+	default:
+		var err error
+		if job, err = clientset.BatchV1().Jobs(t.Namespace).Get(ctx, name, metav1.GetOptions{}); err != nil {
+			return "", fmt.Errorf("failed to get migration job: %w", err)
+		}
+	}
+
+	switch jobState(job) {
+	case batchv1.JobComplete:
+		return "", nil
+	case batchv1.JobFailed:
+		return fmt.Sprintf("migration job %s failed", job.Name), nil
+	}
+	return fmt.Sprintf("migration job %s is still running", job.Name), nil
+}
+
+// latestCronJobRun returns the most recently created Job of a CronJob, or nil
+// if it has none.
+func latestCronJobRun(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string) (*batchv1.Job, error) {
+	jobs, err := clientset.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	var latest *batchv1.Job
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		owner := metav1.GetControllerOf(job)
+		if owner == nil || owner.Kind != "CronJob" || owner.Name != name {
+			continue
+		}
+		if latest == nil || job.CreationTimestamp.After(latest.CreationTimestamp.Time) {
+			latest = job
+		}
+	}
+	return latest, nil
+}
+
+// jobState returns JobComplete or JobFailed once a Job has finished, and ""
+// while it is running.
+func jobState(job *batchv1.Job) batchv1.JobConditionType {
+	for _, cond := range job.Status.Conditions {
+		if (cond.Type == batchv1.JobComplete || cond.Type == batchv1.JobFailed) && cond.Status == corev1.ConditionTrue {
+			return cond.Type
+		}
+	}
+	return ""
+}
+
+// waitForJob polls a Job until it has finished or the timeout expires.
+func waitForJob(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string, timeout time.Duration) (*batchv1.Job, error) {
+	var job *batchv1.Job
+	err := wait.PollUntilContextTimeout(ctx, 5*time.Second, timeout, true, func(ctx context.Context) (bool, error) {
+		var err error
+		job, err = clientset.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return jobState(job) != "", nil
+	})
+	if wait.Interrupted(err) {
+		return nil, fmt.Errorf("did not finish within %s", timeout)
+	}
+	return job, err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// databaseKeyword is the word that marks a workload as a database.
+const databaseKeyword = "database"
+
+// nameMatcher decides whether a workload name marks it as a database. The
+// zero value looks for the keyword anywhere in the name; with a naming
+// convention, the keyword must be the whole of one segment of the name. A
+// name pattern or substrings replace the keyword: names matching the pattern
+// or containing any of the substrings match.
+type nameMatcher struct {
+	convention *regexp.Regexp
+	segment    string
+
+	pattern  *regexp.Regexp
+	contains []string
+}
+
+// withPatterns returns a matcher selecting names that match the regular
+// expression or contain one of the substrings, instead of the keyword. It
+// cannot be combined with a naming convention.
+func (m nameMatcher) withPatterns(pattern string, contains []string) (nameMatcher, error) {
+	if pattern == "" && len(contains) == 0 {
+		return m, nil
+	}
+	if m.convention != nil {
+		return nameMatcher{}, fmt.Errorf("--name-pattern and --name-contains cannot be combined with --naming-convention")
+	}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nameMatcher{}, fmt.Errorf("invalid --name-pattern: %w", err)
+		}
+		m.pattern = re
+	}
+	for _, s := range contains {
+		m.contains = append(m.contains, strings.ToLower(s))
+	}
+	return m, nil
+}
+
+// newNameMatcher compiles a naming convention such as
+// "{tenant}-{component}-{env}" into a matcher that compares the named segment
+// with the database keyword. Each placeholder matches one run of letters and
+// digits, so separators in the template split names unambiguously. Names that
+// do not follow the convention never match. An empty convention yields the
+// substring matcher.
+func newNameMatcher(convention, segment string) (nameMatcher, error) {
+	if convention == "" {
+		return nameMatcher{}, nil
+	}
+
+	placeholder := regexp.MustCompile(`\{([a-z][a-z0-9_]*)\}`)
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	found := false
+	last := 0
+	for _, loc := range placeholder.FindAllStringSubmatchIndex(convention, -1) {
+		pattern.WriteString(regexp.QuoteMeta(convention[last:loc[0]]))
+		name := convention[loc[2]:loc[3]]
+		fmt.Fprintf(&pattern, "(?P<%s>[a-z0-9]+)", name)
+		if name == segment {
+			found = true
+		}
+		last = loc[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(convention[last:]))
+	pattern.WriteString("$")
+
+	if !found {
+		return nameMatcher{}, fmt.Errorf("naming convention %q has no {%s} segment", convention, segment)
+	}
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nameMatcher{}, fmt.Errorf("invalid naming convention %q: %w", convention, err)
+	}
+	return nameMatcher{convention: re, segment: segment}, nil
+}
+
+// matches reports whether a workload name marks it as a database.
+func (m nameMatcher) matches(name string) bool {
+	if m.pattern != nil || len(m.contains) > 0 {
+		if m.pattern != nil && m.pattern.MatchString(name) {
+			return true
+		}
+		name = strings.ToLower(name)
+		for _, s := range m.contains {
+			if strings.Contains(name, s) {
+				return true
+			}
+		}
+		return false
+	}
+
+	name = strings.ToLower(name)
+	if m.convention == nil {
+		return strings.Contains(name, databaseKeyword)
+	}
+	return nameSegment(m.convention, name, m.segment) == databaseKeyword
+}
+
+// reason explains why a matching workload was selected.
+func (m nameMatcher) reason() string {
+	if m.pattern != nil || len(m.contains) > 0 {
+		var alternatives []string
+		if m.pattern != nil {
+			alternatives = append(alternatives, fmt.Sprintf("matches /%s/", m.pattern))
+		}
+		for _, s := range m.contains {
+			alternatives = append(alternatives, fmt.Sprintf("contains %q", s))
+		}
+		return "name " + strings.Join(alternatives, " or ")
+	}
+	if m.convention == nil {
+		return fmt.Sprintf("name contains %q", databaseKeyword)
+	}
+	return fmt.Sprintf("{%s} segment of the name is %q", m.segment, databaseKeyword)
+}
+
+// nameSegment returns the named segment of a name that follows a compiled
+// naming convention, or an empty string if it does not follow it.
+func nameSegment(convention *regexp.Regexp, name, segment string) string {
+	match := convention.FindStringSubmatch(name)
+	if match == nil {
+		return ""
+	}
+	return match[convention.SubexpIndex(segment)]
+}
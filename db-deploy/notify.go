@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// configNotificationsKey is the key of the --config file holding the
+// notification routes.
+const configNotificationsKey = "notifications"
+
+// notificationConfig is the notifications section of a --config file:
+//
+//	notifications:
+//	  smtp:
+//	    server: smtp.example.com:587
+//	    from: db-pods@example.com
+//	    username: db-pods
+//	    passwordEnv: SMTP_PASSWORD
+//	  routes:
+//	  - name: payments
+//	    namespaces: [payments, payments-*]
+//	    webhook: https://hooks.slack.com/services/...
+//	  - name: analytics
+//	    pattern: ^analytics-
+//	    email: [data-eng@example.com]
+//
+// Every route receives the results of the workloads it matches, so each
+// owning team only hears about its own databases.
+type notificationConfig struct {
+	SMTP   smtpConfig          `json:"smtp"`
+	Routes []notificationRoute `json:"routes"`
+}
+
+type smtpConfig struct {
+	Server   string `json:"server"`
+	From     string `json:"from"`
+	Username string `json:"username"`
+
+	// PasswordEnv names the environment variable holding the password, so
+	// that it stays out of the configuration file.
+	PasswordEnv string `json:"passwordEnv"`
+}
+
+// notificationRoute sends the results of matching workloads to a webhook, a
+// Slack incoming webhook for instance, and to email addresses. A route
+// without namespaces or pattern matches every workload.
+type notificationRoute struct {
+	Name       string   `json:"name"`
+	Namespaces []string `json:"namespaces"`
+	Pattern    string   `json:"pattern"`
+	Webhook    string   `json:"webhook"`
+	Email      []string `json:"email"`
+
+	pattern *regexp.Regexp
+}
+
+// matches reports whether the route covers the target: its namespace
+// matches one of the glob patterns, if any, and its name the regular
+// expression, if any.
+func (r notificationRoute) matches(t target) bool {
+	if len(r.Namespaces) > 0 && !excludedNamespace(t.Namespace, r.Namespaces) {
+		return false
+	}
+	return r.pattern == nil || r.pattern.MatchString(t.Name)
+}
+
+// loadNotificationConfig reads the notifications section of a --config file.
+// It returns nil if the file has none.
+func loadNotificationConfig(file string) (*notificationConfig, error) {
+	raw, err := readConfigSection(file, configNotificationsKey)
+	if err != nil || raw == nil {
+		return nil, err
+	}
+
+	var nc notificationConfig
+	if err := json.Unmarshal(raw, &nc); err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", file, configNotificationsKey, err)
+	}
+	for i := range nc.Routes {
+		r := &nc.Routes[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("route %d", i+1)
+		}
+		if r.Webhook == "" && len(r.Email) == 0 {
+			return nil, fmt.Errorf("%s: %s: %s has neither a webhook nor email addresses", file, configNotificationsKey, r.Name)
+		}
+		if len(r.Email) > 0 && (nc.SMTP.Server == "" || nc.SMTP.From == "") {
+			return nil, fmt.Errorf("%s: %s: %s sends email, which requires smtp.server and smtp.from", file, configNotificationsKey, r.Name)
+		}
+		for _, pattern := range r.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: %s: %s: invalid namespace pattern %q: %w", file, configNotificationsKey, r.Name, pattern, err)
+			}
+		}
+		if r.Pattern != "" {
+			if r.pattern, err = regexp.Compile(r.Pattern); err != nil {
+				return nil, fmt.Errorf("%s: %s: %s: invalid pattern: %w", file, configNotificationsKey, r.Name, err)
+			}
+		}
+	}
+	return &nc, nil
+}
+
+// notify sends each route the report of the workloads it matches. Routes
+// matching none of the results are not notified. Failures are returned
+// together once every route has been tried.
+func (nc *notificationConfig) notify(ctx context.Context, runID string, results []result) error {
+	var errs []string
+	for _, route := range nc.Routes {
+		var matched []result
+		for _, res := range results {
+			if route.matches(res.Target) {
+				matched = append(matched, res)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		var report bytes.Buffer
+		printReport(&report, matched, nil, nil)
+		subject := fmt.Sprintf("db-pods run %s: %s", runID, summarizeResults(matched))
+
+		if route.Webhook != "" {
+			if err := postNotification(ctx, route.Webhook, subject, report.String(), matched); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", route.Name, err))
+			}
+		}
+		if len(route.Email) > 0 {
+			if err := nc.SMTP.send(route.Email, subject, report.String()); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", route.Name, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("notifications failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// summarizeResults counts results by status, e.g. "2 restarted, 1 failed".
+func summarizeResults(results []result) string {
+	counts := make(map[string]int)
+	for _, res := range results {
+		counts[res.status()]++
+	}
+	var parts []string
+	for _, status := range []string{statusRestarted, statusRolloutFailed, statusFailed, statusSkipped, statusScaledToZero, statusDryRun} {
+		if n := counts[status]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, strings.ReplaceAll(status, "_", " ")))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// postNotification posts a report as JSON. The text field makes the payload
+// readable by Slack and compatible incoming webhooks.
+func postNotification(ctx context.Context, url, subject, report string, results []result) error {
+	type workload struct {
+		Kind      string `json:"kind"`
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+		Status    string `json:"status"`
+	}
+	payload := struct {
+		Text      string     `json:"text"`
+		Workloads []workload `json:"workloads"`
+	}{Text: subject + "\n```" + report + "```"}
+	for _, res := range results {
+		payload.Workloads = append(payload.Workloads, workload{res.Target.Kind, res.Target.Namespace, res.Target.Name, res.status()})
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// send emails a plain text message.
+func (c smtpConfig) send(to []string, subject, body string) error {
+	var auth smtp.Auth
+	if c.Username != "" {
+		host, _, _ := strings.Cut(c.Server, ":")
+		auth = smtp.PlainAuth("", c.Username, os.Getenv(c.PasswordEnv), host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(c.Server, auth, c.From, to, msg.Bytes())
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"redeploy-database-pods/pkg/apis/v1alpha1"
+	"redeploy-database-pods/pkg/restart"
+)
+
+//go:embed crd/databaserestartpolicies.yaml
+var policyCRD []byte
+
+// policyRetryDelay is the delay before a policy whose run could not start,
+// because another run holds the lease or discovery failed, is tried again.
+const policyRetryDelay = time.Minute
+
+// policyReconciler runs DatabaseRestartPolicies when their schedule is due.
+// Each run goes through the same checks as a db-pods run and takes the run
+// lease, so policies never restart workloads alongside each other or
+// alongside runs started from the command line.
+type policyReconciler struct {
+	client.Client
+	clientset     *kubernetes.Clientset
+	dynamic       dynamic.Interface
+	cluster       *clusterCapabilities
+	lockNamespace string
+	recorder      record.EventRecorder
+}
+
+// Reconcile validates a policy, runs it if its schedule is due and records
+// the outcome in its status. Runs missed while the operator was down are
+// made up by a single run.
+func (r *policyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var policy v1alpha1.DatabaseRestartPolicy
+	if err := r.Get(ctx, req.NamespacedName, &policy); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	base := policy.DeepCopy()
+	policy.Status.ObservedGeneration = policy.Generation
+
+	discovery, due, err := policySchedule(&policy)
+	switch {
+	case err != nil:
+		setPolicyCondition(&policy, v1alpha1.ConditionReady, false, "InvalidSpec", err.Error())
+		policy.Status.NextScheduleTime = nil
+		return ctrl.Result{}, r.patchStatus(ctx, &policy, base)
+	case policy.Spec.Suspend:
+		setPolicyCondition(&policy, v1alpha1.ConditionReady, false, "Suspended", "restarts are suspended")
+		policy.Status.NextScheduleTime = nil
+		return ctrl.Result{}, r.patchStatus(ctx, &policy, base)
+	}
+	setPolicyCondition(&policy, v1alpha1.ConditionReady, true, "Scheduled", fmt.Sprintf("restarts on schedule %q", policy.Spec.Schedule))
+
+	now := time.Now()
+	if now.Before(due) {
+		policy.Status.NextScheduleTime = &metav1.Time{Time: due}
+		return ctrl.Result{RequeueAfter: due.Sub(now)}, r.patchStatus(ctx, &policy, base)
+	}
+
+	run, err := r.runPolicy(ctx, &policy, discovery)
+	if err != nil {
+		slog.Error("Policy run did not start", "namespace", policy.Namespace, "policy", policy.Name, "error", err)
+		setPolicyCondition(&policy, v1alpha1.ConditionSucceeded, false, "RunNotStarted", err.Error())
+		r.recorder.Eventf(&policy, corev1.EventTypeWarning, "RunNotStarted", "Run did not start, retrying in %s: %v", policyRetryDelay, err)
+		return ctrl.Result{RequeueAfter: policyRetryDelay}, r.patchStatus(ctx, &policy, base)
+	}
+
+	policy.Status.LastScheduleTime = &metav1.Time{Time: due}
+	policy.Status.LastRun = run
+	summary := fmt.Sprintf("run %s restarted %d, skipped %d and failed %d workloads", run.RunID, run.Restarted, run.Skipped, run.Failed)
+	if run.Failed > 0 {
+		setPolicyCondition(&policy, v1alpha1.ConditionSucceeded, false, "WorkloadsFailed", summary)
+		r.recorder.Event(&policy, corev1.EventTypeWarning, "RunFailed", summary)
+	} else {
+		setPolicyCondition(&policy, v1alpha1.ConditionSucceeded, true, "RunCompleted", summary)
+		r.recorder.Event(&policy, corev1.EventTypeNormal, "RunCompleted", summary)
+	}
+
+	_, next, _ := policySchedule(&policy)
+	now = time.Now()
+	if next.Before(now) {
+		// The run outlasted the next scheduled time, which is skipped
+		schedule, _ := parseCron(policy.Spec.Schedule)
+		next, _ = schedule.next(now)
+	}
+	policy.Status.NextScheduleTime = &metav1.Time{Time: next}
+	return ctrl.Result{RequeueAfter: next.Sub(now)}, r.patchStatus(ctx, &policy, base)
+}
+
+// policySchedule returns the discovery options of a policy and when its next
+// run is due, counting from its last run or, before the first, from its
+// creation.
+func policySchedule(policy *v1alpha1.DatabaseRestartPolicy) (discoveryOptions, time.Time, error) {
+	discovery := discoveryOptions{namespaces: []string{policy.Namespace}, kinds: policy.Spec.Kinds}
+	for _, kind := range policy.Spec.Kinds {
+		discovery.includeRollouts = discovery.includeRollouts || kind == restart.KindRollout
+	}
+	if policy.Spec.Selector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(policy.Spec.Selector)
+		if err != nil {
+			return discovery, time.Time{}, fmt.Errorf("invalid selector: %w", err)
+		}
+		discovery.selector = selector.String()
+	}
+
+	schedule, err := parseCron(policy.Spec.Schedule)
+	if err != nil {
+		return discovery, time.Time{}, fmt.Errorf("invalid schedule %q: %w", policy.Spec.Schedule, err)
+	}
+	last := policy.CreationTimestamp.Time
+	if policy.Status.LastScheduleTime != nil {
+		last = policy.Status.LastScheduleTime.Time
+	}
+	due, ok := schedule.next(last)
+	if !ok {
+		return discovery, time.Time{}, fmt.Errorf("schedule %q never matches", policy.Spec.Schedule)
+	}
+	return discovery, due, nil
+}
+
+// policyOptions returns the options of the runs of a policy. They are those
+// of the retries of the daemon, with the safety constraints of the policy.
+func (r *policyReconciler) policyOptions(policy *v1alpha1.DatabaseRestartPolicy) options {
+	safety := policy.Spec.Safety
+	opts := options{
+		wait:                 true,
+		rolloutTimeout:       10 * time.Minute,
+		windowsTimeoutFactor: 3,
+		volumeOpTimeout:      time.Minute,
+		debug:                debugConfig{image: defaultDebugImage},
+		maxFleetUnavailable:  int(safety.MaxUnavailable),
+		rollback:             safety.RollbackOnFailure,
+		pauseOnPreemption:    safety.PauseOnPreemption,
+		cluster:              r.cluster,
+		reason:               policy.Spec.Reason,
+	}
+	opts.slo.action = sloBudgetBlock
+	if safety.RolloutTimeout != nil {
+		opts.rolloutTimeout = safety.RolloutTimeout.Duration
+	}
+	if safety.MaxBackupAge != nil {
+		opts.maxBackupAge = safety.MaxBackupAge.Duration
+	}
+	if safety.ReplicationTimeout != nil {
+		opts.replicationTimeout = safety.ReplicationTimeout.Duration
+	}
+	return opts
+}
+
+// runPolicy restarts the workloads of a policy one at a time, oldest pods
+// first, and returns the outcome. It returns an error if the run could not
+// start, such as during a cluster upgrade, in which case nothing was
+// restarted.
+func (r *policyReconciler) runPolicy(ctx context.Context, policy *v1alpha1.DatabaseRestartPolicy, discovery discoveryOptions) (*v1alpha1.RunStatus, error) {
+	targets, err := discoverTargets(ctx, r.clientset, r.dynamic, discovery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover workloads: %w", err)
+	}
+
+	if err := checkUpgrade(ctx, r.clientset, false); err != nil {
+		return nil, err
+	}
+
+	runID := newRunID()
+	lock, err := acquireRunLock(ctx, r.clientset, r.lockNamespace, runID, onConflictExit)
+	if err != nil {
+		return nil, err
+	}
+	if lock != nil {
+		defer lock.release()
+	}
+
+	run := &v1alpha1.RunStatus{RunID: runID, StartTime: metav1.Now()}
+	slog.Info("Running policy", "namespace", policy.Namespace, "policy", policy.Name, "workloads", len(targets), "runId", runID)
+	runner := &runner{clientset: r.clientset, dynamic: r.dynamic, opts: r.policyOptions(policy), runID: runID}
+	if runner.opts.maxFleetUnavailable > 0 {
+		fleet, err := newFleetMonitor(ctx, r.clientset, r.dynamic, targets)
+		if err != nil {
+			return nil, fmt.Errorf("failed to watch workloads: %w", err)
+		}
+		defer fleet.stop()
+		runner.fleet = fleet
+	}
+
+	for i := range targets {
+		if err := inspectPods(ctx, r.clientset, &targets[i]); err != nil {
+			workloadLogger(targets[i]).Error("Error inspecting pods", "error", err)
+		}
+	}
+	sortByPodAge(targets)
+
+	maxFailures := int32(1)
+	if policy.Spec.Safety.MaxFailures > 0 {
+		maxFailures = policy.Spec.Safety.MaxFailures
+	}
+	for _, t := range targets {
+		var res result
+		switch {
+		case run.Failed >= maxFailures:
+			res = result{Target: t, Skipped: fmt.Sprintf("the run stopped after %d failed restarts", run.Failed)}
+		case policy.Spec.Safety.MinInterval != nil && !t.LastRestart.IsZero() && time.Since(t.LastRestart) < policy.Spec.Safety.MinInterval.Duration:
+			res = result{Target: t, Skipped: fmt.Sprintf("restarted %s ago, within the minimum interval of %s", formatAge(time.Since(t.LastRestart)), policy.Spec.Safety.MinInterval.Duration)}
+		default:
+			res = runner.run(ctx, t)
+		}
+
+		workload := v1alpha1.WorkloadStatus{Kind: t.Kind, Name: t.Name, Result: res.status()}
+		switch workload.Result {
+		case statusRestarted:
+			run.Restarted++
+		case statusFailed, statusRolloutFailed:
+			run.Failed++
+			if workload.Message = errorString(res.Err); workload.Message == "" {
+				workload.Message = errorString(res.RolloutErr)
+			}
+		default:
+			run.Skipped++
+			workload.Message = res.Skipped
+		}
+		run.Workloads = append(run.Workloads, workload)
+	}
+	run.CompletionTime = &metav1.Time{Time: time.Now()}
+	return run, nil
+}
+
+// errorString returns the message of err, or "" if it is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// setPolicyCondition sets a condition of a policy for its current generation.
+func setPolicyCondition(policy *v1alpha1.DatabaseRestartPolicy, conditionType string, status bool, reason, message string) {
+	condition := metav1.Condition{
+		Type:               conditionType,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: policy.Generation,
+		Reason:             reason,
+		Message:            message,
+	}
+	if status {
+		condition.Status = metav1.ConditionTrue
+	}
+	apimeta.SetStatusCondition(&policy.Status.Conditions, condition)
+}
+
+// patchStatus writes the status of a policy if it changed since base.
+func (r *policyReconciler) patchStatus(ctx context.Context, policy, base *v1alpha1.DatabaseRestartPolicy) error {
+	if err := r.Status().Patch(ctx, policy, client.MergeFrom(base)); err != nil {
+		return fmt.Errorf("failed to update the status of policy %s/%s: %w", policy.Namespace, policy.Name, err)
+	}
+	return nil
+}
+
+// operatorCommand runs "db-pods operator", which reconciles
+// DatabaseRestartPolicies: it restarts the workloads each policy selects on
+// the policy's schedule and reports every run in the policy's status and
+// events.
+func operatorCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	watchNamespace := fs.String("watch-namespace", "", "only reconcile the policies of this namespace (all namespaces when empty)")
+	lockNamespace := fs.String("lock-namespace", "default", "namespace of the "+runLeaseName+" Lease that keeps the runs of policies apart from each other and from db-pods runs")
+	metricsListen := fs.String("metrics-listen", ":8080", "address to serve the controller metrics on, or 0 to disable them")
+	healthListen := fs.String("health-listen", ":8081", "address to serve the /healthz and /readyz probes on")
+	leaderElect := fs.Bool("leader-elect", true, "elect a leader through the "+operatorLeaderLease+" Lease in --lock-namespace, so that only one of several replicas reconciles policies")
+	printCRD := fs.Bool("print-crd", false, "print the CustomResourceDefinition of DatabaseRestartPolicy and exit, for kubectl apply or a GitOps repository")
+	return func(args []string) {
+		setupLogging()
+
+		if *printCRD {
+			os.Stdout.Write(policyCRD)
+			return
+		}
+
+		ctrl.SetLogger(logr.FromSlogHandler(slog.Default().Handler()))
+		scheme := runtime.NewScheme()
+		if err := clientgoscheme.AddToScheme(scheme); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if err := v1alpha1.AddToScheme(scheme); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		mgrOpts := ctrl.Options{
+			Scheme:                 scheme,
+			Metrics:                metricsserver.Options{BindAddress: *metricsListen},
+			HealthProbeBindAddress: *healthListen,
+			// Replicas waiting for the lease still answer their probes
+			LeaderElection:                *leaderElect,
+			LeaderElectionID:              operatorLeaderLease,
+			LeaderElectionNamespace:       *lockNamespace,
+			LeaderElectionReleaseOnCancel: true,
+		}
+		if *watchNamespace != "" {
+			mgrOpts.Cache.DefaultNamespaces = map[string]cache.Config{*watchNamespace: {}}
+		}
+		mgr, err := ctrl.NewManager(restConfig(), mgrOpts)
+		if err != nil {
+			log.Fatalf("Error creating the controller manager: %v", err)
+		}
+		if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if err := mgr.AddReadyzCheck("ping", healthz.Ping); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		clientset, dynamicClient := newClients()
+		reconciler := &policyReconciler{
+			Client:        mgr.GetClient(),
+			clientset:     clientset,
+			dynamic:       dynamicClient,
+			cluster:       detectCapabilitiesOrWarn(clientset),
+			lockNamespace: *lockNamespace,
+			recorder:      mgr.GetEventRecorderFor("db-pods"),
+		}
+		// Status updates leave the generation alone and do not trigger
+		// another reconcile; runs are triggered by their requeue time
+		err = ctrl.NewControllerManagedBy(mgr).
+			For(&v1alpha1.DatabaseRestartPolicy{}).
+			WithEventFilter(predicate.GenerationChangedPredicate{}).
+			Complete(reconciler)
+		if err != nil {
+			log.Fatalf("Error creating the controller: %v", err)
+		}
+
+		slog.Info("Reconciling DatabaseRestartPolicies", "namespace", *watchNamespace, "lockNamespace", *lockNamespace)
+		if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// osLabel is the well-known node label holding the operating system.
+const osLabel = "kubernetes.io/os"
+
+// osWindows is the operating system of Windows nodes. Windows pods start and
+// stop far more slowly than Linux ones, so their timeouts are extended.
+const osWindows = "windows"
+
+// podOS returns the operating system a pod template is scheduled to, from its
+// spec.os, its node selector or its required node affinity, or "" if it does
+// not constrain it.
+func podOS(spec *corev1.PodSpec) string {
+	if spec.OS != nil && spec.OS.Name != "" {
+		return string(spec.OS.Name)
+	}
+	if os := spec.NodeSelector[osLabel]; os != "" {
+		return os
+	}
+
+	// Node selector terms are ORed, so all of them must agree
+	affinity := spec.Affinity
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return ""
+	}
+	os := ""
+	for _, term := range affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		termOS := ""
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == osLabel && expr.Operator == corev1.NodeSelectorOpIn && len(expr.Values) == 1 {
+				termOS = expr.Values[0]
+			}
+		}
+		if termOS == "" || (os != "" && termOS != os) {
+			return ""
+		}
+		os = termOS
+	}
+	return os
+}
+
+// scaleTimeout extends a timeout for targets running on Windows nodes.
+func scaleTimeout(t target, timeout time.Duration, windowsFactor float64) time.Duration {
+	if t.OS != osWindows || windowsFactor <= 0 {
+		return timeout
+	}
+	return time.Duration(float64(timeout) * windowsFactor)
+}
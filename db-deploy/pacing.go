@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pacingConfig describes how the campaign is paced by the error rate of the
+// services consuming the databases.
+type pacingConfig struct {
+	prometheusURL string
+	query         string
+	maxIncrease   float64
+	interval      time.Duration
+	maxPause      time.Duration
+}
+
+// pacer slows down or pauses a run while the error rate of consuming
+// services is elevated above the baseline measured when the run started.
+// Within half of the allowed increase, restarts proceed normally; up to the
+// allowed increase, each restart waits one interval first; beyond it the run
+// pauses until the error rate is back within half of the increase.
+type pacer struct {
+	cfg      pacingConfig
+	baseline float64
+	client   *http.Client
+}
+
+// newPacer measures the baseline error rate.
+func newPacer(ctx context.Context, cfg pacingConfig) (*pacer, error) {
+	p := &pacer{cfg: cfg, client: &http.Client{Timeout: 30 * time.Second}}
+	baseline, err := p.errorRate(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure baseline error rate: %w", err)
+	}
+	p.baseline = baseline
+	fmt.Fprintf(progress, "Baseline error rate of consuming services: %g\n", baseline)
+	return p, nil
+}
+
+// wait blocks until the error rate allows the next restart. It fails if the
+// error rate stays elevated for longer than the maximum pause.
+func (p *pacer) wait(ctx context.Context) error {
+	slow := p.baseline + p.cfg.maxIncrease/2
+	limit := p.baseline + p.cfg.maxIncrease
+
+	rate, err := p.errorRate(ctx)
+	if err != nil {
+		return err
+	}
+	if rate <= slow {
+		return nil
+	}
+	if rate <= limit {
+		fmt.Fprintf(progress, "Error rate of consuming services is rising (%g, baseline %g), slowing down\n", rate, p.baseline)
+		return sleep(ctx, p.cfg.interval)
+	}
+
+	fmt.Fprintf(progress, "Error rate of consuming services is elevated (%g, baseline %g), pausing\n", rate, p.baseline)
+	deadline := time.Now().Add(p.cfg.maxPause)
+	for rate > slow {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("error rate of consuming services still elevated (%g, baseline %g) after pausing for %s", rate, p.baseline, p.cfg.maxPause)
+		}
+		if err := sleep(ctx, p.cfg.interval); err != nil {
+			return err
+		}
+		if rate, err = p.errorRate(ctx); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(progress, "Error rate of consuming services is back to %g, resuming\n", rate)
+	return nil
+}
+
+// errorRate evaluates the pacing query and returns the highest value among
+// the returned series, so one suffering consumer is enough to slow down.
+func (p *pacer) errorRate(ctx context.Context) (float64, error) {
+	values, err := queryPrometheus(ctx, p.client, p.cfg.prometheusURL, p.cfg.query)
+	if err != nil {
+		return 0, err
+	}
+
+	var highest float64
+	for _, v := range values {
+		if v > highest {
+			highest = v
+		}
+	}
+	return highest, nil
+}
+
+// queryPrometheus evaluates an instant query and returns the value of every
+// returned series.
+func queryPrometheus(ctx context.Context, client *http.Client, prometheusURL, query string) ([]float64, error) {
+	endpoint := strings.TrimSuffix(prometheusURL, "/") + "/api/v1/query?" + url.Values{"query": {query}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Value [2]interface{} `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid response from Prometheus: %w", err)
+	}
+	if body.Status != "success" {
+		return nil, fmt.Errorf("prometheus query failed: %s", body.Error)
+	}
+	if body.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("query must return an instant vector, got %s", body.Data.ResultType)
+	}
+
+	var values []float64
+	for _, sample := range body.Data.Result {
+		value, ok := sample.Value[1].(string)
+		if !ok {
+			continue
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
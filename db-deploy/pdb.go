@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// pdbPoll is how often the PodDisruptionBudgets blocking a restart are
+// looked at again.
+const pdbPoll = 10 * time.Second
+
+// rolloutUnavailable returns how many pods of the target its rollout takes
+// down at once, as set by its update strategy. Zero means the rollout keeps
+// every pod available, such as a Deployment that only surges.
+func rolloutUnavailable(ctx context.Context, clientset kubernetes.Interface, t target) (int, error) {
+	switch t.Kind {
+	case "deployment":
+		deployment, err := clientset.AppsV1().Deployments(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("failed to get deployment: %w", err)
+		}
+		replicas := 1
+		if deployment.Spec.Replicas != nil {
+			replicas = int(*deployment.Spec.Replicas)
+		}
+		if deployment.Spec.Strategy.Type == appsv1.RecreateDeploymentStrategyType {
+			return replicas, nil
+		}
+		maxSurge, maxUnavailable := intstr.FromString("25%"), intstr.FromString("25%")
+		if ru := deployment.Spec.Strategy.RollingUpdate; ru != nil {
+			if ru.MaxSurge != nil {
+				maxSurge = *ru.MaxSurge
+			}
+			if ru.MaxUnavailable != nil {
+				maxUnavailable = *ru.MaxUnavailable
+			}
+		}
+		// Resolved as the deployment controller does: surge rounds up,
+		// unavailability down, and at least one of them must be positive
+		surge, err := intstr.GetScaledValueFromIntOrPercent(&maxSurge, replicas, true)
+		if err != nil {
+			return 0, err
+		}
+		unavailable, err := intstr.GetScaledValueFromIntOrPercent(&maxUnavailable, replicas, false)
+		if err != nil {
+			return 0, err
+		}
+		if surge == 0 && unavailable == 0 {
+			unavailable = 1
+		}
+		return unavailable, nil
+	case "statefulset":
+		sts, err := clientset.AppsV1().StatefulSets(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("failed to get statefulset: %w", err)
+		}
+		if sts.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+			return 0, nil
+		}
+		if ru := sts.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.MaxUnavailable != nil {
+			replicas := 1
+			if sts.Spec.Replicas != nil {
+				replicas = int(*sts.Spec.Replicas)
+			}
+			unavailable, err := intstr.GetScaledValueFromIntOrPercent(ru.MaxUnavailable, replicas, true)
+			if err != nil {
+				return 0, err
+			}
+			return max(unavailable, 1), nil
+		}
+		return 1, nil
+	case "daemonset":
+		ds, err := clientset.AppsV1().DaemonSets(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("failed to get daemonset: %w", err)
+		}
+		if ds.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType {
+			return 0, nil
+		}
+		ru := ds.Spec.UpdateStrategy.RollingUpdate
+		if ru == nil {
+			return 1, nil
+		}
+		scheduled := int(ds.Status.DesiredNumberScheduled)
+		if ru.MaxSurge != nil {
+			surge, err := intstr.GetScaledValueFromIntOrPercent(ru.MaxSurge, scheduled, true)
+			if err != nil {
+				return 0, err
+			}
+			if surge > 0 {
+				return 0, nil
+			}
+		}
+		if ru.MaxUnavailable != nil {
+			unavailable, err := intstr.GetScaledValueFromIntOrPercent(ru.MaxUnavailable, scheduled, true)
+			if err != nil {
+				return 0, err
+			}
+			return max(unavailable, 1), nil
+		}
+		return 1, nil
+	}
+	// Argo Rollouts replace pods one step at a time
+	return 1, nil
+}
+
+// blockingBudgets returns the PodDisruptionBudgets covering pods of the
+// target that allow fewer disruptions than its rollout causes, and whether
+// they only block it until pods they count as unhealthy recover.
+func blockingBudgets(ctx context.Context, clientset kubernetes.Interface, t target, unavailable int) ([]string, bool, error) {
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid selector: %w", err)
+	}
+	pods, err := clientset.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to list pods: %w", err)
+	}
+	budgets, err := clientset.PolicyV1().PodDisruptionBudgets(t.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to list poddisruptionbudgets: %w", err)
+	}
+
+	var blocking []string
+	temporary := true
+	for _, pdb := range budgets.Items {
+		if !coversPods(&pdb, pods.Items) {
+			continue
+		}
+		status := pdb.Status
+		stale := status.ObservedGeneration < pdb.Generation
+		if !stale && int(status.DisruptionsAllowed) >= unavailable {
+			continue
+		}
+		blocking = append(blocking, fmt.Sprintf("%s allows %d disruptions with %d of %d pods healthy", pdb.Name, status.DisruptionsAllowed, status.CurrentHealthy, status.ExpectedPods))
+		if !stale && status.CurrentHealthy >= status.ExpectedPods {
+			temporary = false
+		}
+	}
+	return blocking, temporary, nil
+}
+
+// coversPods reports whether the budget selects any of the pods. Budgets
+// with an empty selector select nothing, as with the eviction API.
+func coversPods(pdb *policyv1.PodDisruptionBudget, pods []corev1.Pod) bool {
+	if pdb.Spec.Selector == nil {
+		return false
+	}
+	selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+	if err != nil || selector.Empty() {
+		return false
+	}
+	for _, pod := range pods {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForDisruptionBudgets fences the restart of a target whose pods are
+// covered by PodDisruptionBudgets: a rolling restart does not go through the
+// eviction API, so it would take down more pods than the budgets allow. It
+// waits up to timeout for them to allow as many disruptions as the rollout
+// causes. It returns why the target may not be restarted, or "", and whether
+// that may clear up: budgets blocked by unhealthy pods may allow the restart
+// later, while budgets that allow too few disruptions with every pod healthy
+// never will.
+func waitForDisruptionBudgets(ctx context.Context, clientset kubernetes.Interface, t target, timeout time.Duration) (string, bool, error) {
+	if t.Selector == nil {
+		return "", false, nil
+	}
+	unavailable, err := rolloutUnavailable(ctx, clientset, t)
+	if err != nil || unavailable == 0 {
+		return "", false, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		blocking, temporary, err := blockingBudgets(ctx, clientset, t, unavailable)
+		if err != nil {
+			return "", false, err
+		}
+		if len(blocking) == 0 {
+			if waiting {
+				progressf(t, "PodDisruptionBudgets of %s allow its restart again", t)
+			}
+			return "", false, nil
+		}
+		reason := fmt.Sprintf("the rollout takes down %d pods at once, but PodDisruptionBudget %s", unavailable, strings.Join(blocking, "; "))
+		if !temporary || !time.Now().Before(deadline) {
+			return reason, temporary, nil
+		}
+		if !waiting {
+			progressf(t, "Waiting for the PodDisruptionBudgets of %s to allow its restart: %s", t, reason)
+			waiting = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		case <-time.After(pdbPoll):
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto copies the receiver into out.
+func (in *DatabaseRestartPolicy) DeepCopyInto(out *DatabaseRestartPolicy) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy returns a copy of the policy.
+func (in *DatabaseRestartPolicy) DeepCopy() *DatabaseRestartPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseRestartPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *DatabaseRestartPolicy) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *DatabaseRestartPolicyList) DeepCopyInto(out *DatabaseRestartPolicyList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		out.Items = make([]DatabaseRestartPolicy, len(in.Items))
+		for i := range in.Items {
+			in.Items[i].DeepCopyInto(&out.Items[i])
+		}
+	}
+}
+
+// DeepCopy returns a copy of the list.
+func (in *DatabaseRestartPolicyList) DeepCopy() *DatabaseRestartPolicyList {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseRestartPolicyList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object.
+func (in *DatabaseRestartPolicyList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *DatabaseRestartPolicySpec) DeepCopyInto(out *DatabaseRestartPolicySpec) {
+	*out = *in
+	if in.Selector != nil {
+		out.Selector = in.Selector.DeepCopy()
+	}
+	if in.Kinds != nil {
+		out.Kinds = append([]string(nil), in.Kinds...)
+	}
+	in.Safety.DeepCopyInto(&out.Safety)
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *SafetySpec) DeepCopyInto(out *SafetySpec) {
+	*out = *in
+	out.RolloutTimeout = copyDuration(in.RolloutTimeout)
+	out.MinInterval = copyDuration(in.MinInterval)
+	out.MaxBackupAge = copyDuration(in.MaxBackupAge)
+	out.ReplicationTimeout = copyDuration(in.ReplicationTimeout)
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *DatabaseRestartPolicyStatus) DeepCopyInto(out *DatabaseRestartPolicyStatus) {
+	*out = *in
+	if in.LastScheduleTime != nil {
+		out.LastScheduleTime = in.LastScheduleTime.DeepCopy()
+	}
+	if in.NextScheduleTime != nil {
+		out.NextScheduleTime = in.NextScheduleTime.DeepCopy()
+	}
+	if in.LastRun != nil {
+		out.LastRun = new(RunStatus)
+		in.LastRun.DeepCopyInto(out.LastRun)
+	}
+	if in.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(in.Conditions))
+		for i := range in.Conditions {
+			in.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+}
+
+// DeepCopyInto copies the receiver into out.
+func (in *RunStatus) DeepCopyInto(out *RunStatus) {
+	*out = *in
+	in.StartTime.DeepCopyInto(&out.StartTime)
+	if in.CompletionTime != nil {
+		out.CompletionTime = in.CompletionTime.DeepCopy()
+	}
+	if in.Workloads != nil {
+		out.Workloads = append([]WorkloadStatus(nil), in.Workloads...)
+	}
+}
+
+func copyDuration(d *metav1.Duration) *metav1.Duration {
+	if d == nil {
+		return nil
+	}
+	c := *d
+	return &c
+}
@@ -0,0 +1,21 @@
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+// GroupVersion is the API group and version of the resources.
+var GroupVersion = schema.GroupVersion{Group: "db-restart.io", Version: "v1alpha1"}
+
+var (
+	// SchemeBuilder registers the resources with a scheme.
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the resources to a scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	SchemeBuilder.Register(&DatabaseRestartPolicy{}, &DatabaseRestartPolicyList{})
+}
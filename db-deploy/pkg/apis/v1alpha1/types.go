@@ -0,0 +1,148 @@
+// Package v1alpha1 holds the DatabaseRestartPolicy resource of the db-pods
+// operator, in the db-restart.io API group. A policy declares which database
+// workloads of its namespace are restarted, when, and within which safety
+// constraints, so that restarts are managed in Git like the workloads
+// themselves instead of through ad-hoc runs.
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DatabaseRestartPolicy restarts the database workloads of its namespace on a
+// schedule.
+type DatabaseRestartPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DatabaseRestartPolicySpec   `json:"spec"`
+	Status DatabaseRestartPolicyStatus `json:"status,omitempty"`
+}
+
+// DatabaseRestartPolicySpec is the desired restart behaviour of a policy.
+type DatabaseRestartPolicySpec struct {
+	// Selector picks the workloads by label. Without it, the workloads whose
+	// name marks them as databases are picked, as in a db-pods run.
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// Kinds restricts the workload kinds considered: deployment,
+	// statefulset, daemonset or rollout. Deployments, StatefulSets and
+	// DaemonSets are considered when empty.
+	Kinds []string `json:"kinds,omitempty"`
+
+	// Schedule is a five-field cron expression, evaluated in UTC unless
+	// prefixed with TZ=ZONE, at whose minutes the workloads are restarted.
+	Schedule string `json:"schedule"`
+
+	// Suspend stops scheduling restarts without deleting the policy.
+	Suspend bool `json:"suspend,omitempty"`
+
+	// Reason is recorded in the restart history of the workloads. It
+	// defaults to what their state says, as in a db-pods run.
+	Reason string `json:"reason,omitempty"`
+
+	// Safety constrains the scheduled runs.
+	Safety SafetySpec `json:"safety,omitempty"`
+}
+
+// SafetySpec holds the constraints of the runs of a policy. The checks every
+// run makes, such as freezes, blackout windows and migrations, always apply.
+type SafetySpec struct {
+	// RolloutTimeout is how long each rollout may take before the workload
+	// counts as failed. It defaults to 10 minutes.
+	RolloutTimeout *metav1.Duration `json:"rolloutTimeout,omitempty"`
+
+	// MinInterval skips workloads restarted more recently than this, by the
+	// policy or otherwise.
+	MinInterval *metav1.Duration `json:"minInterval,omitempty"`
+
+	// MaxBackupAge refuses to restart databases whose last backup is older
+	// than this.
+	MaxBackupAge *metav1.Duration `json:"maxBackupAge,omitempty"`
+
+	// ReplicationTimeout is how long a member of a cluster managed by a
+	// recognised database operator waits for the cluster to report healthy
+	// replication before it is left for the next run. Degraded clusters are
+	// left alone at once by default.
+	ReplicationTimeout *metav1.Duration `json:"replicationTimeout,omitempty"`
+
+	// MaxUnavailable pauses before each restart while more than this many
+	// replicas of the workloads of the policy are unavailable.
+	MaxUnavailable int32 `json:"maxUnavailable,omitempty"`
+
+	// MaxFailures stops a run once this many workloads failed to restart,
+	// leaving the rest for the next run. It defaults to 1.
+	MaxFailures int32 `json:"maxFailures,omitempty"`
+
+	// RollbackOnFailure rolls Deployments whose rollout did not complete
+	// back to their previous revision.
+	RollbackOnFailure bool `json:"rollbackOnFailure,omitempty"`
+
+	// PauseOnPreemption ends a run once a pod of a restarted workload is
+	// preempted by a higher-priority pod.
+	PauseOnPreemption bool `json:"pauseOnPreemption,omitempty"`
+}
+
+// DatabaseRestartPolicyStatus is the observed state of a policy.
+type DatabaseRestartPolicyStatus struct {
+	// ObservedGeneration is the generation of the spec last reconciled.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// LastScheduleTime is the scheduled time of the last run.
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+
+	// NextScheduleTime is when the next run is due.
+	NextScheduleTime *metav1.Time `json:"nextScheduleTime,omitempty"`
+
+	// LastRun is the outcome of the last run.
+	LastRun *RunStatus `json:"lastRun,omitempty"`
+
+	// Conditions holds the Ready condition, which is false while the
+	// schedule is invalid or the policy suspended, and the Succeeded
+	// condition of the last run.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// RunStatus is the outcome of one run of a policy.
+type RunStatus struct {
+	// RunID identifies the run in the logs, events and annotations of the
+	// workloads, as for db-pods runs.
+	RunID string `json:"runId"`
+
+	StartTime      metav1.Time  `json:"startTime"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	Restarted int32 `json:"restarted"`
+	Skipped   int32 `json:"skipped"`
+	Failed    int32 `json:"failed"`
+
+	// Workloads lists the outcome of each workload of the run.
+	Workloads []WorkloadStatus `json:"workloads,omitempty"`
+}
+
+// WorkloadStatus is the outcome of one workload in a run.
+type WorkloadStatus struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+
+	// Result is restarted, rollout_failed, failed, skipped or
+	// scaled_to_zero.
+	Result string `json:"result"`
+
+	// Message tells why the workload was skipped or failed.
+	Message string `json:"message,omitempty"`
+}
+
+// DatabaseRestartPolicyList is a list of policies.
+type DatabaseRestartPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []DatabaseRestartPolicy `json:"items"`
+}
+
+// Condition types of policies.
+const (
+	ConditionReady     = "Ready"
+	ConditionSucceeded = "Succeeded"
+)
@@ -0,0 +1,123 @@
+package restart
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// templateMutations compares the pod template that was sent to the API server
+// with the one it returned and lists the fields that differ. Anything listed
+// was changed by a mutating admission webhook rather than by the restart.
+func templateMutations(sent, returned *corev1.PodTemplateSpec) []string {
+	a, err := runtime.DefaultUnstructuredConverter.ToUnstructured(sent)
+	if err != nil {
+		return []string{fmt.Sprintf("<could not compare templates: %v>", err)}
+	}
+	b, err := runtime.DefaultUnstructuredConverter.ToUnstructured(returned)
+	if err != nil {
+		return []string{fmt.Sprintf("<could not compare templates: %v>", err)}
+	}
+	return diffPaths("spec.template", a, b)
+}
+
+// patchMutations compares the restart patch with the pod template the API
+// server returned for it. Without the template from before the patch, other
+// fields cannot be told apart from changes controllers made meanwhile, so
+// only a changed restart annotation is listed.
+func patchMutations(restartedAt string, returned *corev1.PodTemplateSpec) []string {
+	if returned.Annotations[RestartedAtAnnotation] != restartedAt {
+		return []string{"spec.template.metadata.annotations." + RestartedAtAnnotation}
+	}
+	return nil
+}
+
+// diffPaths returns the paths below prefix at which a and b differ. Lists of
+// named items, such as containers, are matched by name so that an injected
+// container is reported once instead of shifting every later index.
+func diffPaths(prefix string, a, b interface{}) []string {
+	if reflect.DeepEqual(a, b) {
+		return nil
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			return []string{prefix}
+		}
+		keys := make(map[string]bool)
+		for k := range av {
+			keys[k] = true
+		}
+		for k := range bv {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		var paths []string
+		for _, k := range sorted {
+			paths = append(paths, diffPaths(prefix+"."+k, av[k], bv[k])...)
+		}
+		return paths
+
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			return []string{prefix}
+		}
+		an, aNamed := namedItems(av)
+		bn, bNamed := namedItems(bv)
+		if !aNamed || !bNamed {
+			return []string{prefix}
+		}
+
+		var paths []string
+		for _, name := range sortedKeys(an, bn) {
+			paths = append(paths, diffPaths(fmt.Sprintf("%s[%s]", prefix, name), an[name], bn[name])...)
+		}
+		return paths
+	}
+	return []string{prefix}
+}
+
+// namedItems indexes a list by the "name" field of its items. It reports
+// false if any item has no name.
+func namedItems(items []interface{}) (map[string]interface{}, bool) {
+	named := make(map[string]interface{}, len(items))
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		name, ok := m["name"].(string)
+		if !ok {
+			return nil, false
+		}
+		named[name] = m
+	}
+	return named, true
+}
+
+// sortedKeys returns the union of the keys of a and b in sorted order.
+func sortedKeys(a, b map[string]interface{}) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, m := range []map[string]interface{}{a, b} {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
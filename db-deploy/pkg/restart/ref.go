@@ -0,0 +1,80 @@
+// Package restart holds the parts of db-pods that other programs can build
+// on: parsing workload references and, through Restarter, restarting
+// workloads and waiting for their rollouts. The db-pods command is a wrapper
+// adding target discovery, safety checks and reporting around it.
+package restart
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Kinds of workloads that can be restarted.
+const (
+	KindDeployment  = "deployment"
+	KindStatefulSet = "statefulset"
+	KindDaemonSet   = "daemonset"
+	KindRollout     = "rollout"
+)
+
+// kindAliases maps the accepted spellings of each kind, as kubectl accepts
+// them, to the kind.
+var kindAliases = map[string]string{
+	"deployment": KindDeployment, "deployments": KindDeployment, "deploy": KindDeployment,
+	"statefulset": KindStatefulSet, "statefulsets": KindStatefulSet, "sts": KindStatefulSet,
+	"daemonset": KindDaemonSet, "daemonsets": KindDaemonSet, "ds": KindDaemonSet,
+	"rollout": KindRollout, "rollouts": KindRollout, "ro": KindRollout,
+}
+
+// TargetRef identifies a workload. Its text form is KIND/NAMESPACE/NAME, as
+// used on the command line and in plan files.
+type TargetRef struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// ParseTargetRef parses a workload reference of the form KIND/NAMESPACE/NAME,
+// where KIND is deployment, statefulset, daemonset or rollout, in singular or
+// plural, or one of their short names. The kind is normalised and the
+// reference validated.
+func ParseTargetRef(s string) (TargetRef, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 3 {
+		return TargetRef{}, fmt.Errorf("invalid workload reference %q, expected KIND/NAMESPACE/NAME", s)
+	}
+	kind, ok := kindAliases[strings.ToLower(parts[0])]
+	if !ok {
+		return TargetRef{}, fmt.Errorf("invalid workload reference %q: unsupported kind %q", s, parts[0])
+	}
+	ref := TargetRef{Kind: kind, Namespace: parts[1], Name: parts[2]}
+	if err := ref.Validate(); err != nil {
+		return TargetRef{}, fmt.Errorf("invalid workload reference %q: %w", s, err)
+	}
+	return ref, nil
+}
+
+// String returns the reference as KIND/NAMESPACE/NAME. It is parsed back by
+// ParseTargetRef.
+func (r TargetRef) String() string {
+	return r.Kind + "/" + r.Namespace + "/" + r.Name
+}
+
+// Validate checks that the kind is supported and that the namespace and name
+// are valid object names.
+func (r TargetRef) Validate() error {
+	switch r.Kind {
+	case KindDeployment, KindStatefulSet, KindDaemonSet, KindRollout:
+	default:
+		return fmt.Errorf("unsupported kind %q", r.Kind)
+	}
+	if errs := validation.IsDNS1123Label(r.Namespace); len(errs) > 0 {
+		return fmt.Errorf("invalid namespace %q: %s", r.Namespace, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsDNS1123Subdomain(r.Name); len(errs) > 0 {
+		return fmt.Errorf("invalid name %q: %s", r.Name, strings.Join(errs, "; "))
+	}
+	return nil
+}
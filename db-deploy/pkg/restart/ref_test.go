@@ -0,0 +1,68 @@
+package restart
+
+import "testing"
+
+func TestParseTargetRef(t *testing.T) {
+	tests := []struct {
+		in   string
+		want TargetRef
+	}{
+		{"deployment/payments/api", TargetRef{Kind: KindDeployment, Namespace: "payments", Name: "api"}},
+		{"deploy/payments/api", TargetRef{Kind: KindDeployment, Namespace: "payments", Name: "api"}},
+		{"statefulsets/payments/postgres", TargetRef{Kind: KindStatefulSet, Namespace: "payments", Name: "postgres"}},
+		{"StatefulSet/payments/postgres", TargetRef{Kind: KindStatefulSet, Namespace: "payments", Name: "postgres"}},
+		{"sts/payments/postgres-0.replica", TargetRef{Kind: KindStatefulSet, Namespace: "payments", Name: "postgres-0.replica"}},
+		{"ds/kube-system/node-exporter", TargetRef{Kind: KindDaemonSet, Namespace: "kube-system", Name: "node-exporter"}},
+		{"ro/payments/api", TargetRef{Kind: KindRollout, Namespace: "payments", Name: "api"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseTargetRef(tt.in)
+		if err != nil {
+			t.Errorf("ParseTargetRef(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseTargetRef(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseTargetRefInvalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"payments/postgres",
+		"statefulset/payments/postgres/0",
+		"pod/payments/postgres",
+		"statefulset//postgres",
+		"statefulset/Payments/postgres",
+		"statefulset/payments/",
+		"statefulset/payments/Postgres",
+	} {
+		if ref, err := ParseTargetRef(in); err == nil {
+			t.Errorf("ParseTargetRef(%q) = %+v, want an error", in, ref)
+		}
+	}
+}
+
+func TestTargetRefStringRoundTrip(t *testing.T) {
+	ref := TargetRef{Kind: KindStatefulSet, Namespace: "payments", Name: "postgres"}
+	if got := ref.String(); got != "statefulset/payments/postgres" {
+		t.Fatalf("String() = %q", got)
+	}
+	parsed, err := ParseTargetRef(ref.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != ref {
+		t.Errorf("ParseTargetRef(%q) = %+v, want %+v", ref.String(), parsed, ref)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (TargetRef{Kind: "pod", Namespace: "payments", Name: "postgres"}).Validate(); err == nil {
+		t.Error("Validate accepted an unsupported kind")
+	}
+	if err := (TargetRef{Kind: KindDeployment, Namespace: "payments", Name: "api"}).Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package restart
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+// RestartedAtAnnotation is the pod template annotation that triggers the
+// rollout of deployments, statefulsets and daemonsets, as set by kubectl
+// rollout restart.
+const RestartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// RolloutResource is the resource of Argo Rollouts.
+var RolloutResource = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+
+// Restarter restarts workloads the way kubectl rollout restart does and waits
+// for their rollouts. It only needs a kubernetes.Interface, so it works as
+// well with the fake clientset as with a real cluster.
+type Restarter struct {
+	client  kubernetes.Interface
+	dynamic dynamic.Interface
+
+	// Now returns the time written to the restarted workloads. It defaults to
+	// time.Now.
+	Now func() time.Time
+}
+
+// New returns a Restarter using the given clients. The dynamic client is only
+// used for Argo Rollouts and may be nil if they are never restarted.
+func New(client kubernetes.Interface, dynamicClient dynamic.Interface) *Restarter {
+	return &Restarter{client: client, dynamic: dynamicClient, Now: time.Now}
+}
+
+// Restart triggers a graceful rollout of the workload and returns the pod
+// template fields that admission webhooks changed on the way. With dryRun,
+// the change only passes through admission on the server and is not
+// persisted, and every field of the pod template is compared. Otherwise the
+// restart takes a single request, and only the fields of the restart patch
+// itself are compared.
+func (r *Restarter) Restart(ctx context.Context, ref TargetRef, dryRun bool) ([]string, error) {
+	switch ref.Kind {
+	case KindDeployment, KindStatefulSet, KindDaemonSet:
+		return r.restartTemplate(ctx, ref, dryRun)
+	case KindRollout:
+		return r.restartRollout(ctx, ref.Namespace, ref.Name, dryRun)
+	}
+	return nil, fmt.Errorf("unsupported workload kind %q", ref.Kind)
+}
+
+// restartTemplate sets the restart annotation on the pod template of a
+// Deployment, StatefulSet or DaemonSet with a strategic merge patch, as
+// kubectl rollout restart does. A patch of the annotation alone cannot
+// conflict with controllers updating the workload meanwhile. Only dry runs
+// read the workload first, to compare its whole pod template with the one
+// admission returns; applied restarts compare the returned template with the
+// patch, so that neither an extra request nor the changes controllers make
+// meanwhile end up in the report.
+func (r *Restarter) restartTemplate(ctx context.Context, ref TargetRef, dryRun bool) ([]string, error) {
+	restartedAt := r.Now().Format(time.RFC3339)
+	data, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{RestartedAtAnnotation: restartedAt},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		get   func() (*corev1.PodTemplateSpec, error)
+		patch func() (*corev1.PodTemplateSpec, error)
+	)
+	opts := metav1.PatchOptions{DryRun: DryRunOption(dryRun)}
+	switch ref.Kind {
+	case KindDeployment:
+		client := r.client.AppsV1().Deployments(ref.Namespace)
+		get = func() (*corev1.PodTemplateSpec, error) {
+			deployment, err := client.Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return &deployment.Spec.Template, nil
+		}
+		patch = func() (*corev1.PodTemplateSpec, error) {
+			deployment, err := client.Patch(ctx, ref.Name, types.StrategicMergePatchType, data, opts)
+			if err != nil {
+				return nil, err
+			}
+			return &deployment.Spec.Template, nil
+		}
+	case KindStatefulSet:
+		client := r.client.AppsV1().StatefulSets(ref.Namespace)
+		get = func() (*corev1.PodTemplateSpec, error) {
+			statefulset, err := client.Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return &statefulset.Spec.Template, nil
+		}
+		patch = func() (*corev1.PodTemplateSpec, error) {
+			statefulset, err := client.Patch(ctx, ref.Name, types.StrategicMergePatchType, data, opts)
+			if err != nil {
+				return nil, err
+			}
+			return &statefulset.Spec.Template, nil
+		}
+	case KindDaemonSet:
+		client := r.client.AppsV1().DaemonSets(ref.Namespace)
+		get = func() (*corev1.PodTemplateSpec, error) {
+			daemonset, err := client.Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			return &daemonset.Spec.Template, nil
+		}
+		patch = func() (*corev1.PodTemplateSpec, error) {
+			daemonset, err := client.Patch(ctx, ref.Name, types.StrategicMergePatchType, data, opts)
+			if err != nil {
+				return nil, err
+			}
+			return &daemonset.Spec.Template, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported workload kind %q", ref.Kind)
+	}
+
+	var sent *corev1.PodTemplateSpec
+	if dryRun {
+		if sent, err = get(); err != nil {
+			return nil, fmt.Errorf("failed to get %s: %w", ref.Kind, err)
+		}
+		if sent.Annotations == nil {
+			sent.Annotations = make(map[string]string)
+		}
+		sent.Annotations[RestartedAtAnnotation] = restartedAt
+	}
+	returned, err := patch()
+	if err != nil {
+		return nil, fmt.Errorf("failed to patch %s: %w", ref.Kind, err)
+	}
+	if sent == nil {
+		return patchMutations(restartedAt, returned), nil
+	}
+	return templateMutations(sent, returned), nil
+}
+
+// restartRollout asks the Argo Rollouts controller to restart every pod of the
+// rollout by setting spec.restartAt, which it performs respecting the
+// rollout's maxUnavailable. The patch sends no pod template field, so only
+// dry runs, which read the rollout first, report webhook mutations.
+func (r *Restarter) restartRollout(ctx context.Context, namespace, name string, dryRun bool) ([]string, error) {
+	if r.dynamic == nil {
+		return nil, fmt.Errorf("restarting rollouts requires a dynamic client")
+	}
+	client := r.dynamic.Resource(RolloutResource).Namespace(namespace)
+	var rollout *unstructured.Unstructured
+	if dryRun {
+		var err error
+		if rollout, err = client.Get(ctx, name, metav1.GetOptions{}); err != nil {
+			return nil, fmt.Errorf("failed to get rollout: %w", err)
+		}
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"restartAt": r.Now().UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	patched, err := client.Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{DryRun: DryRunOption(dryRun)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to patch rollout: %w", err)
+	}
+
+	if rollout == nil {
+		return nil, nil
+	}
+	sent, _, _ := unstructured.NestedFieldNoCopy(rollout.Object, "spec", "template")
+	returned, _, _ := unstructured.NestedFieldNoCopy(patched.Object, "spec", "template")
+	return diffPaths("spec.template", sent, returned), nil
+}
+
+// Wait blocks until the rollout of the workload has finished, it failed or
+// the timeout expired. A zero timeout waits until ctx is done.
+func (r *Restarter) Wait(ctx context.Context, ref TargetRef, timeout time.Duration) error {
+	lw, obj, err := WorkloadListWatch(ctx, r.client, r.dynamic, ref)
+	if err != nil {
+		return err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	_, err = watchtools.UntilWithSync(ctx, lw, obj, nil, func(event watch.Event) (bool, error) {
+		switch event.Type {
+		case watch.Deleted:
+			return false, fmt.Errorf("%s was deleted while waiting for rollout", ref.Kind)
+		case watch.Added, watch.Modified:
+			return RolloutComplete(event.Object)
+		}
+		return false, nil
+	})
+	if wait.Interrupted(err) {
+		return fmt.Errorf("timed out after %s waiting for rollout", timeout)
+	}
+	return err
+}
+
+// WorkloadListWatch returns a ListerWatcher scoped to a single workload,
+// together with an empty object of the matching type.
+func WorkloadListWatch(ctx context.Context, client kubernetes.Interface, dynamicClient dynamic.Interface, ref TargetRef) (cache.ListerWatcher, runtime.Object, error) {
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", ref.Name).String()
+
+	var (
+		list    func(metav1.ListOptions) (runtime.Object, error)
+		watchFn func(metav1.ListOptions) (watch.Interface, error)
+		obj     runtime.Object
+	)
+	switch ref.Kind {
+	case KindDeployment:
+		c := client.AppsV1().Deployments(ref.Namespace)
+		list = func(options metav1.ListOptions) (runtime.Object, error) { return c.List(ctx, options) }
+		watchFn = func(options metav1.ListOptions) (watch.Interface, error) { return c.Watch(ctx, options) }
+		obj = &appsv1.Deployment{}
+	case KindStatefulSet:
+		c := client.AppsV1().StatefulSets(ref.Namespace)
+		list = func(options metav1.ListOptions) (runtime.Object, error) { return c.List(ctx, options) }
+		watchFn = func(options metav1.ListOptions) (watch.Interface, error) { return c.Watch(ctx, options) }
+		obj = &appsv1.StatefulSet{}
+	case KindDaemonSet:
+		c := client.AppsV1().DaemonSets(ref.Namespace)
+		list = func(options metav1.ListOptions) (runtime.Object, error) { return c.List(ctx, options) }
+		watchFn = func(options metav1.ListOptions) (watch.Interface, error) { return c.Watch(ctx, options) }
+		obj = &appsv1.DaemonSet{}
+	case KindRollout:
+		if dynamicClient == nil {
+			return nil, nil, fmt.Errorf("watching rollouts requires a dynamic client")
+		}
+		c := dynamicClient.Resource(RolloutResource).Namespace(ref.Namespace)
+		list = func(options metav1.ListOptions) (runtime.Object, error) { return c.List(ctx, options) }
+		watchFn = func(options metav1.ListOptions) (watch.Interface, error) { return c.Watch(ctx, options) }
+		obj = &unstructured.Unstructured{}
+	default:
+		return nil, nil, fmt.Errorf("unsupported workload kind %q", ref.Kind)
+	}
+
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			return list(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return watchFn(options)
+		},
+	}
+	return lw, obj, nil
+}
+
+// DryRunOption returns the DryRun field of create, update and patch options.
+func DryRunOption(dryRun bool) []string {
+	if dryRun {
+		return []string{metav1.DryRunAll}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package restart
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var restartTime = time.Date(2024, 6, 1, 2, 0, 0, 0, time.UTC)
+
+func podTemplate() corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "postgres"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "postgres", Image: "postgres:16"}}},
+	}
+}
+
+func newRestarter(objects ...runtime.Object) (*Restarter, *fake.Clientset) {
+	client := fake.NewSimpleClientset(objects...)
+	r := New(client, nil)
+	r.Now = func() time.Time { return restartTime }
+	return r, client
+}
+
+func TestRestartPatchesAnnotation(t *testing.T) {
+	meta := metav1.ObjectMeta{Namespace: "payments", Name: "postgres"}
+	tests := []struct {
+		kind     string
+		resource string
+		object   runtime.Object
+		template func(*fake.Clientset) (*corev1.PodTemplateSpec, error)
+	}{
+		{
+			kind:     KindDeployment,
+			resource: "deployments",
+			object:   &appsv1.Deployment{ObjectMeta: meta, Spec: appsv1.DeploymentSpec{Template: podTemplate()}},
+			template: func(c *fake.Clientset) (*corev1.PodTemplateSpec, error) {
+				d, err := c.AppsV1().Deployments("payments").Get(context.Background(), "postgres", metav1.GetOptions{})
+				if err != nil {
+					return nil, err
+				}
+				return &d.Spec.Template, nil
+			},
+		},
+		{
+			kind:     KindStatefulSet,
+			resource: "statefulsets",
+			object:   &appsv1.StatefulSet{ObjectMeta: meta, Spec: appsv1.StatefulSetSpec{Template: podTemplate()}},
+			template: func(c *fake.Clientset) (*corev1.PodTemplateSpec, error) {
+				s, err := c.AppsV1().StatefulSets("payments").Get(context.Background(), "postgres", metav1.GetOptions{})
+				if err != nil {
+					return nil, err
+				}
+				return &s.Spec.Template, nil
+			},
+		},
+		{
+			kind:     KindDaemonSet,
+			resource: "daemonsets",
+			object:   &appsv1.DaemonSet{ObjectMeta: meta, Spec: appsv1.DaemonSetSpec{Template: podTemplate()}},
+			template: func(c *fake.Clientset) (*corev1.PodTemplateSpec, error) {
+				d, err := c.AppsV1().DaemonSets("payments").Get(context.Background(), "postgres", metav1.GetOptions{})
+				if err != nil {
+					return nil, err
+				}
+				return &d.Spec.Template, nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			r, client := newRestarter(tt.object)
+			ref := TargetRef{Kind: tt.kind, Namespace: "payments", Name: "postgres"}
+			mutations, err := r.Restart(context.Background(), ref, false)
+			if err != nil {
+				t.Fatalf("Restart failed: %v", err)
+			}
+			if len(mutations) != 0 {
+				t.Errorf("Restart reported mutations %v without any webhook", mutations)
+			}
+
+			template, err := tt.template(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := template.Annotations[RestartedAtAnnotation], restartTime.Format(time.RFC3339); got != want {
+				t.Errorf("%s annotation = %q, want %q", RestartedAtAnnotation, got, want)
+			}
+			if !reflect.DeepEqual(template.Spec, podTemplate().Spec) {
+				t.Errorf("pod spec changed by the restart: %+v", template.Spec)
+			}
+
+			var patch k8stesting.PatchAction
+			for _, action := range client.Actions() {
+				if p, ok := action.(k8stesting.PatchAction); ok {
+					patch = p
+				}
+			}
+			if patch == nil {
+				t.Fatal("Restart did not patch the workload")
+			}
+			if patch.GetResource().Resource != tt.resource || patch.GetPatchType() != types.StrategicMergePatchType {
+				t.Errorf("Restart sent a %s patch of %s, want a strategic merge patch of %s", patch.GetPatchType(), patch.GetResource().Resource, tt.resource)
+			}
+			var sent map[string]interface{}
+			if err := json.Unmarshal(patch.GetPatch(), &sent); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]interface{}{"spec": map[string]interface{}{"template": map[string]interface{}{"metadata": map[string]interface{}{
+				"annotations": map[string]interface{}{RestartedAtAnnotation: restartTime.Format(time.RFC3339)},
+			}}}}
+			if !reflect.DeepEqual(sent, want) {
+				t.Errorf("patch = %s, want only the restart annotation", patch.GetPatch())
+			}
+		})
+	}
+}
+
+// injectSidecar makes patches of deployments return the workload with an
+// extra container, as a mutating admission webhook would, and with the
+// restart annotation set to annotation, without storing it, as a dry run
+// would.
+func injectSidecar(client *fake.Clientset, annotation string) {
+	client.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		obj, err := client.Tracker().Get(patch.GetResource(), patch.GetNamespace(), patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		deployment := obj.(*appsv1.Deployment).DeepCopy()
+		if deployment.Spec.Template.Annotations == nil {
+			deployment.Spec.Template.Annotations = make(map[string]string)
+		}
+		deployment.Spec.Template.Annotations[RestartedAtAnnotation] = annotation
+		deployment.Spec.Template.Spec.Containers = append(deployment.Spec.Template.Spec.Containers, corev1.Container{Name: "istio-proxy", Image: "istio/proxyv2"})
+		return true, deployment, nil
+	})
+}
+
+func TestRestartReportsWebhookMutations(t *testing.T) {
+	tests := []struct {
+		name       string
+		dryRun     bool
+		annotation string
+		want       []string
+	}{
+		// Dry runs compare the whole pod template
+		{"dry run", true, restartTime.Format(time.RFC3339), []string{"spec.template.spec.containers[istio-proxy]"}},
+		// Applied restarts only compare the fields of the patch
+		{"applied", false, restartTime.Format(time.RFC3339), nil},
+		{"applied with a changed annotation", false, "rewritten", []string{"spec.template.metadata.annotations." + RestartedAtAnnotation}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "payments", Name: "api"},
+				Spec:       appsv1.DeploymentSpec{Template: podTemplate()},
+			}
+			r, client := newRestarter(deployment)
+			injectSidecar(client, tt.annotation)
+
+			ref := TargetRef{Kind: KindDeployment, Namespace: "payments", Name: "api"}
+			mutations, err := r.Restart(context.Background(), ref, tt.dryRun)
+			if err != nil {
+				t.Fatalf("Restart failed: %v", err)
+			}
+			if !reflect.DeepEqual(mutations, tt.want) {
+				t.Errorf("mutations = %v, want %v", mutations, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestartTakesOneRequest(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "payments", Name: "api"},
+		Spec:       appsv1.DeploymentSpec{Template: podTemplate()},
+	}
+	r, client := newRestarter(deployment)
+	ref := TargetRef{Kind: KindDeployment, Namespace: "payments", Name: "api"}
+	if _, err := r.Restart(context.Background(), ref, false); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+	if actions := client.Actions(); len(actions) != 1 || actions[0].GetVerb() != "patch" {
+		t.Errorf("Restart made requests %v, want a single patch", actions)
+	}
+}
+
+func TestRestartUnsupportedKind(t *testing.T) {
+	r, _ := newRestarter()
+	if _, err := r.Restart(context.Background(), TargetRef{Kind: "pod", Namespace: "payments", Name: "postgres"}, false); err == nil {
+		t.Error("Restart accepted an unsupported kind")
+	}
+}
+
+func TestRestartRolloutWithoutDynamicClient(t *testing.T) {
+	r, _ := newRestarter()
+	if _, err := r.Restart(context.Background(), TargetRef{Kind: KindRollout, Namespace: "payments", Name: "postgres"}, false); err == nil {
+		t.Error("Restart of a rollout succeeded without a dynamic client")
+	}
+}
+
+func TestDryRunOption(t *testing.T) {
+	if got := DryRunOption(true); !reflect.DeepEqual(got, []string{metav1.DryRunAll}) {
+		t.Errorf("DryRunOption(true) = %v", got)
+	}
+	if got := DryRunOption(false); got != nil {
+		t.Errorf("DryRunOption(false) = %v, want nil", got)
+	}
+}
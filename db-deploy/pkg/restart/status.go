@@ -0,0 +1,101 @@
+package restart
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// RolloutComplete reports whether the rollout of a workload has finished. The
+// checks mirror the ones performed by kubectl rollout status.
+func RolloutComplete(obj runtime.Object) (bool, error) {
+	switch w := obj.(type) {
+	case *appsv1.Deployment:
+		if w.Generation > w.Status.ObservedGeneration {
+			return false, nil
+		}
+		for _, cond := range w.Status.Conditions {
+			if cond.Type == appsv1.DeploymentProgressing && cond.Reason == "ProgressDeadlineExceeded" {
+				return false, fmt.Errorf("deployment exceeded its progress deadline")
+			}
+		}
+		if w.Spec.Replicas != nil && w.Status.UpdatedReplicas < *w.Spec.Replicas {
+			return false, nil
+		}
+		if w.Status.Replicas > w.Status.UpdatedReplicas {
+			return false, nil
+		}
+		return w.Status.AvailableReplicas >= w.Status.UpdatedReplicas, nil
+
+	case *appsv1.StatefulSet:
+		if w.Spec.UpdateStrategy.Type != appsv1.RollingUpdateStatefulSetStrategyType {
+			return false, fmt.Errorf("rollout status is only available for %s strategy type", appsv1.RollingUpdateStatefulSetStrategyType)
+		}
+		if w.Status.ObservedGeneration == 0 || w.Generation > w.Status.ObservedGeneration {
+			return false, nil
+		}
+		if w.Spec.Replicas != nil && w.Status.ReadyReplicas < *w.Spec.Replicas {
+			return false, nil
+		}
+		if ru := w.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.Partition != nil && *ru.Partition > 0 {
+			if w.Spec.Replicas != nil {
+				return w.Status.UpdatedReplicas >= *w.Spec.Replicas-*ru.Partition, nil
+			}
+			return true, nil
+		}
+		return w.Status.UpdateRevision == w.Status.CurrentRevision, nil
+
+	case *appsv1.DaemonSet:
+		if w.Spec.UpdateStrategy.Type != appsv1.RollingUpdateDaemonSetStrategyType {
+			return false, fmt.Errorf("rollout status is only available for %s strategy type", appsv1.RollingUpdateDaemonSetStrategyType)
+		}
+		if w.Generation > w.Status.ObservedGeneration {
+			return false, nil
+		}
+		if w.Status.UpdatedNumberScheduled < w.Status.DesiredNumberScheduled {
+			return false, nil
+		}
+		return w.Status.NumberAvailable >= w.Status.DesiredNumberScheduled, nil
+
+	case *unstructured.Unstructured:
+		return argoRolloutComplete(w)
+	}
+	return false, fmt.Errorf("unsupported object type %T", obj)
+}
+
+// argoRolloutComplete reports whether an Argo Rollout has observed its latest
+// spec, finished any requested restart and become healthy.
+func argoRolloutComplete(rollout *unstructured.Unstructured) (bool, error) {
+	// Older controllers stored a hash here, newer ones the generation as a
+	// string; either way it must match the current generation to count
+	observed, _, _ := unstructured.NestedFieldNoCopy(rollout.Object, "status", "observedGeneration")
+	if fmt.Sprint(observed) != strconv.FormatInt(rollout.GetGeneration(), 10) {
+		return false, nil
+	}
+
+	if value, found, _ := unstructured.NestedString(rollout.Object, "spec", "restartAt"); found {
+		restartAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return false, fmt.Errorf("invalid spec.restartAt %q: %w", value, err)
+		}
+		value, _, _ = unstructured.NestedString(rollout.Object, "status", "restartedAt")
+		restartedAt, err := time.Parse(time.RFC3339, value)
+		if err != nil || restartedAt.Before(restartAt) {
+			return false, nil
+		}
+	}
+
+	phase, _, _ := unstructured.NestedString(rollout.Object, "status", "phase")
+	switch phase {
+	case "Healthy":
+		return true, nil
+	case "Degraded":
+		message, _, _ := unstructured.NestedString(rollout.Object, "status", "message")
+		return false, fmt.Errorf("rollout is degraded: %s", message)
+	}
+	return false, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// planMountPath is where the emitted Job mounts the plan ConfigMap.
+const planMountPath = "/etc/db-pods"
+
+// planCommand prints the restart plan without restarting anything, or emits
+// a Job that executes it from inside the cluster.
+func planCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	discovery := addDiscoveryFlags(fs)
+	emitJob := fs.Bool("emit-job", false, "print a ConfigMap holding the plan and a Job executing it, for clusters this binary cannot reach; arguments after -- are passed to the Job")
+	image := fs.String("image", "", "db-pods image the Job runs, from a registry the cluster can pull from (required with --emit-job)")
+	jobNamespace := fs.String("job-namespace", "default", "namespace of the emitted ConfigMap and Job")
+	serviceAccount := fs.String("service-account", "db-pods", "service account the Job runs as; it needs the permissions of a normal run")
+	runbook := fs.String("runbook", "", "write the plan as a step-by-step Markdown runbook, with verification steps and abort criteria, to this file")
+	writePlan := fs.String("write-plan", "", "write the plan file, as executed with --plan, to this file")
+	rolloutTimeout := fs.Duration("rollout-timeout", 10*time.Minute, "rollout timeout the runbook documents and its command uses")
+	addConfigFlag(fs)
+	return func(args []string) {
+		setupLogging()
+
+		if *emitJob && *image == "" {
+			log.Fatalf("--emit-job requires --image")
+		}
+
+		// Every artifact of the plan records the same plan time, which the run
+		// executing it reuses
+		planTime = time.Now().UTC().Truncate(time.Second)
+
+		discoveryOpts, err := discovery.options()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		clientset, dynamicClient := newClients()
+		ctx := context.Background()
+
+		targets, err := discoverTargets(ctx, clientset, dynamicClient, discoveryOpts)
+		if err != nil {
+			log.Fatalf("Error discovering workloads: %v", err)
+		}
+
+		if *writePlan != "" {
+			if err := os.WriteFile(*writePlan, []byte(formatPlanFile(targets, planTime)), 0o644); err != nil {
+				log.Fatalf("Error writing plan: %v", err)
+			}
+		}
+
+		if !*emitJob {
+			for i := range targets {
+				if err := inspectPods(ctx, clientset, &targets[i]); err != nil {
+					workloadLogger(targets[i]).Error("Error inspecting pods", "error", err)
+				}
+				if err := inspectMemory(ctx, clientset, dynamicClient, &targets[i]); err != nil {
+					workloadLogger(targets[i]).Error("Error inspecting memory usage", "error", err)
+				}
+			}
+			printPlan(targets)
+
+			if *runbook != "" {
+				planFile := *writePlan
+				if planFile == "" {
+					planFile = "plan.txt"
+				}
+				f, err := os.Create(*runbook)
+				if err != nil {
+					log.Fatalf("Error writing runbook: %v", err)
+				}
+				err = writeRunbook(f, targets, runbookOptions{planTime: planTime, planFile: planFile, rolloutTimeout: *rolloutTimeout})
+				if closeErr := f.Close(); err == nil {
+					err = closeErr
+				}
+				if err != nil {
+					log.Fatalf("Error writing runbook: %v", err)
+				}
+				fmt.Fprintf(progress, "Wrote runbook to %s\n", *runbook)
+			}
+			return
+		}
+
+		if err := writePlanJob(os.Stdout, targets, planJob{
+			id:             strings.ToLower(newRunID()),
+			namespace:      *jobNamespace,
+			image:          *image,
+			serviceAccount: *serviceAccount,
+			args:           args,
+			planTime:       planTime,
+		}); err != nil {
+			log.Fatalf("Error writing job: %v", err)
+		}
+	}
+}
+
+// planJob describes the Job emitted by "db-pods plan --emit-job".
+type planJob struct {
+	id             string
+	namespace      string
+	image          string
+	serviceAccount string
+	args           []string
+	planTime       time.Time
+}
+
+// writePlanJob writes a self-contained ConfigMap and Job manifest that
+// restart exactly the planned targets. The plan time is frozen into the Job's
+// arguments, so the annotations it writes match the reviewed plan.
+func writePlanJob(w io.Writer, targets []target, job planJob) error {
+	name := "db-pods-" + job.id
+	labels := map[string]string{"app.kubernetes.io/name": "db-pods"}
+
+	configMap := &corev1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Name: name + "-plan", Namespace: job.namespace, Labels: labels},
+		Data:       map[string]string{"plan": formatPlanFile(targets, job.planTime)},
+	}
+
+	args := append([]string{
+		"restart",
+		"--plan", planMountPath + "/plan",
+		"--plan-time", job.planTime.UTC().Format(time.RFC3339),
+	}, job.args...)
+	backoffLimit := int32(0)
+	manifest := &batchv1.Job{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: job.namespace, Labels: labels},
+		Spec: batchv1.JobSpec{
+			// A failed run must be looked at, not repeated blindly
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: job.serviceAccount,
+					RestartPolicy:      corev1.RestartPolicyNever,
+					Containers: []corev1.Container{{
+						Name:         "db-pods",
+						Image:        job.image,
+						Args:         args,
+						VolumeMounts: []corev1.VolumeMount{{Name: "plan", MountPath: planMountPath, ReadOnly: true}},
+					}},
+					Volumes: []corev1.Volume{{
+						Name: "plan",
+						VolumeSource: corev1.VolumeSource{
+							ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: configMap.Name}},
+						},
+					}},
+				},
+			},
+		},
+	}
+
+	for i, obj := range []interface{}{configMap, manifest} {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(w, "---")
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatPlanFile renders targets as a plan file: one KIND/NAMESPACE/NAME
+// reference per line, preceded by comments.
+func formatPlanFile(targets []target, planTime time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# db-pods plan, %d workloads, plan time %s\n", len(targets), planTime.UTC().Format(time.RFC3339))
+	for _, t := range targets {
+		fmt.Fprintln(&b, t.ref())
+	}
+	return b.String()
+}
+
+// planFingerprint identifies a plan file by the SHA-256 of its contents.
+// Plans written by "db-pods plan" carry their plan time, so a new plan of the
+// same workloads is a new sweep, while retrying a run of the same file is not.
+func planFingerprint(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:12]), nil
+}
+
+// readPlanFile reads the workload references of a plan file. Blank lines and
+// lines starting with # are ignored.
+func readPlanFile(path string) ([]target, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var refs []target
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ref, err := parseTargetRef(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		refs = append(refs, ref)
+	}
+	return refs, scanner.Err()
+}
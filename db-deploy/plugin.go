@@ -0,0 +1,22 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// kubectlPluginName is the name the binary is installed under to be run as
+// "kubectl db-restart". kubectl maps the dash of a plugin command to an
+// underscore in the file name.
+const kubectlPluginName = "kubectl-db_restart"
+
+// kubectlPlugin is set when the binary runs as a kubectl plugin. Workloads
+// are then looked up like kubectl does: in the namespace of the kubeconfig
+// context unless --namespace or --all-namespaces is given.
+var kubectlPlugin bool
+
+// isKubectlPlugin reports whether the binary was started under the plugin
+// name, with or without the .exe suffix of Windows.
+func isKubectlPlugin(arg0 string) bool {
+	return strings.TrimSuffix(filepath.Base(arg0), ".exe") == kubectlPluginName
+}
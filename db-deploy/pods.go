@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+// imagePullFailures are the container waiting reasons that mean an image will
+// not become available without intervention.
+var imagePullFailures = map[string]bool{
+	"ErrImagePull":     true,
+	"ImagePullBackOff": true,
+	"InvalidImageName": true,
+}
+
+// inspectPods looks at the current pods of a target and records the ones
+// that are already Pending, each annotated with the reason the scheduler or
+// kubelet gave for it, the containers that are crashlooping, the start time
+// of the oldest pod, and the service mesh the pods belong to.
+func inspectPods(ctx context.Context, clientset *kubernetes.Clientset, t *target) error {
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector: %w", err)
+	}
+
+	pods, err := clientset.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	for _, pod := range pods.Items {
+		if start := pod.Status.StartTime; start != nil && pod.DeletionTimestamp == nil && (t.OldestPod.IsZero() || start.Time.Before(t.OldestPod)) {
+			t.OldestPod = start.Time
+		}
+		if t.Mesh == "" {
+			t.Mesh = detectMesh(&pod)
+		}
+		for _, container := range crashLoopingContainers(&pod) {
+			t.CrashLooping = append(t.CrashLooping, pod.Name+"/"+container)
+		}
+		if pod.Status.Phase != corev1.PodPending || pod.DeletionTimestamp != nil {
+			continue
+		}
+		t.PendingPods = append(t.PendingPods, fmt.Sprintf("%s (%s)", pod.Name, pendingReason(&pod)))
+	}
+	return nil
+}
+
+// Orders in which targets are restarted, selected with --order.
+const (
+	// orderAge restarts the targets whose oldest pod has been running
+	// longest first, so that an aborted run has already cycled the most
+	// stale pods.
+	orderAge = "age"
+
+	// orderDiscovery keeps the order in which targets were discovered.
+	orderDiscovery = "discovery"
+)
+
+// sortByPodAge orders targets by the start time of their oldest pod, oldest
+// first. Targets without running pods come last, in their original order.
+func sortByPodAge(targets []target) {
+	sort.SliceStable(targets, func(i, j int) bool {
+		a, b := targets[i].OldestPod, targets[j].OldestPod
+		if a.IsZero() || b.IsZero() {
+			return !a.IsZero() && b.IsZero()
+		}
+		return a.Before(b)
+	})
+}
+
+// pendingReason explains why a pod is Pending, preferring an unschedulable
+// condition over container waiting reasons.
+func pendingReason(pod *corev1.Pod) string {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse && cond.Reason != "" {
+			return cond.Reason
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting != nil && status.State.Waiting.Reason != "" {
+			return status.State.Waiting.Reason
+		}
+	}
+	return "Pending"
+}
+
+// newPodListWatch returns a ListerWatcher for the pods in a namespace that
+// match the selector.
+func newPodListWatch(ctx context.Context, clientset *kubernetes.Clientset, namespace string, selector labels.Selector) cache.ListerWatcher {
+	client := clientset.CoreV1().Pods(namespace)
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector.String()
+			return client.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector.String()
+			return client.Watch(ctx, options)
+		},
+	}
+}
+
+// watchImagePulls follows the pods of a target created since the given time
+// and returns an error as soon as one of them cannot pull its image. It
+// returns nil once ctx is done.
+func watchImagePulls(ctx context.Context, clientset *kubernetes.Clientset, t target, since time.Time) error {
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector: %w", err)
+	}
+
+	_, err = watchtools.UntilWithSync(ctx, newPodListWatch(ctx, clientset, t.Namespace, selector), &corev1.Pod{}, nil, func(event watch.Event) (bool, error) {
+		pod, ok := event.Object.(*corev1.Pod)
+		if !ok || event.Type == watch.Deleted || pod.CreationTimestamp.Time.Before(since) {
+			return false, nil
+		}
+		return false, imagePullError(pod)
+	})
+	if wait.Interrupted(err) {
+		return nil
+	}
+	return err
+}
+
+// imagePullError returns an error describing the first container of the pod
+// that is stuck pulling its image, or nil.
+func imagePullError(pod *corev1.Pod) error {
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			waiting := status.State.Waiting
+			if waiting != nil && imagePullFailures[waiting.Reason] {
+				return fmt.Errorf("pod %s cannot pull image %s for container %s: %s: %s", pod.Name, status.Image, status.Name, waiting.Reason, waiting.Message)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+// preemptedReason is the reason of the events the scheduler records on pods
+// it preempts to make room for pods of higher priority.
+const preemptedReason = "Preempted"
+
+// watchPreemptions follows the Preempted events recorded since the given time
+// on the pods of a target and calls onPreemption for each preempted pod,
+// with the message naming the preemptor. Preempted pods may be gone by the
+// time the event is seen, so like rolloutWarnings it recognises them by
+// their name, which starts with that of the workload. It returns nil once
+// ctx is done.
+func watchPreemptions(ctx context.Context, clientset *kubernetes.Clientset, t target, since time.Time, onPreemption func(pod, message string)) error {
+	client := clientset.CoreV1().Events(t.Namespace)
+	fieldSelector := fields.AndSelectors(
+		fields.OneTermEqualSelector("involvedObject.kind", "Pod"),
+		fields.OneTermEqualSelector("reason", preemptedReason),
+	).String()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = fieldSelector
+			return client.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fieldSelector
+			return client.Watch(ctx, options)
+		},
+	}
+
+	seen := make(map[string]bool)
+	_, err := watchtools.UntilWithSync(ctx, lw, &corev1.Event{}, nil, func(event watch.Event) (bool, error) {
+		e, ok := event.Object.(*corev1.Event)
+		if !ok || event.Type == watch.Deleted || eventTime(*e).Before(since) {
+			return false, nil
+		}
+		pod := e.InvolvedObject.Name
+		if seen[pod] || !strings.HasPrefix(pod, t.Name+"-") {
+			return false, nil
+		}
+		seen[pod] = true
+		onPreemption(pod, e.Message)
+		return false, nil
+	})
+	if wait.Interrupted(err) {
+		return nil
+	}
+	return err
+}
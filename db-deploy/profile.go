@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// profileDev relaxes the defaults meant for shared clusters on a developer's
+// local single-node cluster.
+const profileDev = "dev"
+
+// devProfileDefaults are the flag values --profile dev uses unless they are
+// given on the command line or in the --config file. A local cluster has a
+// single copy of each database and nobody else depending on it, so there is
+// no point in waiting long, pacing restarts or insisting on fresh backups.
+var devProfileDefaults = map[string]string{
+	"rollout-timeout":     "2m",
+	"retry-delay":         "5s",
+	"pacing-interval":     "5s",
+	"warmup-interval":     "500ms",
+	"warmup-timeout":      "1m",
+	"migration-timeout":   "2m",
+	"volume-op-timeout":   "2m",
+	"replication-timeout": "2m",
+	"max-backup-age":      "0",
+}
+
+// detectDevCluster returns the local distribution running the cluster, such
+// as kind, minikube or k3s, or an empty string if the cluster does not have
+// exactly one node of such a distribution.
+func detectDevCluster(ctx context.Context, clientset *kubernetes.Clientset) (string, error) {
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list nodes: %w", err)
+	}
+	if len(nodes.Items) != 1 {
+		return "", nil
+	}
+
+	node := nodes.Items[0]
+	switch {
+	case strings.HasPrefix(node.Spec.ProviderID, "kind://"):
+		return "kind", nil
+	case node.Labels["minikube.k8s.io/name"] != "":
+		return "minikube", nil
+	case strings.Contains(node.Status.NodeInfo.KubeletVersion, "+k3s"):
+		return "k3s", nil
+	}
+	return "", nil
+}
+
+// applyDevProfile sets the flags of fs that were not given to their
+// --profile dev values.
+func applyDevProfile(fs *pflag.FlagSet) error {
+	names := make([]string, 0, len(devProfileDefaults))
+	for name := range devProfileDefaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Changed(name) {
+			continue
+		}
+		if err := fs.Set(name, devProfileDefaults[name]); err != nil {
+			return fmt.Errorf("--profile %s: %s: %w", profileDev, name, err)
+		}
+	}
+	return nil
+}
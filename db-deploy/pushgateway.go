@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pushgatewayJob is the job label under which runs push their metrics.
+const pushgatewayJob = "db-pods"
+
+// pushMetrics pushes the metrics of a run to a Prometheus Pushgateway,
+// replacing those of the previous run. Unlike the textfile, the pushed
+// counters and histogram cover this run only; Prometheus treats each push as
+// a counter reset, so increase() still adds the runs up.
+func pushMetrics(ctx context.Context, gateway string, finishedAt time.Time, results []result, waited bool) error {
+	samples := make(map[string]float64)
+	workloads := observeRestarts(samples, results, waited)
+	body := formatRunMetrics(samples, finishedAt, workloads)
+
+	target := strings.TrimSuffix(gateway, "/") + "/metrics/job/" + url.PathEscape(pushgatewayJob)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("pushgateway returned %s", resp.Status)
+	}
+	return nil
+}
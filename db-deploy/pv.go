@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// findVolumeTargets returns the workloads whose pods mount the claims bound
+// to the given PersistentVolumes. Storage maintenance is planned per volume,
+// so the workloads are selected by what they sit on rather than by name.
+func findVolumeTargets(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, pvNames []string, opts discoveryOptions) ([]target, error) {
+	// Claims by namespace, then name
+	claims := make(map[string]map[string]bool)
+	for _, name := range pvNames {
+		pv, err := clientset.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get persistent volume %s: %w", name, err)
+		}
+		ref := pv.Spec.ClaimRef
+		if ref == nil || pv.Status.Phase != corev1.VolumeBound {
+			slog.Warn("Persistent volume is not bound to a claim, skipping it", "persistentVolume", name)
+			continue
+		}
+		if claims[ref.Namespace] == nil {
+			claims[ref.Namespace] = make(map[string]bool)
+		}
+		claims[ref.Namespace][ref.Name] = true
+	}
+
+	namespaces := make([]string, 0, len(claims))
+	for namespace := range claims {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	var targets []target
+	for _, namespace := range namespaces {
+		owners, err := claimOwners(ctx, clientset, namespace, claims[namespace])
+		if err != nil {
+			return nil, err
+		}
+		found, err := ownedTargets(ctx, clientset, dynamicClient, opts, namespace, owners)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, found...)
+	}
+	return targets, nil
+}
+
+// ownedTargets returns the workloads of a namespace named, as KIND/NAME, in
+// owners, which maps them to the reason they were selected. Owners that are
+// not restartable workloads are logged.
+func ownedTargets(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, opts discoveryOptions, namespace string, owners map[string]string) ([]target, error) {
+	if len(owners) == 0 {
+		return nil, nil
+	}
+
+	workloads, err := listWorkloadsIn(ctx, clientset, dynamicClient, opts, namespace)
+	if err != nil {
+		return nil, err
+	}
+	var targets []target
+	for _, w := range workloads {
+		if reason, ok := owners[w.Kind+"/"+w.Name]; ok {
+			w.MatchReason = reason
+			targets = append(targets, w)
+			delete(owners, w.Kind+"/"+w.Name)
+		}
+	}
+	for owner, reason := range owners {
+		slog.Warn("Workload matched but cannot be restarted", "workload", owner, "namespace", namespace, "reason", reason)
+	}
+	return targets, nil
+}
+
+// claimOwners returns the workloads, as KIND/NAME, that own pods mounting one
+// of the named claims, mapped to the claim they mount.
+func claimOwners(ctx context.Context, clientset *kubernetes.Clientset, namespace string, claims map[string]bool) (map[string]string, error) {
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	owners := make(map[string]string)
+	for _, pod := range pods.Items {
+		claim := ""
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && claims[volume.PersistentVolumeClaim.ClaimName] {
+				claim = volume.PersistentVolumeClaim.ClaimName
+			}
+		}
+		if claim == "" {
+			continue
+		}
+
+		owner, err := podWorkload(ctx, clientset, &pod)
+		if err != nil {
+			return nil, err
+		}
+		if owner == "" {
+			slog.Warn("Pod uses a selected volume but is not managed by a workload", "namespace", namespace, "pod", pod.Name)
+			continue
+		}
+		owners[owner] = "uses claim " + claim + " of a selected volume"
+	}
+	return owners, nil
+}
+
+// podWorkload returns the workload managing a pod as KIND/NAME, following
+// ReplicaSets up to their Deployment or Argo Rollout. It returns an empty
+// string for pods without a controller.
+func podWorkload(ctx context.Context, clientset *kubernetes.Clientset, pod *corev1.Pod) (string, error) {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return "", nil
+	}
+	switch ref.Kind {
+	case "StatefulSet":
+		return "statefulset/" + ref.Name, nil
+	case "DaemonSet":
+		return "daemonset/" + ref.Name, nil
+	case "ReplicaSet":
+		rs, err := clientset.AppsV1().ReplicaSets(pod.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to get replicaset %s: %w", ref.Name, err)
+		}
+		owner := metav1.GetControllerOf(rs)
+		switch {
+		case owner == nil:
+			return "", nil
+		case owner.Kind == "Deployment":
+			return "deployment/" + owner.Name, nil
+		case owner.Kind == "Rollout":
+			return "rollout/" + owner.Name, nil
+		}
+	}
+	return "", nil
+}
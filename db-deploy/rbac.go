@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// rbacFeature is an optional capability of db-pods together with the
+// permissions it needs on top of a plain restart.
+type rbacFeature struct {
+	description string
+	rules       []rbacv1.PolicyRule
+}
+
+// rbacBaseRules are needed by every run: finding and restarting workloads,
+// the run lock, the progress ConfigMap, the namespace fallback and
+// concurrency annotations, the replication status of the clusters of
+// database operators, the memory usage of pods, the PodDisruptionBudgets
+// covering them and the nodes and kured lock that reveal a cluster upgrade.
+var rbacBaseRules = []rbacv1.PolicyRule{
+	{APIGroups: []string{"apps"}, Resources: []string{"deployments", "statefulsets", "daemonsets"}, Verbs: []string{"get", "list", "update", "patch"}},
+	{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"list"}},
+	{APIGroups: []string{"coordination.k8s.io"}, Resources: []string{"leases"}, Verbs: []string{"get", "create", "update"}},
+	{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get", "create", "patch"}},
+	{APIGroups: []string{""}, Resources: []string{"namespaces"}, Verbs: []string{"get", "list"}},
+	{APIGroups: []string{"authorization.k8s.io"}, Resources: []string{"selfsubjectaccessreviews", "selfsubjectrulesreviews"}, Verbs: []string{"create"}},
+	{APIGroups: []string{"acid.zalan.do"}, Resources: []string{"postgresqls"}, Verbs: []string{"get"}},
+	{APIGroups: []string{"mongodbcommunity.mongodb.com"}, Resources: []string{"mongodbcommunity"}, Verbs: []string{"get"}},
+	{APIGroups: []string{"psmdb.percona.com"}, Resources: []string{"perconaservermongodbs"}, Verbs: []string{"get"}},
+	{APIGroups: []string{"metrics.k8s.io"}, Resources: []string{"pods"}, Verbs: []string{"list"}},
+	{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"list"}},
+	{APIGroups: []string{"policy"}, Resources: []string{"poddisruptionbudgets"}, Verbs: []string{"list"}},
+}
+
+// rbacFeatures are the features "db-pods rbac --features" accepts.
+var rbacFeatures = map[string]rbacFeature{
+	"strict": {"--strict: watch the workloads for changes made by others", []rbacv1.PolicyRule{
+		{APIGroups: []string{"apps"}, Resources: []string{"deployments", "statefulsets", "daemonsets"}, Verbs: []string{"watch"}},
+	}},
+	"wait": {"--wait: follow rollouts, autoscaler evictions and preemptions", []rbacv1.PolicyRule{
+		{APIGroups: []string{"apps"}, Resources: []string{"deployments", "statefulsets", "daemonsets"}, Verbs: []string{"watch"}},
+		{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "watch"}},
+		{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"get"}},
+		{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"list", "watch"}},
+	}},
+	"checks": {"verification classes with endpoints or exec checks", []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"services", "pods"}, Verbs: []string{"list"}},
+		{APIGroups: []string{"discovery.k8s.io"}, Resources: []string{"endpointslices"}, Verbs: []string{"list"}},
+		{APIGroups: []string{""}, Resources: []string{"pods/ephemeralcontainers"}, Verbs: []string{"update"}},
+		{APIGroups: []string{""}, Resources: []string{"pods", "pods/log", "endpoints"}, Verbs: []string{"get"}},
+	}},
+	"events": {"read events to explain failed rollouts", []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"list"}},
+	}},
+	"exec": {"--debug-before-restart: ephemeral debug containers", []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"pods/ephemeralcontainers"}, Verbs: []string{"update"}},
+		{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}},
+		{APIGroups: []string{""}, Resources: []string{"pods/log"}, Verbs: []string{"get"}},
+	}},
+	"snapshots": {"--max-backup-age: VolumeSnapshots of the database volumes", []rbacv1.PolicyRule{
+		{APIGroups: []string{"snapshot.storage.k8s.io"}, Resources: []string{"volumesnapshots"}, Verbs: []string{"list"}},
+	}},
+	"diagnostics": {"--diagnostics-dir: pod logs, events and node conditions", []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"pods/log"}, Verbs: []string{"get"}},
+		{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"list"}},
+		{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"get"}},
+	}},
+	"rollouts": {"--include-rollouts: Argo Rollouts", []rbacv1.PolicyRule{
+		{APIGroups: []string{"argoproj.io"}, Resources: []string{"rollouts"}, Verbs: []string{"get", "list", "watch", "patch"}},
+	}},
+	"mesh": {"--mesh-outlier-hold: Istio DestinationRules", []rbacv1.PolicyRule{
+		{APIGroups: []string{"networking.istio.io"}, Resources: []string{"destinationrules"}, Verbs: []string{"get", "patch"}},
+	}},
+	"cronjobs": {"--suspended-cronjobs trigger and --run-migrations", []rbacv1.PolicyRule{
+		{APIGroups: []string{"batch"}, Resources: []string{"cronjobs"}, Verbs: []string{"get", "list"}},
+		{APIGroups: []string{"batch"}, Resources: []string{"jobs"}, Verbs: []string{"get", "list", "create"}},
+	}},
+	"volumes": {"--pv selection and waiting for volume operations", []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"persistentvolumes", "persistentvolumeclaims"}, Verbs: []string{"get"}},
+		{APIGroups: []string{"apps"}, Resources: []string{"replicasets"}, Verbs: []string{"get"}},
+		{APIGroups: []string{"storage.k8s.io"}, Resources: []string{"volumeattachments"}, Verbs: []string{"list"}},
+	}},
+	"rollback": {"--rollback-on-failure: previous Deployment revisions", []rbacv1.PolicyRule{
+		{APIGroups: []string{"apps"}, Resources: []string{"replicasets"}, Verbs: []string{"list"}},
+	}},
+	"undo": {"db-pods undo: rollout history of the restarted workloads", []rbacv1.PolicyRule{
+		{APIGroups: []string{"apps"}, Resources: []string{"replicasets", "controllerrevisions"}, Verbs: []string{"list"}},
+	}},
+	"vclusters": {"db-pods vclusters: the kubeconfigs vclusters export", []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get"}},
+	}},
+	"unhealthy": {"--only-unhealthy: deleting unhealthy pods", []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"delete"}},
+	}},
+	"profile": {"--profile dev: detecting local single-node clusters", []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"list"}},
+	}},
+	"operator": {"db-pods operator: DatabaseRestartPolicies and their events", []rbacv1.PolicyRule{
+		{APIGroups: []string{"db-restart.io"}, Resources: []string{"databaserestartpolicies"}, Verbs: []string{"get", "list", "watch"}},
+		{APIGroups: []string{"db-restart.io"}, Resources: []string{"databaserestartpolicies/status"}, Verbs: []string{"patch"}},
+		{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"create", "patch"}},
+		{APIGroups: []string{"apps"}, Resources: []string{"deployments", "statefulsets", "daemonsets"}, Verbs: []string{"watch"}},
+		{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "watch"}},
+		{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"get"}},
+		{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"list", "watch"}},
+	}},
+	"services": {"--service selection", []rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"services"}, Verbs: []string{"get"}},
+		{APIGroups: []string{"apps"}, Resources: []string{"replicasets"}, Verbs: []string{"get"}},
+	}},
+}
+
+// rbacCommand prints the ClusterRole, and optionally its binding, that grants
+// exactly the permissions of the selected features.
+func rbacCommand(fs *pflag.FlagSet) func(args []string) {
+	var names []string
+	for name := range rbacFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	features := fs.String("features", "", "comma-separated features to grant on top of restarting workloads, or \"all\": "+strings.Join(names, ", "))
+	name := fs.String("name", "db-pods", "name of the ClusterRole and ClusterRoleBinding")
+	serviceAccount := fs.String("service-account", "", "also bind the role to this service account, as NAMESPACE/NAME")
+	return func(args []string) {
+		selected := splitList(*features)
+		if len(selected) == 1 && selected[0] == "all" {
+			selected = names
+		}
+		rules, err := rbacRules(selected)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		if err := writeRBAC(os.Stdout, *name, rules, *serviceAccount); err != nil {
+			log.Fatalf("Error writing manifest: %v", err)
+		}
+	}
+}
+
+// rbacFeatureList lists the features with what each of them grants, for
+// the help of rbac.
+func rbacFeatureList() string {
+	var names []string
+	for name := range rbacFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("Features:")
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n  %-12s %s", name, rbacFeatures[name].description)
+	}
+	return b.String()
+}
+
+// rbacRules returns the base rules followed by those of the features.
+// Permissions granted more than once are only granted once.
+func rbacRules(features []string) ([]rbacv1.PolicyRule, error) {
+	rules := append([]rbacv1.PolicyRule(nil), rbacBaseRules...)
+	for _, name := range features {
+		feature, ok := rbacFeatures[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown feature %q", name)
+		}
+		rules = append(rules, feature.rules...)
+	}
+	return mergeRules(rules), nil
+}
+
+// mergeRules combines rules on the same API group and resource, so that each
+// resource appears once with the union of its verbs.
+func mergeRules(rules []rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	type key struct{ group, resource string }
+	verbs := make(map[key]map[string]bool)
+	var order []key
+	for _, rule := range rules {
+		for _, group := range rule.APIGroups {
+			for _, resource := range rule.Resources {
+				k := key{group, resource}
+				if verbs[k] == nil {
+					verbs[k] = make(map[string]bool)
+					order = append(order, k)
+				}
+				for _, verb := range rule.Verbs {
+					verbs[k][verb] = true
+				}
+			}
+		}
+	}
+
+	// Resources of a group granted the same verbs share a rule again
+	var merged []rbacv1.PolicyRule
+	index := make(map[string]int)
+	for _, k := range order {
+		var list []string
+		for verb := range verbs[k] {
+			list = append(list, verb)
+		}
+		sort.Strings(list)
+		id := k.group + "|" + strings.Join(list, ",")
+		if i, ok := index[id]; ok {
+			merged[i].Resources = append(merged[i].Resources, k.resource)
+			continue
+		}
+		index[id] = len(merged)
+		merged = append(merged, rbacv1.PolicyRule{APIGroups: []string{k.group}, Resources: []string{k.resource}, Verbs: list})
+	}
+	return merged
+}
+
+// writeRBAC writes the ClusterRole and, if a service account is given, its
+// ClusterRoleBinding as YAML. The role is cluster-wide because databases are
+// discovered across namespaces and some rules cover cluster-scoped resources.
+func writeRBAC(w io.Writer, name string, rules []rbacv1.PolicyRule, serviceAccount string) error {
+	objects := []interface{}{&rbacv1.ClusterRole{
+		TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Rules:      rules,
+	}}
+
+	if serviceAccount != "" {
+		namespace, account, ok := strings.Cut(serviceAccount, "/")
+		if !ok || namespace == "" || account == "" {
+			return fmt.Errorf("invalid --service-account %q, expected NAMESPACE/NAME", serviceAccount)
+		}
+		objects = append(objects, &rbacv1.ClusterRoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: name},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Namespace: namespace, Name: account}},
+		})
+	}
+
+	for i, obj := range objects {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(w, "---")
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
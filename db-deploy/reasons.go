@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// restartHistoryAnnotation holds the last restarts of a workload made by the
+// tool, oldest first, as a JSON list of restartRecord.
+const restartHistoryAnnotation = "db-deploy/restart-history"
+
+// restartHistorySize is the default number of restarts kept per workload.
+const restartHistorySize = 50
+
+// Reasons recorded for restarts started without --reason.
+const (
+	reasonRoutine      = "routine"
+	reasonCrashLooping = "crashlooping"
+	reasonUnhealthy    = "unhealthy pods"
+	reasonGameDay      = "game day"
+)
+
+// restartRecord is one restart in the history of a workload.
+type restartRecord struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	RunID  string    `json:"runId"`
+}
+
+// restartHistory parses the restarts recorded on a workload. A malformed
+// annotation counts as an empty history.
+func restartHistory(t target) []restartRecord {
+	var records []restartRecord
+	if value := t.Annotations[restartHistoryAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &records); err != nil {
+			return nil
+		}
+	}
+	return records
+}
+
+// appendRestartHistory returns the history annotation of a target with the
+// given restart added, dropping the entries past the TTL of the retention and
+// the oldest ones beyond its size.
+func appendRestartHistory(t target, record restartRecord, retention historyRetention) (string, error) {
+	var records []restartRecord
+	for _, past := range restartHistory(t) {
+		if !retention.expired(past.Time) {
+			records = append(records, past)
+		}
+	}
+	records = append(records, record)
+	if len(records) > retention.size() {
+		records = records[len(records)-retention.size():]
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// restartReason returns why a target is being restarted: the --reason of the
+// run, or else what the run or the target's state says about it.
+func restartReason(t target, opts options) string {
+	switch {
+	case opts.reason != "":
+		return opts.reason
+	case opts.onlyUnhealthy:
+		return reasonUnhealthy
+	case opts.chaos.enabled():
+		return reasonGameDay
+	case len(t.CrashLooping) > 0:
+		return reasonCrashLooping
+	}
+	return reasonRoutine
+}
+
+// restartStats counts the restarts of a workload since some time, by reason.
+type restartStats struct {
+	Target      target         `json:"-"`
+	Kind        string         `json:"kind"`
+	Namespace   string         `json:"namespace"`
+	Name        string         `json:"name"`
+	Restarts    int            `json:"restarts"`
+	Reasons     map[string]int `json:"reasons"`
+	LastRestart *time.Time     `json:"lastRestart,omitempty"`
+	Chronic     bool           `json:"chronic"`
+}
+
+// countRestarts aggregates the restart history of a target since the given
+// time. The workload is chronic once it has been restarted at least chronic
+// times, unless chronic is 0.
+func countRestarts(t target, since time.Time, chronic int) restartStats {
+	stats := restartStats{Target: t, Kind: t.Kind, Namespace: t.Namespace, Name: t.Name, Reasons: make(map[string]int)}
+	for _, record := range restartHistory(t) {
+		if record.Time.Before(since) {
+			continue
+		}
+		stats.Restarts++
+		stats.Reasons[record.Reason]++
+		if stats.LastRestart == nil || record.Time.After(*stats.LastRestart) {
+			last := record.Time
+			stats.LastRestart = &last
+		}
+	}
+	stats.Chronic = chronic > 0 && stats.Restarts >= chronic
+	return stats
+}
+
+// formatReasons renders restart counts by reason, most frequent first.
+func formatReasons(reasons map[string]int) string {
+	names := make([]string, 0, len(reasons))
+	for name := range reasons {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if reasons[names[i]] != reasons[names[j]] {
+			return reasons[names[i]] > reasons[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s %d", name, reasons[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// reportCommand runs "db-pods report --by-workload", which aggregates the
+// restart history of the matching workloads to show how often each was
+// restarted and why, most restarted first.
+func reportCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	discovery := addDiscoveryFlags(fs)
+	byWorkload := fs.Bool("by-workload", false, "report the restarts of each workload by reason, from the history recorded in its "+restartHistoryAnnotation+" annotation")
+	since := fs.Duration("since", 90*24*time.Hour, "only count restarts made within this long")
+	chronic := fs.Int("chronic", 5, "flag workloads restarted at least this many times within --since as chronic offenders that need a real fix (0 disables)")
+	output := fs.String("output", "text", "output format: text or json")
+	return func(args []string) {
+		setupLogging()
+
+		if !*byWorkload {
+			log.Fatalf("db-pods report requires --by-workload")
+		}
+		if *output != "text" && *output != "json" {
+			log.Fatalf("Unknown --output %q, expected text or json", *output)
+		}
+		discoveryOpts, err := discovery.options()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		clientset, dynamicClient := newClients()
+		targets, err := discoverTargets(context.Background(), clientset, dynamicClient, discoveryOpts)
+		if err != nil {
+			log.Fatalf("Error discovering workloads: %v", err)
+		}
+
+		cutoff := time.Now().Add(-*since)
+		stats := make([]restartStats, 0, len(targets))
+		for _, t := range targets {
+			stats = append(stats, countRestarts(t, cutoff, *chronic))
+		}
+		sort.SliceStable(stats, func(i, j int) bool { return stats[i].Restarts > stats[j].Restarts })
+
+		if *output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(stats); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			return
+		}
+		printRestartStats(os.Stdout, stats, *since)
+	}
+}
+
+// printRestartStats prints the restart statistics of workloads as a table.
+func printRestartStats(w io.Writer, stats []restartStats, since time.Duration) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tKIND\tNAME\tRESTARTS\tLAST RESTART\tREASONS\tNOTE")
+	chronic := 0
+	for _, s := range stats {
+		last := "never"
+		if s.LastRestart != nil {
+			last = formatLastRestart(*s.LastRestart)
+		}
+		note := ""
+		if s.Chronic {
+			note = "chronic"
+			chronic++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", s.Namespace, s.Kind, s.Name, s.Restarts, last, formatReasons(s.Reasons), note)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d of %d workloads restarted chronically within %s\n", chronic, len(stats), formatAge(since))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// replicationPoll is the delay between reads of the status of a cluster
+// whose replication is degraded.
+const replicationPoll = 10 * time.Second
+
+// clusterOperator is a database operator whose custom resource reports the
+// replication health of the cluster it manages. Restarting a member of a
+// degraded cluster can take down the last in-sync replica, so the fence
+// holds restarts back until the operator reports the cluster healthy.
+type clusterOperator struct {
+	name     string
+	resource schema.GroupVersionResource
+
+	// kind is the kind of the resource, as found in the owner references
+	// the operator sets on the workloads of a cluster.
+	kind string
+
+	// clusterLabel names the cluster on its workloads, for operators that
+	// set no owner references. The workloads must also carry labels.
+	clusterLabel string
+	labels       map[string]string
+
+	// degraded returns what the cluster reports about its replication, or
+	// "" if it is healthy.
+	degraded func(cluster *unstructured.Unstructured) string
+}
+
+// clusterOperators are the database operators the replication fence
+// recognises.
+var clusterOperators = []clusterOperator{
+	{
+		name:         "Zalando postgres-operator",
+		resource:     schema.GroupVersionResource{Group: "acid.zalan.do", Version: "v1", Resource: "postgresqls"},
+		kind:         "postgresql",
+		clusterLabel: "cluster-name",
+		labels:       map[string]string{"application": "spilo"},
+		degraded:     zalandoDegraded,
+	},
+	{
+		name:     "MongoDB Community operator",
+		resource: schema.GroupVersionResource{Group: "mongodbcommunity.mongodb.com", Version: "v1", Resource: "mongodbcommunity"},
+		kind:     "MongoDBCommunity",
+		degraded: mongoDBCommunityDegraded,
+	},
+	{
+		name:     "Percona Operator for MongoDB",
+		resource: schema.GroupVersionResource{Group: "psmdb.percona.com", Version: "v1", Resource: "perconaservermongodbs"},
+		kind:     "PerconaServerMongoDB",
+		degraded: perconaMongoDBDegraded,
+	},
+}
+
+// zalandoDegraded reads the status Patroni reports through the Zalando
+// operator, which is Running once every member is up and streaming.
+func zalandoDegraded(cluster *unstructured.Unstructured) string {
+	status, _, _ := unstructured.NestedString(cluster.Object, "status", "PostgresClusterStatus")
+	switch status {
+	case "Running":
+		return ""
+	case "":
+		return "the cluster reports no status"
+	}
+	return "the cluster status is " + status
+}
+
+// mongoDBCommunityDegraded requires the Running phase with every member of
+// the replica set up.
+func mongoDBCommunityDegraded(cluster *unstructured.Unstructured) string {
+	phase, _, _ := unstructured.NestedString(cluster.Object, "status", "phase")
+	if phase != "Running" {
+		return fmt.Sprintf("the replica set phase is %q", phase)
+	}
+	members, found, _ := unstructured.NestedInt64(cluster.Object, "spec", "members")
+	current, _, _ := unstructured.NestedInt64(cluster.Object, "status", "currentMongoDBMembers")
+	if found && current < members {
+		return fmt.Sprintf("%d of %d replica set members are up", current, members)
+	}
+	return ""
+}
+
+// perconaMongoDBDegraded requires the ready state, with every member of each
+// replica set ready.
+func perconaMongoDBDegraded(cluster *unstructured.Unstructured) string {
+	state, _, _ := unstructured.NestedString(cluster.Object, "status", "state")
+	if state != "ready" {
+		return fmt.Sprintf("the cluster state is %q", state)
+	}
+	replsets, _, _ := unstructured.NestedMap(cluster.Object, "status", "replsets")
+	names := make([]string, 0, len(replsets))
+	for name := range replsets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var degraded []string
+	for _, name := range names {
+		ready, _, _ := unstructured.NestedInt64(replsets, name, "ready")
+		size, _, _ := unstructured.NestedInt64(replsets, name, "size")
+		if ready < size {
+			degraded = append(degraded, fmt.Sprintf("replica set %s has %d of %d members ready", name, ready, size))
+		}
+	}
+	return strings.Join(degraded, ", ")
+}
+
+// findCluster returns the operator and the resource of the cluster a target
+// is a member of, or a nil operator if no recognised operator manages it.
+func findCluster(ctx context.Context, clientset kubernetes.Interface, dynamicClient dynamic.Interface, t target) (*clusterOperator, *unstructured.Unstructured, error) {
+	obj, err := getWorkload(ctx, clientset, dynamicClient, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	accessor, err := apimeta.Accessor(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range clusterOperators {
+		op := &clusterOperators[i]
+		name := ""
+		for _, owner := range accessor.GetOwnerReferences() {
+			gv, err := schema.ParseGroupVersion(owner.APIVersion)
+			if err == nil && gv.Group == op.resource.Group && owner.Kind == op.kind {
+				name = owner.Name
+			}
+		}
+		if name == "" && op.clusterLabel != "" && hasLabels(t.Labels, op.labels) {
+			name = t.Labels[op.clusterLabel]
+		}
+		if name == "" {
+			continue
+		}
+
+		cluster, err := dynamicClient.Resource(op.resource).Namespace(t.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get %s %s: %w", op.kind, name, err)
+		}
+		return op, cluster, nil
+	}
+	return nil, nil, nil
+}
+
+// hasLabels reports whether labels include every one of want.
+func hasLabels(labels, want map[string]string) bool {
+	for key, value := range want {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// waitForReplication fences the restart of a member of a cluster managed by
+// a recognised operator: it waits up to timeout for the cluster to report
+// healthy replication. It returns what the cluster still reports once the
+// timeout expires, or "" if the target may be restarted.
+func waitForReplication(ctx context.Context, clientset kubernetes.Interface, dynamicClient dynamic.Interface, t target, timeout time.Duration) (string, error) {
+	op, cluster, err := findCluster(ctx, clientset, dynamicClient, t)
+	if err != nil || op == nil {
+		return "", err
+	}
+
+	name := cluster.GetName()
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		degraded := op.degraded(cluster)
+		if degraded == "" {
+			if waiting {
+				progressf(t, "Replication of %s %s is healthy again", op.kind, name)
+			}
+			return "", nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Sprintf("replication of %s %s is degraded: %s", op.kind, name, degraded), nil
+		}
+		if !waiting {
+			progressf(t, "Waiting for the replication of %s %s, managed by the %s, to recover before restarting %s: %s", op.kind, name, op.name, t, degraded)
+			waiting = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(replicationPoll):
+		}
+		cluster, err = dynamicClient.Resource(op.resource).Namespace(t.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to get %s %s: %w", op.kind, name, err)
+		}
+	}
+}
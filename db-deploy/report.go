@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// progress receives human-readable progress output. When the report is
+// written as JSON it is switched to stderr, so that stdout carries nothing but
+// the report.
+var progress io.Writer = os.Stdout
+
+// result records the outcome of restarting a single target.
+type result struct {
+	Target     target
+	Restarted  bool
+	Skipped    string // reason the target was deliberately not restarted
+	Err        error
+	RolloutErr error
+	Duration   time.Duration
+
+	// Mutations lists pod template fields that admission webhooks changed:
+	// any field with --server-dry-run, and the fields of the restart patch
+	// when the restart was applied.
+	Mutations []string
+
+	// Diagnostics is the path of the diagnostic bundle collected after the
+	// target failed.
+	Diagnostics string
+
+	// Disruptions lists pods, created by the restart, that the cluster
+	// autoscaler evicted again while the rollout was awaited.
+	Disruptions []string
+
+	// Preemptions lists pods of the target that the scheduler preempted for
+	// pods of higher priority while the rollout was awaited, with the
+	// scheduler's message.
+	Preemptions []string
+
+	// DebugOutput lists the files holding the output of debug containers
+	// run in crashlooping pods before the restart.
+	DebugOutput []string
+
+	// Application is set when the target was restarted as part of an
+	// application.
+	Application string
+
+	// DryRun is set when the restart was only simulated with a server side
+	// dry run.
+	DryRun bool
+
+	// Warnings lists the warnings the API server returned for the restart.
+	Warnings []string
+
+	// ScaledToZero is set when the target was skipped because it has no
+	// replicas to restart.
+	ScaledToZero bool
+
+	// Attempts counts how often the target was tried. Zero means once.
+	Attempts int
+
+	// DeletedPods lists the pods deleted by --only-unhealthy, with the
+	// reason each was unhealthy.
+	DeletedPods []string
+
+	// RolledBackTo is the revision a Deployment was rolled back to after
+	// its rollout failed, and RollbackErr why rolling it back failed.
+	RolledBackTo int64
+	RollbackErr  error
+
+	// Awaited is set when the rollout of a restarted target was followed
+	// until it completed or failed.
+	Awaited bool
+
+	// VerificationClass names the verification class the target matched,
+	// or is empty for the default pipeline, and Checks holds the outcome of
+	// each check of the pipeline in order.
+	VerificationClass string
+	Checks            []checkResult
+
+	// Deferred is set when the target was skipped for a reason expected to
+	// clear up, and is queued to be retried later.
+	Deferred bool
+}
+
+// attempts returns the number of times the target was tried.
+func (r result) attempts() int {
+	if r.Attempts == 0 {
+		return 1
+	}
+	return r.Attempts
+}
+
+// printPlan prints the targets that are about to be restarted.
+func printPlan(targets []target) {
+	fmt.Fprintf(progress, "Restart plan (%d workloads):\n", len(targets))
+	if !planTime.IsZero() {
+		fmt.Fprintf(progress, "  plan time: %s\n", planTime.UTC().Format(time.RFC3339))
+	}
+	for _, t := range targets {
+		var notes []string
+		if t.OS != "" {
+			notes = append(notes, t.OS)
+		}
+		if t.Mesh != "" {
+			notes = append(notes, t.Mesh+" sidecar")
+		}
+		if !t.OldestPod.IsZero() {
+			notes = append(notes, "oldest pod "+formatAge(planNow().Sub(t.OldestPod)))
+		}
+		if len(notes) > 0 {
+			fmt.Fprintf(progress, "  - %s (%s)\n", t, strings.Join(notes, ", "))
+		} else {
+			fmt.Fprintf(progress, "  - %s\n", t)
+		}
+		if optedOut(t) {
+			fmt.Fprintf(progress, "      opted out (%s=%s), will be skipped\n", skipAnnotation, t.Annotations[skipAnnotation])
+		} else if _, frozen := frozenUntil(t, planNow()); frozen {
+			fmt.Fprintf(progress, "      frozen (%s=%s), will be skipped\n", frozenUntilAnnotation, t.Annotations[frozenUntilAnnotation])
+		} else if reason := blackout(t, planNow()); reason != "" {
+			fmt.Fprintf(progress, "      %s, will be skipped\n", reason)
+		}
+		if len(t.PendingPods) > 0 {
+			fmt.Fprintf(progress, "      already pending before restart: %s\n", strings.Join(t.PendingPods, ", "))
+		}
+		if scaledToZero(t) {
+			fmt.Fprintln(progress, "      scaled to zero replicas")
+		}
+		if migration := t.Annotations[migrationAnnotation]; migration != "" {
+			fmt.Fprintf(progress, "      restarted only after migration %s succeeded\n", migration)
+		}
+		if len(t.CrashLooping) > 0 {
+			fmt.Fprintf(progress, "      crashlooping: %s\n", strings.Join(t.CrashLooping, ", "))
+		}
+		if t.Memory != nil {
+			fmt.Fprintf(progress, "      %s in pod %s\n", t.Memory, t.Memory.Pod)
+		}
+	}
+	fmt.Fprintln(progress)
+}
+
+// printDryRun lists the workloads a run would restart, with the reason each
+// was selected, and notes the ones it would skip regardless.
+func printDryRun(w io.Writer, targets []target) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tKIND\tNAME\tMATCHED BECAUSE\tNOTE")
+	restarted := 0
+	for _, t := range targets {
+		note := ""
+		switch _, frozen := frozenUntil(t, planNow()); {
+		case optedOut(t):
+			note = "opted out with " + skipAnnotation + ", would be skipped"
+		case frozen:
+			note = "frozen, would be skipped"
+		case blackout(t, planNow()) != "":
+			note = blackout(t, planNow()) + ", would be skipped"
+		case scaledToZero(t):
+			note = "scaled to zero, skipped unless --scale-idle"
+		default:
+			restarted++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", t.Namespace, t.Kind, t.Name, t.MatchReason, note)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nDry run: %d of %d matched workloads would be restarted, nothing was changed\n", restarted, len(targets))
+}
+
+// formatAge renders a pod age coarsely, in days once it exceeds one.
+func formatAge(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+	return d.Round(time.Minute).String()
+}
+
+// printCronJobPlan prints the database CronJobs in scope and what will happen
+// to the suspended ones.
+func printCronJobPlan(cronJobs []cronJob, mode string) {
+	if len(cronJobs) == 0 {
+		return
+	}
+	fmt.Fprintf(progress, "Database CronJobs in scope (%d):\n", len(cronJobs))
+	for _, c := range cronJobs {
+		fmt.Fprintf(progress, "  - %s (%s", c, c.Schedule)
+		if c.Active > 0 {
+			fmt.Fprintf(progress, ", %d active jobs", c.Active)
+		}
+		if !c.LastSchedule.IsZero() {
+			fmt.Fprintf(progress, ", last run %s", c.LastSchedule.UTC().Format(time.RFC3339))
+		}
+		fmt.Fprintln(progress, ")")
+		if c.Suspended {
+			if mode == suspendedCronJobsTrigger {
+				fmt.Fprintln(progress, "      suspended, will be triggered once after the restarts")
+			} else {
+				fmt.Fprintln(progress, "      suspended, will be skipped")
+			}
+		}
+	}
+	fmt.Fprintln(progress)
+}
+
+// Outcomes of a single target, as reported by result.status.
+const (
+	statusRestarted     = "restarted"
+	statusRolloutFailed = "rollout_failed"
+	statusFailed        = "failed"
+	statusSkipped       = "skipped"
+	statusScaledToZero  = "scaled_to_zero"
+	statusDryRun        = "dry_run"
+)
+
+// status classifies the outcome of the result.
+func (r result) status() string {
+	switch {
+	case r.ScaledToZero:
+		return statusScaledToZero
+	case r.Skipped != "":
+		return statusSkipped
+	case r.Err != nil:
+		return statusFailed
+	case r.RolloutErr != nil:
+		return statusRolloutFailed
+	case r.DryRun:
+		return statusDryRun
+	}
+	return statusRestarted
+}
+
+// printReport prints a summary of the run. Failures on workloads that already
+// had Pending pods are marked so they are not attributed to the restart. The
+// warnings the API server returned during the run are listed last, since they
+// often give the first notice of APIs deprecated by a cluster upgrade.
+func printReport(w io.Writer, results []result, cronJobs []cronJob, warnings []apiWarning) {
+	restarted := 0
+	fmt.Fprintln(w, "\nSummary:")
+	for _, res := range results {
+		status := "restarted, rollout complete"
+		if !res.Awaited {
+			status = "restart accepted, rollout not awaited"
+		}
+		switch res.status() {
+		case statusSkipped, statusScaledToZero:
+			status = "skipped: " + res.Skipped
+			if res.Deferred {
+				status = "deferred: " + res.Skipped
+			}
+		case statusFailed:
+			status = fmt.Sprintf("failed: %v", res.Err)
+			if res.DryRun {
+				status = fmt.Sprintf("admission would deny: %v", res.Err)
+			}
+		case statusDryRun:
+			status = "admission would accept"
+		case statusRolloutFailed:
+			status = fmt.Sprintf("rollout failed: %v", res.RolloutErr)
+		}
+		if res.Restarted {
+			restarted++
+		}
+		if n := res.attempts(); n > 1 {
+			status += fmt.Sprintf(" (after %d attempts)", n)
+		}
+		fmt.Fprintf(w, "  %s: %s\n", res.Target, status)
+		if len(res.Target.PendingPods) > 0 {
+			fmt.Fprintf(w, "      pre-existing pending pods: %s\n", strings.Join(res.Target.PendingPods, ", "))
+		}
+		for _, finding := range res.Target.SecurityFindings {
+			fmt.Fprintf(w, "      security: %s\n", finding)
+		}
+		if res.Diagnostics != "" {
+			fmt.Fprintf(w, "      diagnostics: %s\n", res.Diagnostics)
+		}
+		switch {
+		case res.RolledBackTo > 0:
+			fmt.Fprintf(w, "      rolled back to revision %d\n", res.RolledBackTo)
+		case res.RollbackErr != nil:
+			fmt.Fprintf(w, "      rollback failed: %v\n", res.RollbackErr)
+		}
+		if len(res.DeletedPods) > 0 {
+			fmt.Fprintf(w, "      replaced unhealthy pods: %s\n", strings.Join(res.DeletedPods, ", "))
+		}
+		if len(res.Disruptions) > 0 {
+			fmt.Fprintf(w, "      disrupted again by autoscaler scale-down: %s\n", strings.Join(res.Disruptions, ", "))
+		}
+		if checks := formatChecks(res); checks != "" {
+			fmt.Fprintf(w, "      verification: %s\n", checks)
+		}
+		if len(res.Preemptions) > 0 {
+			fmt.Fprintf(w, "      preempted by higher-priority pods: %s\n", strings.Join(res.Preemptions, ", "))
+		}
+		if len(res.DebugOutput) > 0 {
+			fmt.Fprintf(w, "      debug output: %s\n", strings.Join(res.DebugOutput, ", "))
+		}
+		if len(res.Mutations) > 0 {
+			fmt.Fprintf(w, "      changed by admission webhooks: %s\n", strings.Join(res.Mutations, ", "))
+		}
+		for _, warning := range res.Warnings {
+			fmt.Fprintf(w, "      warning: %s\n", warning)
+		}
+	}
+
+	if apps := applicationResults(results); len(apps) > 0 {
+		fmt.Fprintln(w, "\nApplications:")
+		for _, app := range apps {
+			fmt.Fprintf(w, "  %s: %s (%d workloads)\n", app.name, applicationStatus(app.results), len(app.results))
+		}
+	}
+
+	if len(cronJobs) > 0 {
+		fmt.Fprintln(w, "\nCronJobs:")
+		for _, c := range cronJobs {
+			switch c.Action {
+			case cronJobTriggered:
+				fmt.Fprintf(w, "  %s: triggered as job %s\n", c, c.Job)
+			case cronJobFailed:
+				fmt.Fprintf(w, "  %s: trigger failed: %v\n", c, c.Err)
+			default:
+				fmt.Fprintf(w, "  %s: %s\n", c, c.Action)
+			}
+		}
+	}
+
+	if len(warnings) > 0 {
+		fmt.Fprintln(w, "\nAPI server warnings:")
+		for _, warning := range warnings {
+			fmt.Fprintf(w, "  %s (%dx)\n", warning.Text, warning.Count)
+		}
+	}
+
+	fmt.Fprintf(w, "\nTotal resources restarted: %d\n", restarted)
+}
+
+// applicationResult holds the results of the targets of one application.
+type applicationResult struct {
+	name    string
+	results []result
+}
+
+// applicationResults groups results by application, in the order the
+// applications were restarted. Results outside an application are left out.
+func applicationResults(results []result) []applicationResult {
+	var apps []applicationResult
+	index := make(map[string]int)
+	for _, res := range results {
+		if res.Application == "" {
+			continue
+		}
+		i, ok := index[res.Application]
+		if !ok {
+			i = len(apps)
+			index[res.Application] = i
+			apps = append(apps, applicationResult{name: res.Application})
+		}
+		apps[i].results = append(apps[i].results, res)
+	}
+	return apps
+}
+
+// formatChecks summarizes the verification pipeline of a result, such as
+// "rollout passed in 42s, exec failed: ...". It is empty for the default
+// pipeline when every check passed or did not apply, which the status
+// already says.
+func formatChecks(res result) string {
+	failed := false
+	for _, c := range res.Checks {
+		failed = failed || c.Status == checkFailed
+	}
+	if res.VerificationClass == "" && !failed {
+		return ""
+	}
+
+	var parts []string
+	for _, c := range res.Checks {
+		switch c.Status {
+		case checkPassed:
+			parts = append(parts, fmt.Sprintf("%s passed in %s", c.Name, c.Duration.Round(time.Second)))
+		case checkFailed:
+			parts = append(parts, fmt.Sprintf("%s failed: %v", c.Name, c.Err))
+		default:
+			parts = append(parts, fmt.Sprintf("%s %s", c.Name, strings.ReplaceAll(c.Status, "_", " ")))
+		}
+	}
+	summary := strings.Join(parts, ", ")
+	if res.VerificationClass != "" {
+		summary = res.VerificationClass + ": " + summary
+	}
+	return summary
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// reportSchemaVersion identifies the layout of the JSON report. Within a
+// version, fields are only ever added: existing fields keep their name, type
+// and meaning, so consumers can rely on them. Removing or changing a field
+// requires a new version and a new schema file.
+const reportSchemaVersion = "db-pods.report/v1"
+
+//go:embed schema/report-v1.schema.json
+var reportSchema []byte
+
+// jsonReport is the machine-readable report written by --output json. It is
+// described by schema/report-v1.schema.json.
+type jsonReport struct {
+	SchemaVersion string       `json:"schemaVersion"`
+	RunID         string       `json:"runId"`
+	StartedAt     time.Time    `json:"startedAt"`
+	FinishedAt    time.Time    `json:"finishedAt"`
+	Summary       jsonSummary  `json:"summary"`
+	Results       []jsonResult `json:"results"`
+
+	Applications []jsonApplication `json:"applications,omitempty"`
+	CronJobs     []jsonCronJob     `json:"cronJobs,omitempty"`
+	APIWarnings  []jsonAPIWarning  `json:"apiWarnings,omitempty"`
+}
+
+type jsonAPIWarning struct {
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+}
+
+type jsonCronJob struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Schedule  string `json:"schedule"`
+	Suspended bool   `json:"suspended"`
+	Action    string `json:"action"`
+	Job       string `json:"job,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type jsonApplication struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Workloads int    `json:"workloads"`
+}
+
+type jsonSummary struct {
+	Total         int `json:"total"`
+	Restarted     int `json:"restarted"`
+	RolloutFailed int `json:"rolloutFailed"`
+	Failed        int `json:"failed"`
+	Skipped       int `json:"skipped"`
+	DryRun        int `json:"dryRun,omitempty"`
+	ScaledToZero  int `json:"scaledToZero,omitempty"`
+}
+
+type jsonCheck struct {
+	Name            string  `json:"name"`
+	Status          string  `json:"status"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+type jsonMemory struct {
+	Pod             string `json:"pod"`
+	WorkingSetBytes int64  `json:"workingSetBytes"`
+	RequestBytes    int64  `json:"requestBytes,omitempty"`
+	LimitBytes      int64  `json:"limitBytes,omitempty"`
+}
+
+type jsonResult struct {
+	Kind                     string      `json:"kind"`
+	Namespace                string      `json:"namespace"`
+	Name                     string      `json:"name"`
+	Status                   string      `json:"status"`
+	Error                    string      `json:"error,omitempty"`
+	SkipReason               string      `json:"skipReason,omitempty"`
+	Deferred                 bool        `json:"deferred,omitempty"`
+	DurationSeconds          float64     `json:"durationSeconds"`
+	RolloutAwaited           bool        `json:"rolloutAwaited,omitempty"`
+	Mesh                     string      `json:"mesh,omitempty"`
+	OS                       string      `json:"os,omitempty"`
+	PendingPodsBeforeRestart []string    `json:"pendingPodsBeforeRestart,omitempty"`
+	MemoryBeforeRestart      *jsonMemory `json:"memoryBeforeRestart,omitempty"`
+	Application              string      `json:"application,omitempty"`
+	WebhookMutations         []string    `json:"webhookMutations,omitempty"`
+	DiagnosticsPath          string      `json:"diagnosticsPath,omitempty"`
+	DebugOutputPaths         []string    `json:"debugOutputPaths,omitempty"`
+	AutoscalerEvictions      []string    `json:"autoscalerEvictions,omitempty"`
+	Preemptions              []string    `json:"preemptions,omitempty"`
+	VerificationClass        string      `json:"verificationClass,omitempty"`
+	Checks                   []jsonCheck `json:"checks,omitempty"`
+	DeletedPods              []string    `json:"deletedPods,omitempty"`
+	RolledBackToRevision     int64       `json:"rolledBackToRevision,omitempty"`
+	RollbackError            string      `json:"rollbackError,omitempty"`
+	Attempts                 int         `json:"attempts"`
+	Warnings                 []string    `json:"warnings,omitempty"`
+	SecurityFindings         []string    `json:"securityFindings,omitempty"`
+}
+
+// writeJSONReport writes the results of a run as a JSON report.
+func writeJSONReport(w io.Writer, runID string, startedAt, finishedAt time.Time, results []result, cronJobs []cronJob, warnings []apiWarning) error {
+	report := jsonReport{
+		SchemaVersion: reportSchemaVersion,
+		RunID:         runID,
+		StartedAt:     startedAt.UTC(),
+		FinishedAt:    finishedAt.UTC(),
+		Results:       make([]jsonResult, 0, len(results)),
+	}
+
+	for _, res := range results {
+		r := jsonResult{
+			Kind:                     res.Target.Kind,
+			Namespace:                res.Target.Namespace,
+			Name:                     res.Target.Name,
+			Status:                   res.status(),
+			SkipReason:               res.Skipped,
+			Deferred:                 res.Deferred,
+			DurationSeconds:          res.Duration.Seconds(),
+			RolloutAwaited:           res.Awaited,
+			Mesh:                     res.Target.Mesh,
+			OS:                       res.Target.OS,
+			PendingPodsBeforeRestart: res.Target.PendingPods,
+			Application:              res.Application,
+			WebhookMutations:         res.Mutations,
+			DiagnosticsPath:          res.Diagnostics,
+			DebugOutputPaths:         res.DebugOutput,
+			AutoscalerEvictions:      res.Disruptions,
+			Preemptions:              res.Preemptions,
+			VerificationClass:        res.VerificationClass,
+			DeletedPods:              res.DeletedPods,
+			RolledBackToRevision:     res.RolledBackTo,
+			Attempts:                 res.attempts(),
+			Warnings:                 res.Warnings,
+			SecurityFindings:         res.Target.SecurityFindings,
+		}
+		if m := res.Target.Memory; m != nil {
+			r.MemoryBeforeRestart = &jsonMemory{Pod: m.Pod, WorkingSetBytes: m.WorkingSet, RequestBytes: m.Request, LimitBytes: m.Limit}
+		}
+		for _, c := range res.Checks {
+			check := jsonCheck{Name: c.Name, Status: c.Status, DurationSeconds: c.Duration.Seconds()}
+			if c.Err != nil {
+				check.Error = c.Err.Error()
+			}
+			r.Checks = append(r.Checks, check)
+		}
+		switch r.Status {
+		case statusRestarted:
+			report.Summary.Restarted++
+		case statusRolloutFailed:
+			report.Summary.RolloutFailed++
+			r.Error = res.RolloutErr.Error()
+			if res.RollbackErr != nil {
+				r.RollbackError = res.RollbackErr.Error()
+			}
+		case statusFailed:
+			report.Summary.Failed++
+			r.Error = res.Err.Error()
+		case statusSkipped:
+			report.Summary.Skipped++
+		case statusDryRun:
+			report.Summary.DryRun++
+		case statusScaledToZero:
+			report.Summary.ScaledToZero++
+		}
+		report.Summary.Total++
+		report.Results = append(report.Results, r)
+	}
+
+	for _, app := range applicationResults(results) {
+		report.Applications = append(report.Applications, jsonApplication{
+			Name:      app.name,
+			Status:    applicationStatus(app.results),
+			Workloads: len(app.results),
+		})
+	}
+
+	for _, c := range cronJobs {
+		j := jsonCronJob{
+			Namespace: c.Namespace,
+			Name:      c.Name,
+			Schedule:  c.Schedule,
+			Suspended: c.Suspended,
+			Action:    c.Action,
+			Job:       c.Job,
+		}
+		if c.Err != nil {
+			j.Error = c.Err.Error()
+		}
+		report.CronJobs = append(report.CronJobs, j)
+	}
+
+	for _, warning := range warnings {
+		report.APIWarnings = append(report.APIWarnings, jsonAPIWarning{Message: warning.Text, Count: warning.Count})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// schemaCommand prints the JSON schema of the report written by --output json.
+func schemaCommand(args []string) {
+	os.Stdout.Write(reportSchema)
+}
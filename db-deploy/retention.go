@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// historyRetention bounds what the tool keeps of past runs, so that the state
+// of long-lived daemons and scheduled runs does not grow without end: the
+// restart history annotation of each workload, the entries of the deferred
+// queue and the diagnostic bundles of runs.
+type historyRetention struct {
+	// limit is the number of restarts kept in the history of each workload
+	// and of runs kept under --diagnostics-dir. Zero means
+	// restartHistorySize.
+	limit int
+
+	// ttl is the age past which restarts, deferred entries and diagnostic
+	// bundles are pruned, whatever the limit. Zero keeps them until the
+	// limit is reached.
+	ttl time.Duration
+}
+
+// defaultHistoryTTL is the default of --history-ttl.
+const defaultHistoryTTL = 90 * 24 * time.Hour
+
+// addRetentionFlags defines --history-limit and --history-ttl on fs.
+func addRetentionFlags(fs *pflag.FlagSet, r *historyRetention) {
+	r.limit = restartHistorySize
+	r.ttl = defaultHistoryTTL
+	fs.IntVar(&r.limit, "history-limit", r.limit, "number of restarts kept in the "+restartHistoryAnnotation+" annotation of each workload, and of runs kept under --diagnostics-dir")
+	fs.Var((*daysDuration)(&r.ttl), "history-ttl", "prune restart history, deferred queue entries and diagnostic bundles older than this, such as 90d or 720h; 0 keeps them until --history-limit")
+}
+
+// validate checks the values of the retention flags.
+func (r historyRetention) validate() error {
+	if r.limit < 1 {
+		return fmt.Errorf("--history-limit must be at least 1")
+	}
+	if r.ttl < 0 {
+		return fmt.Errorf("--history-ttl must not be negative")
+	}
+	return nil
+}
+
+// size returns the number of records kept.
+func (r historyRetention) size() int {
+	if r.limit <= 0 {
+		return restartHistorySize
+	}
+	return r.limit
+}
+
+// expired reports whether a record made at the given time is past the TTL.
+func (r historyRetention) expired(at time.Time) bool {
+	return r.ttl > 0 && time.Since(at) > r.ttl
+}
+
+// daysDuration is a duration flag that also accepts a number of days, such as
+// 90d, which time.ParseDuration does not.
+type daysDuration time.Duration
+
+func (d *daysDuration) String() string {
+	duration := time.Duration(*d)
+	if duration > 0 && duration%(24*time.Hour) == 0 {
+		return strconv.Itoa(int(duration/(24*time.Hour))) + "d"
+	}
+	return duration.String()
+}
+
+func (d *daysDuration) Type() string {
+	return "duration"
+}
+
+func (d *daysDuration) Set(value string) error {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return fmt.Errorf("invalid number of days %q", value)
+		}
+		*d = daysDuration(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = daysDuration(duration)
+	return nil
+}
+
+// pruneDiagnostics removes the diagnostic bundles of past runs from dir, one
+// subdirectory per run, beyond the newest ones the retention keeps and past
+// its TTL. Failures are logged, since pruning never fails a run.
+func pruneDiagnostics(dir string, r historyRetention) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Cannot prune diagnostics", "dir", dir, "error", err)
+		}
+		return
+	}
+	type run struct {
+		path     string
+		modified time.Time
+	}
+	var runs []run
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		runs = append(runs, run{filepath.Join(dir, entry.Name()), info.ModTime()})
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].modified.After(runs[j].modified) })
+	for i, run := range runs {
+		if i < r.size() && !r.expired(run.modified) {
+			continue
+		}
+		if err := os.RemoveAll(run.path); err != nil {
+			slog.Warn("Cannot prune diagnostics", "dir", run.path, "error", err)
+			continue
+		}
+		slog.Info("Pruned diagnostics of a past run", "dir", run.path)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// apiBackoff spaces the attempts of the writes to workloads: 500ms, 1s, 2s
+// and so on up to apiBackoffCap, each up to half again as long, so that
+// several runs or controllers retrying at once drift apart. Its steps are
+// the number of attempts, set with --api-attempts.
+var apiBackoff = wait.Backoff{
+	Duration: 500 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.5,
+	Steps:    5,
+}
+
+// apiBackoffCap is the longest delay between two attempts, before jitter.
+const apiBackoffCap = 30 * time.Second
+
+// retriableAPIError reports whether a failed request may succeed when sent
+// again: a conflict with another writer, throttling, a timeout, an
+// unavailable or failing API server, or a dropped connection.
+func retriableAPIError(err error) bool {
+	return apierrors.IsConflict(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err) ||
+		utilnet.IsConnectionReset(err) ||
+		utilnet.IsProbableEOF(err)
+}
+
+// retryAPI calls fn until it succeeds, fails with an error that is not
+// retriable, or the attempts of apiBackoff are used up, sleeping with
+// exponential backoff in between. It returns the last error. fn must redo
+// any read it bases its write on, since a conflict means it is stale.
+func retryAPI(ctx context.Context, what string, fn func(ctx context.Context) error) error {
+	backoff := apiBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(ctx); err == nil || !retriableAPIError(err) || backoff.Steps <= 1 {
+			return err
+		}
+		delay := backoff.Step()
+		if backoff.Duration > apiBackoffCap {
+			backoff.Duration = apiBackoffCap
+		}
+		slog.Warn("Retrying", "request", what, "attempt", attempt, "delay", delay.Round(time.Millisecond).String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
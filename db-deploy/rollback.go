@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// deploymentRevisionAnnotation is set by the deployment controller on a
+// Deployment and its ReplicaSets.
+const deploymentRevisionAnnotation = "deployment.kubernetes.io/revision"
+
+// rollbackDeployment rolls a Deployment back to the revision before its
+// current one, as "kubectl rollout undo" does, by restoring the pod template
+// of the ReplicaSet of that revision. It returns the revision rolled back to.
+func rollbackDeployment(ctx context.Context, clientset *kubernetes.Clientset, t target) (int64, error) {
+	deployment, err := clientset.AppsV1().Deployments(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get deployment: %w", err)
+	}
+	previous, revision, err := previousReplicaSet(ctx, clientset, deployment)
+	if err != nil {
+		return 0, err
+	}
+	return revision, restoreReplicaSet(ctx, clientset, deployment, previous)
+}
+
+// previousReplicaSet returns the ReplicaSet of the revision before the
+// current one of a Deployment, and that revision.
+func previousReplicaSet(ctx context.Context, clientset *kubernetes.Clientset, deployment *appsv1.Deployment) (*appsv1.ReplicaSet, int64, error) {
+	current, err := strconv.ParseInt(deployment.Annotations[deploymentRevisionAnnotation], 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("deployment has no valid %s annotation", deploymentRevisionAnnotation)
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid selector: %w", err)
+	}
+	replicaSets, err := clientset.AppsV1().ReplicaSets(deployment.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list replicasets: %w", err)
+	}
+
+	var previous *appsv1.ReplicaSet
+	var previousRevision int64
+	for i := range replicaSets.Items {
+		rs := &replicaSets.Items[i]
+		if owner := metav1.GetControllerOf(rs); owner == nil || owner.UID != deployment.UID {
+			continue
+		}
+		revision, err := strconv.ParseInt(rs.Annotations[deploymentRevisionAnnotation], 10, 64)
+		if err != nil || revision >= current {
+			continue
+		}
+		if revision > previousRevision {
+			previous, previousRevision = rs, revision
+		}
+	}
+	if previous == nil {
+		return nil, 0, fmt.Errorf("no revision before %d is left to roll back to", current)
+	}
+	return previous, previousRevision, nil
+}
+
+// restoreReplicaSet sets the pod template of a Deployment to that of one of
+// its ReplicaSets.
+func restoreReplicaSet(ctx context.Context, clientset *kubernetes.Clientset, deployment *appsv1.Deployment, rs *appsv1.ReplicaSet) error {
+	template := rs.Spec.Template.DeepCopy()
+	delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+	deployments := clientset.AppsV1().Deployments(deployment.Namespace)
+	current := deployment.DeepCopy()
+	err := retryAPI(ctx, "roll back deployment "+deployment.Namespace+"/"+deployment.Name, func(ctx context.Context) error {
+		current.Spec.Template = *template
+		_, err := deployments.Update(ctx, current, metav1.UpdateOptions{})
+		if apierrors.IsConflict(err) {
+			// Base the next attempt on the deployment as it is now
+			if latest, getErr := deployments.Get(ctx, deployment.Name, metav1.GetOptions{}); getErr == nil {
+				current = latest
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update deployment: %w", err)
+	}
+	return nil
+}
+
+// lastControllerRevisions returns the current and the previous
+// ControllerRevision of a StatefulSet or DaemonSet, which keep their rollout
+// history. The previous one is nil if no earlier revision is left.
+func lastControllerRevisions(ctx context.Context, clientset *kubernetes.Clientset, owner metav1.Object, selector *metav1.LabelSelector) (current, previous *appsv1.ControllerRevision, err error) {
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid selector: %w", err)
+	}
+	revisions, err := clientset.AppsV1().ControllerRevisions(owner.GetNamespace()).List(ctx, metav1.ListOptions{LabelSelector: labelSelector.String()})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list controllerrevisions: %w", err)
+	}
+
+	var owned []*appsv1.ControllerRevision
+	for i := range revisions.Items {
+		if ref := metav1.GetControllerOf(&revisions.Items[i]); ref != nil && ref.UID == owner.GetUID() {
+			owned = append(owned, &revisions.Items[i])
+		}
+	}
+	if len(owned) == 0 {
+		return nil, nil, fmt.Errorf("no controllerrevision found")
+	}
+	sort.Slice(owned, func(i, j int) bool { return owned[i].Revision < owned[j].Revision })
+	current = owned[len(owned)-1]
+	if len(owned) > 1 {
+		previous = owned[len(owned)-2]
+	}
+	return current, previous, nil
+}
+
+// revisionTemplate decodes the pod template recorded in a ControllerRevision.
+func revisionTemplate(revision *appsv1.ControllerRevision) (*corev1.PodTemplateSpec, error) {
+	var data struct {
+		Spec struct {
+			Template corev1.PodTemplateSpec `json:"template"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(revision.Data.Raw, &data); err != nil {
+		return nil, fmt.Errorf("failed to decode controllerrevision %s: %w", revision.Name, err)
+	}
+	return &data.Spec.Template, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	watchtools "k8s.io/client-go/tools/watch"
+
+	"redeploy-database-pods/pkg/restart"
+)
+
+// waitForRollout blocks until the target has finished rolling out or the
+// timeout expires. Instead of polling Get in a loop it lists the object once
+// and then follows a watch on it, so completion is noticed as soon as the
+// controller publishes the new status and the API server only has to serve a
+// single long-lived request per workload.
+//
+// Pods created since the restart are watched alongside the workload, and the
+// wait fails early if one of them cannot pull its image. If one of them is
+// evicted by a cluster autoscaler scale-down, onDisruption is called and the
+// timeout starts over, since its replacement needs the full time again.
+func waitForRollout(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, t target, since time.Time, timeout time.Duration, onDisruption func(pod, node string)) error {
+	lw, obj, err := restart.WorkloadListWatch(ctx, clientset, dynamicClient, t.ref())
+	if err != nil {
+		return err
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	timedOut := fmt.Errorf("timed out after %s waiting for rollout", timeout)
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() { cancel(timedOut) })
+		defer timer.Stop()
+	}
+
+	if t.Selector != nil {
+		go func() {
+			if err := watchImagePulls(ctx, clientset, t, since); err != nil {
+				cancel(err)
+			}
+		}()
+		go func() {
+			err := watchAutoscalerEvictions(ctx, clientset, t, since, func(pod, node string) {
+				if timer != nil {
+					timer.Reset(timeout)
+				}
+				onDisruption(pod, node)
+			})
+			if err != nil {
+				cancel(err)
+			}
+		}()
+	}
+
+	// The last state seen is kept to explain why the rollout failed
+	var last runtime.Object
+	_, err = watchtools.UntilWithSync(ctx, lw, obj, nil, func(event watch.Event) (bool, error) {
+		switch event.Type {
+		case watch.Deleted:
+			return false, fmt.Errorf("%s was deleted while waiting for rollout", t.Kind)
+		case watch.Added, watch.Modified:
+			last = event.Object
+			return restart.RolloutComplete(event.Object)
+		}
+		return false, nil
+	})
+	if wait.Interrupted(err) {
+		if cause := context.Cause(ctx); cause != context.Canceled && cause != context.DeadlineExceeded {
+			err = cause
+		} else {
+			err = timedOut
+		}
+	}
+	if err != nil && last != nil && parent.Err() == nil {
+		return explainRolloutFailure(parent, clientset, t, last, since, err)
+	}
+	return err
+}
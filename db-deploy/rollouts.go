@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+
+	"redeploy-database-pods/pkg/restart"
+)
+
+var rolloutResource = restart.RolloutResource
+
+// listRollouts returns every Argo Rollout in a single namespace, or in all of
+// them for metav1.NamespaceAll.
+func listRollouts(ctx context.Context, dynamicClient dynamic.Interface, namespace string, options metav1.ListOptions) ([]target, error) {
+	rollouts, err := dynamicClient.Resource(rolloutResource).Namespace(namespace).List(ctx, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rollouts: %w", err)
+	}
+
+	var targets []target
+	for _, rollout := range rollouts.Items {
+		t := target{Kind: "rollout", Namespace: rollout.GetNamespace(), Name: rollout.GetName(), Labels: rollout.GetLabels(), Annotations: rollout.GetAnnotations()}
+		if value, found, _ := unstructured.NestedString(rollout.Object, "spec", "restartAt"); found {
+			t.LastRestart, _ = time.Parse(time.RFC3339, value)
+		}
+		if replicas, found, _ := unstructured.NestedInt64(rollout.Object, "spec", "replicas"); found {
+			n := int32(replicas)
+			t.Replicas = &n
+		}
+		if template, found, _ := unstructured.NestedMap(rollout.Object, "spec", "template", "spec"); found {
+			spec := &corev1.PodSpec{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(template, spec); err == nil {
+				t.OS = podOS(spec)
+			}
+		}
+		if selector, found, _ := unstructured.NestedMap(rollout.Object, "spec", "selector"); found {
+			t.Selector = &metav1.LabelSelector{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(selector, t.Selector); err != nil {
+				return nil, fmt.Errorf("invalid selector on rollout %s/%s: %w", t.Namespace, t.Name, err)
+			}
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// rolloutAvailability returns the desired and available replica counts of an
+// Argo Rollout.
+func rolloutAvailability(rollout *unstructured.Unstructured) (want, available int32) {
+	want = 1
+	if replicas, found, _ := unstructured.NestedInt64(rollout.Object, "spec", "replicas"); found {
+		want = int32(replicas)
+	}
+	if replicas, found, _ := unstructured.NestedInt64(rollout.Object, "status", "availableReplicas"); found {
+		available = int32(replicas)
+	}
+	return want, available
+}
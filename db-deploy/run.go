@@ -0,0 +1,793 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// options holds the command line settings that affect how each target is
+// restarted.
+type options struct {
+	wait           bool
+	rolloutTimeout time.Duration
+
+	// devProfile is set on local single-node clusters, where safety checks
+	// that protect shared clusters are skipped.
+	devProfile bool
+
+	// adaptiveTimeout replaces rolloutTimeout by a timeout derived from
+	// each target's past rollouts once enough of them are known.
+	adaptiveTimeout adaptiveTimeoutConfig
+
+	meshOutlierHold bool
+	warmup          warmupConfig
+
+	// windowsTimeoutFactor multiplies the timeouts of targets running on
+	// Windows nodes.
+	windowsTimeoutFactor float64
+
+	// maxFleetUnavailable caps the number of unavailable replicas across
+	// all targets before another restart may be issued.
+	maxFleetUnavailable int
+
+	// maxConcurrent caps the number of targets per namespace that may be
+	// rolling out at once, unless the namespace declares its own limit.
+	maxConcurrent int
+
+	chaos chaosOptions
+
+	// retries is the number of times a failed target is requeued, and
+	// retryDelay the pause before each pass over the requeued targets.
+	retries    int
+	retryDelay time.Duration
+
+	// volumeOpTimeout bounds how long a restart is deferred while storage
+	// operations are in progress on the target's volumes.
+	volumeOpTimeout time.Duration
+
+	// pacing slows the run down when consuming services start failing.
+	pacing pacingConfig
+
+	// serverDryRun only sends each restart through admission on the server,
+	// to learn which webhooks and policies would act on it.
+	serverDryRun bool
+
+	// migration configures the check of migrations linked to targets.
+	migration migrationConfig
+
+	// slo holds back restarts while the error budget of consuming services
+	// is nearly exhausted.
+	slo sloConfig
+
+	// replicationTimeout is how long a member of a cluster managed by a
+	// recognised database operator waits for the cluster to report healthy
+	// replication before it is deferred.
+	replicationTimeout time.Duration
+
+	// maxBackupAge refuses restarts of databases whose last backup is
+	// older. Zero disables the check.
+	maxBackupAge time.Duration
+
+	// debug configures the ephemeral container attached to crashlooping
+	// pods before they are restarted.
+	debug debugConfig
+
+	// scaleIdle restarts targets scaled to zero by briefly scaling them up
+	// to one replica, instead of skipping them.
+	scaleIdle bool
+
+	// rollback rolls Deployments whose rollout failed back to their previous
+	// revision.
+	rollback bool
+
+	// onlyUnhealthy deletes only the pods failing their probes or stuck
+	// terminating instead of rolling the whole workload.
+	onlyUnhealthy bool
+
+	// cluster is what the cluster supports, or nil if unknown.
+	cluster *clusterCapabilities
+
+	// reason is recorded in the restart history of each restarted target;
+	// restartReason derives one when it is empty.
+	reason string
+
+	// pauseOnPreemption defers the remaining targets once a pod of a
+	// restarted target has been preempted.
+	pauseOnPreemption bool
+
+	// verification holds the verification pipelines of target classes, or
+	// is nil if every target gets the default pipeline.
+	verification *verificationConfig
+
+	// minMemoryUsage skips targets whose pods all use a smaller share of
+	// their memory than this. Zero disables the check.
+	minMemoryUsage float64
+
+	// planFingerprint is the fingerprint of the --plan file the run executes,
+	// stamped on every workload it restarts. Workloads already stamped with
+	// it are skipped, which makes re-running a plan safe. Empty outside of
+	// plans.
+	planFingerprint string
+
+	// notAfter is when the run stops starting restarts, such as the end of
+	// a maintenance window, deferring the remaining targets. Zero means no
+	// limit.
+	notAfter time.Time
+
+	// pdbTimeout is how long to wait for the PodDisruptionBudgets covering
+	// a target to allow its rollout before deferring it.
+	pdbTimeout time.Duration
+
+	// diagnosticsDir is where diagnostic bundles of failed targets are
+	// written. Diagnostics are not collected if it is empty.
+	diagnosticsDir string
+
+	// retention bounds the restart history recorded on workloads and the
+	// entries kept in the deferred queue.
+	retention historyRetention
+}
+
+// runner restarts targets according to its options.
+type runner struct {
+	clientset *kubernetes.Clientset
+	dynamic   dynamic.Interface
+	opts      options
+	runID     string
+	fleet     *fleetMonitor
+	progress  *campaignProgress
+	pacer     *pacer
+	events    *eventBus
+
+	// namespaceLimits holds the concurrency limits declared by namespaces.
+	namespaceLimits map[string]int
+
+	// pausedBy names the preempted pod that paused the run with
+	// --pause-on-preemption, and abortedBy the failed stage that aborted a
+	// staged run.
+	pauseMu   sync.Mutex
+	pausedBy  string
+	abortedBy string
+}
+
+// pause stops the run from starting further restarts, recording why.
+func (r *runner) pause(reason string) {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+	if r.pausedBy == "" {
+		r.pausedBy = reason
+	}
+}
+
+// paused returns why the run was paused, or "" if it was not.
+func (r *runner) paused() string {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+	return r.pausedBy
+}
+
+// abort stops the run from starting further restarts for good, recording
+// why. Unlike a pause, the targets it holds back are not deferred, since
+// retrying them would repeat what failed.
+func (r *runner) abort(reason string) {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+	if r.abortedBy == "" {
+		r.abortedBy = reason
+	}
+}
+
+// aborted returns why the run was aborted, or "" if it was not.
+func (r *runner) aborted() string {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+	return r.abortedBy
+}
+
+// trackedRestart tracks a target from the moment its restart is triggered
+// until its rollout has been verified.
+type trackedRestart struct {
+	res         result
+	began       time.Time
+	restartedAt time.Time
+
+	// scaledUp is set when the target was scaled up from zero replicas for
+	// the restart; its rollout is then always awaited before scaling back.
+	scaledUp bool
+
+	// cleanups undo temporary changes made for the restart and run in
+	// reverse order once it is finished.
+	cleanups []func()
+}
+
+// run restarts a single target and, when requested, waits for its rollout
+// and for any mesh sidecars to become ready.
+func (r *runner) run(ctx context.Context, t target) result {
+	return r.finish(ctx, r.start(ctx, t))
+}
+
+// retryFailed requeues the targets that failed, once the sweep is done, up to
+// the configured number of retries. Transient problems such as node pressure
+// or an unavailable webhook often clear up within minutes, so each pass waits
+// for the retry delay first. Results are replaced in place.
+func (r *runner) retryFailed(ctx context.Context, results []result) {
+	// The failures that aborted a staged run stand
+	if r.aborted() != "" {
+		return
+	}
+	for attempt := 1; attempt <= r.opts.retries; attempt++ {
+		var failed []int
+		for i, res := range results {
+			if status := res.status(); status == statusFailed || status == statusRolloutFailed {
+				failed = append(failed, i)
+			}
+		}
+		if len(failed) == 0 {
+			return
+		}
+
+		fmt.Fprintf(progress, "Retrying %d failed workloads in %s (retry %d of %d)\n", len(failed), r.opts.retryDelay, attempt, r.opts.retries)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.opts.retryDelay):
+		}
+
+		for _, i := range failed {
+			prev := results[i]
+			res := r.run(ctx, prev.Target)
+			res.Application = prev.Application
+			res.Attempts = prev.attempts() + 1
+			res.Duration += prev.Duration
+			results[i] = res
+		}
+	}
+}
+
+// runTogether triggers the restarts of all targets before waiting for any of
+// them, so that workloads that belong together roll out at the same time.
+func (r *runner) runTogether(ctx context.Context, targets []target) []result {
+	restarts := make([]*trackedRestart, len(targets))
+	for i, t := range targets {
+		restarts[i] = r.start(ctx, t)
+	}
+
+	results := make([]result, len(targets))
+	for i, rs := range restarts {
+		results[i] = r.finish(ctx, rs)
+	}
+	return results
+}
+
+// start checks whether the target may be restarted and, if so, triggers its
+// restart.
+func (r *runner) start(ctx context.Context, t target) *trackedRestart {
+	rs := &trackedRestart{res: result{Target: t}, began: time.Now()}
+
+	if optedOut(t) {
+		rs.res.Skipped = "opted out with " + skipAnnotation + "=" + t.Annotations[skipAnnotation]
+		progressSkip(t, rs.res.Skipped)
+		return rs
+	}
+	if fp := r.opts.planFingerprint; fp != "" && t.Annotations[planFingerprintAnnotation] == fp {
+		rs.res.Skipped = "already restarted by run " + t.Annotations[runIDAnnotation] + " of this plan"
+		progressSkip(t, rs.res.Skipped)
+		return rs
+	}
+
+	if until, frozen := frozenUntil(t, planNow()); frozen {
+		rs.res.Skipped = "frozen"
+		if !until.IsZero() {
+			rs.res.Skipped += " until " + until.Format(time.RFC3339)
+		}
+		if reason := t.Annotations[frozenReasonAnnotation]; reason != "" {
+			rs.res.Skipped += ": " + reason
+		}
+		rs.res.Deferred = true
+		progressSkip(t, rs.res.Skipped)
+		return rs
+	}
+	if reason := blackout(t, planNow()); reason != "" {
+		rs.res.Skipped = reason
+		rs.res.Deferred = true
+		progressSkip(t, rs.res.Skipped)
+		return rs
+	}
+
+	if reason := r.aborted(); reason != "" {
+		rs.res.Skipped = "run aborted after " + reason
+		progressSkip(t, rs.res.Skipped)
+		return rs
+	}
+	if reason := r.paused(); reason != "" {
+		rs.res.Skipped = "run paused after the preemption of " + reason
+		rs.res.Deferred = true
+		progressSkip(t, rs.res.Skipped)
+		return rs
+	}
+	if !r.opts.notAfter.IsZero() && time.Now().After(r.opts.notAfter) {
+		rs.res.Skipped = "the run window closed at " + r.opts.notAfter.Format(time.RFC3339)
+		rs.res.Deferred = true
+		progressSkip(t, rs.res.Skipped)
+		return rs
+	}
+
+	if m := t.Memory; r.opts.minMemoryUsage > 0 && m != nil && m.ratio() > 0 && m.ratio() < r.opts.minMemoryUsage {
+		rs.res.Skipped = fmt.Sprintf("%s, below --min-memory-usage", m)
+		progressSkip(t, rs.res.Skipped)
+		return rs
+	}
+
+	if r.opts.serverDryRun {
+		r.simulate(ctx, rs)
+		return rs
+	}
+
+	if scaledToZero(t) && !r.opts.scaleIdle {
+		rs.res.ScaledToZero = true
+		rs.res.Skipped = "scaled to zero replicas"
+		progressSkip(t, rs.res.Skipped)
+		return rs
+	}
+
+	if r.pacer != nil {
+		if err := r.pacer.wait(ctx); err != nil {
+			workloadLogger(t).Error("Not restarting workload", "error", err)
+			rs.res.Err = err
+			return rs
+		}
+	}
+
+	if r.fleet != nil && r.opts.maxFleetUnavailable > 0 {
+		if err := r.fleet.waitBelow(ctx, r.opts.maxFleetUnavailable, r.opts.rolloutTimeout); err != nil {
+			workloadLogger(t).Error("Not restarting workload", "error", err)
+			rs.res.Err = err
+			return rs
+		}
+	}
+	reason, err := waitForReplication(ctx, r.clientset, r.dynamic, t, r.opts.replicationTimeout)
+	if err != nil {
+		workloadLogger(t).Error("Not restarting workload: cannot check the replication of its cluster", "error", err)
+		rs.res.Err = fmt.Errorf("cannot check replication: %w", err)
+		return rs
+	}
+	if reason != "" {
+		rs.res.Skipped = reason
+		rs.res.Deferred = true
+		progressSkip(t, rs.res.Skipped)
+		return rs
+	}
+
+	// A local cluster has nobody to keep the budgets for, and deleting pods
+	// that are already unhealthy takes nothing from them
+	if !r.opts.devProfile && !r.opts.onlyUnhealthy {
+		reason, temporary, err := waitForDisruptionBudgets(ctx, r.clientset, t, r.opts.pdbTimeout)
+		if err != nil {
+			workloadLogger(t).Error("Not restarting workload: cannot check its PodDisruptionBudgets", "error", err)
+			rs.res.Err = fmt.Errorf("cannot check PodDisruptionBudgets: %w", err)
+			return rs
+		}
+		if reason != "" {
+			rs.res.Skipped = reason
+			rs.res.Deferred = temporary
+			progressSkip(t, rs.res.Skipped)
+			return rs
+		}
+	}
+
+	if limit := r.concurrencyLimit(t.Namespace); r.fleet != nil && limit > 0 {
+		if err := r.fleet.waitForSlot(ctx, t, limit, scaleTimeout(t, r.opts.rolloutTimeout, r.opts.windowsTimeoutFactor)); err != nil {
+			workloadLogger(t).Error("Not restarting workload", "error", err)
+			rs.res.Err = err
+			return rs
+		}
+		rs.cleanups = append(rs.cleanups, func() { r.fleet.releaseSlot(t) })
+	}
+
+	if r.opts.maxBackupAge > 0 {
+		backup, err := lastBackup(ctx, r.clientset, r.dynamic, t)
+		if err != nil {
+			workloadLogger(t).Error("Not restarting workload: cannot determine its last backup", "error", err)
+			rs.res.Err = fmt.Errorf("cannot determine last backup: %w", err)
+			return rs
+		}
+		switch age := time.Since(backup); {
+		case backup.IsZero():
+			rs.res.Skipped = "no backup found"
+		case age > r.opts.maxBackupAge:
+			rs.res.Skipped = fmt.Sprintf("last backup is %s old, older than --max-backup-age", age.Round(time.Minute))
+		}
+		if rs.res.Skipped != "" {
+			// The next scheduled backup is expected to catch up
+			rs.res.Deferred = true
+			progressSkip(t, rs.res.Skipped)
+			return rs
+		}
+	}
+
+	if _, ok := t.Annotations[migrationAnnotation]; ok {
+		reason, err := checkMigration(ctx, r.clientset, t, r.opts.migration, r.runID)
+		if err != nil {
+			workloadLogger(t).Error("Not restarting workload: cannot check its migration", "error", err)
+			rs.res.Err = fmt.Errorf("cannot check migration: %w", err)
+			return rs
+		}
+		if reason != "" {
+			rs.res.Skipped = reason
+			rs.res.Deferred = true
+			progressSkip(t, rs.res.Skipped)
+			return rs
+		}
+	}
+
+	if r.opts.slo.query != "" || t.Annotations[sloBudgetQueryAnnotation] != "" {
+		skip, warning, err := checkErrorBudget(ctx, r.opts.slo, t)
+		if err != nil {
+			workloadLogger(t).Error("Not restarting workload: cannot determine its error budget", "error", err)
+			rs.res.Err = fmt.Errorf("cannot determine error budget: %w", err)
+			return rs
+		}
+		if warning != "" {
+			workloadLogger(t).Warn("Restarting workload although " + warning)
+			rs.res.Warnings = append(rs.res.Warnings, warning)
+		}
+		if skip != "" {
+			rs.res.Skipped = skip
+			rs.res.Deferred = true
+			progressSkip(t, rs.res.Skipped)
+			return rs
+		}
+	}
+
+	if t.Selector != nil {
+		pending, err := waitForVolumeOperations(ctx, r.clientset, t, r.opts.volumeOpTimeout)
+		if err != nil {
+			workloadLogger(t).Error("Not restarting workload", "error", err)
+			rs.res.Err = err
+			return rs
+		}
+		if len(pending) > 0 {
+			rs.res.Skipped = "storage operations still in progress: " + strings.Join(pending, "; ")
+			rs.res.Deferred = true
+			progressSkip(t, rs.res.Skipped)
+			return rs
+		}
+	}
+
+	// Mark the workload so that a crash mid-restart leaves a trace that
+	// "db-pods cleanup" can find
+	marker := map[string]interface{}{restartInProgressAnnotation: r.runID}
+	if r.opts.chaos.enabled() {
+		marker[chaosAnnotation] = r.runID
+	}
+	if err := patchAnnotations(ctx, r.clientset, r.dynamic, t, marker); err != nil {
+		workloadLogger(t).Error("Error marking workload as in progress", "error", err)
+	}
+	rs.cleanups = append(rs.cleanups, func() {
+		done := map[string]interface{}{restartInProgressAnnotation: nil}
+		if rs.res.Restarted {
+			done[runIDAnnotation] = r.runID
+			if r.opts.planFingerprint != "" {
+				done[planFingerprintAnnotation] = r.opts.planFingerprint
+			}
+			history, err := appendRestartHistory(t, restartRecord{Time: rs.restartedAt.UTC(), Reason: restartReason(t, r.opts), RunID: r.runID}, r.opts.retention)
+			if err != nil {
+				workloadLogger(t).Error("Error recording restart history", "error", err)
+			} else {
+				done[restartHistoryAnnotation] = history
+			}
+		}
+		if err := patchAnnotations(context.Background(), r.clientset, r.dynamic, t, done); err != nil {
+			workloadLogger(t).Error("Error clearing in-progress marker", "error", err)
+		}
+	})
+
+	if r.opts.meshOutlierHold && t.Mesh == meshIstio {
+		restore, err := holdOutlierDetection(ctx, r.dynamic, t)
+		if err != nil {
+			workloadLogger(t).Error("Error suspending outlier detection", "error", err)
+		} else if restore != nil {
+			rs.cleanups = append(rs.cleanups, func() {
+				if err := restore(context.Background()); err != nil {
+					workloadLogger(t).Error("Error restoring outlier detection", "error", err)
+				}
+			})
+		}
+	}
+
+	if r.opts.debug.enabled() && len(t.CrashLooping) > 0 {
+		dir := ""
+		if r.opts.diagnosticsDir != "" {
+			dir = filepath.Join(r.opts.diagnosticsDir, r.runID)
+		}
+		files, err := debugCrashLoopingPods(ctx, r.clientset, t, r.opts.debug, dir)
+		if err != nil {
+			workloadLogger(t).Error("Error debugging workload before restart", "error", err)
+		}
+		rs.res.DebugOutput = files
+	}
+
+	if scaledToZero(t) {
+		if err := scaleWorkload(ctx, r.clientset, r.dynamic, t, 1); err != nil {
+			workloadLogger(t).Error("Error scaling up workload", "error", err)
+			rs.res.Err = err
+			return rs
+		}
+		progressf(t, "Scaled %s up from zero replicas for the restart", t)
+		rs.scaledUp = true
+		rs.cleanups = append(rs.cleanups, func() {
+			if err := scaleWorkload(context.Background(), r.clientset, r.dynamic, t, 0); err != nil {
+				workloadLogger(t).Error("Error scaling workload back to zero replicas", "error", err)
+				return
+			}
+			progressf(t, "Scaled %s back to zero replicas", t)
+		})
+	}
+
+	// Pod creation timestamps only have second precision
+	rs.restartedAt = time.Now().Truncate(time.Second)
+	if r.opts.onlyUnhealthy {
+		deleted, err := deleteUnhealthyPods(ctx, r.clientset, t)
+		rs.res.DeletedPods = deleted
+		if err != nil {
+			workloadLogger(t).Error("Error replacing unhealthy pods", "error", err)
+			rs.res.Err = err
+			return rs
+		}
+		if len(deleted) == 0 {
+			rs.res.Skipped = "no unhealthy pods"
+			progressSkip(t, rs.res.Skipped)
+			return rs
+		}
+		rs.res.Restarted = true
+		return rs
+	}
+	mutations, err := restartTarget(ctx, r.clientset, r.dynamic, t, false)
+	if err != nil {
+		workloadLogger(t).Error("Error restarting workload", "error", err)
+		rs.res.Err = err
+		return rs
+	}
+	progressf(t, "Successfully restarted %s", t)
+	if len(mutations) > 0 {
+		workloadLogger(t).Info("Admission webhooks changed the pod template", "mutations", mutations)
+		rs.res.Mutations = mutations
+	}
+	rs.res.Restarted = true
+	if r.fleet != nil {
+		r.fleet.markRestarted(t)
+	}
+
+	return rs
+}
+
+// simulate sends the restart of a target through admission with a server
+// side dry run and records what admission webhooks and policies did with it:
+// whether it was denied, the warnings they returned and the pod template
+// fields they changed. Audit annotations are not returned to clients, so
+// policies acting only through them remain invisible.
+func (r *runner) simulate(ctx context.Context, rs *trackedRestart) {
+	t := rs.res.Target
+	rs.res.DryRun = true
+	apiWarnings.drain()
+	mutations, err := restartTarget(ctx, r.clientset, r.dynamic, t, true)
+	rs.res.Warnings = apiWarnings.drain()
+	rs.res.Mutations = mutations
+	if err != nil {
+		rs.res.Err = err
+		progressf(t, "Admission would deny the restart of %s: %v", t, err)
+		return
+	}
+	progressf(t, "Admission would accept the restart of %s", t)
+}
+
+// finish waits for a triggered restart to roll out, if requested, and undoes
+// any temporary changes made for it.
+func (r *runner) finish(ctx context.Context, rs *trackedRestart) result {
+	if rs.res.Restarted && (r.opts.wait || rs.scaledUp) {
+		rs.res.RolloutErr = r.verify(ctx, rs)
+		rs.res.Awaited = true
+	}
+
+	if rs.res.RolloutErr != nil && r.opts.rollback && rs.res.Target.Kind == "deployment" && !r.opts.onlyUnhealthy {
+		revision, err := rollbackDeployment(ctx, r.clientset, rs.res.Target)
+		if err != nil {
+			workloadLogger(rs.res.Target).Error("Error rolling back workload", "error", err)
+			rs.res.RollbackErr = err
+		} else {
+			progressf(rs.res.Target, "Rolled %s back to revision %d", rs.res.Target, revision)
+			rs.res.RolledBackTo = revision
+		}
+	}
+
+	if status := rs.res.status(); r.opts.diagnosticsDir != "" && (status == statusFailed || status == statusRolloutFailed) {
+		path, err := collectDiagnostics(ctx, r.clientset, rs.res.Target, filepath.Join(r.opts.diagnosticsDir, r.runID))
+		if err != nil {
+			workloadLogger(rs.res.Target).Error("Error collecting diagnostics", "error", err)
+		} else {
+			progressf(rs.res.Target, "Wrote diagnostics for %s to %s", rs.res.Target, path)
+			rs.res.Diagnostics = path
+		}
+	}
+
+	for i := len(rs.cleanups) - 1; i >= 0; i-- {
+		rs.cleanups[i]()
+	}
+	rs.res.Duration = time.Since(rs.began)
+	if r.progress != nil {
+		r.progress.finish(ctx, rs.res.Target)
+	}
+	r.events.workloadFinished(ctx, rs.res)
+	return rs.res
+}
+
+// verify runs the verification pipeline of a restarted target's class,
+// stopping at the first check that fails, and records the outcome of every
+// check. The error of the failed check is returned.
+func (r *runner) verify(ctx context.Context, rs *trackedRestart) error {
+	class, checks := r.opts.verification.checksFor(rs.res.Target)
+	rs.res.VerificationClass = class
+
+	var failure error
+	for _, spec := range checks {
+		cr := checkResult{Name: spec.label(), Status: checkNotRun}
+		if failure == nil {
+			began := time.Now()
+			err := r.runCheck(ctx, rs, spec)
+			cr.Duration = time.Since(began)
+			switch {
+			case errors.Is(err, errCheckSkipped):
+				cr.Status = checkSkipped
+			case err != nil:
+				cr.Status, cr.Err = checkFailed, err
+				failure = err
+			default:
+				cr.Status = checkPassed
+			}
+		}
+		rs.res.Checks = append(rs.res.Checks, cr)
+	}
+	return failure
+}
+
+// runCheck runs one check of a verification pipeline.
+func (r *runner) runCheck(ctx context.Context, rs *trackedRestart, spec checkSpec) error {
+	t := rs.res.Target
+	timeout := spec.timeout
+	if timeout == 0 {
+		timeout = defaultCheckTimeout
+	}
+
+	var err error
+	switch spec.Check {
+	case checkRollout:
+		return r.verifyRollout(ctx, rs, spec.timeout, spec.delay)
+	case checkSidecars:
+		// Application containers can report ready before the mesh proxy
+		// is able to route traffic, so a meshed rollout is only done once
+		// every sidecar is
+		if t.Mesh == "" {
+			return errCheckSkipped
+		}
+		if spec.timeout == 0 {
+			timeout = scaleTimeout(t, r.opts.rolloutTimeout, r.opts.windowsTimeoutFactor)
+		}
+		if err = waitForSidecars(ctx, r.clientset, t, timeout); err == nil {
+			progressf(t, "Sidecars ready for %s", t)
+		}
+	case checkWarmup:
+		url := r.opts.warmup.urlFor(t)
+		if url == "" {
+			return errCheckSkipped
+		}
+		cfg := r.opts.warmup
+		if spec.timeout > 0 {
+			cfg.timeout = spec.timeout
+		}
+		if err = waitForWarmup(ctx, r.clientset, t, url, cfg); err == nil {
+			progressf(t, "Warm-up complete for %s", t)
+		}
+	case checkEndpoints:
+		if err = waitForEndpoints(ctx, r.clientset, t, r.opts.cluster.has(featureEndpointSlices), timeout); err == nil {
+			progressf(t, "Endpoints ready for %s", t)
+		}
+	case checkConnectivity:
+		if err = waitForConnectivity(ctx, r.clientset, t, spec.Port, timeout); err == nil {
+			progressf(t, "Pods of %s accept connections", t)
+		}
+	case checkExec:
+		if !r.opts.cluster.has(featureEphemeralContainers) {
+			return errCheckSkipped
+		}
+		if err = runExecCheck(ctx, r.clientset, t, spec, r.opts.debug, timeout); err == nil {
+			progressf(t, "Check %s passed for %s", spec.label(), t)
+		}
+	case checkMetrics:
+		if err = waitForMetrics(ctx, r.opts.slo.prometheusURL, t, spec, timeout); err == nil {
+			progressf(t, "Check %s passed for %s", spec.label(), t)
+		}
+	default:
+		err = fmt.Errorf("unknown check %q", spec.Check)
+	}
+	if err != nil && !errors.Is(err, errCheckSkipped) {
+		workloadLogger(t).Error("Verification check failed", "check", spec.label(), "error", err)
+	}
+	return err
+}
+
+// verifyRollout waits for the rollout of a restarted target, within timeout
+// if set and otherwise within its rollout timeout, and records how long it
+// took. The wait starts after delay, which databases slow to begin
+// terminating are given by their verification class.
+func (r *runner) verifyRollout(ctx context.Context, rs *trackedRestart, timeout, delay time.Duration) error {
+	t := rs.res.Target
+	if delay > 0 {
+		progressf(t, "Waiting %s before following the rollout of %s", delay, t)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	var mu sync.Mutex
+	onDisruption := func(pod, node string) {
+		progressf(t, "Pod %s of %s was evicted by a cluster autoscaler scale-down of node %s, waiting for its replacement", pod, t, node)
+		mu.Lock()
+		rs.res.Disruptions = append(rs.res.Disruptions, fmt.Sprintf("%s (node %s)", pod, node))
+		mu.Unlock()
+	}
+
+	// Preemption during the rollout means the cluster lacks the capacity the
+	// database had before the restart
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	defer stopWatching()
+	go func() {
+		err := watchPreemptions(watchCtx, r.clientset, t, rs.restartedAt, func(pod, message string) {
+			workloadLogger(t).Warn("Pod preempted by a higher-priority pod during the rollout", "pod", pod, "message", message)
+			mu.Lock()
+			rs.res.Preemptions = append(rs.res.Preemptions, fmt.Sprintf("%s (%s)", pod, message))
+			mu.Unlock()
+			if r.opts.pauseOnPreemption {
+				r.pause(fmt.Sprintf("pod %s of %s", pod, t))
+			}
+		})
+		if err != nil {
+			workloadLogger(t).Warn("Cannot watch for preemptions", "error", err)
+		}
+	}()
+
+	fallback := scaleTimeout(t, r.opts.rolloutTimeout, r.opts.windowsTimeoutFactor)
+	if timeout == 0 {
+		timeout = r.opts.adaptiveTimeout.rolloutTimeout(t, fallback)
+		switch {
+		case timeout != fallback:
+			progressf(t, "Waiting up to %s for the rollout of %s, based on its past rollouts", timeout, t)
+		case timeout != r.opts.rolloutTimeout:
+			progressf(t, "Waiting up to %s for the rollout of %s, which runs on Windows nodes", timeout, t)
+		}
+	}
+	if err := waitForRollout(ctx, r.clientset, r.dynamic, t, rs.restartedAt, timeout, onDisruption); err != nil {
+		workloadLogger(t).Error("Rollout did not complete", "error", err)
+		return err
+	}
+	// Rollouts disrupted by the autoscaler or by preemption took longer than
+	// they normally would, so they are left out of the history
+	mu.Lock()
+	disrupted := len(rs.res.Disruptions) > 0 || len(rs.res.Preemptions) > 0
+	mu.Unlock()
+	if !disrupted && !r.opts.onlyUnhealthy {
+		if err := recordRolloutDuration(ctx, r.clientset, r.dynamic, t, time.Since(rs.restartedAt)); err != nil {
+			workloadLogger(t).Error("Error recording rollout duration", "error", err)
+		}
+	}
+
+	progressf(t, "Rollout complete for %s", t)
+	return nil
+}
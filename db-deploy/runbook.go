@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// runbookOptions holds what the runbook needs to know beyond the targets.
+type runbookOptions struct {
+	planTime       time.Time
+	planFile       string
+	rolloutTimeout time.Duration
+}
+
+// writeRunbook renders the plan as a step-by-step maintenance runbook in
+// Markdown for change advisory board review. The plan file it embeds is the
+// one the documented command executes, so the reviewed document and the run
+// cannot drift apart.
+func writeRunbook(w io.Writer, targets []target, opts runbookOptions) error {
+	planTime := opts.planTime.UTC().Format(time.RFC3339)
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Database restart runbook\n\n")
+	fmt.Fprintf(&b, "- Plan time: %s\n", planTime)
+	fmt.Fprintf(&b, "- Workloads: %d\n", len(targets))
+	fmt.Fprintf(&b, "- Rollout timeout per workload: %s\n\n", opts.rolloutTimeout)
+
+	fmt.Fprintf(&b, "## Pre-checks\n\n")
+	fmt.Fprintf(&b, "1. Confirm the current context points at the intended cluster: `kubectl config current-context`.\n")
+	fmt.Fprintf(&b, "2. Confirm no other restart run is active: `kubectl get lease %s -A`.\n", runLeaseName)
+	fmt.Fprintf(&b, "3. Review the notes on each step below; frozen workloads will be skipped.\n\n")
+
+	fmt.Fprintf(&b, "## Execution\n\n")
+	fmt.Fprintf(&b, "Save the plan file below as `%s` and run:\n\n", opts.planFile)
+	fmt.Fprintf(&b, "```sh\ndb-pods restart --plan %s --plan-time %s --wait --rollout-timeout %s\n```\n\n", opts.planFile, planTime, opts.rolloutTimeout)
+	fmt.Fprintf(&b, "The run restarts the workloads in the order of the steps below and verifies each one before moving on.\n\n")
+
+	fmt.Fprintf(&b, "## Steps\n")
+	for i, t := range targets {
+		fmt.Fprintf(&b, "\n### Step %d: restart %s\n\n", i+1, t)
+		if optedOut(t) {
+			fmt.Fprintf(&b, "- **Opted out** (%s=%s): will be skipped.\n", skipAnnotation, t.Annotations[skipAnnotation])
+			continue
+		}
+		if _, frozen := frozenUntil(t, opts.planTime); frozen {
+			fmt.Fprintf(&b, "- **Frozen** (%s=%s): will be skipped.\n", frozenUntilAnnotation, t.Annotations[frozenUntilAnnotation])
+			continue
+		}
+		if reason := blackout(t, opts.planTime); reason != "" {
+			fmt.Fprintf(&b, "- **Blackout**: %s at the plan time; will be skipped if it still applies.\n", reason)
+			continue
+		}
+		if len(t.PendingPods) > 0 {
+			fmt.Fprintf(&b, "- Already pending before the restart: %s.\n", strings.Join(t.PendingPods, ", "))
+		}
+		if len(t.CrashLooping) > 0 {
+			fmt.Fprintf(&b, "- Crashlooping before the restart: %s.\n", strings.Join(t.CrashLooping, ", "))
+		}
+		if t.Mesh != "" {
+			fmt.Fprintf(&b, "- Runs a %s sidecar; the rollout is only done once every sidecar is ready.\n", t.Mesh)
+		}
+		fmt.Fprintf(&b, "- Manual equivalent: `%s`\n", restartCommandLine(t))
+		fmt.Fprintf(&b, "- Verify: `%s`\n", verifyCommandLine(t, opts.rolloutTimeout))
+	}
+
+	fmt.Fprintf(&b, "\n## Abort criteria\n\n")
+	fmt.Fprintf(&b, "Stop the run (Ctrl-C) and do not continue with the remaining steps if:\n\n")
+	fmt.Fprintf(&b, "- a rollout does not complete within %s;\n", opts.rolloutTimeout)
+	fmt.Fprintf(&b, "- new pods cannot pull their image, or enter CrashLoopBackOff;\n")
+	fmt.Fprintf(&b, "- the database's clients report errors that started with the restart.\n\n")
+	fmt.Fprintf(&b, "After an abort, run `db-pods cleanup` to remove in-progress markers, and roll a failed workload back with `kubectl rollout undo` where it applies.\n\n")
+
+	fmt.Fprintf(&b, "## Plan file\n\n```\n%s```\n", formatPlanFile(targets, opts.planTime))
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// restartCommandLine returns the kubectl command that restarts a target by
+// hand.
+func restartCommandLine(t target) string {
+	if t.Kind == "rollout" {
+		return fmt.Sprintf("kubectl argo rollouts restart -n %s %s", t.Namespace, t.Name)
+	}
+	return fmt.Sprintf("kubectl rollout restart -n %s %s/%s", t.Namespace, t.Kind, t.Name)
+}
+
+// verifyCommandLine returns the kubectl command that waits for a target's
+// rollout.
+func verifyCommandLine(t target, timeout time.Duration) string {
+	if t.Kind == "rollout" {
+		return fmt.Sprintf("kubectl argo rollouts status -n %s %s --timeout %s", t.Namespace, t.Name, timeout)
+	}
+	return fmt.Sprintf("kubectl rollout status -n %s %s/%s --timeout %s", t.Namespace, t.Kind, t.Name, timeout)
+}
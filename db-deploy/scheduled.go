@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// maintenanceWindows are the recurring periods restarts are confined to.
+// Each expression gives the minutes a window opens at; every window stays
+// open for the same duration.
+type maintenanceWindows struct {
+	opens    []cronSchedule
+	duration time.Duration
+}
+
+// parseMaintenanceWindows parses the cron expressions at which windows open,
+// evaluated in timezone unless they carry their own TZ= prefix.
+func parseMaintenanceWindows(exprs []string, timezone string, duration time.Duration) (maintenanceWindows, error) {
+	w := maintenanceWindows{duration: duration}
+	if len(exprs) == 0 {
+		return w, errors.New("at least one --window is required")
+	}
+	if duration <= 0 {
+		return w, errors.New("--window-duration must be positive")
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return w, fmt.Errorf("invalid --timezone: %w", err)
+	}
+	for _, expr := range exprs {
+		zoned := strings.TrimSpace(expr)
+		if !strings.HasPrefix(zoned, "TZ=") {
+			zoned = "TZ=" + timezone + " " + zoned
+		}
+		schedule, err := parseCron(zoned)
+		if err != nil {
+			return w, fmt.Errorf("invalid --window %q: %w", expr, err)
+		}
+		w.opens = append(w.opens, schedule)
+	}
+	return w, nil
+}
+
+// next returns the window that is open at t or, if none is, the next one to
+// open. It returns false if no window ever opens.
+func (w maintenanceWindows) next(t time.Time) (opens, closes time.Time, ok bool) {
+	// A window that opened up to its duration before t is still open
+	from := t.Add(-w.duration)
+	for _, schedule := range w.opens {
+		if start, found := schedule.next(from); found && (!ok || start.Before(opens)) {
+			opens, ok = start, true
+		}
+	}
+	return opens, opens.Add(w.duration), ok
+}
+
+// scheduledCommand runs "db-pods scheduled", which stays up and starts a
+// restart run whenever a maintenance window opens, sleeping in between. Each
+// run is "db-pods restart" with the arguments after "--" and a --not-after of
+// the end of the window, so that no restart starts once it has closed.
+func scheduledCommand(fs *pflag.FlagSet) func(args []string) {
+	addLogFlags(fs)
+	var windows stringList
+	fs.Var(&windows, "window", "cron expression of the minutes a maintenance window opens at, such as \"0 2 * * 0\" for 2am on Sundays, optionally prefixed with TZ=ZONE; repeat for several windows")
+	timezone := fs.String("timezone", "UTC", "time zone of the --window expressions without a TZ= prefix, such as Europe/Berlin")
+	duration := fs.Duration("window-duration", 2*time.Hour, "how long each maintenance window stays open; restarts that have not started when it closes are deferred to the next run")
+	configFile := addConfigFlag(fs)
+	return func(args []string) {
+		setupLogging()
+
+		w, err := parseMaintenanceWindows(windows, *timezone, *duration)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		restartArgs := args
+		if *configFile != "" {
+			// The runs read their settings from the restart: section
+			restartArgs = append([]string{"--config", *configFile}, restartArgs...)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		// after is the end of the last run's window, which is not run again
+		var after time.Time
+		for {
+			now := time.Now()
+			from := now
+			if after.After(now) {
+				from = after
+			}
+			opens, closes, ok := w.next(from)
+			if !ok {
+				log.Fatalf("No maintenance window ever opens")
+			}
+			if wait := opens.Sub(now); wait > 0 {
+				slog.Info("Sleeping until the next maintenance window", "opens", opens.Format(time.RFC3339), "closes", closes.Format(time.RFC3339))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+
+			slog.Info("Maintenance window open, starting a run", "closes", closes.Format(time.RFC3339))
+			runArgs := append([]string{"restart", "--not-after", closes.Format(time.RFC3339)}, restartArgs...)
+			if err := runSubcommand(ctx, runArgs); err != nil {
+				slog.Error("Scheduled run failed", "error", err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			after = closes
+		}
+	}
+}
+
+// runSubcommand runs db-pods itself with the given arguments, passing its
+// output through. Cancelling ctx forwards SIGTERM to it, which lets it finish
+// the workload at hand, and it is waited for.
+func runSubcommand(ctx context.Context, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the db-pods executable: %w", err)
+	}
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	return cmd.Run()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// findServiceTargets returns the workloads whose pods back the given
+// Services, named as NAMESPACE/NAME. Incident responders usually know the
+// Service an application connects to rather than the workloads behind it.
+func findServiceTargets(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, services []string, opts discoveryOptions) ([]target, error) {
+	// Owners by namespace, gathered first so that a workload behind several
+	// of the Services is only selected once
+	owners := make(map[string]map[string]string)
+	var namespaces []string
+	for _, ref := range services {
+		namespace, name, ok := strings.Cut(ref, "/")
+		if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid service reference %q, expected NAMESPACE/NAME", ref)
+		}
+		svc, err := clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get service %s: %w", ref, err)
+		}
+		if len(svc.Spec.Selector) == 0 {
+			slog.Warn("Service has no selector, skipping it", "service", ref)
+			continue
+		}
+
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(svc.Spec.Selector).String()})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pods of service %s: %w", ref, err)
+		}
+		if owners[namespace] == nil {
+			owners[namespace] = make(map[string]string)
+			namespaces = append(namespaces, namespace)
+		}
+		for _, pod := range pods.Items {
+			owner, err := podWorkload(ctx, clientset, &pod)
+			if err != nil {
+				return nil, err
+			}
+			if owner == "" {
+				slog.Warn("Pod backs a service but is not managed by a workload", "namespace", namespace, "pod", pod.Name, "service", ref)
+				continue
+			}
+			if _, ok := owners[namespace][owner]; !ok {
+				owners[namespace][owner] = "backs service " + ref
+			}
+		}
+	}
+
+	var targets []target
+	for _, namespace := range namespaces {
+		found, err := ownedTargets(ctx, clientset, dynamicClient, opts, namespace, owners[namespace])
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, found...)
+	}
+	return targets, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// slackListLimit caps the workloads listed per section of a Slack summary,
+// keeping the message readable on large runs.
+const slackListLimit = 20
+
+// postSlackSummary posts the outcome of a run to a Slack incoming webhook:
+// the counts by status, the restarted workloads and every failure with its
+// error, so that on-call engineers see what happened without the logs.
+func postSlackSummary(ctx context.Context, webhook, runID string, results []result) error {
+	body, err := json.Marshal(map[string]string{"text": formatSlackSummary(runID, results)})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("slack webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// formatSlackSummary renders a run as Slack mrkdwn.
+func formatSlackSummary(runID string, results []result) string {
+	var restarted, failed []string
+	for _, res := range results {
+		switch res.status() {
+		case statusRestarted:
+			restarted = append(restarted, "`"+res.Target.String()+"`")
+		case statusFailed, statusRolloutFailed:
+			err := res.Err
+			if err == nil {
+				err = res.RolloutErr
+			}
+			detail := fmt.Sprintf("• `%s`: %v", res.Target, err)
+			if res.RolledBackTo > 0 {
+				detail += fmt.Sprintf(" (rolled back to revision %d)", res.RolledBackTo)
+			}
+			failed = append(failed, detail)
+		}
+	}
+
+	var b strings.Builder
+	summary := summarizeResults(results)
+	if summary == "" {
+		summary = "no workloads matched"
+	}
+	icon := ":white_check_mark:"
+	if len(failed) > 0 {
+		icon = ":x:"
+	}
+	fmt.Fprintf(&b, "%s *db-pods run %s*: %s\n", icon, runID, summary)
+	if len(restarted) > 0 {
+		fmt.Fprintf(&b, "*Restarted:* %s\n", strings.Join(truncateList(restarted), ", "))
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(&b, "*Failed:*\n%s\n", strings.Join(truncateList(failed), "\n"))
+	}
+	return b.String()
+}
+
+// truncateList keeps the first slackListLimit items and notes how many were
+// left out.
+func truncateList(items []string) []string {
+	if len(items) <= slackListLimit {
+		return items
+	}
+	return append(items[:slackListLimit:slackListLimit], fmt.Sprintf("and %d more", len(items)-slackListLimit))
+}
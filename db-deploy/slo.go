@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sloBudgetQueryAnnotation overrides --slo-budget-query for a workload. Like
+// the flag it may contain {namespace} and {name}.
+const sloBudgetQueryAnnotation = "db-deploy/slo-budget-query"
+
+// Actions taken when the error budget of a consuming service is nearly
+// exhausted.
+const (
+	sloBudgetBlock = "block"
+	sloBudgetWarn  = "warn"
+)
+
+// sloConfig describes the error budget check made before each restart.
+type sloConfig struct {
+	prometheusURL string
+	query         string
+	minBudget     float64
+	action        string
+}
+
+// queryFor returns the budget query of a target with its placeholders
+// expanded, or "" if the target has none.
+func (c sloConfig) queryFor(t target) string {
+	query := c.query
+	if q := t.Annotations[sloBudgetQueryAnnotation]; q != "" {
+		query = q
+	}
+	return strings.NewReplacer("{namespace}", t.Namespace, "{name}", t.Name).Replace(query)
+}
+
+// remainingErrorBudget evaluates the budget query of a target and returns the
+// lowest remaining error budget ratio among the returned series, so a single
+// service close to exhausting its budget is enough. It returns false if the
+// target has no query or the query returned nothing.
+//
+// The query is expected to return the remaining error budget as a ratio
+// between 0 and 1, such as the slo:period_error_budget_remaining:ratio series
+// recorded by Sloth.
+func remainingErrorBudget(ctx context.Context, cfg sloConfig, t target) (float64, bool, error) {
+	query := cfg.queryFor(t)
+	if query == "" {
+		return 0, false, nil
+	}
+	if cfg.prometheusURL == "" {
+		return 0, false, fmt.Errorf("%s annotation requires --prometheus-url", sloBudgetQueryAnnotation)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	values, err := queryPrometheus(ctx, client, cfg.prometheusURL, query)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(values) == 0 {
+		return 0, false, nil
+	}
+
+	lowest := values[0]
+	for _, v := range values[1:] {
+		if v < lowest {
+			lowest = v
+		}
+	}
+	return lowest, true, nil
+}
+
+// checkErrorBudget returns why the target must not be restarted because the
+// error budget of its consumers is nearly exhausted, or a warning to record
+// instead when the configured action is to warn.
+func checkErrorBudget(ctx context.Context, cfg sloConfig, t target) (skip, warning string, err error) {
+	budget, ok, err := remainingErrorBudget(ctx, cfg, t)
+	if err != nil || !ok || budget >= cfg.minBudget {
+		return "", "", err
+	}
+	reason := fmt.Sprintf("only %.1f%% of the error budget remains, below --slo-min-budget %.1f%%", budget*100, cfg.minBudget*100)
+	if cfg.action == sloBudgetWarn {
+		return "", reason, nil
+	}
+	return reason, "", nil
+}
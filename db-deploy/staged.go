@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Modes of --canary.
+const (
+	// canaryWorkload restarts a single workload, or application with
+	// --group-by-app, first.
+	canaryWorkload = "workload"
+
+	// canaryNamespace restarts every workload of one namespace first.
+	canaryNamespace = "namespace"
+)
+
+// runUnit is a workload, or an application with --group-by-app, restarted as
+// one unit of a run.
+type runUnit struct {
+	name      string
+	namespace string
+	run       func() []result
+}
+
+// runStaged runs the units of a run in stages. With a canary mode, the first
+// unit, or every unit of the first unit's namespace, is restarted on its own
+// and must roll out before the rest follow; canaries that restart nothing,
+// such as frozen workloads, are passed over for the next ones. The rest are
+// restarted in batches of batchSize units, or all together if it is zero, up
+// to n at a time. A failed canary, or with batches a failed batch, aborts the
+// run: the units of the later stages are skipped.
+func (r *runner) runStaged(units []runUnit, canary string, batchSize, n int) []result {
+	var results []result
+	run := func(stage []runUnit) []result {
+		fns := make([]func() []result, len(stage))
+		for i, u := range stage {
+			fns[i] = u.run
+		}
+		stageResults := runConcurrently(fns, n)
+		results = append(results, stageResults...)
+		return stageResults
+	}
+
+	pending := units
+	for canary != "" && len(pending) > 0 && r.aborted() == "" {
+		var stage, rest []runUnit
+		for _, u := range pending {
+			if len(stage) == 0 || canary == canaryNamespace && u.namespace == stage[0].namespace {
+				stage = append(stage, u)
+			} else {
+				rest = append(rest, u)
+			}
+		}
+		pending = rest
+		if canary == canaryNamespace {
+			fmt.Fprintf(progress, "\nCanary: namespace %s\n", stage[0].namespace)
+		} else {
+			fmt.Fprintf(progress, "\nCanary: %s\n", stage[0].name)
+		}
+
+		stageResults := run(stage)
+		if failed := failedResults(stageResults); len(failed) > 0 {
+			r.abort("the failure of canary " + strings.Join(failed, ", "))
+			break
+		}
+		if restartedAny(stageResults) {
+			fmt.Fprintf(progress, "Canary healthy, restarting the remaining %d units\n\n", len(pending))
+			break
+		}
+		fmt.Fprintln(progress, "Canary restarted nothing, trying the next one")
+	}
+
+	for batch := 1; len(pending) > 0; batch++ {
+		size := batchSize
+		if size == 0 || size > len(pending) {
+			size = len(pending)
+		}
+		stage := pending[:size]
+		pending = pending[size:]
+		if batchSize > 0 && r.aborted() == "" {
+			fmt.Fprintf(progress, "\nBatch %d: %d units\n", batch, len(stage))
+		}
+
+		stageResults := run(stage)
+		if failed := failedResults(stageResults); batchSize > 0 && len(failed) > 0 && r.aborted() == "" {
+			r.abort(fmt.Sprintf("the failure of %s in batch %d", strings.Join(failed, ", "), batch))
+		}
+	}
+	return results
+}
+
+// failedResults returns the targets whose restart or rollout failed.
+func failedResults(results []result) []string {
+	var failed []string
+	for _, res := range results {
+		if status := res.status(); status == statusFailed || status == statusRolloutFailed {
+			failed = append(failed, res.Target.String())
+		}
+	}
+	return failed
+}
+
+// restartedAny reports whether any of the results is a restart.
+func restartedAny(results []result) bool {
+	for _, res := range results {
+		if res.status() == statusRestarted {
+			return true
+		}
+	}
+	return false
+}
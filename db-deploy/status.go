@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"redeploy-database-pods/pkg/restart"
+)
+
+// workloadStatus is the rollout state of a workload as shown by
+// "db-pods status".
+type workloadStatus struct {
+	target    target
+	want      int32
+	available int32
+	state     string
+}
+
+// statusCommand runs "db-pods status", which shows whether the matching
+// workloads have finished rolling out.
+func statusCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	discovery := addDiscoveryFlags(fs)
+	return func(args []string) {
+		setupLogging()
+
+		discoveryOpts, err := discovery.options()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		clientset, dynamicClient := newClients()
+		ctx := context.Background()
+		targets, err := discoverTargets(ctx, clientset, dynamicClient, discoveryOpts)
+		if err != nil {
+			log.Fatalf("Error discovering workloads: %v", err)
+		}
+
+		statuses := make([]workloadStatus, 0, len(targets))
+		for _, t := range targets {
+			statuses = append(statuses, getWorkloadStatus(ctx, clientset, dynamicClient, t))
+		}
+		printWorkloadStatus(os.Stdout, statuses)
+	}
+}
+
+// getWorkloadStatus fetches a workload and evaluates its rollout with the
+// checks of kubectl rollout status.
+func getWorkloadStatus(ctx context.Context, clientset kubernetes.Interface, dynamicClient dynamic.Interface, t target) workloadStatus {
+	status := workloadStatus{target: t}
+	obj, err := getWorkload(ctx, clientset, dynamicClient, t)
+	if err != nil {
+		status.state = err.Error()
+		return status
+	}
+	status.want, status.available = workloadAvailability(obj)
+	switch done, err := restart.RolloutComplete(obj); {
+	case err != nil:
+		status.state = err.Error()
+	case done:
+		status.state = "rolled out"
+	default:
+		status.state = "rolling out"
+	}
+	return status
+}
+
+// getWorkload returns the current object of a target.
+func getWorkload(ctx context.Context, clientset kubernetes.Interface, dynamicClient dynamic.Interface, t target) (runtime.Object, error) {
+	var (
+		obj runtime.Object
+		err error
+	)
+	switch t.Kind {
+	case "deployment":
+		obj, err = clientset.AppsV1().Deployments(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+	case "statefulset":
+		obj, err = clientset.AppsV1().StatefulSets(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+	case "daemonset":
+		obj, err = clientset.AppsV1().DaemonSets(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+	case "rollout":
+		obj, err = dynamicClient.Resource(rolloutResource).Namespace(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+	default:
+		return nil, fmt.Errorf("unsupported workload kind %q", t.Kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", t.Kind, err)
+	}
+	return obj, nil
+}
+
+// printWorkloadStatus prints the rollout state of workloads as a table.
+func printWorkloadStatus(w io.Writer, statuses []workloadStatus) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tKIND\tNAME\tAVAILABLE\tLAST RESTART\tSTATUS")
+	for _, s := range statuses {
+		t := s.target
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d/%d\t%s\t%s\n", t.Namespace, t.Kind, t.Name, s.available, s.want, formatLastRestart(t.LastRestart), s.state)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// volumeOperationPoll is how often a deferred restart checks whether the
+// storage operations on its volumes have completed.
+const volumeOperationPoll = 10 * time.Second
+
+// volumeOperations returns the storage operations in progress on the volumes
+// of a target's pods: claims being resized and volumes being attached to or
+// detached from a node.
+func volumeOperations(ctx context.Context, clientset *kubernetes.Clientset, t target) ([]string, error) {
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %w", err)
+	}
+	pods, err := clientset.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	var ops []string
+	volumes := make(map[string]string) // persistent volume to claim
+	seen := make(map[string]bool)
+	for _, pod := range pods.Items {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim == nil || seen[volume.PersistentVolumeClaim.ClaimName] {
+				continue
+			}
+			name := volume.PersistentVolumeClaim.ClaimName
+			seen[name] = true
+
+			pvc, err := clientset.CoreV1().PersistentVolumeClaims(t.Namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get persistent volume claim %s: %w", name, err)
+			}
+			for _, cond := range pvc.Status.Conditions {
+				if cond.Status != corev1.ConditionTrue {
+					continue
+				}
+				switch cond.Type {
+				case corev1.PersistentVolumeClaimResizing:
+					ops = append(ops, fmt.Sprintf("claim %s is being resized", name))
+				case corev1.PersistentVolumeClaimFileSystemResizePending:
+					ops = append(ops, fmt.Sprintf("claim %s is waiting for a file system resize", name))
+				}
+			}
+			if pvc.Spec.VolumeName != "" {
+				volumes[pvc.Spec.VolumeName] = name
+			}
+		}
+	}
+	if len(volumes) == 0 {
+		return ops, nil
+	}
+
+	attachments, err := clientset.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if apierrors.IsForbidden(err) {
+		workloadLogger(t).Warn("Cannot check volume attachments", "error", err)
+		return ops, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volume attachments: %w", err)
+	}
+	for _, va := range attachments.Items {
+		pv := va.Spec.Source.PersistentVolumeName
+		if pv == nil || volumes[*pv] == "" {
+			continue
+		}
+		switch {
+		case va.DeletionTimestamp != nil:
+			ops = append(ops, fmt.Sprintf("claim %s is being detached from node %s", volumes[*pv], va.Spec.NodeName))
+		case !va.Status.Attached:
+			ops = append(ops, fmt.Sprintf("claim %s is being attached to node %s", volumes[*pv], va.Spec.NodeName))
+		}
+	}
+	return ops, nil
+}
+
+// waitForVolumeOperations defers the restart of a target until no storage
+// operation is in progress on its volumes, since restarting a database mid
+// resize has corrupted file systems before. If the operations do not complete
+// within the timeout, it returns the ones still pending.
+func waitForVolumeOperations(ctx context.Context, clientset *kubernetes.Clientset, t target, timeout time.Duration) ([]string, error) {
+	var pending []string
+	err := wait.PollUntilContextTimeout(ctx, volumeOperationPoll, timeout, true, func(ctx context.Context) (bool, error) {
+		ops, err := volumeOperations(ctx, clientset, t)
+		if err != nil {
+			return false, err
+		}
+		if len(ops) > 0 && len(pending) == 0 {
+			progressf(t, "Deferring restart of %s: %s", t, strings.Join(ops, "; "))
+		}
+		pending = ops
+		return len(ops) == 0, nil
+	})
+	if wait.Interrupted(err) {
+		return pending, nil
+	}
+	return nil, err
+}
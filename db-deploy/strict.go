@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	watchtools "k8s.io/client-go/tools/watch"
+
+	"redeploy-database-pods/pkg/restart"
+)
+
+// ownAnnotationPrefixes start the workload annotations that the tool and the
+// workload controllers maintain during a run, which --strict does not count
+// as changes.
+var ownAnnotationPrefixes = []string{"db-deploy/", "deployment.kubernetes.io/", "rollout.argoproj.io/"}
+
+// mutationGuard watches the targets of a --strict run for changes made by
+// anyone but the run itself, so that the cluster ends up exactly as the plan
+// intended or the run says why not.
+type mutationGuard struct {
+	ignoreReplicas bool
+	onChange       func(t target)
+
+	mu        sync.Mutex
+	baselines map[string]map[string]interface{}
+	changes   map[string][]string
+	targets   map[string]target
+	wg        sync.WaitGroup
+}
+
+// guardTargets records the current state of the targets and watches them
+// until ctx is done, calling onChange the first time one of them is changed
+// by someone else. With ignoreReplicas, as with --scale-idle, changes to the
+// replica count are the run's own. Targets that no longer exist are left
+// out.
+func guardTargets(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, targets []target, ignoreReplicas bool, onChange func(t target)) (*mutationGuard, error) {
+	g := &mutationGuard{
+		ignoreReplicas: ignoreReplicas,
+		onChange:       onChange,
+		baselines:      make(map[string]map[string]interface{}),
+		changes:        make(map[string][]string),
+		targets:        make(map[string]target),
+	}
+	for _, t := range targets {
+		lw, _, err := restart.WorkloadListWatch(ctx, clientset, dynamicClient, t.ref())
+		if err != nil {
+			return nil, err
+		}
+		list, err := lw.List(metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get %s: %w", t, err)
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil || len(items) == 0 {
+			continue
+		}
+		baseline, err := g.normalize(items[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t, err)
+		}
+		listMeta, err := meta.ListAccessor(list)
+		if err != nil {
+			return nil, err
+		}
+		w, err := watchtools.NewRetryWatcher(listMeta.GetResourceVersion(), lw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to watch %s: %w", t, err)
+		}
+		key := t.String()
+		g.baselines[key] = baseline
+		g.targets[key] = t
+		g.wg.Add(1)
+		go g.follow(ctx, key, w)
+	}
+	return g, nil
+}
+
+// follow compares every version of a target seen on the watch with its
+// baseline until ctx is done.
+func (g *mutationGuard) follow(ctx context.Context, key string, w *watchtools.RetryWatcher) {
+	defer g.wg.Done()
+	defer w.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.Done():
+			return
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return
+			}
+			switch event.Type {
+			case watch.Deleted:
+				g.record(key, []string{"workload deleted"})
+			case watch.Modified:
+				current, err := g.normalize(event.Object)
+				if err != nil {
+					slog.Warn("Cannot compare workload with its state before the run", "workload", key, "error", err)
+					continue
+				}
+				g.record(key, diffObjects("", g.baselines[key], current))
+			}
+		}
+	}
+}
+
+// record keeps the latest differences of a target from its baseline.
+// Changes reverted since are forgotten, but the run they aborted stays
+// aborted.
+func (g *mutationGuard) record(key string, diff []string) {
+	g.mu.Lock()
+	_, seen := g.changes[key]
+	if len(diff) == 0 {
+		delete(g.changes, key)
+	} else {
+		g.changes[key] = diff
+	}
+	g.mu.Unlock()
+	if len(diff) > 0 && !seen {
+		workloadLogger(g.targets[key]).Error("Workload changed by someone else during a --strict run", "diff", strings.Join(diff, "; "))
+		g.onChange(g.targets[key])
+	}
+}
+
+// stop waits for the watches to end once ctx is done and returns the
+// differences of the changed targets from their baselines, by target.
+func (g *mutationGuard) stop() map[string][]string {
+	g.wg.Wait()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.changes
+}
+
+// normalize converts a workload to a map without the fields that change
+// during any run: its status, the bookkeeping of the API server, the
+// annotations of the tool and the controllers, and the restart marker of
+// its pod template.
+func (g *mutationGuard) normalize(obj runtime.Object) (map[string]interface{}, error) {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	delete(u, "status")
+	for _, field := range []string{"resourceVersion", "generation", "managedFields"} {
+		unstructured.RemoveNestedField(u, "metadata", field)
+	}
+	annotations, _, _ := unstructured.NestedStringMap(u, "metadata", "annotations")
+	for key := range annotations {
+		for _, prefix := range ownAnnotationPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				unstructured.RemoveNestedField(u, "metadata", "annotations", key)
+			}
+		}
+	}
+	unstructured.RemoveNestedField(u, "spec", "template", "metadata", "annotations", restart.RestartedAtAnnotation)
+	unstructured.RemoveNestedField(u, "spec", "restartAt")
+	if g.ignoreReplicas {
+		unstructured.RemoveNestedField(u, "spec", "replicas")
+	}
+	// Removing the only annotation leaves a map that was not there before
+	for _, path := range [][]string{{"metadata", "annotations"}, {"spec", "template", "metadata", "annotations"}} {
+		if m, found, _ := unstructured.NestedMap(u, path...); found && len(m) == 0 {
+			unstructured.RemoveNestedField(u, path...)
+		}
+	}
+	return u, nil
+}
+
+// diffObjects lists the fields that differ between two objects, as
+// "path: old -> new" with JSON values, sorted by path.
+func diffObjects(path string, before, after map[string]interface{}) []string {
+	var diff []string
+	keys := make(map[string]bool)
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+	for k := range keys {
+		p := k
+		if path != "" {
+			p = path + "." + k
+		}
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		bm, bIsMap := b.(map[string]interface{})
+		am, aIsMap := a.(map[string]interface{})
+		switch {
+		case bIsMap && aIsMap:
+			diff = append(diff, diffObjects(p, bm, am)...)
+		case !inBefore:
+			diff = append(diff, fmt.Sprintf("%s: added %s", p, jsonValue(a)))
+		case !inAfter:
+			diff = append(diff, fmt.Sprintf("%s: removed %s", p, jsonValue(b)))
+		case !reflect.DeepEqual(a, b):
+			diff = append(diff, fmt.Sprintf("%s: %s -> %s", p, jsonValue(b), jsonValue(a)))
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+func jsonValue(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// printExternalChanges prints the changes made to targets by others during
+// a --strict run.
+func printExternalChanges(w io.Writer, changes map[string][]string) {
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(w, "\nChanged by someone else during the run (--strict):")
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %s\n", key)
+		for _, line := range changes[key] {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"redeploy-database-pods/pkg/restart"
+)
+
+// target is a workload selected for restart.
+type target struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Selector  *metav1.LabelSelector
+
+	// MatchReason explains why discovery selected the workload.
+	MatchReason string
+
+	// Labels and Annotations are the workload's own metadata, not that of
+	// its pod template.
+	Labels      map[string]string
+	Annotations map[string]string
+
+	// OS is the operating system the workload's pods are scheduled to, or
+	// empty if the pod template does not constrain it.
+	OS string
+
+	// Mesh names the service mesh whose sidecar is injected into the
+	// workload's pods, or is empty if the pods are not meshed.
+	Mesh string
+
+	// PendingPods lists pods of the workload that were already Pending before
+	// the restart, together with the reason they could not run.
+	PendingPods []string
+
+	// Replicas is the desired number of replicas, or nil for kinds that do
+	// not declare one.
+	Replicas *int32
+
+	// SecurityFindings lists weaknesses of the workload's pod template found
+	// by --security-audit.
+	SecurityFindings []string
+
+	// LastRestart is when the workload was last restarted through its
+	// restartedAt template annotation, or zero if it never was.
+	LastRestart time.Time
+
+	// OldestPod is the start time of the workload's longest running pod
+	// before the restart, or zero if none was running.
+	OldestPod time.Time
+
+	// CrashLooping lists containers of the workload's pods that were in
+	// CrashLoopBackOff before the restart, as POD/CONTAINER.
+	CrashLooping []string
+
+	// Memory is the memory usage before the restart of the workload's pod
+	// using the largest share of its memory, or nil if metrics-server did
+	// not report it.
+	Memory *memoryUsage
+}
+
+func (t target) String() string {
+	return fmt.Sprintf("%s %s/%s", t.Kind, t.Namespace, t.Name)
+}
+
+// ref returns the reference identifying the target.
+func (t target) ref() restart.TargetRef {
+	return restart.TargetRef{Kind: t.Kind, Namespace: t.Namespace, Name: t.Name}
+}
+
+// parseTargetRef parses a workload reference of the form KIND/NAMESPACE/NAME
+// into a target with only those fields set.
+func parseTargetRef(s string) (target, error) {
+	ref, err := restart.ParseTargetRef(s)
+	if err != nil {
+		return target{}, err
+	}
+	return target{Kind: ref.Kind, Namespace: ref.Namespace, Name: ref.Name}, nil
+}
+
+// discoveryOptions controls which workloads are considered.
+type discoveryOptions struct {
+	// fallbackNamespaces are searched when workloads cannot be listed
+	// cluster-wide.
+	fallbackNamespaces []string
+
+	// includeRollouts adds Argo Rollouts to the deployments, statefulsets
+	// and daemonsets.
+	includeRollouts bool
+
+	// pvs selects the workloads using these PersistentVolumes instead of
+	// matching by name.
+	pvs []string
+
+	// services selects the workloads backing these Services, as
+	// NAMESPACE/NAME, instead of matching by name.
+	services []string
+
+	// planFile selects exactly the workloads listed in a plan file.
+	planFile string
+
+	// names decides which workload names mark a database.
+	names nameMatcher
+
+	// selector is a label selector applied by the API server when listing
+	// workloads. When set, it selects databases instead of their names.
+	selector string
+
+	// excludedNamespaces are glob patterns of namespaces never searched
+	// unless listed in namespaces, such as those of the control plane and of
+	// operators.
+	excludedNamespaces []string
+
+	// kinds restricts the workload kinds listed. When empty, deployments,
+	// statefulsets and daemonsets are listed, and rollouts if
+	// includeRollouts is set.
+	kinds []string
+
+	// namespaces restricts discovery to these namespaces. When empty,
+	// workloads are listed cluster-wide.
+	namespaces []string
+
+	// skippedNamespaces are glob patterns of namespaces never selected from,
+	// whatever the selection mode.
+	skippedNamespaces []string
+
+	// requireAnnotation only selects the workloads that opted in with the
+	// enabledAnnotation, instead of matching their names.
+	requireAnnotation bool
+}
+
+// enabledAnnotation opts a workload in to restarts under --require-annotation,
+// when set to "true".
+const enabledAnnotation = "db-deploy/enabled"
+
+// optedIn reports whether the workload opted in to restarts with the
+// enabledAnnotation.
+func optedIn(t target) bool {
+	enabled, err := strconv.ParseBool(t.Annotations[enabledAnnotation])
+	return err == nil && enabled
+}
+
+// inScope reports whether workloads of the namespace may be selected under
+// --namespace and --exclude-namespace.
+func (opts discoveryOptions) inScope(namespace string) bool {
+	if excludedNamespace(namespace, opts.skippedNamespaces) {
+		return false
+	}
+	return len(opts.namespaces) == 0 || opts.namespaceListed(namespace)
+}
+
+// namespaceListed reports whether the namespace was given with --namespace.
+func (opts discoveryOptions) namespaceListed(namespace string) bool {
+	for _, ns := range opts.namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// workloadKinds are the kinds accepted by --kinds.
+var workloadKinds = []string{"deployment", "statefulset", "daemonset", "rollout"}
+
+// listsKind reports whether workloads of the kind are listed.
+func (opts discoveryOptions) listsKind(kind string) bool {
+	if len(opts.kinds) == 0 {
+		return kind != "rollout" || opts.includeRollouts
+	}
+	for _, k := range opts.kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultSystemNamespaces are never searched, whether workloads match by name,
+// label selector or annotation, unless --include-system is given. Operators
+// keep internal components in their own namespaces, and some of them have
+// "database" in their name or carry the labels of the databases they manage.
+const defaultSystemNamespaces = "kube-system,kube-public,kube-node-lease,*-system"
+
+// discoveryFlags are the command line flags that fill discoveryOptions.
+type discoveryFlags struct {
+	fallbackNamespaces *string
+	includeRollouts    *bool
+	pvs                *string
+	services           *string
+	planFile           *string
+	namingConvention   *string
+	namingSegment      *string
+	namePattern        *string
+	nameContains       *stringList
+	selector           *string
+	systemNamespaces   *string
+	includeSystem      *bool
+	kinds              *string
+	namespaces         *stringList
+	excludeNamespaces  *stringList
+	requireAnnotation  *bool
+
+	// allNamespaces is only defined when running as a kubectl plugin.
+	allNamespaces *bool
+}
+
+// addDiscoveryFlags defines the flags that select workloads on fs.
+func addDiscoveryFlags(fs *pflag.FlagSet) *discoveryFlags {
+	nameContains := &stringList{}
+	fs.Var(nameContains, "name-contains", "select workloads whose name contains this substring instead of \""+databaseKeyword+"\"; may be repeated")
+	namespaces := &stringList{}
+	excludeNamespaces := &stringList{}
+	fs.Var(excludeNamespaces, "exclude-namespace", "never select workloads in this namespace, or glob pattern such as monitoring-*; may be repeated")
+	var allNamespaces *bool
+	if kubectlPlugin {
+		fs.VarP(namespaces, "namespace", "n", "only select workloads in this namespace, even a system one; may be repeated. Without it, only the namespace of the kubeconfig context is searched")
+		allNamespaces = fs.BoolP("all-namespaces", "A", false, "search every namespace instead of the namespace of the kubeconfig context")
+	} else {
+		fs.Var(namespaces, "namespace", "only select workloads in this namespace, even a system one; may be repeated")
+	}
+	return &discoveryFlags{
+		allNamespaces:      allNamespaces,
+		nameContains:       nameContains,
+		namespaces:         namespaces,
+		excludeNamespaces:  excludeNamespaces,
+		namePattern:        fs.String("name-pattern", "", "select workloads whose name matches this regular expression, e.g. ^(pg|mysql|mongo)-, instead of containing \""+databaseKeyword+"\""),
+		fallbackNamespaces: fs.String("fallback-namespaces", "", "comma-separated namespaces to search when workloads cannot be listed cluster-wide (default: every namespace the caller can list workloads in)"),
+		pvs:                fs.String("pv", "", "comma-separated PersistentVolumes; select the workloads whose pods use them instead of matching by name"),
+		services:           fs.String("service", "", "comma-separated Services as NAMESPACE/NAME; select the workloads whose pods back them instead of matching by name"),
+		includeRollouts:    fs.Bool("include-rollouts", false, "also select matching Argo Rollouts"),
+		planFile:           fs.String("plan", "", "select exactly the workloads listed in this plan file (see \"db-pods plan --emit-job\")"),
+		namingConvention:   fs.String("naming-convention", "", "template of workload names such as {tenant}-{component}-{env}; when set, only names whose --naming-segment is exactly \""+databaseKeyword+"\" match, instead of any name containing it"),
+		namingSegment:      fs.String("naming-segment", "component", "segment of --naming-convention compared with \""+databaseKeyword+"\""),
+		selector:           fs.String("selector", "", "label selector, e.g. app.kubernetes.io/component=database, that selects database workloads instead of their names"),
+		systemNamespaces:   fs.String("system-namespaces", defaultSystemNamespaces, "comma-separated namespaces, or glob patterns, never searched for workloads, whether they match by name, --selector or --require-annotation, unless --include-system is given or they are listed with --namespace"),
+		includeSystem:      fs.Bool("include-system", false, "also search the --system-namespaces"),
+		requireAnnotation:  fs.Bool("require-annotation", false, "only select workloads annotated "+enabledAnnotation+"=true, whatever their name; with --pv, --service or --selector, only those among the workloads they select"),
+		kinds:              fs.String("kinds", "", "comma-separated workload kinds to select among deployment, statefulset, daemonset and rollout (default: all but rollout, unless --include-rollouts)"),
+	}
+}
+
+// scoped reports whether the flags narrow the selection down explicitly,
+// by namespace, label selector, name, opt-in annotation, volume, service or
+// plan, rather than relying on the default match across the whole cluster.
+func (f *discoveryFlags) scoped() bool {
+	return len(*f.namespaces) > 0 || *f.selector != "" || *f.namePattern != "" || len(*f.nameContains) > 0 || *f.requireAnnotation ||
+		*f.namingConvention != "" || *f.pvs != "" || *f.services != "" || *f.planFile != "" || f.contextScoped()
+}
+
+// contextScoped reports whether the selection is limited to the namespace of
+// the kubeconfig context, as it is for a kubectl plugin given neither
+// --namespace nor --all-namespaces. Volumes, Services and plans name their
+// own namespaces.
+func (f *discoveryFlags) contextScoped() bool {
+	return f.allNamespaces != nil && !*f.allNamespaces && len(*f.namespaces) == 0 &&
+		*f.pvs == "" && *f.services == "" && *f.planFile == ""
+}
+
+// options returns the discovery options set by the flags.
+func (f *discoveryFlags) options() (discoveryOptions, error) {
+	names, err := newNameMatcher(*f.namingConvention, *f.namingSegment)
+	if err != nil {
+		return discoveryOptions{}, err
+	}
+	if names, err = names.withPatterns(*f.namePattern, *f.nameContains); err != nil {
+		return discoveryOptions{}, err
+	}
+	if _, err := labels.Parse(*f.selector); err != nil {
+		return discoveryOptions{}, fmt.Errorf("invalid --selector: %w", err)
+	}
+	var excluded []string
+	if !*f.includeSystem {
+		excluded = splitList(*f.systemNamespaces)
+		for _, pattern := range excluded {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return discoveryOptions{}, fmt.Errorf("invalid --system-namespaces pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	for _, pattern := range *f.excludeNamespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return discoveryOptions{}, fmt.Errorf("invalid --exclude-namespace pattern %q: %w", pattern, err)
+		}
+	}
+	namespaces := []string(*f.namespaces)
+	if f.contextScoped() {
+		namespace, err := contextNamespace()
+		if err != nil {
+			return discoveryOptions{}, err
+		}
+		namespaces = []string{namespace}
+	}
+	kinds := splitList(*f.kinds)
+	for _, kind := range kinds {
+		known := false
+		for _, k := range workloadKinds {
+			known = known || k == kind
+		}
+		if !known {
+			return discoveryOptions{}, fmt.Errorf("unknown --kinds entry %q, expected one of %s", kind, strings.Join(workloadKinds, ", "))
+		}
+	}
+	return discoveryOptions{
+		fallbackNamespaces: splitList(*f.fallbackNamespaces),
+		includeRollouts:    *f.includeRollouts,
+		pvs:                splitList(*f.pvs),
+		services:           splitList(*f.services),
+		planFile:           *f.planFile,
+		names:              names,
+		selector:           *f.selector,
+		excludedNamespaces: excluded,
+		kinds:              kinds,
+		namespaces:         namespaces,
+		skippedNamespaces:  *f.excludeNamespaces,
+		requireAnnotation:  *f.requireAnnotation,
+	}, nil
+}
+
+// discoverTargets returns the workloads selected by the discovery options: the
+// ones listed in a plan file, the ones using the given volumes, the ones
+// backing the given Services, or otherwise the ones whose name marks them as
+// databases. Apart from a plan, which is executed as approved, they are
+// limited to the namespaces in scope and, under --require-annotation, to the
+// workloads that opted in.
+func discoverTargets(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, opts discoveryOptions) ([]target, error) {
+	var found []target
+	var err error
+	switch {
+	case opts.planFile != "":
+		refs, err := readPlanFile(opts.planFile)
+		if err != nil {
+			return nil, err
+		}
+		return resolveTargets(ctx, clientset, dynamicClient, refs)
+	case len(opts.pvs) > 0:
+		found, err = findVolumeTargets(ctx, clientset, dynamicClient, opts.pvs, opts)
+	case len(opts.services) > 0:
+		found, err = findServiceTargets(ctx, clientset, dynamicClient, opts.services, opts)
+	default:
+		found, err = findTargets(ctx, clientset, dynamicClient, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []target
+	for _, t := range found {
+		if opts.inScope(t.Namespace) && (!opts.requireAnnotation || optedIn(t)) {
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// errTargetNotFound is returned by resolveTargets for a referenced workload
+// that does not exist.
+var errTargetNotFound = errors.New("not found")
+
+// resolveTargets looks up referenced workloads, filling in the details that a
+// KIND/NAMESPACE/NAME reference lacks. It fails if any of them is missing.
+// Argo Rollouts are only listed in the namespaces of referenced rollouts, so
+// that clusters without their CRD resolve the other kinds.
+func resolveTargets(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, refs []target) ([]target, error) {
+	rolloutNamespaces := make(map[string]bool)
+	for _, ref := range refs {
+		rolloutNamespaces[ref.Namespace] = rolloutNamespaces[ref.Namespace] || ref.Kind == "rollout"
+	}
+
+	listed := make(map[string][]target)
+	var targets []target
+	for _, ref := range refs {
+		workloads, ok := listed[ref.Namespace]
+		if !ok {
+			var err error
+			opts := discoveryOptions{includeRollouts: rolloutNamespaces[ref.Namespace]}
+			workloads, err = listWorkloadsIn(ctx, clientset, dynamicClient, opts, ref.Namespace)
+			if err != nil {
+				return nil, err
+			}
+			listed[ref.Namespace] = workloads
+		}
+
+		found := false
+		for _, w := range workloads {
+			if w.Kind == ref.Kind && w.Name == ref.Name {
+				w.MatchReason = "listed in the plan"
+				targets = append(targets, w)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s %w", ref, errTargetNotFound)
+		}
+	}
+	return targets, nil
+}
+
+// findTargets lists workloads across all namespaces and returns the ones whose
+// name marks them as databases, or every listed one when a label selector
+// already narrowed the list down to databases.
+func findTargets(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, opts discoveryOptions) ([]target, error) {
+	workloads, err := listWorkloads(ctx, clientset, dynamicClient, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []target
+	excluded := 0
+	for _, w := range workloads {
+		if opts.selector == "" && !opts.requireAnnotation && !opts.names.matches(w.Name) {
+			continue
+		}
+		if excludedNamespace(w.Namespace, opts.excludedNamespaces) && !opts.namespaceListed(w.Namespace) {
+			excluded++
+			continue
+		}
+		w.MatchReason = opts.matchReason()
+		targets = append(targets, w)
+	}
+	if excluded > 0 {
+		slog.Info("Ignoring matching workloads in system namespaces (use --include-system to select them)", "count", excluded)
+	}
+	return targets, nil
+}
+
+// matchReason explains why findTargets selected a workload.
+func (opts discoveryOptions) matchReason() string {
+	if opts.selector != "" {
+		return fmt.Sprintf("labels match %q", opts.selector)
+	}
+	if opts.requireAnnotation {
+		return "annotated " + enabledAnnotation + "=true"
+	}
+	return opts.names.reason()
+}
+
+// excludedNamespace reports whether the namespace matches one of the
+// patterns.
+func excludedNamespace(namespace string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// listWorkloads returns every workload in the cluster, or in the namespaces
+// given with --namespace. If the caller may not list them cluster-wide, it
+// falls back to the namespaces the caller does have access to.
+func listWorkloads(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, opts discoveryOptions) ([]target, error) {
+	if len(opts.namespaces) > 0 {
+		var workloads []target
+		for _, namespace := range opts.namespaces {
+			found, err := listWorkloadsIn(ctx, clientset, dynamicClient, opts, namespace)
+			if err != nil {
+				return nil, fmt.Errorf("namespace %s: %w", namespace, err)
+			}
+			workloads = append(workloads, found...)
+		}
+		return workloads, nil
+	}
+
+	workloads, err := listWorkloadsIn(ctx, clientset, dynamicClient, opts, metav1.NamespaceAll)
+	if err == nil || !apierrors.IsForbidden(err) {
+		return workloads, err
+	}
+
+	namespaces, nsErr := accessibleNamespaces(ctx, clientset, opts.fallbackNamespaces)
+	if nsErr != nil {
+		return nil, fmt.Errorf("%w (and no namespace fallback is available: %v)", err, nsErr)
+	}
+	slog.Warn("Cluster-wide listing is forbidden, searching the accessible namespaces instead", "count", len(namespaces))
+
+	workloads = nil
+	for _, namespace := range namespaces {
+		found, err := listWorkloadsIn(ctx, clientset, dynamicClient, opts, namespace)
+		if apierrors.IsForbidden(err) {
+			slog.Warn("Skipping namespace", "namespace", namespace, "error", err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		workloads = append(workloads, found...)
+	}
+	return workloads, nil
+}
+
+// listWorkloadsIn returns every workload in a single namespace, or in all of
+// them for metav1.NamespaceAll.
+func listWorkloadsIn(ctx context.Context, clientset *kubernetes.Clientset, dynamicClient dynamic.Interface, opts discoveryOptions, namespace string) ([]target, error) {
+	var workloads []target
+
+	listOptions := metav1.ListOptions{LabelSelector: opts.selector}
+
+	// Get all deployments in the namespace
+	if opts.listsKind("deployment") {
+		deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, listOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list deployments: %w", err)
+		}
+		for _, deployment := range deployments.Items {
+			workloads = append(workloads, target{Kind: "deployment", Namespace: deployment.Namespace, Name: deployment.Name, Selector: deployment.Spec.Selector, Labels: deployment.Labels, Annotations: deployment.Annotations, Replicas: deployment.Spec.Replicas, LastRestart: lastRestart(deployment.Spec.Template.Annotations), OS: podOS(&deployment.Spec.Template.Spec)})
+		}
+	}
+
+	// Get all statefulsets in the namespace
+	if opts.listsKind("statefulset") {
+		statefulsets, err := clientset.AppsV1().StatefulSets(namespace).List(ctx, listOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list statefulsets: %w", err)
+		}
+		for _, statefulset := range statefulsets.Items {
+			workloads = append(workloads, target{Kind: "statefulset", Namespace: statefulset.Namespace, Name: statefulset.Name, Selector: statefulset.Spec.Selector, Labels: statefulset.Labels, Annotations: statefulset.Annotations, Replicas: statefulset.Spec.Replicas, LastRestart: lastRestart(statefulset.Spec.Template.Annotations), OS: podOS(&statefulset.Spec.Template.Spec)})
+		}
+	}
+
+	// Get all daemonsets in the namespace
+	if opts.listsKind("daemonset") {
+		daemonsets, err := clientset.AppsV1().DaemonSets(namespace).List(ctx, listOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list daemonsets: %w", err)
+		}
+		for _, daemonset := range daemonsets.Items {
+			workloads = append(workloads, target{Kind: "daemonset", Namespace: daemonset.Namespace, Name: daemonset.Name, Selector: daemonset.Spec.Selector, Labels: daemonset.Labels, Annotations: daemonset.Annotations, LastRestart: lastRestart(daemonset.Spec.Template.Annotations), OS: podOS(&daemonset.Spec.Template.Spec)})
+		}
+	}
+
+	if opts.listsKind("rollout") {
+		rollouts, err := listRollouts(ctx, dynamicClient, namespace, listOptions)
+		if err != nil {
+			return nil, err
+		}
+		workloads = append(workloads, rollouts...)
+	}
+
+	return workloads, nil
+}
+
+// lastRestart parses the restartedAt annotation of a pod template.
+func lastRestart(annotations map[string]string) time.Time {
+	restarted, err := time.Parse(time.RFC3339, annotations[restart.RestartedAtAnnotation])
+	if err != nil {
+		return time.Time{}
+	}
+	return restarted
+}
+
+// targetNamespaces returns the namespaces of the targets, in order of first
+// appearance.
+func targetNamespaces(targets []target) []string {
+	var namespaces []string
+	seen := make(map[string]bool)
+	for _, t := range targets {
+		if !seen[t.Namespace] {
+			seen[t.Namespace] = true
+			namespaces = append(namespaces, t.Namespace)
+		}
+	}
+	return namespaces
+}
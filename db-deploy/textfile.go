@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rolloutDurationBuckets are the upper bounds, in seconds, of the
+// metricRolloutDuration histogram.
+var rolloutDurationBuckets = []float64{10, 30, 60, 120, 300, 600, 1200, 1800}
+
+// writeMetricsTextfile writes the metrics of a run to path in the Prometheus
+// text format read by node-exporter's textfile collector, for hosts that run
+// db-pods from cron without a Pushgateway.
+//
+// Counters and the duration histogram are carried over from the previous
+// file and accumulate across runs, so rate() and increase() keep working. The
+// file is replaced atomically so the collector never reads half of it.
+func writeMetricsTextfile(path string, finishedAt time.Time, results []result, waited bool) error {
+	samples, err := readCumulativeSamples(path)
+	if err != nil {
+		return err
+	}
+	workloads := observeRestarts(samples, results, waited)
+	text := formatRunMetrics(samples, finishedAt, workloads)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(text); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// observeRestarts adds the restarts of a run to the counter and histogram
+// samples, keyed by series, and returns the number of workloads of the run
+// by status. Rollout durations are only observed when the run waited for
+// rollouts.
+func observeRestarts(samples map[string]float64, results []result, waited bool) map[string]int {
+	workloads := map[string]int{statusRestarted: 0, statusRolloutFailed: 0, statusFailed: 0, statusSkipped: 0, statusScaledToZero: 0}
+	for _, res := range results {
+		status := res.status()
+		workloads[status]++
+
+		outcome := "succeeded"
+		switch status {
+		case statusSkipped, statusDryRun, statusScaledToZero:
+			continue
+		case statusFailed, statusRolloutFailed:
+			outcome = "failed"
+		}
+		labels := fmt.Sprintf(`kind=%q,namespace=%q`, res.Target.Kind, res.Target.Namespace)
+		samples[fmt.Sprintf(`%s{%s,result=%q}`, metricRestartsTotal, labels, outcome)]++
+
+		if !waited || status != statusRestarted {
+			continue
+		}
+		seconds := res.Duration.Seconds()
+		for _, le := range rolloutDurationBuckets {
+			// Empty buckets are still written, as the histogram requires
+			var hit float64
+			if seconds <= le {
+				hit = 1
+			}
+			samples[fmt.Sprintf(`%s_bucket{%s,le="%s"}`, metricRolloutDuration, labels, strconv.FormatFloat(le, 'f', -1, 64))] += hit
+		}
+		samples[fmt.Sprintf(`%s_bucket{%s,le="+Inf"}`, metricRolloutDuration, labels)]++
+		samples[fmt.Sprintf(`%s_sum{%s}`, metricRolloutDuration, labels)] += seconds
+		samples[fmt.Sprintf(`%s_count{%s}`, metricRolloutDuration, labels)]++
+	}
+	return workloads
+}
+
+// formatRunMetrics renders the counter and histogram samples and the
+// workloads of the last run in the Prometheus text format.
+func formatRunMetrics(samples map[string]float64, finishedAt time.Time, workloads map[string]int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s Workload restarts by namespace, kind and result.\n", metricRestartsTotal)
+	fmt.Fprintf(&b, "# TYPE %s counter\n", metricRestartsTotal)
+	writeSamples(&b, samples, metricRestartsTotal+"{")
+	fmt.Fprintf(&b, "# HELP %s Time from triggering a restart until its rollout completed.\n", metricRolloutDuration)
+	fmt.Fprintf(&b, "# TYPE %s histogram\n", metricRolloutDuration)
+	writeSamples(&b, samples, metricRolloutDuration+"_")
+	fmt.Fprintf(&b, "# HELP %s Unix time at which the last run finished.\n", metricLastRunTimestamp)
+	fmt.Fprintf(&b, "# TYPE %s gauge\n", metricLastRunTimestamp)
+	fmt.Fprintf(&b, "%s %d\n", metricLastRunTimestamp, finishedAt.Unix())
+	fmt.Fprintf(&b, "# HELP %s Workloads of the last run by status.\n", metricLastRunWorkloads)
+	fmt.Fprintf(&b, "# TYPE %s gauge\n", metricLastRunWorkloads)
+	for _, status := range []string{statusRestarted, statusRolloutFailed, statusFailed, statusSkipped, statusScaledToZero} {
+		fmt.Fprintf(&b, "%s{status=%q} %d\n", metricLastRunWorkloads, status, workloads[status])
+	}
+	return b.String()
+}
+
+// readCumulativeSamples reads the counter and histogram samples of a previous
+// metrics file, keyed by series. A missing file yields no samples.
+func readCumulativeSamples(path string) (map[string]float64, error) {
+	samples := make(map[string]float64)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return samples, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, metricRestartsTotal+"{") && !strings.HasPrefix(line, metricRolloutDuration+"_") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		samples[line[:i]] = value
+	}
+	return samples, scanner.Err()
+}
+
+// writeSamples writes the samples whose series starts with prefix, sorted so
+// that the file is stable between runs.
+func writeSamples(b *strings.Builder, samples map[string]float64, prefix string) {
+	var series []string
+	for s := range samples {
+		if strings.HasPrefix(s, prefix) {
+			series = append(series, s)
+		}
+	}
+	sort.Strings(series)
+	for _, s := range series {
+		fmt.Fprintf(b, "%s %s\n", s, strconv.FormatFloat(samples[s], 'f', -1, 64))
+	}
+}
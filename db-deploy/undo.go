@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/pflag"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"redeploy-database-pods/pkg/restart"
+)
+
+// undoneRunAnnotation holds the ID of the run whose restart of the workload
+// was undone by "db-pods undo". It replaces the run ID annotation, so that
+// the same restart is never undone twice, and the plan fingerprint, so that
+// re-running the plan restarts the workload again.
+const undoneRunAnnotation = "db-deploy/undone-run"
+
+// undoStep rolls one workload back to the revision before its restart.
+type undoStep struct {
+	revision int64
+	apply    func(ctx context.Context) error
+}
+
+// planUndo works out how to roll a target back to the revision before its
+// restart, from the rollout history of Deployments, StatefulSets and
+// DaemonSets. It refuses when the current revision changed more than the
+// restart annotation, since rolling it back would revert that change too.
+func planUndo(ctx context.Context, clientset *kubernetes.Clientset, t target) (*undoStep, error) {
+	switch t.Kind {
+	case "deployment":
+		deployment, err := clientset.AppsV1().Deployments(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get deployment: %w", err)
+		}
+		previous, revision, err := previousReplicaSet(ctx, clientset, deployment)
+		if err != nil {
+			return nil, err
+		}
+		if !restartOnlyChange(&deployment.Spec.Template, &previous.Spec.Template) {
+			return nil, fmt.Errorf("the pod template changed since revision %d beyond the restart, undo it by hand", revision)
+		}
+		return &undoStep{revision: revision, apply: func(ctx context.Context) error {
+			return restoreReplicaSet(ctx, clientset, deployment, previous)
+		}}, nil
+
+	case "statefulset", "daemonset":
+		var (
+			owner    metav1.Object
+			selector *metav1.LabelSelector
+			template *corev1.PodTemplateSpec
+			patch    func(ctx context.Context, data []byte) error
+		)
+		if t.Kind == "statefulset" {
+			sts, err := clientset.AppsV1().StatefulSets(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get statefulset: %w", err)
+			}
+			owner, selector, template = sts, sts.Spec.Selector, &sts.Spec.Template
+			patch = func(ctx context.Context, data []byte) error {
+				_, err := clientset.AppsV1().StatefulSets(t.Namespace).Patch(ctx, t.Name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+				return err
+			}
+		} else {
+			ds, err := clientset.AppsV1().DaemonSets(t.Namespace).Get(ctx, t.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get daemonset: %w", err)
+			}
+			owner, selector, template = ds, ds.Spec.Selector, &ds.Spec.Template
+			patch = func(ctx context.Context, data []byte) error {
+				_, err := clientset.AppsV1().DaemonSets(t.Namespace).Patch(ctx, t.Name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+				return err
+			}
+		}
+
+		current, previous, err := lastControllerRevisions(ctx, clientset, owner, selector)
+		if err != nil {
+			return nil, err
+		}
+		if previous == nil {
+			return nil, fmt.Errorf("no revision before %d is left to roll back to", current.Revision)
+		}
+		previousTemplate, err := revisionTemplate(previous)
+		if err != nil {
+			return nil, err
+		}
+		if !restartOnlyChange(template, previousTemplate) {
+			return nil, fmt.Errorf("the pod template changed since revision %d beyond the restart, undo it by hand", previous.Revision)
+		}
+		// The revision holds a patch restoring its pod template, which is
+		// what "kubectl rollout undo" applies
+		return &undoStep{revision: previous.Revision, apply: func(ctx context.Context) error {
+			err := retryAPI(ctx, "roll back "+t.String(), func(ctx context.Context) error {
+				return patch(ctx, previous.Data.Raw)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to patch %s: %w", t.Kind, err)
+			}
+			return nil
+		}}, nil
+
+	case "rollout":
+		return nil, fmt.Errorf("undo Argo Rollouts with \"kubectl argo rollouts undo\"")
+	}
+	return nil, fmt.Errorf("unsupported workload kind %q", t.Kind)
+}
+
+// restartOnlyChange reports whether two pod templates differ in nothing but
+// the restart annotation, and the pod template hash of ReplicaSets.
+func restartOnlyChange(current, previous *corev1.PodTemplateSpec) bool {
+	a, b := current.DeepCopy(), previous.DeepCopy()
+	for _, template := range []*corev1.PodTemplateSpec{a, b} {
+		delete(template.Annotations, restart.RestartedAtAnnotation)
+		delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+	}
+	return apiequality.Semantic.DeepEqual(a, b)
+}
+
+// lastRunID returns the most recent run that restarted any of the targets,
+// or "" if none did. Runs that were undone count, so that undoing the last
+// run twice reports it as undone instead of undoing the run before it.
+func lastRunID(targets []target) string {
+	last := ""
+	for _, t := range targets {
+		for _, id := range []string{t.Annotations[runIDAnnotation], t.Annotations[undoneRunAnnotation]} {
+			// Run IDs start with their time, so they sort in time order
+			if id > last {
+				last = id
+			}
+		}
+	}
+	return last
+}
+
+// undoCommand runs "db-pods undo", which rolls the workloads restarted by a
+// run back to their revision from before the run, limited to the workloads
+// in scope, so that a run can be reverted in part during an incident.
+func undoCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	discovery := addDiscoveryFlags(fs)
+	last := fs.Bool("last", false, "undo the most recent run that restarted workloads in scope")
+	runID := fs.String("run", "", "undo this run instead of the most recent one")
+	all := fs.Bool("all", false, "allow undoing a run across the cluster without a --namespace, --selector or other scope")
+	dryRun := fs.Bool("dry-run", false, "only list the workloads that would be rolled back and to which revision")
+	wait := fs.Bool("wait", true, "wait for each rolled back workload to finish rolling out")
+	rolloutTimeout := fs.Duration("rollout-timeout", 10*time.Minute, "maximum time to wait for a single rollout to complete")
+	lockNamespace := fs.String("lock-namespace", "default", "namespace of the "+runLeaseName+" Lease that keeps the undo apart from runs")
+	return func(args []string) {
+		setupLogging()
+
+		if *last == (*runID != "") {
+			log.Fatalf("db-pods undo requires exactly one of --last or --run")
+		}
+		discoveryOpts, err := discovery.options()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if !*all && !discovery.scoped() {
+			log.Fatalf("Refusing to undo a run across the whole cluster; narrow it down with --namespace, --selector or another scope, or pass --all")
+		}
+
+		clientset, dynamicClient := newClients()
+		ctx := context.Background()
+		targets, err := discoverTargets(ctx, clientset, dynamicClient, discoveryOpts)
+		if err != nil {
+			log.Fatalf("Error discovering workloads: %v", err)
+		}
+
+		id := *runID
+		if *last {
+			if id = lastRunID(targets); id == "" {
+				fmt.Println("No run restarted the workloads in scope")
+				return
+			}
+		}
+		var restarted []target
+		undone := 0
+		for _, t := range targets {
+			switch id {
+			case t.Annotations[runIDAnnotation]:
+				restarted = append(restarted, t)
+			case t.Annotations[undoneRunAnnotation]:
+				undone++
+			}
+		}
+		if len(restarted) == 0 {
+			if undone > 0 {
+				fmt.Printf("Run %s was already undone on the %d workload(s) in scope it restarted\n", id, undone)
+			} else {
+				fmt.Printf("Run %s restarted none of the workloads in scope\n", id)
+			}
+			return
+		}
+		fmt.Fprintf(progress, "Undoing run %s on %d workload(s)\n", id, len(restarted))
+
+		if *dryRun {
+			for _, t := range restarted {
+				step, err := planUndo(ctx, clientset, t)
+				if err != nil {
+					fmt.Printf("  - %s: cannot be undone: %v\n", t, err)
+					continue
+				}
+				fmt.Printf("  - %s: would roll back to revision %d\n", t, step.revision)
+			}
+			return
+		}
+
+		lock, err := acquireRunLock(ctx, clientset, *lockNamespace, newRunID(), onConflictExit)
+		if err != nil {
+			log.Fatalf("Error acquiring run lock: %v", err)
+		}
+		if lock != nil {
+			defer lock.release()
+		}
+
+		restarter := restart.New(clientset, dynamicClient)
+		failed := 0
+		for _, t := range restarted {
+			step, err := planUndo(ctx, clientset, t)
+			if err == nil {
+				err = step.apply(ctx)
+			}
+			if err == nil {
+				err = patchAnnotations(ctx, clientset, dynamicClient, t, map[string]interface{}{runIDAnnotation: nil, planFingerprintAnnotation: nil, undoneRunAnnotation: id})
+			}
+			if err == nil && *wait {
+				err = restarter.Wait(ctx, t.ref(), *rolloutTimeout)
+			}
+			if err != nil {
+				workloadLogger(t).Error("Could not undo the restart", "runId", id, "error", err)
+				failed++
+				continue
+			}
+			progressf(t, "Rolled %s back to revision %d", t, step.revision)
+		}
+
+		fmt.Printf("Undid run %s on %d of %d workload(s)\n", id, len(restarted)-failed, len(restarted))
+		if failed > 0 {
+			// Release the lease before exiting, deferred calls do not run
+			if lock != nil {
+				lock.release()
+			}
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// unreadyGrace is how long a running pod must have been unready before
+	// --only-unhealthy replaces it, so pods that are merely starting up or
+	// briefly failing a probe are left alone.
+	unreadyGrace = 2 * time.Minute
+
+	// terminatingGrace is how long a pod may remain past its deletion
+	// deadline before it counts as stuck terminating.
+	terminatingGrace = time.Minute
+)
+
+// unhealthyReason explains why a pod should be replaced by --only-unhealthy,
+// or returns "" for a healthy pod. Pending pods are not considered: they
+// usually wait for resources, and replacing them does not help.
+func unhealthyReason(pod *corev1.Pod, now time.Time) string {
+	if pod.DeletionTimestamp != nil {
+		if now.Sub(pod.DeletionTimestamp.Time) > terminatingGrace {
+			return fmt.Sprintf("stuck terminating since %s", pod.DeletionTimestamp.UTC().Format(time.RFC3339))
+		}
+		return ""
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		return ""
+	}
+	if containers := crashLoopingContainers(pod); len(containers) > 0 {
+		return fmt.Sprintf("container %s crashlooping", containers[0])
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady && c.Status != corev1.ConditionTrue && now.Sub(c.LastTransitionTime.Time) > unreadyGrace {
+			return fmt.Sprintf("unready for %s", now.Sub(c.LastTransitionTime.Time).Round(time.Second))
+		}
+	}
+	return ""
+}
+
+// deleteUnhealthyPods deletes the pods of a target that fail their probes or
+// are stuck terminating, leaving the healthy ones running. Pods stuck
+// terminating are deleted without a grace period, since their graceful
+// deletion already failed. It returns the deleted pods with the reason.
+func deleteUnhealthyPods(ctx context.Context, clientset *kubernetes.Clientset, t target) ([]string, error) {
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %w", err)
+	}
+	pods, err := clientset.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	now := time.Now()
+	var deleted []string
+	for _, pod := range pods.Items {
+		reason := unhealthyReason(&pod, now)
+		if reason == "" {
+			continue
+		}
+		var opts metav1.DeleteOptions
+		if pod.DeletionTimestamp != nil {
+			opts.GracePeriodSeconds = new(int64)
+		}
+		err := clientset.CoreV1().Pods(t.Namespace).Delete(ctx, pod.Name, opts)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete pod %s: %w", pod.Name, err)
+		}
+		progressf(t, "Deleted pod %s of %s: %s", pod.Name, t, reason)
+		deleted = append(deleted, fmt.Sprintf("%s (%s)", pod.Name, reason))
+	}
+	return deleted, nil
+}
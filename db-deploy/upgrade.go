@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/kubernetes"
+)
+
+// kuredLockAnnotation is set on the kured DaemonSet by the node holding the
+// reboot lock, while it drains and reboots.
+const kuredLockAnnotation = "weave.works/kured-node-lock"
+
+// kuredDaemonSets are where kured is commonly installed.
+var kuredDaemonSets = []struct{ namespace, name string }{
+	{"kube-system", "kured"},
+	{"kured", "kured"},
+}
+
+// upgradeNodeAnnotations mark nodes that an upgrade orchestrator is about to
+// replace, with the orchestrator that sets them.
+var upgradeNodeAnnotations = map[string]string{
+	"kops.k8s.io/needs-update": "kOps rolling update",
+}
+
+// controlPlaneLabels mark the control plane nodes, under their current and
+// their legacy name.
+var controlPlaneLabels = []string{"node-role.kubernetes.io/control-plane", "node-role.kubernetes.io/master"}
+
+// detectUpgrade looks for signs of a cluster upgrade or of a rolling node
+// reboot in progress: the kured reboot lock being held, cordoned control
+// plane nodes, kubelets of different minor versions and nodes marked for
+// replacement by an upgrade orchestrator. It returns a description of each
+// sign found; none means no upgrade is apparent. Restarting databases while
+// nodes are drained under them doubles the disruption.
+func detectUpgrade(ctx context.Context, clientset kubernetes.Interface) ([]string, error) {
+	var signs []string
+
+	for _, ds := range kuredDaemonSets {
+		kured, err := clientset.AppsV1().DaemonSets(ds.namespace).Get(ctx, ds.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get daemonset %s/%s: %w", ds.namespace, ds.name, err)
+		}
+		if lock := kuredLockHolder(kured.Annotations[kuredLockAnnotation]); lock != "" {
+			signs = append(signs, fmt.Sprintf("kured holds the reboot lock for node %s", lock))
+		}
+	}
+
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	var cordoned []string
+	marked := make(map[string][]string)
+	minors := make(map[string][]string)
+	for _, node := range nodes.Items {
+		if node.Spec.Unschedulable && isControlPlane(&node) {
+			cordoned = append(cordoned, node.Name)
+		}
+		for annotation, orchestrator := range upgradeNodeAnnotations {
+			if _, ok := node.Annotations[annotation]; ok {
+				marked[orchestrator] = append(marked[orchestrator], node.Name)
+			}
+		}
+		if v, err := version.ParseGeneric(node.Status.NodeInfo.KubeletVersion); err == nil {
+			minor := fmt.Sprintf("v%d.%d", v.Major(), v.Minor())
+			minors[minor] = append(minors[minor], node.Name)
+		}
+	}
+	if len(cordoned) > 0 {
+		signs = append(signs, "control plane nodes are cordoned: "+strings.Join(cordoned, ", "))
+	}
+	orchestrators := make([]string, 0, len(marked))
+	for orchestrator := range marked {
+		orchestrators = append(orchestrators, orchestrator)
+	}
+	sort.Strings(orchestrators)
+	for _, orchestrator := range orchestrators {
+		signs = append(signs, fmt.Sprintf("nodes are marked for a %s: %s", orchestrator, strings.Join(marked[orchestrator], ", ")))
+	}
+	if len(minors) > 1 {
+		var versions []string
+		for minor, names := range minors {
+			versions = append(versions, fmt.Sprintf("%s on %d", minor, len(names)))
+		}
+		sort.Strings(versions)
+		signs = append(signs, "nodes run different kubelet versions: "+strings.Join(versions, ", "))
+	}
+	return signs, nil
+}
+
+// kuredLockHolder returns the node holding the kured lock whose annotation
+// value is given, or "" if the lock is free. kured stores a JSON document
+// naming the node, and "null" or nothing once released.
+func kuredLockHolder(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "null" {
+		return ""
+	}
+	var lock struct {
+		NodeID string `json:"nodeID"`
+	}
+	if err := json.Unmarshal([]byte(value), &lock); err != nil || lock.NodeID == "" {
+		return "unknown"
+	}
+	return lock.NodeID
+}
+
+// isControlPlane reports whether a node runs the control plane.
+func isControlPlane(node *corev1.Node) bool {
+	for _, label := range controlPlaneLabels {
+		if _, ok := node.Labels[label]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUpgrade refuses to proceed while a cluster upgrade is underway,
+// returning an error describing its signs, unless force is set, in which
+// case they are only logged. A cluster that cannot be checked, for lack of
+// permissions, is not held up.
+func checkUpgrade(ctx context.Context, clientset kubernetes.Interface, force bool) error {
+	signs, err := detectUpgrade(ctx, clientset)
+	if apierrors.IsForbidden(err) {
+		slog.Warn("Cannot check for a cluster upgrade in progress", "error", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check for a cluster upgrade: %w", err)
+	}
+	if len(signs) == 0 {
+		return nil
+	}
+	if force {
+		slog.Warn("Restarting during a cluster upgrade", "signs", strings.Join(signs, "; "))
+		return nil
+	}
+	return fmt.Errorf("a cluster upgrade appears to be underway: %s", strings.Join(signs, "; "))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// vclusterSelector matches the StatefulSets or Deployments that run the
+// control plane of a vcluster, whose release label holds its name.
+const vclusterSelector = "app=vcluster"
+
+// vclusterKubeconfigKey is the key of the kubeconfig in the Secret a vcluster
+// exports it to, vc-NAME in its host namespace.
+const vclusterKubeconfigKey = "config"
+
+// vcluster is a virtual cluster found in the host cluster.
+type vcluster struct {
+	namespace string
+	name      string
+	kind      string
+
+	// kubeconfig connects to the virtual cluster, or is nil with err set if
+	// its exported kubeconfig cannot be used
+	kubeconfig *clientcmdapi.Config
+	server     string
+	err        error
+}
+
+func (v vcluster) String() string {
+	return v.namespace + "/" + v.name
+}
+
+// discoverVClusters finds the vclusters hosted in the namespaces matching
+// namespaceSelector, with the kubeconfigs they export.
+func discoverVClusters(ctx context.Context, clientset *kubernetes.Clientset, namespaceSelector string) ([]vcluster, error) {
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: namespaceSelector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+
+	var found []vcluster
+	for _, ns := range namespaces.Items {
+		// vcluster runs its control plane as a StatefulSet, or as a
+		// Deployment when it keeps its data in an external database
+		sts, err := clientset.AppsV1().StatefulSets(ns.Name).List(ctx, metav1.ListOptions{LabelSelector: vclusterSelector})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list statefulsets in %s: %w", ns.Name, err)
+		}
+		for _, s := range sts.Items {
+			found = append(found, vcluster{namespace: ns.Name, name: vclusterName(s.ObjectMeta), kind: "statefulset"})
+		}
+		deployments, err := clientset.AppsV1().Deployments(ns.Name).List(ctx, metav1.ListOptions{LabelSelector: vclusterSelector})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list deployments in %s: %w", ns.Name, err)
+		}
+		for _, d := range deployments.Items {
+			found = append(found, vcluster{namespace: ns.Name, name: vclusterName(d.ObjectMeta), kind: "deployment"})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].String() < found[j].String() })
+
+	for i := range found {
+		found[i].kubeconfig, found[i].server, found[i].err = vclusterKubeconfig(ctx, clientset, found[i])
+	}
+	return found, nil
+}
+
+// vclusterName returns the name of the vcluster whose control plane is the
+// given object.
+func vclusterName(meta metav1.ObjectMeta) string {
+	if release := meta.Labels["release"]; release != "" {
+		return release
+	}
+	return meta.Name
+}
+
+// vclusterKubeconfig reads the kubeconfig a vcluster exports to its vc-NAME
+// Secret. That kubeconfig points at localhost, where "vcluster connect"
+// forwards the API server to; such addresses are replaced with the Service
+// of the vcluster, which is reachable from inside the host cluster only. To
+// run from outside it, export the kubeconfig with a reachable server, with
+// exportKubeConfig.server in the vcluster values.
+func vclusterKubeconfig(ctx context.Context, clientset *kubernetes.Clientset, v vcluster) (*clientcmdapi.Config, string, error) {
+	secret, err := clientset.CoreV1().Secrets(v.namespace).Get(ctx, "vc-"+v.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, "", fmt.Errorf("no exported kubeconfig in secret vc-%s", v.name)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get secret vc-%s: %w", v.name, err)
+	}
+	data := secret.Data[vclusterKubeconfigKey]
+	if len(data) == 0 {
+		return nil, "", fmt.Errorf("secret vc-%s has no %q key", v.name, vclusterKubeconfigKey)
+	}
+	config, err := clientcmd.Load(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid kubeconfig in secret vc-%s: %w", v.name, err)
+	}
+	current := config.Contexts[config.CurrentContext]
+	if current == nil || config.Clusters[current.Cluster] == nil {
+		return nil, "", fmt.Errorf("the kubeconfig in secret vc-%s has no current context", v.name)
+	}
+
+	cluster := config.Clusters[current.Cluster]
+	if u, err := url.Parse(cluster.Server); err == nil && isLoopback(u.Hostname()) {
+		cluster.Server = fmt.Sprintf("https://%s.%s.svc:443", v.name, v.namespace)
+	}
+	return config, cluster.Server, nil
+}
+
+// isLoopback reports whether host names the local machine.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// vclustersCommand runs "db-pods vclusters", which lists the vclusters hosted
+// in the cluster and, with --restart, runs "db-pods restart" inside each of
+// them with the flags after "--", one virtual cluster after the other.
+func vclustersCommand(fs *pflag.FlagSet) func(args []string) {
+	addClusterFlags(fs)
+	addLogFlags(fs)
+	namespaceSelector := fs.String("namespace-selector", "", "label selector of the host namespaces searched for vclusters, such as vcluster=true (default: every namespace)")
+	restartInside := fs.Bool("restart", false, "run \"db-pods restart\" with the flags after \"--\" inside each vcluster, through the kubeconfig it exports")
+	return func(args []string) {
+		setupLogging()
+		restartArgs := args
+		if len(restartArgs) > 0 && !*restartInside {
+			log.Fatalf("Flags after \"--\" are only used with --restart")
+		}
+
+		clientset, _ := newClients()
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		vclusters, err := discoverVClusters(ctx, clientset, *namespaceSelector)
+		if err != nil {
+			log.Fatalf("Error discovering vclusters: %v", err)
+		}
+		if len(vclusters) == 0 {
+			fmt.Println("No vclusters found")
+			return
+		}
+
+		if !*restartInside {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAMESPACE\tNAME\tKIND\tSERVER")
+			for _, v := range vclusters {
+				server := v.server
+				if v.err != nil {
+					server = "<" + v.err.Error() + ">"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", v.namespace, v.name, v.kind, server)
+			}
+			w.Flush()
+			return
+		}
+
+		dir, err := os.MkdirTemp("", "db-pods-vclusters-")
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		results := make([]error, len(vclusters))
+		failed := 0
+		for i, v := range vclusters {
+			if ctx.Err() != nil {
+				results[i] = errors.New("not run, interrupted")
+			} else if results[i] = v.err; results[i] == nil {
+				fmt.Fprintf(progress, "Restarting inside vcluster %s\n", v)
+				results[i] = restartInVCluster(ctx, dir, v, restartArgs)
+			}
+			if results[i] != nil {
+				slog.Error("Restart inside vcluster failed", "vcluster", v.String(), "error", results[i])
+				failed++
+			}
+		}
+
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VCLUSTER\tRESULT")
+		for i, v := range vclusters {
+			result := "ok"
+			if results[i] != nil {
+				result = results[i].Error()
+			}
+			fmt.Fprintf(w, "%s\t%s\n", v, result)
+		}
+		w.Flush()
+		if failed > 0 {
+			// Deferred calls do not run on exit
+			os.RemoveAll(dir)
+			os.Exit(1)
+		}
+	}
+}
+
+// restartInVCluster runs "db-pods restart" against a vcluster, through its
+// kubeconfig written to a file in dir.
+func restartInVCluster(ctx context.Context, dir string, v vcluster, args []string) error {
+	path := filepath.Join(dir, v.namespace+"_"+v.name+".kubeconfig")
+	if err := clientcmd.WriteToFile(*v.kubeconfig, path); err != nil {
+		return fmt.Errorf("failed to write kubeconfig: %w", err)
+	}
+	return runSubcommand(ctx, append([]string{"restart", "--kubeconfig", path}, args...))
+}
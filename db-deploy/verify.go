@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// checksumsFile is the name of the release manifest listing the SHA-256 of
+// every artifact. Its cosign signature and signing certificate are published
+// next to it with .sig and .pem suffixes.
+const checksumsFile = "SHA256SUMS"
+
+// verifyBinaryCommand checks that the running executable is a signed release
+// artifact: its digest must be listed in the release checksums, and the
+// checksums themselves must carry a valid cosign signature.
+func verifyBinaryCommand(fs *pflag.FlagSet) func(args []string) {
+	checksums := fs.String("checksums", "", "release checksums file (default: "+checksumsFile+" next to the executable)")
+	signature := fs.String("signature", "", "cosign signature of the checksums file (default: checksums file with a .sig suffix)")
+	certificate := fs.String("certificate", "", "signing certificate for keyless verification (default: checksums file with a .pem suffix)")
+	identity := fs.String("certificate-identity", "", "identity expected in the signing certificate")
+	issuer := fs.String("certificate-oidc-issuer", "", "OIDC issuer expected in the signing certificate")
+	key := fs.String("key", "", "public key to verify the signature with instead of a signing certificate")
+	skipSignature := fs.Bool("insecure-skip-signature", false, "only compare the checksum, without verifying the signature")
+	requireFIPS := fs.Bool("require-fips", false, "fail unless the binary was built in FIPS mode")
+	return func(args []string) {
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatalf("Error locating executable: %v", err)
+		}
+		if exe, err = filepath.EvalSymlinks(exe); err != nil {
+			log.Fatalf("Error locating executable: %v", err)
+		}
+		if *checksums == "" {
+			*checksums = filepath.Join(filepath.Dir(exe), checksumsFile)
+		}
+
+		digest, err := fileDigest(exe)
+		if err != nil {
+			log.Fatalf("Error hashing %s: %v", exe, err)
+		}
+		artifact, err := findChecksum(*checksums, digest)
+		if err != nil {
+			log.Fatalf("Checksum verification failed: %v", err)
+		}
+		fmt.Printf("Checksum: %s matches %s in %s\n", digest, artifact, *checksums)
+
+		if *skipSignature {
+			fmt.Println("Signature: not verified (--insecure-skip-signature)")
+		} else {
+			if *signature == "" {
+				*signature = *checksums + ".sig"
+			}
+			if *certificate == "" && *key == "" {
+				*certificate = *checksums + ".pem"
+			}
+			cosignArgs := []string{"verify-blob", "--signature", *signature}
+			if *key != "" {
+				cosignArgs = append(cosignArgs, "--key", *key)
+			} else {
+				if *identity == "" || *issuer == "" {
+					log.Fatalf("Keyless verification needs --certificate-identity and --certificate-oidc-issuer, or pass --key")
+				}
+				cosignArgs = append(cosignArgs, "--certificate", *certificate, "--certificate-identity", *identity, "--certificate-oidc-issuer", *issuer)
+			}
+			cosignArgs = append(cosignArgs, *checksums)
+
+			cmd := exec.Command("cosign", cosignArgs...)
+			cmd.Stdout = os.Stderr
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				log.Fatalf("Signature verification failed: %v", err)
+			}
+			fmt.Printf("Signature: %s verified\n", *signature)
+		}
+
+		if fipsEnabled() {
+			fmt.Println("FIPS mode: enabled")
+		} else {
+			fmt.Println("FIPS mode: disabled")
+			if *requireFIPS {
+				log.Fatalf("Binary was not built in FIPS mode")
+			}
+		}
+	}
+}
+
+// fileDigest returns the hex-encoded SHA-256 of a file.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// findChecksum looks up a digest in a sha256sum-formatted file and returns
+// the name of the artifact it belongs to. The digest is matched rather than
+// the name, since binaries are usually renamed when they are installed.
+func findChecksum(path, digest string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.EqualFold(fields[0], digest) {
+			return strings.TrimPrefix(fields[1], "*"), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("digest %s is not listed in %s", digest, path)
+}
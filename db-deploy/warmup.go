@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// warmupURLAnnotation lets a workload declare its own warm-up endpoint,
+// overriding --warmup-url.
+const warmupURLAnnotation = "db-deploy/warmup-url"
+
+// warmupConfig describes how a restarted database is probed until its caches
+// are warm.
+type warmupConfig struct {
+	url       string
+	threshold time.Duration
+	samples   int
+	interval  time.Duration
+	timeout   time.Duration
+}
+
+// urlFor returns the warm-up URL template for a target, or an empty string if
+// the target should not be warmed up.
+func (c warmupConfig) urlFor(t target) string {
+	if url := t.Annotations[warmupURLAnnotation]; url != "" {
+		return url
+	}
+	return c.url
+}
+
+// waitForWarmup probes the target's warm-up endpoint until it answers faster
+// than the configured threshold several times in a row. If the URL refers to
+// a pod, every ready pod of the target is warmed up in turn.
+func waitForWarmup(ctx context.Context, clientset *kubernetes.Clientset, t target, url string, cfg warmupConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	replacer := strings.NewReplacer("{namespace}", t.Namespace, "{name}", t.Name)
+	url = replacer.Replace(url)
+
+	if !strings.Contains(url, "{pod") {
+		return probeUntilWarm(ctx, url, cfg)
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector: %w", err)
+	}
+	pods, err := clientset.CoreV1().Pods(t.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp != nil || !podReady(&pod) {
+			continue
+		}
+		podURL := strings.NewReplacer("{pod}", pod.Name, "{pod_ip}", pod.Status.PodIP).Replace(url)
+		if err := probeUntilWarm(ctx, podURL, cfg); err != nil {
+			return fmt.Errorf("pod %s: %w", pod.Name, err)
+		}
+	}
+	return nil
+}
+
+// probeUntilWarm repeatedly requests url until cfg.samples consecutive
+// successful responses arrive within cfg.threshold.
+func probeUntilWarm(ctx context.Context, url string, cfg warmupConfig) error {
+	client := &http.Client{}
+	warm := 0
+	var last time.Duration
+	for {
+		start := time.Now()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return fmt.Errorf("invalid warm-up url: %w", err)
+		}
+		resp, err := client.Do(req)
+		last = time.Since(start)
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		if err == nil && resp.StatusCode < 300 && last < cfg.threshold {
+			warm++
+			if warm >= cfg.samples {
+				return nil
+			}
+		} else {
+			warm = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("still cold after %s (last probe took %s)", cfg.timeout, last)
+		case <-time.After(cfg.interval):
+		}
+	}
+}
+
+// podReady reports whether the pod's Ready condition is true.
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+// warningCollector receives the warning headers the API server attaches to
+// responses, such as deprecation notices and warnings from admission
+// policies.
+type warningCollector struct {
+	mu       sync.Mutex
+	warnings []string
+
+	// seen counts every distinct warning of the run. Unlike warnings it is
+	// not reset by drain.
+	seen map[string]int
+}
+
+// apiWarning is a distinct warning received during the run.
+type apiWarning struct {
+	Text  string
+	Count int
+}
+
+// apiWarnings collects the warnings of every client created by newClients.
+var apiWarnings = &warningCollector{}
+
+// HandleWarningHeader implements rest.WarningHandler.
+func (c *warningCollector) HandleWarningHeader(code int, agent string, text string) {
+	if code != 299 || text == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[string]int)
+	}
+	// Deprecated APIs warn on every request, so only the first one is logged
+	if c.seen[text] == 0 {
+		slog.Warn("Warning from API server", "warning", text)
+	}
+	c.seen[text]++
+	c.warnings = append(c.warnings, text)
+}
+
+// drain returns the warnings received since the last call and forgets them.
+func (c *warningCollector) drain() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	warnings := c.warnings
+	c.warnings = nil
+	return warnings
+}
+
+// distinct returns every distinct warning received so far, most frequent
+// first.
+func (c *warningCollector) distinct() []apiWarning {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	warnings := make([]apiWarning, 0, len(c.seen))
+	for text, count := range c.seen {
+		warnings = append(warnings, apiWarning{Text: text, Count: count})
+	}
+	sort.Slice(warnings, func(i, j int) bool {
+		if warnings[i].Count != warnings[j].Count {
+			return warnings[i].Count > warnings[j].Count
+		}
+		return warnings[i].Text < warnings[j].Text
+	})
+	return warnings
+}